@@ -34,6 +34,21 @@ var (
 
 	// LabelApplicationName is the label which indicates that resource belongs to application with the specified name
 	LabelApplicationName = application.ApplicationFullName + "/app-name"
+
+	// LabelKeyInstance is the well-known label which records the application instance a resource is tracked by
+	LabelKeyInstance = "app.kubernetes.io/instance"
+)
+
+var (
+	// AnnotationKeySyncRevision is the annotation which records the revision a resource was last synced from
+	AnnotationKeySyncRevision = MetadataPrefix + "/sync-revision"
+
+	// AnnotationKeySyncTimestamp is the annotation which records the time a resource was last synced
+	AnnotationKeySyncTimestamp = MetadataPrefix + "/sync-timestamp"
+
+	// AnnotationKeyTrackingID is the annotation which records the application a resource is tracked by, along
+	// with the identity of the resource, so copies of the annotation on other resources are not mistaken for tracking
+	AnnotationKeyTrackingID = MetadataPrefix + "/tracking-id"
 )
 
 // ArgoCDManagerServiceAccount is the name of the service account for managing a cluster
@@ -81,7 +81,7 @@ func (ks *KsonnetAppComparator) CompareAppState(
 	}
 
 	// Retrieve the live versions of the objects
-	liveObjs, err := kubeutil.GetResourcesWithLabel(clst.RESTConfig(), namespace, common.LabelApplicationName, app.Name)
+	liveObjs, err := kubeutil.GetResourcesWithLabel(context.Background(), clst.RESTConfig(), namespace, common.LabelApplicationName, app.Name, nil)
 
 	if err != nil {
 		return nil, err
@@ -127,7 +127,7 @@ func (ctrl *ApplicationController) isRefreshForced(appName string) bool {
 func (ctrl *ApplicationController) watchClusterResources(ctx context.Context, item appv1.Cluster) {
 	config := item.RESTConfig()
 	retryUntilSucceed(func() error {
-		ch, err := kube.WatchResourcesWithLabel(ctx, config, "", common.LabelApplicationName)
+		ch, err := kube.WatchResourcesWithLabel(ctx, config, "", common.LabelApplicationName, nil)
 		if err != nil {
 			return err
 		}
@@ -111,9 +111,14 @@ func (s *Server) Delete(ctx context.Context, q *DeleteApplicationRequest) (*Appl
 		}
 		if clst != nil {
 			config := clst.RESTConfig()
-			err = kube.DeleteResourceWithLabel(config, namespace, common.LabelApplicationName, q.Name)
-			if err != nil && !q.Force {
-				return nil, err
+			deleted, err := kube.DeleteResourceWithLabel(ctx, config, namespace, common.LabelApplicationName, q.Name, kube.DeleteOpts{}, nil)
+			if err != nil {
+				if !q.Force {
+					return nil, err
+				}
+				log.Warnf("Failed to delete resources of application '%s': %v", q.Name, err)
+			} else {
+				log.Infof("Deleted %d resources of application '%s'", len(deleted), q.Name)
 			}
 		}
 	}
@@ -480,7 +485,7 @@ func (s *Server) deploy(
 		targetObjs[i] = obj
 	}
 
-	liveObjs, err := kube.GetLiveResources(config, targetObjs, namespace)
+	liveObjs, err := kube.GetLiveResources(config, targetObjs, namespace, kube.GetLiveOpts{})
 	if err != nil {
 		return nil, nil, err
 	}
@@ -512,7 +517,7 @@ func (s *Server) deploy(
 				resDetails.Message = fmt.Sprintf("will update")
 			}
 		} else {
-			_, err := kube.ApplyResource(config, targetObjs[i], namespace)
+			_, err := kube.ApplyResource(config, targetObjs[i], namespace, kube.ApplyOpts{})
 			if err != nil {
 				return nil, nil, err
 			}
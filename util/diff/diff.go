@@ -3,7 +3,10 @@ package diff
 import (
 	"errors"
 	"fmt"
+	"strings"
 
+	"github.com/ghodss/yaml"
+	"github.com/pmezard/go-difflib/difflib"
 	"github.com/yudai/gojsondiff"
 	"github.com/yudai/gojsondiff/formatter"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
@@ -19,14 +22,44 @@ type DiffResultList struct {
 	Modified bool
 }
 
-// Diff performs a diff on two unstructured objects
+// NormalizeForDiff returns a copy of the live object with the fields which are not present in the
+// config object removed, so that fields populated by the server do not appear as differences
+func NormalizeForDiff(config, live *unstructured.Unstructured) *unstructured.Unstructured {
+	if live == nil {
+		return nil
+	}
+	var configObj map[string]interface{}
+	if config != nil {
+		configObj = config.Object
+	}
+	return &unstructured.Unstructured{Object: removeMapFields(configObj, live.Object)}
+}
+
+// DiffOpts are options for diffing objects
+type DiffOpts struct {
+	// AnnotationFilter lists prefixes of annotation keys which are removed from both objects before
+	// they are compared, such as operational annotations (e.g. "kubectl.kubernetes.io/") which are not
+	// part of the desired state
+	AnnotationFilter []string
+}
+
+// Diff performs a diff on two unstructured objects. Fields which are only present in the right (live)
+// object, such as defaults injected by the API server (e.g. a Service's type and port protocols), are
+// not considered differences.
 func Diff(left, right *unstructured.Unstructured) *DiffResult {
+	return DiffWithOpts(left, right, DiffOpts{})
+}
+
+// DiffWithOpts performs a diff on two unstructured objects, like Diff, using the given options
+func DiffWithOpts(left, right *unstructured.Unstructured, opts DiffOpts) *DiffResult {
+	left = removeAnnotations(left, opts.AnnotationFilter)
+	right = removeAnnotations(right, opts.AnnotationFilter)
 	var leftObj, rightObj map[string]interface{}
 	if left != nil {
 		leftObj = left.Object
 	}
 	if right != nil {
-		rightObj = removeMapFields(leftObj, right.Object)
+		rightObj = NormalizeForDiff(left, right).Object
 	}
 	gjDiff := gojsondiff.New().CompareObjects(leftObj, rightObj)
 	dr := DiffResult{
@@ -36,6 +69,38 @@ func Diff(left, right *unstructured.Unstructured) *DiffResult {
 	return &dr
 }
 
+// removeAnnotations returns a copy of an object without the annotations whose keys have one of the
+// prefixes. The object itself is returned if there are no prefixes.
+func removeAnnotations(obj *unstructured.Unstructured, prefixes []string) *unstructured.Unstructured {
+	if obj == nil || len(prefixes) == 0 {
+		return obj
+	}
+	obj = obj.DeepCopy()
+	FilterAnnotations(obj, prefixes)
+	return obj
+}
+
+// FilterAnnotations removes the annotations whose keys have one of the prefixes from an object
+func FilterAnnotations(obj *unstructured.Unstructured, prefixes []string) {
+	annotations := obj.GetAnnotations()
+	if len(annotations) == 0 {
+		return
+	}
+	for key := range annotations {
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(key, prefix) {
+				delete(annotations, key)
+				break
+			}
+		}
+	}
+	if len(annotations) == 0 {
+		unstructured.RemoveNestedField(obj.Object, "metadata", "annotations")
+	} else {
+		obj.SetAnnotations(annotations)
+	}
+}
+
 // DiffArray performs a diff on a list of unstructured objects. Objects are expected to match
 // environments
 func DiffArray(leftArray, rightArray []*unstructured.Unstructured) (*DiffResultList, error) {
@@ -71,6 +136,67 @@ func (d *DiffResult) ASCIIFormat(left *unstructured.Unstructured, formatOpts for
 	return asciiFmt.Format(d.Diff)
 }
 
+// DiffTextOpts are options for formatting a diff as text
+type DiffTextOpts struct {
+	// NoColor disables coloring of added and removed lines
+	NoColor bool
+}
+
+const (
+	colorRed   = "\x1b[31m"
+	colorGreen = "\x1b[32m"
+	colorReset = "\x1b[0m"
+)
+
+// DiffText returns a unified diff of the YAML of the live and desired objects, after normalizing the
+// live object. Lines which would be added by applying the desired object are prefixed with '+', and
+// lines which would be removed with '-'.
+func DiffText(desired, live *unstructured.Unstructured, opts DiffTextOpts) (string, error) {
+	liveYAML, err := toYAML(NormalizeForDiff(desired, live))
+	if err != nil {
+		return "", err
+	}
+	desiredYAML, err := toYAML(desired)
+	if err != nil {
+		return "", err
+	}
+	text, err := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        difflib.SplitLines(liveYAML),
+		B:        difflib.SplitLines(desiredYAML),
+		FromFile: "live",
+		ToFile:   "desired",
+		Context:  3,
+	})
+	if err != nil {
+		return "", err
+	}
+	if opts.NoColor {
+		return text, nil
+	}
+	lines := strings.SplitAfter(text, "\n")
+	for i, line := range lines {
+		switch {
+		case strings.HasPrefix(line, "+++") || strings.HasPrefix(line, "---"):
+		case strings.HasPrefix(line, "+"):
+			lines[i] = colorGreen + strings.TrimSuffix(line, "\n") + colorReset + "\n"
+		case strings.HasPrefix(line, "-"):
+			lines[i] = colorRed + strings.TrimSuffix(line, "\n") + colorReset + "\n"
+		}
+	}
+	return strings.Join(lines, ""), nil
+}
+
+func toYAML(obj *unstructured.Unstructured) (string, error) {
+	if obj == nil {
+		return "", nil
+	}
+	data, err := yaml.Marshal(obj.Object)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
 // https://github.com/ksonnet/ksonnet/blob/master/pkg/kubecfg/diff.go
 func removeFields(config, live interface{}) interface{} {
 	switch c := config.(type) {
@@ -4,14 +4,25 @@ import (
 	"testing"
 
 	"github.com/argoproj/argo-cd/test"
-	"github.com/argoproj/argo-cd/util/kube"
 	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/api/equality"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
 )
 
+// mustToUnstructured converts a typed object to an unstructured object, as kube.MustToUnstructured does,
+// which these tests can not use since the kube package imports this one
+func mustToUnstructured(obj interface{}) *unstructured.Unstructured {
+	uObj, err := runtime.NewTestUnstructuredConverter(equality.Semantic).ToUnstructured(obj)
+	if err != nil {
+		panic(err)
+	}
+	return &unstructured.Unstructured{Object: uObj}
+}
+
 func TestDiff(t *testing.T) {
 	leftDep := test.DemoDeployment()
-	leftUn := kube.MustToUnstructured(leftDep)
+	leftUn := mustToUnstructured(leftDep)
 
 	diffRes := Diff(leftUn, leftUn)
 	assert.False(t, diffRes.Diff.Modified())
@@ -21,8 +32,8 @@ func TestDiffArraySame(t *testing.T) {
 	leftDep := test.DemoDeployment()
 	rightDep := leftDep.DeepCopy()
 
-	leftUn := kube.MustToUnstructured(leftDep)
-	rightUn := kube.MustToUnstructured(rightDep)
+	leftUn := mustToUnstructured(leftDep)
+	rightUn := mustToUnstructured(rightDep)
 
 	left := []*unstructured.Unstructured{leftUn}
 	right := []*unstructured.Unstructured{rightUn}
@@ -36,8 +47,8 @@ func TestDiffArrayAdditions(t *testing.T) {
 	rightDep := leftDep.DeepCopy()
 	rightDep.Status.Replicas = 1
 
-	leftUn := kube.MustToUnstructured(leftDep)
-	rightUn := kube.MustToUnstructured(rightDep)
+	leftUn := mustToUnstructured(leftDep)
+	rightUn := mustToUnstructured(rightDep)
 
 	left := []*unstructured.Unstructured{leftUn}
 	right := []*unstructured.Unstructured{rightUn}
@@ -52,8 +63,8 @@ func TestDiffArrayModification(t *testing.T) {
 	ten := int32(10)
 	rightDep.Spec.Replicas = &ten
 
-	leftUn := kube.MustToUnstructured(leftDep)
-	rightUn := kube.MustToUnstructured(rightDep)
+	leftUn := mustToUnstructured(leftDep)
+	rightUn := mustToUnstructured(rightDep)
 
 	left := []*unstructured.Unstructured{leftUn}
 	right := []*unstructured.Unstructured{rightUn}
@@ -61,3 +72,72 @@ func TestDiffArrayModification(t *testing.T) {
 	assert.Nil(t, err)
 	assert.True(t, diffResList.Modified)
 }
+
+func TestDiffText(t *testing.T) {
+	desired := mustToUnstructured(test.DemoDeployment())
+	live := desired.DeepCopy()
+	live.Object["spec"].(map[string]interface{})["replicas"] = int64(1)
+	live.Object["status"] = map[string]interface{}{"replicas": int64(1)}
+	desired.Object["spec"].(map[string]interface{})["replicas"] = int64(3)
+
+	text, err := DiffText(desired, live, DiffTextOpts{NoColor: true})
+	assert.Nil(t, err)
+	assert.Contains(t, text, "\n-  replicas: 1\n")
+	assert.Contains(t, text, "\n+  replicas: 3\n")
+	// the status populated by the server is normalized away
+	assert.NotContains(t, text, "status")
+
+	text, err = DiffText(desired, live, DiffTextOpts{})
+	assert.Nil(t, err)
+	assert.Contains(t, text, "\x1b[31m-  replicas: 1\x1b[0m\n")
+	assert.Contains(t, text, "\x1b[32m+  replicas: 3\x1b[0m\n")
+
+	text, err = DiffText(desired, desired, DiffTextOpts{NoColor: true})
+	assert.Nil(t, err)
+	assert.Equal(t, "", text)
+}
+
+func TestDiffIgnoresServerDefaults(t *testing.T) {
+	var desired unstructured.Unstructured
+	err := desired.UnmarshalJSON([]byte(`{
+		"apiVersion": "v1", "kind": "Service", "metadata": {"name": "demo"},
+		"spec": {"ports": [{"port": 80}], "selector": {"app": "demo"}}
+	}`))
+	assert.Nil(t, err)
+	var live unstructured.Unstructured
+	err = live.UnmarshalJSON([]byte(`{
+		"apiVersion": "v1", "kind": "Service", "metadata": {"name": "demo", "uid": "2a1a0b69-2b4c-11e8-a3b6-42010a8a0002"},
+		"spec": {
+			"type": "ClusterIP", "clusterIP": "10.96.0.12", "sessionAffinity": "None",
+			"ports": [{"port": 80, "protocol": "TCP", "targetPort": 80}], "selector": {"app": "demo"}
+		},
+		"status": {"loadBalancer": {}}
+	}`))
+	assert.Nil(t, err)
+
+	assert.False(t, Diff(&desired, &live).Modified)
+
+	live.Object["spec"].(map[string]interface{})["ports"].([]interface{})[0].(map[string]interface{})["port"] = int64(8080)
+	assert.True(t, Diff(&desired, &live).Modified)
+}
+
+func TestDiffAnnotationFilter(t *testing.T) {
+	desired := mustToUnstructured(test.DemoService())
+	desired.SetAnnotations(map[string]string{
+		"kubectl.kubernetes.io/last-applied-configuration": `{"apiVersion":"v1","kind":"Service"}`,
+		"example.com/owner": "team-a",
+	})
+	live := desired.DeepCopy()
+	live.SetAnnotations(map[string]string{
+		"kubectl.kubernetes.io/last-applied-configuration": `{"apiVersion":"v1","kind":"Service","metadata":{"name":"demo"}}`,
+		"example.com/owner": "team-a",
+	})
+
+	opts := DiffOpts{AnnotationFilter: []string{"kubectl.kubernetes.io/"}}
+	assert.True(t, Diff(desired, live).Modified)
+	assert.False(t, DiffWithOpts(desired, live, opts).Modified)
+
+	// other annotations are still compared
+	live.SetAnnotations(map[string]string{"example.com/owner": "team-b"})
+	assert.True(t, DiffWithOpts(desired, live, opts).Modified)
+}
@@ -0,0 +1,318 @@
+package kube
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// ApplyResult is the outcome of applying a single object
+type ApplyResult struct {
+	// Key identifies the applied object
+	Key ResourceKey
+	// Live is the object returned by the server after it was applied
+	Live *unstructured.Unstructured
+	// Error is the error which occurred while applying the object, if any
+	Error error
+}
+
+// KindPriorities maps kinds to the priority in which objects of the kind are applied. Objects of kinds
+// with a lower priority are applied first.
+type KindPriorities map[string]int
+
+// UnknownKindPriority is the priority of kinds which are not in a KindPriorities table, which applies
+// them after all listed kinds
+const UnknownKindPriority = 1000
+
+// DefaultKindPriorities is the order in which kinds are applied, so that objects are created before the
+// objects which depend on them (e.g. namespaces and CRDs before anything else, config before
+// workloads). The priorities are spaced out, so that custom kinds can be ordered in between.
+var DefaultKindPriorities = KindPriorities{
+	"Namespace":                10,
+	"CustomResourceDefinition": 20,
+	"ResourceQuota":            30,
+	"LimitRange":               40,
+	"PodSecurityPolicy":        50,
+	"ServiceAccount":           60,
+	"Secret":                   70,
+	"ConfigMap":                80,
+	"StorageClass":             90,
+	"PersistentVolume":         100,
+	"PersistentVolumeClaim":    110,
+	"ClusterRole":              120,
+	"ClusterRoleBinding":       130,
+	"Role":                     140,
+	"RoleBinding":              150,
+	"Service":                  160,
+	"DaemonSet":                170,
+	"Pod":                      180,
+	"ReplicationController":    190,
+	"ReplicaSet":               200,
+	"Deployment":               210,
+	"StatefulSet":              220,
+	"Job":                      230,
+	"CronJob":                  240,
+	"Ingress":                  250,
+	"APIService":               260,
+}
+
+// KindPriority returns the priority of a kind in DefaultKindPriorities
+func KindPriority(gvk schema.GroupVersionKind) int {
+	return DefaultKindPriorities.Priority(gvk)
+}
+
+// Priority returns the priority of a kind, or UnknownKindPriority if it is not in the table
+func (p KindPriorities) Priority(gvk schema.GroupVersionKind) int {
+	if priority, ok := p[gvk.Kind]; ok {
+		return priority
+	}
+	return UnknownKindPriority
+}
+
+// WithOverrides returns a copy of the table in which the priorities of the given kinds are replaced
+func (p KindPriorities) WithOverrides(overrides map[string]int) KindPriorities {
+	merged := make(KindPriorities, len(p)+len(overrides))
+	for kind, priority := range p {
+		merged[kind] = priority
+	}
+	for kind, priority := range overrides {
+		merged[kind] = priority
+	}
+	return merged
+}
+
+// sortByKindPriority returns a copy of the objects sorted by the order in which their kinds should be
+// applied. Objects of kinds with the same priority are ordered by their Helm hook weight, which is 0 for
+// objects which are not Helm hooks. Nil priorities use DefaultKindPriorities.
+func sortByKindPriority(objs []*unstructured.Unstructured, priorities KindPriorities) []*unstructured.Unstructured {
+	if priorities == nil {
+		priorities = DefaultKindPriorities
+	}
+	sorted := make([]*unstructured.Unstructured, len(objs))
+	copy(sorted, objs)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		iPriority := priorities.Priority(sorted[i].GroupVersionKind())
+		jPriority := priorities.Priority(sorted[j].GroupVersionKind())
+		if iPriority != jPriority {
+			return iPriority < jPriority
+		}
+		return helmHookWeight(sorted[i]) < helmHookWeight(sorted[j])
+	})
+	return sorted
+}
+
+// ApplyManifests applies a set of objects in kind priority order. Every object is attempted, even if
+// applying an earlier object failed. Errors of all failed objects are aggregated in the returned error.
+// If opts.Preflight is set, nothing is applied unless the user has permission to apply every object.
+func ApplyManifests(config *rest.Config, objs []*unstructured.Unstructured, namespace string, opts ApplyOpts) ([]ApplyResult, error) {
+	if opts.ExcludeHelmTests {
+		objs = withoutHelmTests(objs)
+	}
+	if opts.Preflight {
+		kubeclientset, err := kubernetes.NewForConfig(config)
+		if err != nil {
+			return nil, err
+		}
+		err = preflightApply(kubeclientset, objs, namespace)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var results []ApplyResult
+	var errs []error
+	for _, obj := range sortByKindPriority(objs, opts.KindPriorities) {
+		liveObj, err := ApplyResource(config, obj, namespace, opts)
+		results = append(results, ApplyResult{Key: GetResourceKey(obj), Live: liveObj, Error: err})
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return results, utilerrors.NewAggregate(errs)
+}
+
+// ApplyManifestsWithRollback applies a set of objects in kind priority order like ApplyManifests, but
+// stops at the first object which fails to apply, and then attempts to restore the objects applied
+// before it: objects which already existed are re-applied as they were captured before the apply, and
+// objects which were created are deleted. Kubernetes has no transactions, so the rollback is
+// best-effort. Other clients may modify the objects in the meantime, and every object is rolled back
+// even if restoring another one failed. The returned error aggregates the apply error with the errors
+// of all failed rollbacks.
+func ApplyManifestsWithRollback(config *rest.Config, objs []*unstructured.Unstructured, namespace string, opts ApplyOpts) ([]ApplyResult, error) {
+	if opts.ExcludeHelmTests {
+		objs = withoutHelmTests(objs)
+	}
+	if opts.Preflight {
+		kubeclientset, err := kubernetes.NewForConfig(config)
+		if err != nil {
+			return nil, err
+		}
+		err = preflightApply(kubeclientset, objs, namespace)
+		if err != nil {
+			return nil, err
+		}
+	}
+	dynClientPool := dynamic.NewDynamicClientPool(config)
+	disco, err := discovery.NewDiscoveryClientForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	apply := func(obj *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+		return ApplyResource(config, obj, namespace, opts)
+	}
+	return applyManifestsWithRollback(dynClientPool, disco, apply, objs, namespace, opts.KindPriorities)
+}
+
+func applyManifestsWithRollback(dynClientPool dynamic.ClientPool, disco discovery.DiscoveryInterface, apply func(*unstructured.Unstructured) (*unstructured.Unstructured, error), objs []*unstructured.Unstructured, namespace string, priorities KindPriorities) ([]ApplyResult, error) {
+	objs, err := withDefaultNamespace(disco, objs, namespace)
+	if err != nil {
+		return nil, err
+	}
+	sorted := sortByKindPriority(objs, priorities)
+	// objects of kinds which are not served yet (e.g. created by a CRD in the set) are captured as missing
+	previous, err := getLiveResources(dynClientPool, disco, sorted, namespace, GetLiveOpts{IgnoreUnknownKinds: true})
+	if err != nil {
+		return nil, err
+	}
+	var results []ApplyResult
+	for i, obj := range sorted {
+		liveObj, err := apply(obj)
+		results = append(results, ApplyResult{Key: GetResourceKey(obj), Live: liveObj, Error: err})
+		if err != nil {
+			errs := []error{err}
+			errs = append(errs, rollbackApplied(dynClientPool, disco, apply, sorted[:i], previous[:i])...)
+			return results, utilerrors.NewAggregate(errs)
+		}
+	}
+	return results, nil
+}
+
+// rollbackApplied restores applied objects to their previous state in reverse order, re-applying the
+// objects which existed and deleting the objects which did not. A nil previous object means the object
+// did not exist.
+func rollbackApplied(dynClientPool dynamic.ClientPool, disco discovery.DiscoveryInterface, apply func(*unstructured.Unstructured) (*unstructured.Unstructured, error), applied []*unstructured.Unstructured, previous []*unstructured.Unstructured) []error {
+	var errs []error
+	for i := len(applied) - 1; i >= 0; i-- {
+		key := GetResourceKey(applied[i])
+		log.Infof("Rolling back resource %s", key)
+		var err error
+		if previous[i] == nil {
+			err = deleteResource(dynClientPool, disco, applied[i], DeleteOpts{})
+		} else {
+			_, err = apply(withoutServerFields(previous[i]))
+		}
+		if err != nil {
+			log.Warnf("Failed to roll back resource %s: %v", key, err)
+			errs = append(errs, fmt.Errorf("failed to roll back %s: %v", key, err))
+		}
+	}
+	return errs
+}
+
+// ApplyDirectory applies all objects from the YAML and JSON manifests found in a directory and its
+// subdirectories. Hidden files and directories, as well as files of other types, are skipped.
+func ApplyDirectory(config *rest.Config, dir string, namespace string, opts ApplyOpts) ([]ApplyResult, error) {
+	objs, err := readManifestDirectory(dir)
+	if err != nil {
+		return nil, err
+	}
+	return ApplyManifests(config, objs, namespace, opts)
+}
+
+// KustomizeApplyBatchSize is the maximum number of objects ApplyKustomizeOutput decodes before applying
+// them
+var KustomizeApplyBatchSize = 100
+
+// ApplyKustomizeOutput applies the objects of a rendered multi-document YAML stream, such as the output
+// of `kustomize build`. The stream is decoded a document at a time as it is read, and the objects are
+// applied in batches of KustomizeApplyBatchSize, so neither the rendered output nor the decoded objects
+// are buffered as a whole. Each batch is applied like ApplyManifests, so objects are only ordered by kind
+// priority within their batch. kustomize already emits namespaces and CRDs first, so they still precede
+// the objects which depend on them. A batch which cannot be applied at all (e.g. because it fails the
+// preflight check) stops the apply, and the results of the earlier batches are returned with the error.
+func ApplyKustomizeOutput(config *rest.Config, reader io.Reader, namespace string, opts ApplyOpts) ([]ApplyResult, error) {
+	var results []ApplyResult
+	var errs []error
+	var batch []*unstructured.Unstructured
+	var batchErr error
+	applyBatch := func() error {
+		log.Infof("Applying %d rendered objects", len(batch))
+		batchResults, err := ApplyManifests(config, batch, namespace, opts)
+		batch = nil
+		if err != nil && len(batchResults) == 0 {
+			batchErr = err
+			return err
+		}
+		results = append(results, batchResults...)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		return nil
+	}
+	err := decodeYAMLStream(reader, func(obj *unstructured.Unstructured) error {
+		batch = append(batch, obj)
+		if len(batch) < KustomizeApplyBatchSize {
+			return nil
+		}
+		return applyBatch()
+	})
+	if batchErr != nil {
+		return results, batchErr
+	}
+	if err != nil {
+		return results, errors.Wrap(err, "failed to parse rendered manifests")
+	}
+	if len(batch) > 0 {
+		if err := applyBatch(); err != nil {
+			return results, err
+		}
+	}
+	return results, utilerrors.Flatten(utilerrors.NewAggregate(errs))
+}
+
+// readManifestDirectory reads all objects from the manifests in a directory tree
+func readManifestDirectory(dir string) ([]*unstructured.Unstructured, error) {
+	var objs []*unstructured.Unstructured
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path != dir && strings.HasPrefix(info.Name(), ".") {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			return nil
+		}
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".yaml", ".yml", ".json":
+		default:
+			log.Debugf("Skipping non-manifest file %s", path)
+			return nil
+		}
+		fileObjs, err := ReadManifestFile(path)
+		if err != nil {
+			return err
+		}
+		objs = append(objs, fileObjs...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return objs, nil
+}
@@ -0,0 +1,199 @@
+package kube
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/argoproj/argo-cd/test"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/rest"
+	kubetesting "k8s.io/client-go/testing"
+)
+
+// fakeKubectl replaces runKubectl with a fake which echoes back the applied object, recording the
+// objects it was invoked with
+func fakeKubectl(t *testing.T) (applied *[]*unstructured.Unstructured, restore func()) {
+	orig := runKubectl
+	var objs []*unstructured.Unstructured
+	runKubectl = func(args []string, stdin []byte) ([]byte, error) {
+		var obj unstructured.Unstructured
+		err := obj.UnmarshalJSON(stdin)
+		assert.Nil(t, err)
+		objs = append(objs, &obj)
+		return stdin, nil
+	}
+	return &objs, func() { runKubectl = orig }
+}
+
+func TestApplyDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "apply-directory")
+	assert.Nil(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	assert.Nil(t, os.Mkdir(filepath.Join(dir, "nested"), 0755))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "app.yaml"), []byte(multiDocManifest), 0644))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "nested", "ns.json"), []byte(`{"apiVersion": "v1", "kind": "Namespace", "metadata": {"name": "demo"}}`), 0644))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, ".hidden.yaml"), []byte("not: a manifest"), 0644))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "README.md"), []byte("# demo"), 0644))
+
+	applied, restore := fakeKubectl(t)
+	defer restore()
+
+	results, err := ApplyDirectory(&rest.Config{}, dir, "default", ApplyOpts{})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(results))
+	var kinds []string
+	for _, obj := range *applied {
+		kinds = append(kinds, obj.GetKind())
+	}
+	assert.Equal(t, []string{"Namespace", "ConfigMap", "Deployment"}, kinds)
+	for _, res := range results {
+		assert.Nil(t, res.Error)
+		assert.NotNil(t, res.Live)
+	}
+}
+
+// kustomizeOutput is rendered the way `kustomize build` orders objects, which is not the order in which
+// they must be applied
+const kustomizeOutput = `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: demo-app
+spec:
+  replicas: 1
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: demo-app
+---
+apiVersion: v1
+data:
+  env: staging
+kind: ConfigMap
+metadata:
+  name: demo-app-config-5g2f8dt9hm
+`
+
+func TestApplyKustomizeOutput(t *testing.T) {
+	applied, restore := fakeKubectl(t)
+	defer restore()
+
+	results, err := ApplyKustomizeOutput(&rest.Config{}, strings.NewReader(kustomizeOutput), "default", ApplyOpts{})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(results))
+	var kinds []string
+	for _, obj := range *applied {
+		kinds = append(kinds, obj.GetKind())
+	}
+	assert.Equal(t, []string{"ConfigMap", "Service", "Deployment"}, kinds)
+
+	_, err = ApplyKustomizeOutput(&rest.Config{}, strings.NewReader("kind: [unterminated"), "default", ApplyOpts{})
+	assert.NotNil(t, err)
+}
+
+func TestApplyKustomizeOutputBatches(t *testing.T) {
+	applied, restore := fakeKubectl(t)
+	defer restore()
+	batchSize := KustomizeApplyBatchSize
+	KustomizeApplyBatchSize = 2
+	defer func() { KustomizeApplyBatchSize = batchSize }()
+
+	// objects are only ordered within their batch
+	results, err := ApplyKustomizeOutput(&rest.Config{}, strings.NewReader(kustomizeOutput), "default", ApplyOpts{})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(results))
+	var kinds []string
+	for _, obj := range *applied {
+		kinds = append(kinds, obj.GetKind())
+	}
+	assert.Equal(t, []string{"Service", "Deployment", "ConfigMap"}, kinds)
+
+	// the batches applied before a malformed document are reported along with the error
+	*applied = nil
+	results, err = ApplyKustomizeOutput(&rest.Config{}, strings.NewReader(kustomizeOutput+"---\nkind: [unterminated\n"), "default", ApplyOpts{})
+	assert.NotNil(t, err)
+	assert.Equal(t, 2, len(results))
+	assert.Equal(t, 2, len(*applied))
+}
+
+func TestApplyManifestsWithRollback(t *testing.T) {
+	fakeClientPool, fakeDiscovery := newReconcileFixture()
+	var applied []*unstructured.Unstructured
+	apply := func(obj *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+		applied = append(applied, obj)
+		if obj.GetName() == "guestbook-ui" {
+			return nil, errors.New("admission webhook denied the request")
+		}
+		return obj, nil
+	}
+	modified := newReconcileObject("ConfigMap", "guestbook-config")
+	modified.Object["data"] = map[string]interface{}{"color": "blue"}
+	objs := []*unstructured.Unstructured{
+		newReconcileObject("Service", "guestbook-ui"),
+		modified,
+		newReconcileObject("ConfigMap", "guestbook-new"),
+	}
+
+	results, err := applyManifestsWithRollback(fakeClientPool, fakeDiscovery, apply, objs, test.TestNamespace, nil)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "admission webhook denied the request")
+	if assert.Equal(t, 3, len(results)) {
+		assert.Nil(t, results[0].Error)
+		assert.Nil(t, results[1].Error)
+		assert.Equal(t, "guestbook-ui", results[2].Key.Name)
+		assert.NotNil(t, results[2].Error)
+	}
+
+	// the existing config map is restored without the new data and server managed fields, and the new
+	// one is deleted
+	if assert.Equal(t, 4, len(applied)) {
+		restored := applied[3]
+		assert.Equal(t, "guestbook-config", restored.GetName())
+		_, hasData := restored.Object["data"]
+		assert.False(t, hasData)
+		assert.Empty(t, restored.GetUID())
+	}
+	var deleted []string
+	for _, action := range fakeClientPool.Actions() {
+		if action.GetVerb() == "delete" {
+			deleted = append(deleted, action.(kubetesting.DeleteAction).GetName())
+		}
+	}
+	assert.Equal(t, []string{"guestbook-new"}, deleted)
+}
+
+func TestSortByKindPriority(t *testing.T) {
+	newObj := func(apiVersion string, kind string) *unstructured.Unstructured {
+		obj := &unstructured.Unstructured{}
+		obj.SetAPIVersion(apiVersion)
+		obj.SetKind(kind)
+		return obj
+	}
+	kinds := func(objs []*unstructured.Unstructured) []string {
+		var result []string
+		for _, obj := range objs {
+			result = append(result, obj.GetKind())
+		}
+		return result
+	}
+	objs := []*unstructured.Unstructured{
+		newObj("argoproj.io/v1alpha1", "Application"),
+		newObj("apps/v1", "Deployment"),
+		newObj("apiextensions.k8s.io/v1beta1", "CustomResourceDefinition"),
+		newObj("v1", "Namespace"),
+	}
+
+	// custom resources are applied after the definition of their kind
+	assert.Equal(t, []string{"Namespace", "CustomResourceDefinition", "Deployment", "Application"}, kinds(sortByKindPriority(objs, nil)))
+	assert.True(t, KindPriority(objs[2].GroupVersionKind()) < KindPriority(objs[0].GroupVersionKind()))
+
+	priorities := DefaultKindPriorities.WithOverrides(map[string]int{"Application": 15})
+	assert.Equal(t, []string{"Namespace", "Application", "CustomResourceDefinition", "Deployment"}, kinds(sortByKindPriority(objs, priorities)))
+	assert.Equal(t, UnknownKindPriority, DefaultKindPriorities.Priority(objs[0].GroupVersionKind()))
+}
@@ -0,0 +1,89 @@
+package kube
+
+import (
+	"sync"
+	"time"
+
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/rest"
+)
+
+// BulkOptions tune the load put on a cluster by the functions which operate on many resources at once
+type BulkOptions struct {
+	// MaxConcurrency is the maximum number of requests made concurrently
+	MaxConcurrency int
+	// QPS overrides the client side rate limit of the REST config, if set
+	QPS float32
+	// Burst overrides the client side rate limit burst of the REST config, if set
+	Burst int
+	// Timeout bounds the duration of each request made to the cluster. Defaults to DefaultListTimeout,
+	// unless the REST config sets a timeout.
+	Timeout time.Duration
+	// DiscoveryCache is used to discover the API resources of the cluster, if set, rather than querying
+	// the API server on every call
+	DiscoveryCache *Discovery
+	// WarningHandler, if set, receives the warnings returned by the API server, such as the deprecation
+	// warnings of the listed APIs. Warnings are logged either way.
+	WarningHandler WarningHandler
+}
+
+// DefaultBulkOptions are the options used when no BulkOptions are supplied
+var DefaultBulkOptions = BulkOptions{
+	MaxConcurrency: 10,
+}
+
+// withDefaults returns the options to use, filling in defaults for options which are not set
+func (o *BulkOptions) withDefaults() BulkOptions {
+	if o == nil {
+		return DefaultBulkOptions
+	}
+	opts := *o
+	if opts.MaxConcurrency <= 0 {
+		opts.MaxConcurrency = DefaultBulkOptions.MaxConcurrency
+	}
+	return opts
+}
+
+// restConfig returns a copy of the REST config with the rate limit and timeout options applied
+func (o BulkOptions) restConfig(config *rest.Config) *rest.Config {
+	configCopy := *config
+	if o.QPS > 0 {
+		configCopy.QPS = o.QPS
+	}
+	if o.Burst > 0 {
+		configCopy.Burst = o.Burst
+	}
+	if o.Timeout > 0 {
+		configCopy.Timeout = o.Timeout
+	} else if configCopy.Timeout == 0 {
+		configCopy.Timeout = DefaultListTimeout
+	}
+	return &configCopy
+}
+
+// discovery returns the discovery client to use for the cluster of the REST config
+func (o BulkOptions) discovery(config *rest.Config) (discovery.DiscoveryInterface, error) {
+	if o.DiscoveryCache != nil {
+		return o.DiscoveryCache.DiscoveryInterface(), nil
+	}
+	return discovery.NewDiscoveryClientForConfig(config)
+}
+
+// forEachConcurrently calls fn for every index up to n, running at most maxConcurrency calls at once,
+// and waits for all calls to complete
+func forEachConcurrently(n int, maxConcurrency int, fn func(i int)) {
+	sem := make(chan struct{}, maxConcurrency)
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		sem <- struct{}{}
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			fn(i)
+		}(i)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,96 @@
+package kube
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/argoproj/argo-cd/test"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/dynamic"
+	fakedynamic "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/rest"
+	kubetesting "k8s.io/client-go/testing"
+)
+
+// concurrencyTracker records the maximum number of requests in flight at once
+type concurrencyTracker struct {
+	lock     sync.Mutex
+	inFlight int
+	max      int
+}
+
+func (c *concurrencyTracker) reactor(action kubetesting.Action) (handled bool, ret runtime.Object, err error) {
+	c.lock.Lock()
+	c.inFlight++
+	if c.inFlight > c.max {
+		c.max = c.inFlight
+	}
+	c.lock.Unlock()
+	time.Sleep(20 * time.Millisecond)
+	c.lock.Lock()
+	c.inFlight--
+	c.lock.Unlock()
+	return true, &unstructured.UnstructuredList{}, nil
+}
+
+// newTrackedClients returns dynamic clients whose list requests are tracked. Separate fakes are used,
+// since a fake holds a lock while invoking its reactors.
+func newTrackedClients(n int, tracker *concurrencyTracker) []*fakedynamic.FakeClient {
+	clients := make([]*fakedynamic.FakeClient, n)
+	for i := range clients {
+		clients[i] = &fakedynamic.FakeClient{Fake: &kubetesting.Fake{}}
+		clients[i].Fake.AddReactor("list", "*", tracker.reactor)
+	}
+	return clients
+}
+
+func TestBulkOptionsMaxConcurrency(t *testing.T) {
+	bulk := (&BulkOptions{MaxConcurrency: 2}).withDefaults()
+
+	var tracker concurrencyTracker
+	var resourceInterfaces []dynamic.ResourceInterface
+	for _, client := range newTrackedClients(6, &tracker) {
+		resourceInterfaces = append(resourceInterfaces, client.Resource(&metav1.APIResource{Name: "services", Namespaced: true}, test.TestNamespace))
+	}
+	_, err := listResourcesWithLabel(context.Background(), resourceInterfaces, "app", "guestbook", bulk.MaxConcurrency)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, tracker.max)
+
+	tracker = concurrencyTracker{}
+	clients := make(map[string]dynamic.Interface)
+	var apiResources []metav1.APIResource
+	for i, client := range newTrackedClients(6, &tracker) {
+		name := fmt.Sprintf("resources%d", i)
+		clients[name] = client
+		apiResources = append(apiResources, metav1.APIResource{Name: name, Namespaced: true})
+	}
+	clientForResource := func(apiResource metav1.APIResource) (dynamic.Interface, error) {
+		return clients[apiResource.Name], nil
+	}
+	_, _, err = listAllResources(clientForResource, apiResources, test.TestNamespace, metav1.ListOptions{}, ListAllOpts{}, bulk.MaxConcurrency)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, tracker.max)
+}
+
+func TestBulkOptionsDefaults(t *testing.T) {
+	var nilOpts *BulkOptions
+	assert.Equal(t, DefaultBulkOptions, nilOpts.withDefaults())
+
+	bulk := (&BulkOptions{QPS: 50, Burst: 100, Timeout: time.Minute}).withDefaults()
+	assert.Equal(t, DefaultBulkOptions.MaxConcurrency, bulk.MaxConcurrency)
+	config := bulk.restConfig(&rest.Config{Host: "https://localhost:6443", QPS: 5, Burst: 10})
+	assert.Equal(t, float32(50), config.QPS)
+	assert.Equal(t, 100, config.Burst)
+	assert.Equal(t, time.Minute, config.Timeout)
+	assert.Equal(t, "https://localhost:6443", config.Host)
+
+	// without a timeout, requests are bounded by the REST config's timeout, or else DefaultListTimeout
+	assert.Equal(t, DefaultListTimeout, nilOpts.withDefaults().restConfig(&rest.Config{}).Timeout)
+	assert.Equal(t, time.Second, nilOpts.withDefaults().restConfig(&rest.Config{Timeout: time.Second}).Timeout)
+}
@@ -0,0 +1,319 @@
+package kube
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+)
+
+// LabelCache is an in-memory store of all resources matching a label selector, populated by an
+// initial list and kept current by watches. It is meant to be used as the read model of a reconcile
+// loop, instead of repeatedly listing all resource types.
+type LabelCache struct {
+	lock      sync.RWMutex
+	objs      map[ResourceKey]*unstructured.Unstructured
+	hasSynced []cache.InformerSynced
+}
+
+// LabelCacheOpts are options for a LabelCache
+type LabelCacheOpts struct {
+	// WatchList streams the initial state of every resource type through a watch, rather than getting it
+	// with a single list, which reduces the memory used by the API server for large sets of resources.
+	// Resources are listed normally by servers older than 1.27, or which have the WatchList feature
+	// disabled.
+	WatchList bool
+}
+
+// watchListMinVersion is the minor version of Kubernetes 1.x which can stream the initial state of a
+// watch
+const watchListMinVersion = 27
+
+// initialEventsEndAnnotation is the annotation of the bookmark event which marks the end of the initial
+// events of a watch list
+const initialEventsEndAnnotation = "k8s.io/initial-events-end"
+
+// NewLabelCache starts watching all listable and watchable resources in the namespace (or the whole
+// cluster if the namespace is empty) matching the label selector. The watches are stopped when the
+// context is done. The cache is empty until HasSynced returns true.
+func NewLabelCache(ctx context.Context, config *rest.Config, namespace string, selector string, opts LabelCacheOpts) (*LabelCache, error) {
+	if _, err := labels.Parse(selector); err != nil {
+		return nil, err
+	}
+	dynClientPool := dynamic.NewDynamicClientPool(config)
+	disco, err := discovery.NewDiscoveryClientForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	restClientForGroupVersion := func(gv schema.GroupVersion) (rest.Interface, error) {
+		return newUnstructuredRESTClient(config, gv)
+	}
+	return newLabelCache(ctx, dynClientPool, disco, restClientForGroupVersion, namespace, selector, opts)
+}
+
+func newLabelCache(ctx context.Context, dynClientPool dynamic.ClientPool, disco discovery.DiscoveryInterface, restClientForGroupVersion func(schema.GroupVersion) (rest.Interface, error), namespace string, selector string, opts LabelCacheOpts) (*LabelCache, error) {
+	infos, err := APIResourcesSupportingVerb(disco, watchVerb)
+	if err != nil {
+		return nil, err
+	}
+	watchList := false
+	if opts.WatchList {
+		serverVersion, err := disco.ServerVersion()
+		if err != nil {
+			return nil, err
+		}
+		major, minor, err := parseServerVersion(serverVersion)
+		if err != nil {
+			return nil, err
+		}
+		watchList = isAtLeastVersion(major, minor, watchListMinVersion)
+	}
+	listFuncs := make([]cache.ListFunc, 0)
+	watchFuncs := make([]cache.WatchFunc, 0)
+	for i := range infos {
+		info := infos[i]
+		if !supportsVerb(info.APIResource, listVerb) {
+			continue
+		}
+		dclient, err := dynClientPool.ClientForGroupVersionKind(info.GroupVersionKind)
+		if err != nil {
+			return nil, err
+		}
+		resource := dclient.Resource(&info.APIResource, namespace)
+		listFunc := func(options metav1.ListOptions) (runtime.Object, error) {
+			options.LabelSelector = selector
+			return resource.List(options)
+		}
+		if watchList {
+			restClient, err := restClientForGroupVersion(info.GroupVersionKind.GroupVersion())
+			if err != nil {
+				return nil, err
+			}
+			listFunc = watchListWithFallback(restClient, info.APIResource, namespace, selector, listFunc)
+		}
+		listFuncs = append(listFuncs, listFunc)
+		watchFuncs = append(watchFuncs, func(options metav1.ListOptions) (watch.Interface, error) {
+			options.LabelSelector = selector
+			return resource.Watch(options)
+		})
+	}
+
+	c := &LabelCache{objs: make(map[ResourceKey]*unstructured.Unstructured)}
+	handler := cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			c.set(obj)
+		},
+		UpdateFunc: func(old, new interface{}) {
+			c.set(new)
+		},
+		DeleteFunc: func(obj interface{}) {
+			// the informer reports a tombstone if the deletion was missed while the watch was down
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			c.delete(obj)
+		},
+	}
+	for i := range listFuncs {
+		listWatch := &cache.ListWatch{ListFunc: listFuncs[i], WatchFunc: watchFuncs[i]}
+		_, controller := cache.NewInformer(listWatch, &unstructured.Unstructured{}, 0, handler)
+		c.hasSynced = append(c.hasSynced, controller.HasSynced)
+		go controller.Run(ctx.Done())
+	}
+	log.Infof("Started caching %d resource types with label selector '%s'", len(listFuncs), selector)
+	return c, nil
+}
+
+// DedupOpts configure which update events are dropped by DedupUpdates
+type DedupOpts struct {
+	// CompareContent also drops updates which change the resource version of an object, but nothing
+	// else besides the fields the server maintains for every write, such as managed fields
+	CompareContent bool
+}
+
+// volatileMetadataFields are the metadata fields which the server changes on every write, even if the
+// write does not change the object
+var volatileMetadataFields = []string{
+	"resourceVersion",
+	"managedFields",
+}
+
+// DedupUpdates wraps an informer event handler, dropping update events which do not change the object.
+// Informers redeliver every object as an update on each resync, with the same resource version as the
+// previous event, which would otherwise trigger redundant reconciles. Add and delete events are always
+// delivered.
+func DedupUpdates(handler cache.ResourceEventHandler, opts DedupOpts) cache.ResourceEventHandler {
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: handler.OnAdd,
+		UpdateFunc: func(old, new interface{}) {
+			if isNoopUpdate(old, new, opts) {
+				return
+			}
+			handler.OnUpdate(old, new)
+		},
+		DeleteFunc: handler.OnDelete,
+	}
+}
+
+// isNoopUpdate returns whether an update event leaves the object unchanged
+func isNoopUpdate(old, new interface{}, opts DedupOpts) bool {
+	oldObj, ok := old.(*unstructured.Unstructured)
+	if !ok {
+		return false
+	}
+	newObj, ok := new.(*unstructured.Unstructured)
+	if !ok {
+		return false
+	}
+	if oldObj.GetResourceVersion() != "" && oldObj.GetResourceVersion() == newObj.GetResourceVersion() {
+		return true
+	}
+	return opts.CompareContent && equality.Semantic.DeepEqual(withoutVolatileMetadata(oldObj).Object, withoutVolatileMetadata(newObj).Object)
+}
+
+// withoutVolatileMetadata returns a copy of an object without the metadata changed on every write
+func withoutVolatileMetadata(obj *unstructured.Unstructured) *unstructured.Unstructured {
+	obj = obj.DeepCopy()
+	for _, field := range volatileMetadataFields {
+		unstructured.RemoveNestedField(obj.Object, "metadata", field)
+	}
+	return obj
+}
+
+// watchListWithFallback returns a list function which streams the initial state of a resource type
+// through a watch, and falls back to the given list function if the server rejects the watch list
+// because the WatchList feature is disabled
+func watchListWithFallback(restClient rest.Interface, apiResource metav1.APIResource, namespace string, selector string, fallback cache.ListFunc) cache.ListFunc {
+	return func(options metav1.ListOptions) (runtime.Object, error) {
+		list, err := watchListResources(restClient, apiResource, namespace, selector)
+		if err != nil && (apierr.IsBadRequest(err) || apierr.IsInvalid(err)) {
+			log.Debugf("Server does not support watch lists of %s, listing instead: %v", apiResource.Name, err)
+			return fallback(options)
+		}
+		return list, err
+	}
+}
+
+// watchListResources gets the resources of a type with a watch which sends the initial state of the
+// resources as events, ending with a bookmark annotated with initialEventsEndAnnotation. The
+// resource version of the bookmark is the resource version of the returned list. The vendored watch
+// decoder does not support bookmark events, so the event stream is decoded here.
+func watchListResources(restClient rest.Interface, apiResource metav1.APIResource, namespace string, selector string) (*unstructured.UnstructuredList, error) {
+	req := restClient.Get().
+		NamespaceIfScoped(namespace, apiResource.Namespaced).
+		Resource(apiResource.Name).
+		Param("watch", "true").
+		Param("sendInitialEvents", "true").
+		Param("resourceVersionMatch", "NotOlderThan").
+		Param("allowWatchBookmarks", "true")
+	if selector != "" {
+		req = req.Param("labelSelector", selector)
+	}
+	stream, err := req.Stream()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = stream.Close() }()
+
+	list := &unstructured.UnstructuredList{Object: map[string]interface{}{}}
+	decoder := json.NewDecoder(stream)
+	for {
+		var event metav1.WatchEvent
+		if err := decoder.Decode(&event); err != nil {
+			if err == io.EOF {
+				return nil, fmt.Errorf("watch of %s ended before its initial events were received", apiResource.Name)
+			}
+			return nil, errors.WithStack(err)
+		}
+		switch watch.EventType(event.Type) {
+		case watch.Added:
+			var obj unstructured.Unstructured
+			if err := obj.UnmarshalJSON(event.Object.Raw); err != nil {
+				return nil, err
+			}
+			list.Items = append(list.Items, obj)
+		case watch.Error:
+			var status metav1.Status
+			if err := json.Unmarshal(event.Object.Raw, &status); err != nil {
+				return nil, errors.WithStack(err)
+			}
+			return nil, &apierr.StatusError{ErrStatus: status}
+		case "BOOKMARK":
+			var bookmark unstructured.Unstructured
+			if err := bookmark.UnmarshalJSON(event.Object.Raw); err != nil {
+				return nil, err
+			}
+			if bookmark.GetAnnotations()[initialEventsEndAnnotation] == "true" {
+				list.SetResourceVersion(bookmark.GetResourceVersion())
+				return list, nil
+			}
+		}
+	}
+}
+
+func (c *LabelCache) set(obj interface{}) {
+	un, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.objs[GetResourceKey(un)] = un
+}
+
+func (c *LabelCache) delete(obj interface{}) {
+	un, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.objs, GetResourceKey(un))
+}
+
+// Get returns a copy of the cached resource with the given key, or nil if it is not in the cache
+func (c *LabelCache) Get(key ResourceKey) *unstructured.Unstructured {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if obj, ok := c.objs[key]; ok {
+		return obj.DeepCopy()
+	}
+	return nil
+}
+
+// List returns copies of all cached resources
+func (c *LabelCache) List() []*unstructured.Unstructured {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	objs := make([]*unstructured.Unstructured, 0, len(c.objs))
+	for _, obj := range c.objs {
+		objs = append(objs, obj.DeepCopy())
+	}
+	return objs
+}
+
+// HasSynced returns true once the initial list of every resource type has been added to the cache
+func (c *LabelCache) HasSynced() bool {
+	for _, hasSynced := range c.hasSynced {
+		if !hasSynced() {
+			return false
+		}
+	}
+	return true
+}
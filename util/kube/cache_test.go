@@ -0,0 +1,179 @@
+package kube
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/argoproj/argo-cd/test"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/version"
+	"k8s.io/apimachinery/pkg/watch"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	fakedynamic "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/rest"
+	kubetesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestLabelCache(t *testing.T) {
+	fakeDiscovery := &fakediscovery.FakeDiscovery{Fake: &kubetesting.Fake{}}
+	fakeDiscovery.Resources = []*metav1.APIResourceList{{
+		GroupVersion: "apps/v1beta2",
+		APIResources: []metav1.APIResource{
+			{Name: "deployments", Namespaced: true, Kind: "Deployment", Verbs: []string{"list", "watch"}},
+		},
+	}}
+	existing := fakeDeploymentV1beta2()
+	existing.SetName("existing")
+	existing.SetLabels(map[string]string{"app": "guestbook"})
+	fakeWatcher := watch.NewFake()
+	fakeClientPool := fakedynamic.FakeClientPool{}
+	fakeClientPool.AddReactor("list", "deployments", func(action kubetesting.Action) (bool, runtime.Object, error) {
+		return true, &unstructured.UnstructuredList{Items: []unstructured.Unstructured{*existing}}, nil
+	})
+	fakeClientPool.AddWatchReactor("deployments", kubetesting.DefaultWatchReactor(fakeWatcher, nil))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	labelCache, err := newLabelCache(ctx, &fakeClientPool, fakeDiscovery, nil, "", "app=guestbook", LabelCacheOpts{})
+	assert.Nil(t, err)
+	assert.True(t, cache.WaitForCacheSync(ctx.Done(), labelCache.HasSynced))
+	assert.NotNil(t, labelCache.Get(GetResourceKey(existing)))
+
+	added := fakeDeploymentV1beta2()
+	added.SetName("added")
+	added.SetLabels(map[string]string{"app": "guestbook"})
+	fakeWatcher.Add(added)
+	assert.True(t, waitFor(func() bool { return labelCache.Get(GetResourceKey(added)) != nil }))
+	assert.Len(t, labelCache.List(), 2)
+
+	fakeWatcher.Delete(existing)
+	assert.True(t, waitFor(func() bool { return labelCache.Get(GetResourceKey(existing)) == nil }))
+	assert.Len(t, labelCache.List(), 1)
+}
+
+func waitFor(condition func() bool) bool {
+	for i := 0; i < 100; i++ {
+		if condition() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func TestLabelCacheWatchList(t *testing.T) {
+	existing := fakeDeploymentV1beta2()
+	existing.SetName("existing")
+	existing.SetLabels(map[string]string{"app": "guestbook"})
+	existingJSON, err := existing.MarshalJSON()
+	assert.Nil(t, err)
+
+	var query url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query()
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = fmt.Fprintf(w, `{"type": "ADDED", "object": %s}`+"\n", existingJSON)
+		_, _ = fmt.Fprintf(w, `{"type": "BOOKMARK", "object": {"apiVersion": "apps/v1beta2", "kind": "Deployment", "metadata": {"resourceVersion": "42", "annotations": {"%s": "true"}}}}`+"\n", initialEventsEndAnnotation)
+	}))
+	defer server.Close()
+
+	fakeDiscovery := &fakediscovery.FakeDiscovery{Fake: &kubetesting.Fake{}, FakedServerVersion: &version.Info{Major: "1", Minor: "27"}}
+	fakeDiscovery.Resources = []*metav1.APIResourceList{{
+		GroupVersion: "apps/v1beta2",
+		APIResources: []metav1.APIResource{
+			{Name: "deployments", Namespaced: true, Kind: "Deployment", Verbs: []string{"list", "watch"}},
+		},
+	}}
+	fakeClientPool := fakedynamic.FakeClientPool{}
+	fakeClientPool.AddWatchReactor("deployments", kubetesting.DefaultWatchReactor(watch.NewFake(), nil))
+	restClientForGroupVersion := func(gv schema.GroupVersion) (rest.Interface, error) {
+		return newUnstructuredRESTClient(&rest.Config{Host: server.URL}, gv)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	labelCache, err := newLabelCache(ctx, &fakeClientPool, fakeDiscovery, restClientForGroupVersion, test.TestNamespace, "app=guestbook", LabelCacheOpts{WatchList: true})
+	assert.Nil(t, err)
+	assert.True(t, cache.WaitForCacheSync(ctx.Done(), labelCache.HasSynced))
+	assert.NotNil(t, labelCache.Get(GetResourceKey(existing)))
+	assert.Equal(t, "true", query.Get("sendInitialEvents"))
+	assert.Equal(t, "NotOlderThan", query.Get("resourceVersionMatch"))
+	assert.Equal(t, "app=guestbook", query.Get("labelSelector"))
+
+	// the initial state is not listed, and the watch resumes from the resource version of the bookmark
+	for _, action := range fakeClientPool.Actions() {
+		assert.NotEqual(t, "list", action.GetVerb())
+		if watchAction, ok := action.(kubetesting.WatchAction); ok {
+			assert.Equal(t, "42", watchAction.GetWatchRestrictions().ResourceVersion)
+		}
+	}
+}
+
+func TestWatchListFallback(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		_, _ = w.Write([]byte(`{"kind": "Status", "apiVersion": "v1", "status": "Failure", "reason": "Invalid", "code": 422, "message": "sendInitialEvents is forbidden for watch unless the WatchList feature gate is enabled"}`))
+	}))
+	defer server.Close()
+	restClient, err := newUnstructuredRESTClient(&rest.Config{Host: server.URL}, schema.GroupVersion{Group: "apps", Version: "v1beta2"})
+	assert.Nil(t, err)
+
+	listed := false
+	listFunc := watchListWithFallback(restClient, metav1.APIResource{Name: "deployments", Namespaced: true}, test.TestNamespace, "", func(options metav1.ListOptions) (runtime.Object, error) {
+		listed = true
+		return &unstructured.UnstructuredList{}, nil
+	})
+	_, err = listFunc(metav1.ListOptions{})
+	assert.Nil(t, err)
+	assert.True(t, listed)
+}
+
+func TestDedupUpdates(t *testing.T) {
+	var updates int
+	handler := DedupUpdates(cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(old, new interface{}) {
+			updates++
+		},
+	}, DedupOpts{CompareContent: true})
+
+	old := fakeDeploymentV1beta2()
+	old.SetResourceVersion("1")
+
+	// a resync redelivers the object with the same resource version
+	handler.OnUpdate(old, old.DeepCopy())
+	assert.Equal(t, 0, updates)
+
+	// a write which did not change the object
+	rewritten := old.DeepCopy()
+	rewritten.SetResourceVersion("2")
+	handler.OnUpdate(old, rewritten)
+	assert.Equal(t, 0, updates)
+
+	modified := rewritten.DeepCopy()
+	modified.SetResourceVersion("3")
+	unstructured.SetNestedField(modified.Object, int64(5), "spec", "replicas")
+	handler.OnUpdate(rewritten, modified)
+	assert.Equal(t, 1, updates)
+
+	// without content comparison, only redelivered objects are dropped
+	updates = 0
+	handler = DedupUpdates(cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(old, new interface{}) {
+			updates++
+		},
+	}, DedupOpts{})
+	handler.OnUpdate(old, old.DeepCopy())
+	handler.OnUpdate(old, rewritten)
+	assert.Equal(t, 1, updates)
+}
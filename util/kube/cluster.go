@@ -0,0 +1,170 @@
+package kube
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/pkg/errors"
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/version"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/rest"
+)
+
+// Platform is the distribution of Kubernetes a cluster runs
+type Platform string
+
+const (
+	PlatformKubernetes Platform = "Kubernetes"
+	PlatformOpenShift  Platform = "OpenShift"
+)
+
+// openShiftGroup is an API group which is only served by OpenShift clusters
+const openShiftGroup = "route.openshift.io"
+
+// serverSideDryRunMinVersion is the minor version of Kubernetes 1.x in which server-side dry-run became
+// available
+const serverSideDryRunMinVersion = 13
+
+// ClusterCapabilities describes a cluster and the apply features it supports
+type ClusterCapabilities struct {
+	ServerVersion *version.Info
+	// APIGroups are the names of the API groups served by the cluster. The core group is the empty string.
+	APIGroups []string
+	// ServerSideApply is whether the cluster supports server-side apply
+	ServerSideApply bool
+	// DryRun is whether the cluster supports server-side dry-run
+	DryRun   bool
+	Platform Platform
+}
+
+// ClusterInfo probes the version, API groups and capabilities of a cluster, so callers can decide
+// which apply features to use with a single call
+func ClusterInfo(config *rest.Config) (*ClusterCapabilities, error) {
+	disco, err := discovery.NewDiscoveryClientForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return clusterInfo(disco)
+}
+
+func clusterInfo(disco discovery.DiscoveryInterface) (*ClusterCapabilities, error) {
+	serverVersion, err := disco.ServerVersion()
+	if err != nil {
+		return nil, err
+	}
+	major, minor, err := parseServerVersion(serverVersion)
+	if err != nil {
+		return nil, err
+	}
+	groups, err := disco.ServerGroups()
+	if err != nil {
+		return nil, err
+	}
+	info := ClusterCapabilities{
+		ServerVersion:   serverVersion,
+		ServerSideApply: isAtLeastVersion(major, minor, serverSideApplyMinVersion),
+		DryRun:          isAtLeastVersion(major, minor, serverSideDryRunMinVersion),
+		Platform:        PlatformKubernetes,
+	}
+	for _, group := range groups.Groups {
+		info.APIGroups = append(info.APIGroups, group.Name)
+		if group.Name == openShiftGroup {
+			info.Platform = PlatformOpenShift
+		}
+	}
+	return &info, nil
+}
+
+// ClusterUnavailableReason is the reason a cluster failed its preflight check
+type ClusterUnavailableReason string
+
+const (
+	// ClusterUnreachable means the API server could not be connected to, e.g. because its host does not
+	// resolve, the connection is refused or its certificate is not trusted
+	ClusterUnreachable ClusterUnavailableReason = "Unreachable"
+	// ClusterUnauthorized means the API server rejected the credentials of the config
+	ClusterUnauthorized ClusterUnavailableReason = "Unauthorized"
+	// ClusterDegraded means the API server accepted the connection, but did not serve requests in time
+	// or failed them
+	ClusterDegraded ClusterUnavailableReason = "Degraded"
+)
+
+// ClusterUnavailableError is the error returned by PreflightCluster when a cluster can not be applied to
+type ClusterUnavailableError struct {
+	Host   string
+	Reason ClusterUnavailableReason
+	Err    error
+}
+
+func (e *ClusterUnavailableError) Error() string {
+	return fmt.Sprintf("cluster %s is unavailable (%s): %v", e.Host, e.Reason, e.Err)
+}
+
+// Cause returns the underlying error, so errors.Cause unwraps a ClusterUnavailableError
+func (e *ClusterUnavailableError) Cause() error {
+	return e.Err
+}
+
+// IsClusterUnavailableError returns whether an error is, or was caused by, a ClusterUnavailableError.
+// Since a ClusterUnavailableError has a cause itself, errors.Cause would unwrap it, so the chain of
+// causes is walked instead.
+func IsClusterUnavailableError(err error) bool {
+	for _, cause := range causeChain(err) {
+		if _, ok := cause.(*ClusterUnavailableError); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// PreflightCluster checks the API server of a cluster serves its version and API groups within the
+// timeout, so an unavailable cluster is reported once, rather than by every apply failing slowly. A
+// ClusterUnavailableError classifies the failure as a connectivity, authentication or availability
+// problem.
+func PreflightCluster(config *rest.Config, timeout time.Duration) error {
+	configCopy := *config
+	configCopy.Timeout = timeout
+	disco, err := discovery.NewDiscoveryClientForConfig(&configCopy)
+	if err != nil {
+		return fmt.Errorf("REST config invalid: %s", err)
+	}
+	return preflightCluster(disco, config.Host)
+}
+
+func preflightCluster(disco discovery.DiscoveryInterface, host string) error {
+	_, err := disco.ServerVersion()
+	if err == nil {
+		_, err = disco.ServerGroups()
+	}
+	if err != nil {
+		return &ClusterUnavailableError{Host: host, Reason: classifyClusterError(err), Err: err}
+	}
+	return nil
+}
+
+// tlsFailureMessages are fragments of the messages reported when the TLS handshake with a server failed
+var tlsFailureMessages = []string{
+	"x509:",
+	"tls:",
+}
+
+// classifyClusterError derives the reason a request to an API server failed. Connections which could
+// not be established are unreachable, while timeouts after connecting mean the server is degraded.
+func classifyClusterError(err error) ClusterUnavailableReason {
+	cause := errors.Cause(err)
+	if apierr.IsUnauthorized(cause) || apierr.IsForbidden(cause) {
+		return ClusterUnauthorized
+	}
+	if urlErr, ok := cause.(*url.Error); ok {
+		if opErr, ok := urlErr.Err.(*net.OpError); ok && opErr.Op == "dial" {
+			return ClusterUnreachable
+		}
+		if containsAny(urlErr.Err.Error(), tlsFailureMessages) {
+			return ClusterUnreachable
+		}
+	}
+	return ClusterDegraded
+}
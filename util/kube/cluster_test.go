@@ -0,0 +1,101 @@
+package kube
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/version"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	"k8s.io/client-go/rest"
+	kubetesting "k8s.io/client-go/testing"
+)
+
+func TestClusterInfo(t *testing.T) {
+	fakeDiscovery := &fakediscovery.FakeDiscovery{Fake: &kubetesting.Fake{}, FakedServerVersion: &version.Info{Major: "1", Minor: "14"}}
+	fakeDiscovery.Resources = resourceList()
+	info, err := clusterInfo(fakeDiscovery)
+	assert.Nil(t, err)
+	assert.Equal(t, "14", info.ServerVersion.Minor)
+	assert.Contains(t, info.APIGroups, "apps")
+	assert.False(t, info.ServerSideApply)
+	assert.True(t, info.DryRun)
+	assert.Equal(t, PlatformKubernetes, info.Platform)
+
+	fakeDiscovery.Resources = append(fakeDiscovery.Resources, &metav1.APIResourceList{
+		GroupVersion: "route.openshift.io/v1",
+		APIResources: []metav1.APIResource{{Name: "routes", Namespaced: true, Kind: "Route"}},
+	})
+	info, err = clusterInfo(fakeDiscovery)
+	assert.Nil(t, err)
+	assert.Equal(t, PlatformOpenShift, info.Platform)
+}
+
+func preflightReason(t *testing.T, err error) ClusterUnavailableReason {
+	if !assert.True(t, IsClusterUnavailableError(err)) {
+		return ""
+	}
+	return err.(*ClusterUnavailableError).Reason
+}
+
+func TestIsClusterUnavailableErrorWrapped(t *testing.T) {
+	err := &ClusterUnavailableError{Reason: ClusterUnreachable, Err: errors.New("connection refused")}
+	assert.True(t, IsClusterUnavailableError(err))
+	assert.True(t, IsClusterUnavailableError(errors.Wrap(err, "failed to sync")))
+	assert.False(t, IsClusterUnavailableError(errors.New("connection refused")))
+	assert.False(t, IsClusterUnavailableError(nil))
+}
+
+func TestPreflightCluster(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/version":
+			_, _ = w.Write([]byte(`{"major":"1","minor":"9"}`))
+		case "/api":
+			_, _ = w.Write([]byte(`{"kind":"APIVersions","versions":["v1"]}`))
+		case "/apis":
+			_, _ = w.Write([]byte(`{"kind":"APIGroupList","groups":[]}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	assert.Nil(t, PreflightCluster(&rest.Config{Host: server.URL}, time.Second))
+
+	// a server which is shut down refuses connections
+	server.Close()
+	err := PreflightCluster(&rest.Config{Host: server.URL}, time.Second)
+	assert.Equal(t, ClusterUnreachable, preflightReason(t, err))
+}
+
+func TestPreflightClusterUnauthorized(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		_, _ = w.Write([]byte(`{"kind":"Status","apiVersion":"v1","status":"Failure","message":"Unauthorized","reason":"Unauthorized","code":401}`))
+	}))
+	defer server.Close()
+	err := PreflightCluster(&rest.Config{Host: server.URL, BearerToken: "expired"}, time.Second)
+	assert.Equal(t, ClusterUnauthorized, preflightReason(t, err))
+}
+
+func TestPreflightClusterTimeout(t *testing.T) {
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer server.Close()
+	defer close(done)
+	start := time.Now()
+	err := PreflightCluster(&rest.Config{Host: server.URL}, 100*time.Millisecond)
+	assert.Equal(t, ClusterDegraded, preflightReason(t, err))
+	assert.True(t, time.Since(start) < 5*time.Second)
+}
@@ -0,0 +1,89 @@
+package kube
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+)
+
+// MissingCRDsError indicates objects of custom kinds would be applied without the CRDs defining the
+// kinds being installed
+type MissingCRDsError struct {
+	GroupKinds []schema.GroupKind
+}
+
+func (e *MissingCRDsError) Error() string {
+	names := make([]string, len(e.GroupKinds))
+	for i, gk := range e.GroupKinds {
+		names[i] = fmt.Sprintf("%s/%s", gk.Group, gk.Kind)
+	}
+	return fmt.Sprintf("missing CRD: %s", strings.Join(names, ", "))
+}
+
+// crdDefinedKinds returns the kinds defined by the CRDs among the objects
+func crdDefinedKinds(objs []*unstructured.Unstructured) map[schema.GroupKind]bool {
+	defined := make(map[schema.GroupKind]bool)
+	for _, obj := range objs {
+		if obj.GetKind() != "CustomResourceDefinition" {
+			continue
+		}
+		group, _ := unstructured.NestedString(obj.Object, "spec", "group")
+		kind, _ := unstructured.NestedString(obj.Object, "spec", "names", "kind")
+		defined[schema.GroupKind{Group: group, Kind: kind}] = true
+	}
+	return defined
+}
+
+// ValidateCRDsInstalled verifies that the CRDs of all custom kinds among the objects are installed and
+// established, i.e. that the kinds are served by the API server, so a missing CRD is reported before
+// anything is applied rather than as "no matches for kind" midway through. Kinds whose CRD is among the
+// objects themselves are skipped, since the CRD is applied first. All missing CRDs are reported at once
+// in a MissingCRDsError.
+func ValidateCRDsInstalled(config *rest.Config, objs []*unstructured.Unstructured) error {
+	disco, err := discovery.NewDiscoveryClientForConfig(config)
+	if err != nil {
+		return err
+	}
+	return validateCRDsInstalled(disco, objs)
+}
+
+func validateCRDsInstalled(disco discovery.DiscoveryInterface, objs []*unstructured.Unstructured) error {
+	defined := crdDefinedKinds(objs)
+	var scopes map[schema.GroupVersionKind]bool
+	missing := make(map[schema.GroupKind]bool)
+	for _, obj := range objs {
+		gvk := obj.GroupVersionKind()
+		if obj.GetKind() == "CustomResourceDefinition" || scheme.Scheme.Recognizes(gvk) || defined[gvk.GroupKind()] {
+			continue
+		}
+		if scopes == nil {
+			var err error
+			if scopes, err = DiscoverScopes(disco); err != nil {
+				return err
+			}
+		}
+		if _, ok := scopes[gvk]; !ok {
+			missing[gvk.GroupKind()] = true
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	groupKinds := make([]schema.GroupKind, 0, len(missing))
+	for gk := range missing {
+		groupKinds = append(groupKinds, gk)
+	}
+	sort.Slice(groupKinds, func(i, j int) bool {
+		if groupKinds[i].Group != groupKinds[j].Group {
+			return groupKinds[i].Group < groupKinds[j].Group
+		}
+		return groupKinds[i].Kind < groupKinds[j].Kind
+	})
+	return &MissingCRDsError{GroupKinds: groupKinds}
+}
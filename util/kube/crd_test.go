@@ -0,0 +1,49 @@
+package kube
+
+import (
+	"testing"
+
+	"github.com/argoproj/argo-cd/test"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	kubetesting "k8s.io/client-go/testing"
+)
+
+func newCustomResource(apiVersion string, kind string, name string) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{}
+	obj.SetAPIVersion(apiVersion)
+	obj.SetKind(kind)
+	obj.SetName(name)
+	return obj
+}
+
+func TestValidateCRDsInstalled(t *testing.T) {
+	fakeDiscovery := &fakediscovery.FakeDiscovery{Fake: &kubetesting.Fake{}}
+	fakeDiscovery.Resources = append(resourceList(), &metav1.APIResourceList{
+		GroupVersion: "example.com/v1",
+		APIResources: []metav1.APIResource{
+			{Name: "gadgets", Namespaced: true, Kind: "Gadget"},
+		},
+	})
+	svc := MustToUnstructured(test.DemoService())
+	gadget := newCustomResource("example.com/v1", "Gadget", "installed")
+
+	assert.Nil(t, validateCRDsInstalled(fakeDiscovery, []*unstructured.Unstructured{svc, gadget}))
+
+	widget := newCustomResource("example.com/v1", "Widget", "demo")
+	sprocket := newCustomResource("sprockets.io/v1alpha1", "Sprocket", "demo")
+	err := validateCRDsInstalled(fakeDiscovery, []*unstructured.Unstructured{svc, widget, gadget, sprocket})
+	if assert.IsType(t, &MissingCRDsError{}, err) {
+		assert.Equal(t, []schema.GroupKind{{Group: "example.com", Kind: "Widget"}, {Group: "sprockets.io", Kind: "Sprocket"}}, err.(*MissingCRDsError).GroupKinds)
+		assert.Equal(t, "missing CRD: example.com/Widget, sprockets.io/Sprocket", err.Error())
+	}
+
+	// the CRD is applied along with its custom resource
+	crd := newCustomResource("apiextensions.k8s.io/v1beta1", "CustomResourceDefinition", "widgets.example.com")
+	crd.Object["spec"] = map[string]interface{}{"group": "example.com", "names": map[string]interface{}{"kind": "Widget"}}
+	err = validateCRDsInstalled(fakeDiscovery, []*unstructured.Unstructured{crd, widget, sprocket})
+	assert.EqualError(t, err, "missing CRD: sprockets.io/Sprocket")
+}
@@ -0,0 +1,132 @@
+package kube
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/discovery/cached"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+)
+
+// Discovery bundles an in-memory cached discovery client with a REST mapper backed by the same
+// cache. Unlike the discovery client, it is safe to share a Discovery across goroutines.
+type Discovery struct {
+	lock   sync.RWMutex
+	cache  discovery.CachedDiscoveryInterface
+	mapper *discovery.DeferredDiscoveryRESTMapper
+	scopes map[schema.GroupVersionKind]bool
+}
+
+// NewDiscovery returns a Discovery which caches the results of the supplied discovery client
+func NewDiscovery(disco discovery.DiscoveryInterface) *Discovery {
+	cache := cached.NewMemCacheClient(disco)
+	return &Discovery{
+		cache:  cache,
+		mapper: discovery.NewDeferredDiscoveryRESTMapper(cache, dynamic.VersionInterfaces),
+	}
+}
+
+// NewDiscoveryForConfig returns a Discovery for the cluster of the supplied REST config
+func NewDiscoveryForConfig(config *rest.Config) (*Discovery, error) {
+	disco, err := discovery.NewDiscoveryClientForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return NewDiscovery(disco), nil
+}
+
+// ServerResources returns the supported resources for all groups and versions
+func (d *Discovery) ServerResources() ([]*metav1.APIResourceList, error) {
+	d.ensureFilled()
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	resources, err := d.cache.ServerResources()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return resources, nil
+}
+
+// RESTMapping returns the REST mapping of a group kind, preferring the supplied versions
+func (d *Discovery) RESTMapping(gk schema.GroupKind, versions ...string) (*meta.RESTMapping, error) {
+	d.ensureFilled()
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	return d.mapper.RESTMapping(gk, versions...)
+}
+
+// Scopes returns whether each kind served by the API server is namespaced, like DiscoverScopes. The
+// result is computed once until the Discovery is invalidated, and must not be modified.
+func (d *Discovery) Scopes() (map[schema.GroupVersionKind]bool, error) {
+	d.ensureFilled()
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.scopes == nil {
+		scopes, err := DiscoverScopes(d.cache)
+		if err != nil {
+			return nil, err
+		}
+		d.scopes = scopes
+	}
+	return d.scopes, nil
+}
+
+// DiscoveryInterface returns the cached discovery client, for use with functions which accept one
+func (d *Discovery) DiscoveryInterface() discovery.DiscoveryInterface {
+	d.ensureFilled()
+	return d.cache
+}
+
+// Invalidate refreshes the cached discovery information and resets the REST mapper
+func (d *Discovery) Invalidate() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.invalidate()
+}
+
+// ensureFilled populates the cache the first time it is used
+func (d *Discovery) ensureFilled() {
+	d.lock.RLock()
+	fresh := d.cache.Fresh()
+	d.lock.RUnlock()
+	if fresh {
+		return
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if !d.cache.Fresh() {
+		d.invalidate()
+	}
+}
+
+func (d *Discovery) invalidate() {
+	d.cache.Invalidate()
+	d.mapper.Reset()
+	d.scopes = nil
+}
+
+// DiscoverScopes returns whether each kind served by the API server is namespaced (true) or cluster
+// scoped (false). Subresources, such as deployments/scale, are excluded. Use Discovery.Scopes to avoid
+// repeating the discovery on every call.
+func DiscoverScopes(disco discovery.DiscoveryInterface) (map[schema.GroupVersionKind]bool, error) {
+	serverResources, err := disco.ServerResources()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	scopes := make(map[schema.GroupVersionKind]bool)
+	for _, apiResourcesList := range serverResources {
+		for _, apiResource := range apiResourcesList.APIResources {
+			if strings.Contains(apiResource.Name, "/") {
+				continue
+			}
+			scopes[schema.FromAPIVersionAndKind(apiResourcesList.GroupVersion, apiResource.Kind)] = apiResource.Namespaced
+		}
+	}
+	return scopes, nil
+}
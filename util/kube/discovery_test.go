@@ -0,0 +1,64 @@
+package kube
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestDiscoveryConcurrency(t *testing.T) {
+	kubeclientset := fake.NewSimpleClientset()
+	fakeDiscovery, ok := kubeclientset.Discovery().(*fakediscovery.FakeDiscovery)
+	assert.True(t, ok)
+	fakeDiscovery.Fake.Resources = resourceList()
+
+	disco := NewDiscovery(fakeDiscovery)
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			resources, err := disco.ServerResources()
+			assert.Nil(t, err)
+			assert.Equal(t, len(resourceList()), len(resources))
+		}()
+		go func() {
+			defer wg.Done()
+			mapping, err := disco.RESTMapping(schema.GroupKind{Group: "apps", Kind: "Deployment"})
+			assert.Nil(t, err)
+			if assert.NotNil(t, mapping) {
+				assert.Equal(t, "deployments", mapping.Resource)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			disco.Invalidate()
+		}()
+	}
+	wg.Wait()
+}
+
+func TestDiscoverScopes(t *testing.T) {
+	kubeclientset := fake.NewSimpleClientset()
+	fakeDiscovery, ok := kubeclientset.Discovery().(*fakediscovery.FakeDiscovery)
+	assert.True(t, ok)
+	fakeDiscovery.Fake.Resources = clusterScopedResourceList()
+
+	scopes, err := DiscoverScopes(fakeDiscovery)
+	assert.Nil(t, err)
+	assert.True(t, scopes[schema.GroupVersionKind{Group: "apps", Version: "v1beta2", Kind: "Deployment"}])
+	namespaced, ok := scopes[schema.GroupVersionKind{Group: "rbac.authorization.k8s.io", Version: "v1", Kind: "ClusterRole"}]
+	assert.True(t, ok)
+	assert.False(t, namespaced)
+	// subresources are not kinds of their own
+	_, ok = scopes[schema.GroupVersionKind{Version: "v1", Kind: "Scale"}]
+	assert.False(t, ok)
+
+	cached, err := NewDiscovery(fakeDiscovery).Scopes()
+	assert.Nil(t, err)
+	assert.Equal(t, scopes, cached)
+}
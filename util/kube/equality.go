@@ -0,0 +1,127 @@
+package kube
+
+import (
+	"encoding/json"
+	"math"
+	"sort"
+
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// SemanticEqual returns whether two objects are effectively the same object. Status and server
+// managed metadata are ignored, numbers are compared by value regardless of whether they were
+// decoded as integers or floats, and the lists of named elements in orderInsensitiveLists (such as
+// containers, env vars and ports) are compared regardless of their order. Two nil objects are equal.
+func SemanticEqual(a, b *unstructured.Unstructured) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	canonicalA, err := canonicalize(a)
+	if err != nil {
+		return false
+	}
+	canonicalB, err := canonicalize(b)
+	if err != nil {
+		return false
+	}
+	return equality.Semantic.DeepEqual(canonicalA, canonicalB)
+}
+
+// canonicalize returns a representation of an object in which equivalent objects are deeply equal
+func canonicalize(obj *unstructured.Unstructured) (interface{}, error) {
+	obj = withoutServerFields(obj)
+	// a JSON round trip decodes all numbers as float64
+	data, err := json.Marshal(obj.Object)
+	if err != nil {
+		return nil, err
+	}
+	var value interface{}
+	if err = json.Unmarshal(data, &value); err != nil {
+		return nil, err
+	}
+	sortNamedLists(value)
+	return value, nil
+}
+
+// maxExactFloat is the magnitude up to which every whole number is exactly representable as a float64
+const maxExactFloat = 1 << 53
+
+// CanonicalizeNumbers returns a copy of an object in which all whole numbers decoded as float64, as JSON
+// and YAML decoding does, are converted to int64, which is how the API server returns integer fields
+// such as replicas and ports. Comparing canonicalized objects avoids reporting 3 and 3.0 as a
+// difference. Numbers with a fractional part are left as they are.
+func CanonicalizeNumbers(obj *unstructured.Unstructured) *unstructured.Unstructured {
+	obj = obj.DeepCopy()
+	obj.Object = canonicalizeNumbers(obj.Object).(map[string]interface{})
+	return obj
+}
+
+func canonicalizeNumbers(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, field := range v {
+			v[key] = canonicalizeNumbers(field)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = canonicalizeNumbers(item)
+		}
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) <= maxExactFloat {
+			return int64(v)
+		}
+	}
+	return value
+}
+
+// orderInsensitiveLists are the fields holding lists of named elements whose order has no effect.
+// Other lists keep their order, since it may be significant, e.g. init containers run in order.
+var orderInsensitiveLists = map[string]bool{
+	"containers":   true,
+	"env":          true,
+	"ports":        true,
+	"volumes":      true,
+	"volumeMounts": true,
+}
+
+// sortNamedLists sorts, in place, the lists nested in a value which are held by one of the
+// orderInsensitiveLists fields, and whose elements are all objects with a name
+func sortNamedLists(value interface{}) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, field := range v {
+			sortNamedLists(field)
+			if list, ok := field.([]interface{}); ok && orderInsensitiveLists[key] {
+				sortByName(list)
+			}
+		}
+	case []interface{}:
+		for _, item := range v {
+			sortNamedLists(item)
+		}
+	}
+}
+
+// sortByName sorts a list by the names of its elements, unless some element has no name
+func sortByName(list []interface{}) {
+	for _, item := range list {
+		if _, ok := nameOf(item); !ok {
+			return
+		}
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		nameI, _ := nameOf(list[i])
+		nameJ, _ := nameOf(list[j])
+		return nameI < nameJ
+	})
+}
+
+func nameOf(item interface{}) (string, bool) {
+	m, ok := item.(map[string]interface{})
+	if !ok {
+		return "", false
+	}
+	name, ok := m["name"].(string)
+	return name, ok
+}
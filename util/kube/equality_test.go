@@ -0,0 +1,71 @@
+package kube
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestSemanticEqual(t *testing.T) {
+	withEnv := func(env ...interface{}) *unstructured.Unstructured {
+		obj := fakeDeploymentV1beta2()
+		containers, _ := unstructured.NestedSlice(obj.Object, "spec", "template", "spec", "containers")
+		containers[0].(map[string]interface{})["env"] = env
+		unstructured.SetNestedSlice(obj.Object, containers, "spec", "template", "spec", "containers")
+		return obj
+	}
+	foo := map[string]interface{}{"name": "FOO", "value": "1"}
+	bar := map[string]interface{}{"name": "BAR", "value": "2"}
+
+	assert.True(t, SemanticEqual(withEnv(foo, bar), withEnv(bar, foo)))
+	assert.False(t, SemanticEqual(withEnv(foo, bar), withEnv(foo)))
+
+	// init containers run in order, so reordering them is a change
+	withInitContainers := func(names ...string) *unstructured.Unstructured {
+		obj := fakeDeploymentV1beta2()
+		var initContainers []interface{}
+		for _, name := range names {
+			initContainers = append(initContainers, map[string]interface{}{"name": name, "image": "busybox"})
+		}
+		unstructured.SetNestedSlice(obj.Object, initContainers, "spec", "template", "spec", "initContainers")
+		return obj
+	}
+	assert.True(t, SemanticEqual(withInitContainers("migrate", "seed"), withInitContainers("migrate", "seed")))
+	assert.False(t, SemanticEqual(withInitContainers("migrate", "seed"), withInitContainers("seed", "migrate")))
+
+	// numbers decoded as integers and floats are equal
+	a := fakeDeploymentV1beta2()
+	b := fakeDeploymentV1beta2()
+	unstructured.SetNestedField(a.Object, int64(3), "spec", "replicas")
+	unstructured.SetNestedField(b.Object, float64(3), "spec", "replicas")
+	b.SetResourceVersion("123")
+	assert.True(t, SemanticEqual(a, b))
+
+	assert.True(t, SemanticEqual(nil, nil))
+	assert.False(t, SemanticEqual(a, nil))
+}
+
+func TestCanonicalizeNumbers(t *testing.T) {
+	obj := fakeDeploymentV1beta2()
+	unstructured.SetNestedField(obj.Object, float64(3), "spec", "replicas")
+	containers, _ := unstructured.NestedSlice(obj.Object, "spec", "template", "spec", "containers")
+	containers[0].(map[string]interface{})["ports"] = []interface{}{
+		map[string]interface{}{"containerPort": float64(8080), "name": "http"},
+	}
+	unstructured.SetNestedSlice(obj.Object, containers, "spec", "template", "spec", "containers")
+	unstructured.SetNestedField(obj.Object, 0.5, "spec", "template", "metadata", "weight")
+
+	canonical := CanonicalizeNumbers(obj)
+	replicas, _ := unstructured.NestedFieldCopy(canonical.Object, "spec", "replicas")
+	assert.Equal(t, int64(3), replicas)
+	containers, _ = unstructured.NestedSlice(canonical.Object, "spec", "template", "spec", "containers")
+	port := containers[0].(map[string]interface{})["ports"].([]interface{})[0].(map[string]interface{})["containerPort"]
+	assert.Equal(t, int64(8080), port)
+	weight, _ := unstructured.NestedFieldCopy(canonical.Object, "spec", "template", "metadata", "weight")
+	assert.Equal(t, 0.5, weight)
+
+	// the original object is left unchanged
+	replicas, _ = unstructured.NestedFieldCopy(obj.Object, "spec", "replicas")
+	assert.Equal(t, float64(3), replicas)
+}
@@ -0,0 +1,416 @@
+package kube
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// RetryableError indicates an operation failed for a reason which is likely transient, such as an
+// aggregated API server being temporarily unavailable, and that the operation may be retried.
+type RetryableError struct {
+	Err error
+}
+
+func (e *RetryableError) Error() string {
+	return e.Err.Error()
+}
+
+// IsRetryableError returns whether an error is a RetryableError
+func IsRetryableError(err error) bool {
+	_, ok := errors.Cause(err).(*RetryableError)
+	return ok
+}
+
+// UnknownKindError indicates the API server does not serve a group version kind
+type UnknownKindError struct {
+	GroupVersionKind schema.GroupVersionKind
+}
+
+func (e *UnknownKindError) Error() string {
+	return fmt.Sprintf("Server is unable to handle %s", e.GroupVersionKind)
+}
+
+// IsUnknownKindError returns whether an error is an UnknownKindError
+func IsUnknownKindError(err error) bool {
+	_, ok := errors.Cause(err).(*UnknownKindError)
+	return ok
+}
+
+// StaleObjectError indicates an object was modified since it was read, so a write based on it would be
+// rejected as a conflict
+type StaleObjectError struct {
+	Key ResourceKey
+	// ResourceVersion is the version of the object which was read
+	ResourceVersion string
+	// LiveResourceVersion is the current version of the object, or empty if it was deleted
+	LiveResourceVersion string
+}
+
+func (e *StaleObjectError) Error() string {
+	if e.LiveResourceVersion == "" {
+		return fmt.Sprintf("%s at resource version %s was deleted", e.Key, e.ResourceVersion)
+	}
+	return fmt.Sprintf("%s at resource version %s is stale, the live resource version is %s", e.Key, e.ResourceVersion, e.LiveResourceVersion)
+}
+
+// IsStaleObjectError returns whether an error is a StaleObjectError
+func IsStaleObjectError(err error) bool {
+	_, ok := errors.Cause(err).(*StaleObjectError)
+	return ok
+}
+
+// ForbiddenFieldsError indicates an object sets fields which are managed by the server and must not
+// be applied
+type ForbiddenFieldsError struct {
+	Key ResourceKey
+	// Paths are the dot separated paths of the forbidden fields
+	Paths []string
+}
+
+func (e *ForbiddenFieldsError) Error() string {
+	return fmt.Sprintf("%s sets fields managed by the server, which must be removed before applying: %s", e.Key, strings.Join(e.Paths, ", "))
+}
+
+// ApplyConflictError indicates a server-side apply was rejected because it would change fields owned
+// by other field managers
+type ApplyConflictError struct {
+	// Conflicts are the paths of the conflicting fields
+	Conflicts []string
+	Err       error
+}
+
+func (e *ApplyConflictError) Error() string {
+	return e.Err.Error()
+}
+
+// IsApplyConflictError returns whether an error is an ApplyConflictError
+func IsApplyConflictError(err error) bool {
+	_, ok := errors.Cause(err).(*ApplyConflictError)
+	return ok
+}
+
+// parseApplyConflicts extracts the conflicting fields from the output of a failed server-side apply.
+// kubectl reports a single conflicting field at the end of the "Apply failed" line, and multiple
+// conflicting fields as a list of lines prefixed with "- " following it.
+func parseApplyConflicts(output string) ([]string, bool) {
+	lines := strings.Split(output, "\n")
+	for i, line := range lines {
+		idx := strings.Index(line, "Apply failed with ")
+		if idx < 0 {
+			continue
+		}
+		var conflicts []string
+		if fieldIdx := strings.LastIndex(line, ": ."); fieldIdx >= 0 {
+			conflicts = append(conflicts, strings.TrimSpace(line[fieldIdx+2:]))
+		}
+		for _, next := range lines[i+1:] {
+			next = strings.TrimSpace(next)
+			if !strings.HasPrefix(next, "- ") {
+				break
+			}
+			conflicts = append(conflicts, strings.TrimPrefix(next, "- "))
+		}
+		return conflicts, true
+	}
+	return nil, false
+}
+
+// SchemaViolation is a field of a custom resource which violates the OpenAPI schema of its CRD
+type SchemaViolation struct {
+	// Path is the dot separated path of the field
+	Path string
+	// Message describes the violation, e.g. "must be of type integer"
+	Message string
+}
+
+// SchemaValidationError indicates a custom resource was rejected because it violates the OpenAPI schema
+// of its CustomResourceDefinition
+type SchemaValidationError struct {
+	Kind       string
+	Name       string
+	Violations []SchemaViolation
+	Err        error
+}
+
+func (e *SchemaValidationError) Error() string {
+	return e.Err.Error()
+}
+
+// IsSchemaValidationError returns whether an error is a SchemaValidationError
+func IsSchemaValidationError(err error) bool {
+	_, ok := errors.Cause(err).(*SchemaValidationError)
+	return ok
+}
+
+// invalidObjectPattern matches the start of the message the API server reports for an invalid object
+var invalidObjectPattern = regexp.MustCompile(`The (\S+) "([^"]*)" is invalid: `)
+
+// schemaFieldMarker separates the path of a field from the violation in the messages of OpenAPI schema
+// validation, e.g. "spec.replicas in body must be of type integer"
+const schemaFieldMarker = " in body "
+
+// parseSchemaViolations extracts the violations from the output of an apply which failed the OpenAPI
+// schema validation of a CRD, returning the kind and name of the object. The API server reports a list
+// of violations following "validation failure list:" up to Kubernetes 1.15, and every violation as a
+// separate cause, either inline or as a list of lines prefixed with "* ", since.
+func parseSchemaViolations(output string) (string, string, []SchemaViolation, bool) {
+	if !strings.Contains(output, schemaFieldMarker) {
+		return "", "", nil, false
+	}
+	match := invalidObjectPattern.FindStringSubmatchIndex(output)
+	if match == nil {
+		return "", "", nil, false
+	}
+	kind, name := output[match[2]:match[3]], output[match[4]:match[5]]
+	details := output[match[1]:]
+	const failureList = "validation failure list:"
+	if idx := strings.Index(details, failureList); idx >= 0 {
+		details = details[idx+len(failureList):]
+	}
+	var violations []SchemaViolation
+	for _, cause := range strings.Split(details, "\n") {
+		cause = strings.TrimPrefix(strings.TrimSpace(cause), "* ")
+		if cause != "" {
+			violations = append(violations, parseSchemaViolation(cause))
+		}
+	}
+	return kind, name, violations, len(violations) > 0
+}
+
+// parseSchemaViolation parses a single violation, such as
+// `spec.replicas: Invalid value: "string": spec.replicas in body must be of type integer: "string"` or
+// `spec.replicas in body must be of type integer: "string"`
+func parseSchemaViolation(cause string) SchemaViolation {
+	if idx := strings.Index(cause, schemaFieldMarker); idx >= 0 {
+		path := cause[:idx]
+		if sep := strings.LastIndex(path, ": "); sep >= 0 {
+			path = path[sep+2:]
+		}
+		return SchemaViolation{Path: path, Message: cause[idx+len(schemaFieldMarker):]}
+	}
+	if idx := strings.Index(cause, ": "); idx >= 0 {
+		return SchemaViolation{Path: cause[:idx], Message: cause[idx+2:]}
+	}
+	return SchemaViolation{Message: cause}
+}
+
+// ApplyErrorCategory is the category of the reason an apply failed, which determines how a caller should
+// react to the failure (e.g. retry transient failures, but report validation failures to the user)
+type ApplyErrorCategory string
+
+const (
+	// ApplyErrorValidation means the object was rejected as invalid, including by an admission webhook
+	ApplyErrorValidation ApplyErrorCategory = "Validation"
+	// ApplyErrorConflict means the object was modified concurrently, or server-side apply found fields
+	// owned by other field managers
+	ApplyErrorConflict ApplyErrorCategory = "Conflict"
+	// ApplyErrorImmutable means the apply changed a field which cannot be changed after creation
+	ApplyErrorImmutable ApplyErrorCategory = "Immutable"
+	// ApplyErrorForbidden means the user is not permitted to apply the object
+	ApplyErrorForbidden ApplyErrorCategory = "Forbidden"
+	// ApplyErrorWebhook means an admission webhook could not be called
+	ApplyErrorWebhook ApplyErrorCategory = "Webhook"
+	// ApplyErrorTransient means the API server was temporarily unavailable or overloaded
+	ApplyErrorTransient ApplyErrorCategory = "Transient"
+	// ApplyErrorUnknown means the failure could not be classified
+	ApplyErrorUnknown ApplyErrorCategory = "Unknown"
+)
+
+// ApplyError is the error returned when applying an object failed, classified by category. The
+// underlying error, such as a RetryableError or ApplyConflictError, is its cause.
+type ApplyError struct {
+	Category ApplyErrorCategory
+	Err      error
+}
+
+func (e *ApplyError) Error() string {
+	return e.Err.Error()
+}
+
+// Cause returns the underlying error, so errors.Cause unwraps an ApplyError
+func (e *ApplyError) Cause() error {
+	return e.Err
+}
+
+// GetApplyErrorCategory returns the category of an error returned by an apply. Errors which are not
+// ApplyErrors are classified from their message.
+func GetApplyErrorCategory(err error) ApplyErrorCategory {
+	for _, cause := range causeChain(err) {
+		if applyErr, ok := cause.(*ApplyError); ok {
+			return applyErr.Category
+		}
+	}
+	return ClassifyApplyError(err)
+}
+
+// causeChain returns an error followed by each of its causes in turn. Unlike errors.Cause, which only
+// returns the innermost cause, it allows finding errors such as ApplyError which have causes themselves.
+func causeChain(err error) []error {
+	var chain []error
+	for cause := err; cause != nil; {
+		chain = append(chain, cause)
+		causer, ok := cause.(interface{ Cause() error })
+		if !ok {
+			break
+		}
+		cause = causer.Cause()
+	}
+	return chain
+}
+
+// transientMessages are fragments of the messages reported when a request failed due to the API
+// server being unreachable, overloaded or timing out
+var transientMessages = []string{
+	"connection refused",
+	"connection reset by peer",
+	"i/o timeout",
+	"TLS handshake timeout",
+	"(Timeout)",
+	"(TooManyRequests)",
+	"the server was unable to return a response in the time allotted",
+}
+
+// validationMessages are fragments of the messages reported by kubectl when an object was rejected as
+// invalid
+var validationMessages = []string{
+	"is invalid",
+	"error validating",
+	"(BadRequest)",
+	"denied the request",
+	"unable to recognize",
+}
+
+// ClassifyApplyError derives the category of an apply failure from an API error or from the error
+// output of kubectl
+func ClassifyApplyError(err error) ApplyErrorCategory {
+	if err == nil {
+		return ApplyErrorUnknown
+	}
+	cause := errors.Cause(err)
+	msg := err.Error()
+	_, isApplyConflict := parseApplyConflicts(msg)
+	switch {
+	case isApplyConflict || IsApplyConflictError(err) || apierr.IsConflict(cause) || strings.Contains(msg, "the object has been modified"):
+		return ApplyErrorConflict
+	case IsImmutableError(err) || IsImmutableKubectlOutput(msg):
+		return ApplyErrorImmutable
+	case IsWebhookError(err):
+		return ApplyErrorWebhook
+	case apierr.IsForbidden(cause) || strings.Contains(msg, "(Forbidden)") || strings.Contains(msg, "is forbidden"):
+		return ApplyErrorForbidden
+	case IsRetryableError(err) || isServiceUnavailable(err) || apierr.IsTimeout(cause) || apierr.IsServerTimeout(cause) ||
+		apierr.IsTooManyRequests(cause) || containsAny(msg, transientMessages):
+		return ApplyErrorTransient
+	case apierr.IsInvalid(cause) || apierr.IsBadRequest(cause) || containsAny(msg, validationMessages):
+		return ApplyErrorValidation
+	}
+	return ApplyErrorUnknown
+}
+
+func containsAny(msg string, fragments []string) bool {
+	for _, fragment := range fragments {
+		if strings.Contains(msg, fragment) {
+			return true
+		}
+	}
+	return false
+}
+
+// serviceUnavailableMessages are fragments of the messages reported by kubectl when the API server
+// (or an aggregated API server behind it) responds with 503 Service Unavailable
+var serviceUnavailableMessages = []string{
+	"(ServiceUnavailable)",
+	"the server is currently unable to handle the request",
+	"503 Service Unavailable",
+}
+
+// isServiceUnavailable returns whether an error from the API server, or from kubectl, indicates
+// the server was unavailable
+func isServiceUnavailable(err error) bool {
+	if apierr.IsServiceUnavailable(errors.Cause(err)) {
+		return true
+	}
+	msg := err.Error()
+	for _, fragment := range serviceUnavailableMessages {
+		if strings.Contains(msg, fragment) {
+			return true
+		}
+	}
+	return false
+}
+
+// webhookCallFailureMessages are fragments of the messages reported when the API server could not call
+// an admission webhook, as opposed to the webhook denying the request
+var webhookCallFailureMessages = []string{
+	"failed calling webhook",
+	"failed calling admission webhook",
+}
+
+// IsWebhookError returns whether an error from the API server, or from kubectl, indicates a request
+// failed because an admission webhook could not be called (e.g. its service has no endpoints or refused
+// the connection). Such failures are transient while the webhook is restarted, unlike a webhook
+// rejecting the request.
+func IsWebhookError(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := err.Error()
+	for _, fragment := range webhookCallFailureMessages {
+		if strings.Contains(msg, fragment) {
+			return true
+		}
+	}
+	return false
+}
+
+// immutableFieldMessages are fragments of the validation messages the API server reports when an
+// update attempts to change a field which cannot be changed after creation
+var immutableFieldMessages = []string{
+	"field is immutable",
+	"may not be updated",
+	"may not be changed",
+	"updates to statefulset spec for fields other than",
+	"is immutable after creation",
+}
+
+// IsImmutableError returns whether an error from the API server indicates an update was rejected
+// because it changed an immutable field
+func IsImmutableError(err error) bool {
+	if err == nil {
+		return false
+	}
+	cause := errors.Cause(err)
+	if status, ok := cause.(apierr.APIStatus); ok {
+		if !apierr.IsInvalid(cause) {
+			return false
+		}
+		if details := status.Status().Details; details != nil {
+			for _, statusCause := range details.Causes {
+				if containsImmutableFieldMessage(statusCause.Message) {
+					return true
+				}
+			}
+		}
+	}
+	return containsImmutableFieldMessage(err.Error())
+}
+
+// IsImmutableKubectlOutput returns whether the error output of kubectl indicates an apply was
+// rejected because it changed an immutable field
+func IsImmutableKubectlOutput(stderr string) bool {
+	return strings.Contains(stderr, "is invalid") && containsImmutableFieldMessage(stderr)
+}
+
+func containsImmutableFieldMessage(msg string) bool {
+	for _, fragment := range immutableFieldMessages {
+		if strings.Contains(msg, fragment) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,190 @@
+package kube
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/argoproj/argo-cd/test"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+)
+
+func TestIsServiceUnavailable(t *testing.T) {
+	assert.True(t, isServiceUnavailable(apierr.NewServiceUnavailable("metrics.k8s.io/v1beta1 is unavailable")))
+	assert.True(t, isServiceUnavailable(fmt.Errorf("Error from server (ServiceUnavailable): the server is currently unable to handle the request")))
+	assert.False(t, isServiceUnavailable(apierr.NewNotFound(schema.GroupResource{Resource: "services"}, "demo")))
+	assert.False(t, isServiceUnavailable(fmt.Errorf(`The Service "demo" is invalid: spec.ports: Required value`)))
+}
+
+func TestApplyResourceServiceUnavailable(t *testing.T) {
+	defer func(orig func([]string, []byte) ([]byte, error)) { runKubectl = orig }(runKubectl)
+	runKubectl = func(args []string, stdin []byte) ([]byte, error) {
+		return nil, fmt.Errorf(`error when retrieving current configuration of: "STDIN": the server is currently unable to handle the request (get widgets.example.com demo)`)
+	}
+	_, err := applyResource(fake.NewSimpleClientset(), &rest.Config{}, MustToUnstructured(test.DemoService()), test.TestNamespace, ApplyOpts{})
+	assert.NotNil(t, err)
+	assert.True(t, IsRetryableError(err))
+}
+
+func TestIsWebhookError(t *testing.T) {
+	assert.True(t, IsWebhookError(fmt.Errorf(`Error from server (InternalError): error when creating "STDIN": Internal error occurred: failed calling webhook "webhook.cert-manager.io": Post https://cert-manager-webhook.cert-manager.svc:443/mutate?timeout=30s: dial tcp 10.96.0.40:443: connect: connection refused`)))
+	assert.False(t, IsWebhookError(fmt.Errorf(`Error from server: error when creating "STDIN": admission webhook "webhook.cert-manager.io" denied the request: spec.dnsNames: Required value`)))
+	assert.False(t, IsWebhookError(nil))
+}
+
+func TestApplyResourceRetriesWebhookError(t *testing.T) {
+	defer func(orig wait.Backoff) { webhookRetryBackoff = orig }(webhookRetryBackoff)
+	webhookRetryBackoff = wait.Backoff{Steps: 3, Duration: time.Millisecond}
+	defer func(orig func([]string, []byte) ([]byte, error)) { runKubectl = orig }(runKubectl)
+	attempts := 0
+	runKubectl = func(args []string, stdin []byte) ([]byte, error) {
+		attempts++
+		if attempts == 1 {
+			return nil, fmt.Errorf(`Internal error occurred: failed calling webhook "webhook.cert-manager.io": connection refused`)
+		}
+		return stdin, nil
+	}
+	svc := MustToUnstructured(test.DemoService())
+	liveObj, err := applyResource(fake.NewSimpleClientset(), &rest.Config{}, svc, test.TestNamespace, ApplyOpts{})
+	assert.Nil(t, err)
+	assert.Equal(t, svc.GetName(), liveObj.GetName())
+	assert.Equal(t, 2, attempts)
+
+	// a webhook which stays unavailable is retried a bounded number of times
+	attempts = 0
+	runKubectl = func(args []string, stdin []byte) ([]byte, error) {
+		attempts++
+		return nil, fmt.Errorf(`Internal error occurred: failed calling webhook "webhook.cert-manager.io": connection refused`)
+	}
+	_, err = applyResource(fake.NewSimpleClientset(), &rest.Config{}, svc, test.TestNamespace, ApplyOpts{})
+	assert.True(t, IsRetryableError(err))
+	assert.Equal(t, 3, attempts)
+}
+
+func TestClassifyApplyError(t *testing.T) {
+	for _, testCase := range []struct {
+		category ApplyErrorCategory
+		msg      string
+	}{
+		{ApplyErrorValidation, `error: error validating "STDIN": error validating data: ValidationError(Deployment.spec): missing required field "selector" in io.k8s.api.apps.v1.DeploymentSpec`},
+		{ApplyErrorValidation, `The Service "demo" is invalid: spec.ports[0].port: Invalid value: 0: must be between 1 and 65535, inclusive`},
+		{ApplyErrorValidation, `Error from server: error when creating "STDIN": admission webhook "validate.gatekeeper.sh" denied the request: [denied by required-labels]`},
+		{ApplyErrorImmutable, `The Service "demo" is invalid: spec.clusterIP: Invalid value: "": field is immutable`},
+		{ApplyErrorConflict, `error: Apply failed with 1 conflict: conflict with "kube-controller-manager" using apps/v1: .spec.replicas`},
+		{ApplyErrorConflict, `Error from server (Conflict): error when applying patch: Operation cannot be fulfilled on deployments.apps "demo": the object has been modified`},
+		{ApplyErrorForbidden, `Error from server (Forbidden): error when retrieving current configuration of: deployments.apps "demo" is forbidden: User "system:serviceaccount:argocd:argocd-application-controller" cannot get deployments.apps in the namespace "default"`},
+		{ApplyErrorWebhook, `Error from server (InternalError): Internal error occurred: failed calling webhook "webhook.cert-manager.io": connect: connection refused`},
+		{ApplyErrorTransient, `Unable to connect to the server: dial tcp 10.96.0.1:443: i/o timeout`},
+		{ApplyErrorTransient, `Error from server (ServiceUnavailable): the server is currently unable to handle the request`},
+		{ApplyErrorUnknown, `error: something unexpected happened`},
+	} {
+		assert.Equal(t, testCase.category, ClassifyApplyError(fmt.Errorf("%s", testCase.msg)), testCase.msg)
+	}
+	assert.Equal(t, ApplyErrorForbidden, ClassifyApplyError(apierr.NewForbidden(schema.GroupResource{Resource: "services"}, "demo", fmt.Errorf("denied"))))
+	assert.Equal(t, ApplyErrorUnknown, ClassifyApplyError(nil))
+}
+
+func TestApplyResourceApplyError(t *testing.T) {
+	defer func(orig func([]string, []byte) ([]byte, error)) { runKubectl = orig }(runKubectl)
+	runKubectl = func(args []string, stdin []byte) ([]byte, error) {
+		return nil, fmt.Errorf(`The Service "demo" is invalid: spec.clusterIP: Invalid value: "": field is immutable`)
+	}
+	_, err := applyResource(fake.NewSimpleClientset(), &rest.Config{}, MustToUnstructured(test.DemoService()), test.TestNamespace, ApplyOpts{})
+	assert.Equal(t, ApplyErrorImmutable, GetApplyErrorCategory(err))
+	assert.Equal(t, ApplyErrorImmutable, GetApplyErrorCategory(errors.Wrap(err, "sync failed")))
+	assert.False(t, IsRetryableError(err))
+}
+
+func TestIsImmutableError(t *testing.T) {
+	clusterIPErr := apierr.NewInvalid(schema.GroupKind{Kind: "Service"}, "demo", field.ErrorList{
+		field.Invalid(field.NewPath("spec", "clusterIP"), "10.96.0.12", "field is immutable"),
+	})
+	assert.True(t, IsImmutableError(clusterIPErr))
+	assert.True(t, IsImmutableError(errors.Wrap(clusterIPErr, "failed to update")))
+
+	jobErr := apierr.NewInvalid(schema.GroupKind{Group: "batch", Kind: "Job"}, "pi", field.ErrorList{
+		field.Invalid(field.NewPath("spec", "template"), "core.PodTemplateSpec{...}", "field is immutable"),
+	})
+	assert.True(t, IsImmutableError(jobErr))
+
+	requiredErr := apierr.NewInvalid(schema.GroupKind{Kind: "Service"}, "demo", field.ErrorList{
+		field.Required(field.NewPath("spec", "ports"), ""),
+	})
+	assert.False(t, IsImmutableError(requiredErr))
+	assert.False(t, IsImmutableError(apierr.NewNotFound(schema.GroupResource{Resource: "services"}, "demo")))
+	assert.False(t, IsImmutableError(nil))
+}
+
+func TestIsImmutableKubectlOutput(t *testing.T) {
+	assert.True(t, IsImmutableKubectlOutput(`The Service "demo" is invalid: spec.clusterIP: Invalid value: "": field is immutable`))
+	assert.True(t, IsImmutableKubectlOutput(`The Job "pi" is invalid: spec.template: Invalid value: core.PodTemplateSpec{ObjectMeta:v1.ObjectMeta{Name:"", GenerateName:""}}: field is immutable`))
+	assert.True(t, IsImmutableKubectlOutput(`The StatefulSet "web" is invalid: spec: Forbidden: updates to statefulset spec for fields other than 'replicas', 'template', and 'updateStrategy' are forbidden.`))
+	assert.False(t, IsImmutableKubectlOutput(`The Service "demo" is invalid: spec.ports: Required value`))
+	assert.False(t, IsImmutableKubectlOutput(`Error from server (NotFound): services "demo" not found`))
+}
+
+func TestParseApplyConflicts(t *testing.T) {
+	conflicts, ok := parseApplyConflicts(`error: Apply failed with 1 conflict: conflict with "kubectl-client-side-apply" using apps/v1: .spec.replicas
+Please review the fields above--they currently have other managers.`)
+	assert.True(t, ok)
+	assert.Equal(t, []string{".spec.replicas"}, conflicts)
+
+	conflicts, ok = parseApplyConflicts(`error: Apply failed with 2 conflicts: conflicts with "kube-controller-manager" using apps/v1:
+- .spec.replicas
+- .spec.template.spec.containers[name="guestbook"].image
+Please review the fields above--they currently have other managers.`)
+	assert.True(t, ok)
+	assert.Equal(t, []string{".spec.replicas", `.spec.template.spec.containers[name="guestbook"].image`}, conflicts)
+
+	_, ok = parseApplyConflicts(`The Service "demo" is invalid: spec.ports: Required value`)
+	assert.False(t, ok)
+}
+
+func TestParseSchemaViolations(t *testing.T) {
+	kind, name, violations, ok := parseSchemaViolations(`Error from server (Invalid): error when creating "STDIN": The Widget "demo" is invalid: spec.replicas: Invalid value: "string": spec.replicas in body must be of type integer: "string"`)
+	assert.True(t, ok)
+	assert.Equal(t, "Widget", kind)
+	assert.Equal(t, "demo", name)
+	assert.Equal(t, []SchemaViolation{{Path: "spec.replicas", Message: `must be of type integer: "string"`}}, violations)
+
+	_, _, violations, ok = parseSchemaViolations(`The Widget "demo" is invalid: 
+* spec.replicas: Invalid value: "string": spec.replicas in body must be of type integer: "string"
+* spec.size: Unsupported value: "huge": supported values: "small", "large"`)
+	assert.True(t, ok)
+	assert.Equal(t, []SchemaViolation{
+		{Path: "spec.replicas", Message: `must be of type integer: "string"`},
+		{Path: "spec.size", Message: `Unsupported value: "huge": supported values: "small", "large"`},
+	}, violations)
+
+	// Kubernetes 1.15 and earlier
+	_, _, violations, ok = parseSchemaViolations(`The Widget "demo" is invalid: []: Invalid value: map[string]interface {}{"spec":map[string]interface {}{"replicas":"string"}}: validation failure list:
+spec.replicas in body must be of type integer: "string"
+spec.name in body is required`)
+	assert.True(t, ok)
+	assert.Equal(t, []SchemaViolation{
+		{Path: "spec.replicas", Message: `must be of type integer: "string"`},
+		{Path: "spec.name", Message: "is required"},
+	}, violations)
+
+	_, _, _, ok = parseSchemaViolations(`The Service "demo" is invalid: spec.ports: Required value`)
+	assert.False(t, ok)
+}
+
+func TestApplyResourceSchemaValidationError(t *testing.T) {
+	defer func(orig func([]string, []byte) ([]byte, error)) { runKubectl = orig }(runKubectl)
+	runKubectl = func(args []string, stdin []byte) ([]byte, error) {
+		return nil, fmt.Errorf(`The Widget "demo" is invalid: spec.replicas: Invalid value: "string": spec.replicas in body must be of type integer: "string"`)
+	}
+	_, err := applyResource(fake.NewSimpleClientset(), &rest.Config{}, MustToUnstructured(test.DemoService()), test.TestNamespace, ApplyOpts{})
+	assert.True(t, IsSchemaValidationError(err))
+	assert.Equal(t, ApplyErrorValidation, GetApplyErrorCategory(err))
+	schemaErr := errors.Cause(err).(*SchemaValidationError)
+	assert.Equal(t, "spec.replicas", schemaErr.Violations[0].Path)
+}
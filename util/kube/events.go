@@ -0,0 +1,192 @@
+package kube
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	apiv1 "k8s.io/api/core/v1"
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/util/retry"
+)
+
+// EventOpts are options for listing the events of an object
+type EventOpts struct {
+	// Limit caps the number of events returned to the most recent ones. Zero returns all events.
+	Limit int
+}
+
+// GetResourceEvents returns the events involving an object, most recent first
+func GetResourceEvents(config *rest.Config, obj *unstructured.Unstructured, opts EventOpts) ([]apiv1.Event, error) {
+	kubeclientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return getResourceEvents(kubeclientset, obj, opts)
+}
+
+func getResourceEvents(kubeclientset kubernetes.Interface, obj *unstructured.Unstructured, opts EventOpts) ([]apiv1.Event, error) {
+	selector := fields.Set{
+		"involvedObject.name":      obj.GetName(),
+		"involvedObject.namespace": obj.GetNamespace(),
+	}
+	if obj.GetUID() != "" {
+		selector["involvedObject.uid"] = string(obj.GetUID())
+	}
+	list, err := kubeclientset.CoreV1().Events(obj.GetNamespace()).List(metav1.ListOptions{
+		FieldSelector: selector.AsSelector().String(),
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	events := make([]apiv1.Event, 0)
+	for _, event := range list.Items {
+		// apply client side filtering in case the field selector was not honored
+		if event.InvolvedObject.Name != obj.GetName() || event.InvolvedObject.Namespace != obj.GetNamespace() {
+			continue
+		}
+		if obj.GetUID() != "" && event.InvolvedObject.UID != obj.GetUID() {
+			continue
+		}
+		events = append(events, event)
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[j].LastTimestamp.Before(&events[i].LastTimestamp)
+	})
+	if opts.Limit > 0 && len(events) > opts.Limit {
+		events = events[:opts.Limit]
+	}
+	return events, nil
+}
+
+// eventSourceComponent is the component reported as the source of recorded events
+const eventSourceComponent = "argocd"
+
+const (
+	// EventReasonApplied is the reason of events recorded when an object was applied
+	EventReasonApplied = "ResourceApplied"
+	// EventReasonApplyFailed is the reason of events recorded when applying an object failed
+	EventReasonApplyFailed = "ResourceApplyFailed"
+	// EventReasonPruned is the reason of events recorded when an object was pruned
+	EventReasonPruned = "ResourcePruned"
+)
+
+// RecordEvent records a Kubernetes event on an object, so the action shows up in `kubectl describe`.
+// The event type is either apiv1.EventTypeNormal or apiv1.EventTypeWarning. Repeated events with the
+// same type, reason and message are aggregated into a single event whose count is incremented, like
+// the events recorded by Kubernetes controllers. Events of cluster scoped objects are recorded in the
+// default namespace.
+func RecordEvent(config *rest.Config, obj *unstructured.Unstructured, eventType string, reason string, message string) error {
+	kubeclientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return err
+	}
+	return recordEvent(kubeclientset, obj, eventType, reason, message, time.Now())
+}
+
+func recordEvent(kubeclientset kubernetes.Interface, obj *unstructured.Unstructured, eventType string, reason string, message string, now time.Time) error {
+	if eventType != apiv1.EventTypeNormal && eventType != apiv1.EventTypeWarning {
+		return fmt.Errorf("invalid event type %q", eventType)
+	}
+	namespace := obj.GetNamespace()
+	if namespace == "" {
+		namespace = metav1.NamespaceDefault
+	}
+	timestamp := metav1.NewTime(now)
+	event := &apiv1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      eventName(obj, eventType, reason, message),
+			Namespace: namespace,
+		},
+		InvolvedObject: apiv1.ObjectReference{
+			APIVersion:      obj.GetAPIVersion(),
+			Kind:            obj.GetKind(),
+			Namespace:       obj.GetNamespace(),
+			Name:            obj.GetName(),
+			UID:             obj.GetUID(),
+			ResourceVersion: obj.GetResourceVersion(),
+		},
+		Type:           eventType,
+		Reason:         reason,
+		Message:        message,
+		Source:         apiv1.EventSource{Component: eventSourceComponent},
+		FirstTimestamp: timestamp,
+		LastTimestamp:  timestamp,
+		Count:          1,
+	}
+	events := kubeclientset.CoreV1().Events(namespace)
+	_, err := events.Create(event)
+	if err == nil || !apierr.IsAlreadyExists(err) {
+		return errors.WithStack(err)
+	}
+	// concurrent recorders of the same event may update it in between
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		existing, err := events.Get(event.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		existing.Count++
+		existing.LastTimestamp = timestamp
+		_, err = events.Update(existing)
+		return err
+	})
+	return errors.WithStack(err)
+}
+
+// eventNameHashLength is the number of hex digits of the hash which makes event names unique
+const eventNameHashLength = 16
+
+// eventName returns the name of the event of an object with the given type, reason and message, which
+// is the same for repeated events, so they can be aggregated. The object name is truncated, so the event
+// name does not exceed the maximum length of object names.
+func eventName(obj *unstructured.Unstructured, eventType string, reason string, message string) string {
+	h := sha256.New()
+	for _, field := range []string{string(obj.GetUID()), obj.GetKind(), obj.GetNamespace(), obj.GetName(), eventType, reason, message} {
+		_, _ = h.Write([]byte(field))
+		_, _ = h.Write([]byte{0})
+	}
+	prefix := obj.GetName()
+	if maxLength := validation.DNS1123SubdomainMaxLength - eventNameHashLength - 1; len(prefix) > maxLength {
+		// the hash already makes the name unique, and a name must not end with a separator
+		prefix = strings.TrimRight(prefix[:maxLength], ".-")
+	}
+	return fmt.Sprintf("%s.%s", prefix, hex.EncodeToString(h.Sum(nil))[:eventNameHashLength])
+}
+
+// recordApplyEvent records the outcome of applying an object as an event on it. Failures to record the
+// event are logged, but do not fail the apply.
+func recordApplyEvent(kubeclientset kubernetes.Interface, obj *unstructured.Unstructured, liveObj *unstructured.Unstructured, namespace string, applyErr error) {
+	var err error
+	if applyErr != nil {
+		obj = obj.DeepCopy()
+		if obj.GetNamespace() == "" {
+			obj.SetNamespace(namespace)
+		}
+		err = recordEvent(kubeclientset, obj, apiv1.EventTypeWarning, EventReasonApplyFailed, applyErr.Error(), time.Now())
+	} else {
+		err = recordEvent(kubeclientset, liveObj, apiv1.EventTypeNormal, EventReasonApplied, fmt.Sprintf("Applied %s %s", liveObj.GetKind(), liveObj.GetName()), time.Now())
+	}
+	if err != nil {
+		log.Warnf("Failed to record event on %s/%s: %v", obj.GetKind(), obj.GetName(), err)
+	}
+}
+
+// recordPruneEvent records that an object was pruned as an event on it, which outlives the object.
+// Failures to record the event are logged, but do not fail the prune.
+func recordPruneEvent(kubeclientset kubernetes.Interface, obj *unstructured.Unstructured) {
+	err := recordEvent(kubeclientset, obj, apiv1.EventTypeNormal, EventReasonPruned, fmt.Sprintf("Pruned %s %s", obj.GetKind(), obj.GetName()), time.Now())
+	if err != nil {
+		log.Warnf("Failed to record event on %s/%s: %v", obj.GetKind(), obj.GetName(), err)
+	}
+}
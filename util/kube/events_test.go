@@ -0,0 +1,145 @@
+package kube
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/argoproj/argo-cd/test"
+	"github.com/stretchr/testify/assert"
+	apiv1 "k8s.io/api/core/v1"
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+	kubetesting "k8s.io/client-go/testing"
+)
+
+func TestGetResourceEvents(t *testing.T) {
+	obj := MustToUnstructured(test.DemoDeployment())
+	obj.SetUID("4a4c7e4e-2d0b-11e8-b3c8-42010a8a0002")
+	now := time.Now()
+	newEvent := func(name string, involvedName string, age time.Duration) *apiv1.Event {
+		return &apiv1.Event{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: test.TestNamespace},
+			InvolvedObject: apiv1.ObjectReference{
+				Kind:      "Deployment",
+				Name:      involvedName,
+				Namespace: test.TestNamespace,
+				UID:       types.UID("4a4c7e4e-2d0b-11e8-b3c8-42010a8a0002"),
+			},
+			LastTimestamp: metav1.NewTime(now.Add(-age)),
+		}
+	}
+	kubeclientset := fake.NewSimpleClientset(
+		newEvent("oldest", obj.GetName(), 3*time.Minute),
+		newEvent("newest", obj.GetName(), time.Minute),
+		newEvent("middle", obj.GetName(), 2*time.Minute),
+		newEvent("other", "other-deployment", 0),
+	)
+
+	events, err := getResourceEvents(kubeclientset, obj, EventOpts{})
+	assert.Nil(t, err)
+	if assert.Equal(t, 3, len(events)) {
+		assert.Equal(t, "newest", events[0].Name)
+		assert.Equal(t, "middle", events[1].Name)
+		assert.Equal(t, "oldest", events[2].Name)
+	}
+
+	events, err = getResourceEvents(kubeclientset, obj, EventOpts{Limit: 1})
+	assert.Nil(t, err)
+	if assert.Equal(t, 1, len(events)) {
+		assert.Equal(t, "newest", events[0].Name)
+	}
+}
+
+func TestApplyResourceRecordsEvents(t *testing.T) {
+	defer func(orig func([]string, []byte) ([]byte, error)) { runKubectl = orig }(runKubectl)
+	var applyErr error
+	runKubectl = func(args []string, stdin []byte) ([]byte, error) {
+		if applyErr != nil {
+			return nil, applyErr
+		}
+		live := MustToUnstructured(test.DemoService())
+		live.SetUID("1")
+		return live.MarshalJSON()
+	}
+	kubeclientset := fake.NewSimpleClientset()
+	obj := MustToUnstructured(test.DemoService())
+	opts := ApplyOpts{RecordEvents: true}
+
+	// repeated applies are aggregated into a single event
+	for i := 0; i < 2; i++ {
+		_, err := applyResource(kubeclientset, &rest.Config{}, obj, test.TestNamespace, opts)
+		assert.Nil(t, err)
+	}
+	events, err := getResourceEvents(kubeclientset, MustToUnstructured(test.DemoService()), EventOpts{})
+	assert.Nil(t, err)
+	if assert.Equal(t, 1, len(events)) {
+		assert.Equal(t, apiv1.EventTypeNormal, events[0].Type)
+		assert.Equal(t, EventReasonApplied, events[0].Reason)
+		assert.Equal(t, types.UID("1"), events[0].InvolvedObject.UID)
+		assert.Equal(t, int32(2), events[0].Count)
+	}
+
+	applyErr = errors.New(`The Service "guestbook-ui" is invalid`)
+	_, err = applyResource(kubeclientset, &rest.Config{}, obj, test.TestNamespace, opts)
+	assert.NotNil(t, err)
+	events, err = getResourceEvents(kubeclientset, MustToUnstructured(test.DemoService()), EventOpts{})
+	assert.Nil(t, err)
+	var warnings []apiv1.Event
+	for _, event := range events {
+		if event.Type == apiv1.EventTypeWarning {
+			warnings = append(warnings, event)
+		}
+	}
+	if assert.Equal(t, 1, len(warnings)) {
+		assert.Equal(t, EventReasonApplyFailed, warnings[0].Reason)
+		assert.Contains(t, warnings[0].Message, "is invalid")
+	}
+}
+
+func TestRecordEventInvalidType(t *testing.T) {
+	err := recordEvent(fake.NewSimpleClientset(), MustToUnstructured(test.DemoService()), "Info", "Synced", "", time.Now())
+	assert.NotNil(t, err)
+}
+
+func TestRecordEventRetriesConflicts(t *testing.T) {
+	kubeclientset := fake.NewSimpleClientset()
+	obj := MustToUnstructured(test.DemoService())
+	assert.Nil(t, recordEvent(kubeclientset, obj, apiv1.EventTypeNormal, EventReasonApplied, "", time.Now()))
+
+	// another recorder updates the event between the get and the update of the first attempt
+	conflicts := 1
+	kubeclientset.PrependReactor("update", "events", func(action kubetesting.Action) (bool, runtime.Object, error) {
+		if conflicts == 0 {
+			return false, nil, nil
+		}
+		conflicts--
+		return true, nil, apierr.NewConflict(schema.GroupResource{Resource: "events"}, "demo", errors.New("the object has been modified"))
+	})
+	assert.Nil(t, recordEvent(kubeclientset, obj, apiv1.EventTypeNormal, EventReasonApplied, "", time.Now()))
+	assert.Equal(t, 0, conflicts)
+	events, err := getResourceEvents(kubeclientset, obj, EventOpts{})
+	assert.Nil(t, err)
+	if assert.Equal(t, 1, len(events)) {
+		assert.Equal(t, int32(2), events[0].Count)
+	}
+}
+
+func TestEventNameTruncated(t *testing.T) {
+	obj := MustToUnstructured(test.DemoService())
+	obj.SetName(strings.Repeat("a", 235) + ".b" + strings.Repeat("c", 16))
+	name := eventName(obj, apiv1.EventTypeNormal, EventReasonApplied, "")
+	assert.Empty(t, validation.IsDNS1123Subdomain(name))
+	assert.True(t, strings.HasPrefix(name, strings.Repeat("a", 235)+"."))
+
+	// names which fit are kept as they are
+	obj.SetName("guestbook-ui")
+	assert.True(t, strings.HasPrefix(eventName(obj, apiv1.EventTypeNormal, EventReasonApplied, ""), "guestbook-ui."))
+}
@@ -0,0 +1,110 @@
+package kube
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/util/retry"
+)
+
+// GetFinalizers returns the finalizers of an object
+func GetFinalizers(obj *unstructured.Unstructured) []string {
+	return obj.GetFinalizers()
+}
+
+// AddFinalizer adds a finalizer to an object, and returns whether it was added. Adding a finalizer the
+// object already has is a no-op.
+func AddFinalizer(obj *unstructured.Unstructured, name string) bool {
+	finalizers := obj.GetFinalizers()
+	for _, finalizer := range finalizers {
+		if finalizer == name {
+			return false
+		}
+	}
+	obj.SetFinalizers(append(finalizers, name))
+	return true
+}
+
+// RemoveFinalizer removes a finalizer from an object, and returns whether it was removed
+func RemoveFinalizer(obj *unstructured.Unstructured, name string) bool {
+	finalizers := obj.GetFinalizers()
+	remaining := make([]string, 0, len(finalizers))
+	for _, finalizer := range finalizers {
+		if finalizer != name {
+			remaining = append(remaining, finalizer)
+		}
+	}
+	if len(remaining) == len(finalizers) {
+		return false
+	}
+	obj.SetFinalizers(remaining)
+	return true
+}
+
+// IsBeingDeleted returns whether deletion of an object has been requested, i.e. it is terminating and
+// only remains until its finalizers have completed
+func IsBeingDeleted(obj *unstructured.Unstructured) bool {
+	_, ok := unstructured.NestedString(obj.Object, "metadata", "deletionTimestamp")
+	return ok
+}
+
+// DeletionTimestamp returns the time deletion of an object was requested, or nil if it is not being deleted
+func DeletionTimestamp(obj *unstructured.Unstructured) (*time.Time, error) {
+	value, ok := unstructured.NestedString(obj.Object, "metadata", "deletionTimestamp")
+	if !ok {
+		return nil, nil
+	}
+	timestamp, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid deletion timestamp '%s' of %s: %v", value, GetResourceKey(obj), err)
+	}
+	return &timestamp, nil
+}
+
+// UpdateResource applies a modification to the live state of an object and persists it. The live object
+// is fetched again and the modification reapplied whenever the update conflicts with a concurrent change.
+// The mutate function returns whether it changed the object; if it did not, no update is made.
+func UpdateResource(config *rest.Config, obj *unstructured.Unstructured, mutate func(*unstructured.Unstructured) bool) (*unstructured.Unstructured, error) {
+	dynClientPool := dynamic.NewDynamicClientPool(config)
+	disco, err := discovery.NewDiscoveryClientForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return updateResource(dynClientPool, disco, obj, mutate)
+}
+
+func updateResource(dynClientPool dynamic.ClientPool, disco discovery.DiscoveryInterface, obj *unstructured.Unstructured, mutate func(*unstructured.Unstructured) bool) (*unstructured.Unstructured, error) {
+	gvk := obj.GroupVersionKind()
+	dclient, err := dynClientPool.ClientForGroupVersionKind(gvk)
+	if err != nil {
+		return nil, err
+	}
+	apiResource, err := ServerResourceForGroupVersionKind(disco, gvk)
+	if err != nil {
+		return nil, err
+	}
+	reIf := dclient.Resource(apiResource, obj.GetNamespace())
+	var result *unstructured.Unstructured
+	err = retry.RetryOnConflict(retry.DefaultBackoff, func() error {
+		liveObj, err := reIf.Get(obj.GetName(), metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if !mutate(liveObj) {
+			result = liveObj
+			return nil
+		}
+		result, err = reIf.Update(liveObj)
+		return err
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return result, nil
+}
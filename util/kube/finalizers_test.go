@@ -0,0 +1,80 @@
+package kube
+
+import (
+	"testing"
+	"time"
+
+	"github.com/argoproj/argo-cd/test"
+	"github.com/stretchr/testify/assert"
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	fakedynamic "k8s.io/client-go/dynamic/fake"
+	kubetesting "k8s.io/client-go/testing"
+)
+
+const resourcesFinalizer = "resources-finalizer.argocd.argoproj.io"
+
+func TestAddRemoveFinalizer(t *testing.T) {
+	obj := MustToUnstructured(test.DemoService())
+	assert.Empty(t, GetFinalizers(obj))
+
+	assert.True(t, AddFinalizer(obj, resourcesFinalizer))
+	assert.False(t, AddFinalizer(obj, resourcesFinalizer))
+	assert.True(t, AddFinalizer(obj, "foregroundDeletion"))
+	assert.Equal(t, []string{resourcesFinalizer, "foregroundDeletion"}, GetFinalizers(obj))
+
+	assert.True(t, RemoveFinalizer(obj, resourcesFinalizer))
+	assert.False(t, RemoveFinalizer(obj, resourcesFinalizer))
+	assert.Equal(t, []string{"foregroundDeletion"}, GetFinalizers(obj))
+}
+
+func TestUpdateResourceRetriesOnConflict(t *testing.T) {
+	fakeDiscovery := &fakediscovery.FakeDiscovery{Fake: &kubetesting.Fake{}}
+	fakeDiscovery.Resources = resourceList()
+	svc := MustToUnstructured(test.DemoService())
+
+	updates := 0
+	fakeClientPool := fakedynamic.FakeClientPool{}
+	fakeClientPool.AddReactor("get", "services", func(action kubetesting.Action) (handled bool, ret runtime.Object, err error) {
+		return true, svc.DeepCopy(), nil
+	})
+	fakeClientPool.AddReactor("update", "services", func(action kubetesting.Action) (handled bool, ret runtime.Object, err error) {
+		updates++
+		if updates == 1 {
+			return true, nil, apierr.NewConflict(schema.GroupResource{Resource: "services"}, svc.GetName(), nil)
+		}
+		return true, action.(kubetesting.UpdateAction).GetObject(), nil
+	})
+
+	updated, err := updateResource(&fakeClientPool, fakeDiscovery, svc, func(obj *unstructured.Unstructured) bool {
+		return AddFinalizer(obj, resourcesFinalizer)
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, updates)
+	assert.Equal(t, []string{resourcesFinalizer}, GetFinalizers(updated))
+}
+
+func TestDeletionTimestamp(t *testing.T) {
+	obj := MustToUnstructured(test.DemoService())
+	assert.False(t, IsBeingDeleted(obj))
+	timestamp, err := DeletionTimestamp(obj)
+	assert.Nil(t, err)
+	assert.Nil(t, timestamp)
+
+	metadata := obj.Object["metadata"].(map[string]interface{})
+	metadata["deletionTimestamp"] = "2018-03-21T17:04:05Z"
+	assert.True(t, IsBeingDeleted(obj))
+	timestamp, err = DeletionTimestamp(obj)
+	assert.Nil(t, err)
+	if assert.NotNil(t, timestamp) {
+		assert.Equal(t, time.Date(2018, 3, 21, 17, 4, 5, 0, time.UTC), *timestamp)
+	}
+
+	metadata["deletionTimestamp"] = "yesterday"
+	assert.True(t, IsBeingDeleted(obj))
+	_, err = DeletionTimestamp(obj)
+	assert.NotNil(t, err)
+}
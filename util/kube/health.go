@@ -0,0 +1,259 @@
+package kube
+
+import (
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+)
+
+// HealthStatusCode is the health of a resource
+type HealthStatusCode string
+
+const (
+	HealthStatusUnknown     HealthStatusCode = "Unknown"
+	HealthStatusProgressing HealthStatusCode = "Progressing"
+	HealthStatusHealthy     HealthStatusCode = "Healthy"
+	HealthStatusDegraded    HealthStatusCode = "Degraded"
+	HealthStatusMissing     HealthStatusCode = "Missing"
+)
+
+// healthOrder orders health statuses from best to worst
+var healthOrder = []HealthStatusCode{
+	HealthStatusHealthy,
+	HealthStatusUnknown,
+	HealthStatusProgressing,
+	HealthStatusMissing,
+	HealthStatusDegraded,
+}
+
+// IsWorse returns whether the new health status is worse than the current one
+func IsWorse(current HealthStatusCode, newStatus HealthStatusCode) bool {
+	currentIndex, newIndex := 0, 0
+	for i, code := range healthOrder {
+		if current == code {
+			currentIndex = i
+		}
+		if newStatus == code {
+			newIndex = i
+		}
+	}
+	return newIndex > currentIndex
+}
+
+// HealthStatus is the health of a resource along with a human readable explanation
+type HealthStatus struct {
+	Status  HealthStatusCode
+	Message string
+}
+
+// ResourceHealth is the health of an individual resource
+type ResourceHealth struct {
+	Key    ResourceKey
+	Health HealthStatus
+}
+
+// GetResourceHealth returns the health of a live resource. A nil resource is Missing, and kinds without
+// a notion of health are Healthy.
+func GetResourceHealth(obj *unstructured.Unstructured) (*HealthStatus, error) {
+	if obj == nil {
+		return &HealthStatus{Status: HealthStatusMissing}, nil
+	}
+	switch obj.GetKind() {
+	case "Deployment":
+		return getDeploymentHealth(obj)
+	case "Service":
+		if spec, _ := unstructured.NestedString(obj.Object, "spec", "type"); spec == "LoadBalancer" {
+			return getLoadBalancerHealth(obj)
+		}
+	case "Ingress":
+		return getLoadBalancerHealth(obj)
+	case "PersistentVolumeClaim":
+		return getPVCHealth(obj)
+	case "Job", "CronJob":
+		return JobStatus(obj)
+	}
+	return &HealthStatus{Status: HealthStatusHealthy}, nil
+}
+
+// getDeploymentHealth follows the same logic as `kubectl rollout status`
+func getDeploymentHealth(obj *unstructured.Unstructured) (*HealthStatus, error) {
+	conditions, _ := unstructured.NestedSlice(obj.Object, "status", "conditions")
+	for _, item := range conditions {
+		condition, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if condition["type"] == "Progressing" && condition["reason"] == "ProgressDeadlineExceeded" {
+			return &HealthStatus{
+				Status:  HealthStatusDegraded,
+				Message: fmt.Sprintf("Deployment %q exceeded its progress deadline", obj.GetName()),
+			}, nil
+		}
+	}
+	current, err := ObservedGenerationCurrent(obj)
+	if err != nil {
+		return nil, err
+	}
+	if !current {
+		return &HealthStatus{
+			Status:  HealthStatusProgressing,
+			Message: "Waiting for rollout to finish: observed deployment generation less than desired generation",
+		}, nil
+	}
+	replicas, ok := unstructured.NestedInt64(obj.Object, "spec", "replicas")
+	if !ok {
+		replicas = 1
+	}
+	statusReplicas, _ := unstructured.NestedInt64(obj.Object, "status", "replicas")
+	updatedReplicas, _ := unstructured.NestedInt64(obj.Object, "status", "updatedReplicas")
+	availableReplicas, _ := unstructured.NestedInt64(obj.Object, "status", "availableReplicas")
+	var message string
+	switch {
+	case updatedReplicas < replicas:
+		message = fmt.Sprintf("Waiting for rollout to finish: %d out of %d new replicas have been updated...", updatedReplicas, replicas)
+	case statusReplicas > updatedReplicas:
+		message = fmt.Sprintf("Waiting for rollout to finish: %d old replicas are pending termination...", statusReplicas-updatedReplicas)
+	case availableReplicas < updatedReplicas:
+		message = fmt.Sprintf("Waiting for rollout to finish: %d of %d updated replicas are available...", availableReplicas, updatedReplicas)
+	default:
+		return &HealthStatus{Status: HealthStatusHealthy}, nil
+	}
+	return &HealthStatus{Status: HealthStatusProgressing, Message: message}, nil
+}
+
+// ObservedGenerationCurrent returns whether the controller of an object has observed its latest
+// generation, i.e. whether its status reflects its current spec. Objects which do not report an observed
+// generation are assumed to be current.
+func ObservedGenerationCurrent(obj *unstructured.Unstructured) (bool, error) {
+	status, ok := obj.Object["status"].(map[string]interface{})
+	if !ok {
+		return true, nil
+	}
+	var observedGeneration int64
+	switch value := status["observedGeneration"].(type) {
+	case nil:
+		return true, nil
+	case int64:
+		observedGeneration = value
+	case float64:
+		// numbers decoded from JSON
+		observedGeneration = int64(value)
+	default:
+		return false, fmt.Errorf("%s %q has an invalid observed generation: %v", obj.GetKind(), obj.GetName(), value)
+	}
+	return observedGeneration >= obj.GetGeneration(), nil
+}
+
+// getLoadBalancerHealth considers a load balanced Service or an Ingress healthy once an ingress point
+// has been assigned to it
+func getLoadBalancerHealth(obj *unstructured.Unstructured) (*HealthStatus, error) {
+	ingress, _ := unstructured.NestedSlice(obj.Object, "status", "loadBalancer", "ingress")
+	if len(ingress) > 0 {
+		return &HealthStatus{Status: HealthStatusHealthy}, nil
+	}
+	return &HealthStatus{Status: HealthStatusProgressing, Message: "Waiting for an ingress point to be assigned"}, nil
+}
+
+func getPVCHealth(obj *unstructured.Unstructured) (*HealthStatus, error) {
+	phase, _ := unstructured.NestedString(obj.Object, "status", "phase")
+	switch phase {
+	case "Bound":
+		return &HealthStatus{Status: HealthStatusHealthy}, nil
+	case "Pending":
+		return &HealthStatus{Status: HealthStatusProgressing}, nil
+	case "Lost":
+		return &HealthStatus{Status: HealthStatusDegraded, Message: "The claim has lost its underlying volume"}, nil
+	}
+	return &HealthStatus{Status: HealthStatusUnknown}, nil
+}
+
+// JobStatus returns the status of a Job or a CronJob, so hooks can wait for a Job to finish. A Job is
+// Healthy once it completed, Degraded if it failed, and Progressing while it runs. A CronJob does not
+// finish, so it is Healthy, and the message reports when it was last scheduled and its active jobs.
+func JobStatus(obj *unstructured.Unstructured) (*HealthStatus, error) {
+	switch obj.GetKind() {
+	case "Job":
+		return getJobStatus(obj), nil
+	case "CronJob":
+		return getCronJobStatus(obj), nil
+	}
+	return nil, fmt.Errorf("%s %q is not a Job or a CronJob", obj.GetKind(), obj.GetName())
+}
+
+func getJobStatus(obj *unstructured.Unstructured) *HealthStatus {
+	active, _ := unstructured.NestedInt64(obj.Object, "status", "active")
+	succeeded, _ := unstructured.NestedInt64(obj.Object, "status", "succeeded")
+	failed, _ := unstructured.NestedInt64(obj.Object, "status", "failed")
+	conditions, _ := unstructured.NestedSlice(obj.Object, "status", "conditions")
+	for _, item := range conditions {
+		condition, ok := item.(map[string]interface{})
+		if !ok || condition["status"] != "True" {
+			continue
+		}
+		switch condition["type"] {
+		case "Complete":
+			return &HealthStatus{
+				Status:  HealthStatusHealthy,
+				Message: fmt.Sprintf("Job completed: %d succeeded", succeeded),
+			}
+		case "Failed":
+			message := fmt.Sprintf("Job failed: %d failed, %d succeeded", failed, succeeded)
+			if reason, _ := condition["message"].(string); reason != "" {
+				message = fmt.Sprintf("%s: %s", message, reason)
+			}
+			return &HealthStatus{Status: HealthStatusDegraded, Message: message}
+		}
+	}
+	return &HealthStatus{
+		Status:  HealthStatusProgressing,
+		Message: fmt.Sprintf("Job running: %d active, %d succeeded, %d failed", active, succeeded, failed),
+	}
+}
+
+func getCronJobStatus(obj *unstructured.Unstructured) *HealthStatus {
+	active, _ := unstructured.NestedSlice(obj.Object, "status", "active")
+	lastSchedule, _ := unstructured.NestedString(obj.Object, "status", "lastScheduleTime")
+	message := "Not scheduled yet"
+	if lastSchedule != "" {
+		message = fmt.Sprintf("Last scheduled at %s", lastSchedule)
+	}
+	message = fmt.Sprintf("%s, active jobs: %d", message, len(active))
+	if suspend, _ := unstructured.NestedBool(obj.Object, "spec", "suspend"); suspend {
+		message += ", suspended"
+	}
+	return &HealthStatus{Status: HealthStatusHealthy, Message: message}
+}
+
+// AggregateHealth fetches the live state of each of the objects and returns the worst of their health
+// statuses, along with the health of each object
+func AggregateHealth(config *rest.Config, objs []*unstructured.Unstructured) (HealthStatusCode, []ResourceHealth, error) {
+	dynClientPool := dynamic.NewDynamicClientPool(config)
+	disco, err := discovery.NewDiscoveryClientForConfig(config)
+	if err != nil {
+		return "", nil, err
+	}
+	return aggregateHealth(dynClientPool, disco, objs)
+}
+
+func aggregateHealth(dynClientPool dynamic.ClientPool, disco discovery.DiscoveryInterface, objs []*unstructured.Unstructured) (HealthStatusCode, []ResourceHealth, error) {
+	aggregate := HealthStatusHealthy
+	resourceHealths := make([]ResourceHealth, len(objs))
+	for i, obj := range objs {
+		liveObjs, err := getLiveResources(dynClientPool, disco, []*unstructured.Unstructured{obj}, obj.GetNamespace(), GetLiveOpts{IgnoreUnknownKinds: true})
+		if err != nil {
+			return "", nil, err
+		}
+		health, err := GetResourceHealth(liveObjs[0])
+		if err != nil {
+			return "", nil, err
+		}
+		resourceHealths[i] = ResourceHealth{Key: GetResourceKey(obj), Health: *health}
+		if IsWorse(aggregate, health.Status) {
+			aggregate = health.Status
+		}
+	}
+	return aggregate, resourceHealths, nil
+}
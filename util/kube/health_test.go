@@ -0,0 +1,163 @@
+package kube
+
+import (
+	"testing"
+
+	"github.com/argoproj/argo-cd/test"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	fakedynamic "k8s.io/client-go/dynamic/fake"
+	kubetesting "k8s.io/client-go/testing"
+)
+
+func TestGetDeploymentHealth(t *testing.T) {
+	deploy := fakeDeploymentV1beta2()
+	deploy.Object["status"] = map[string]interface{}{
+		"replicas":          int64(2),
+		"updatedReplicas":   int64(2),
+		"availableReplicas": int64(1),
+	}
+	health, err := GetResourceHealth(deploy)
+	assert.Nil(t, err)
+	assert.Equal(t, HealthStatusProgressing, health.Status)
+
+	deploy.Object["status"].(map[string]interface{})["availableReplicas"] = int64(2)
+	health, err = GetResourceHealth(deploy)
+	assert.Nil(t, err)
+	assert.Equal(t, HealthStatusHealthy, health.Status)
+
+	health, err = GetResourceHealth(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, HealthStatusMissing, health.Status)
+}
+
+func TestAggregateHealth(t *testing.T) {
+	fakeDiscovery := &fakediscovery.FakeDiscovery{Fake: &kubetesting.Fake{}}
+	fakeDiscovery.Resources = resourceList()
+
+	svc := MustToUnstructured(test.DemoService())
+	deploy := fakeDeploymentV1beta2()
+	liveDeploy := deploy.DeepCopy()
+	liveDeploy.Object["status"] = map[string]interface{}{
+		"conditions": []interface{}{
+			map[string]interface{}{"type": "Progressing", "status": "False", "reason": "ProgressDeadlineExceeded"},
+		},
+	}
+
+	fakeClientPool := fakedynamic.FakeClientPool{}
+	fakeClientPool.AddReactor("get", "services", func(action kubetesting.Action) (handled bool, ret runtime.Object, err error) {
+		return true, svc, nil
+	})
+	fakeClientPool.AddReactor("get", "deployments", func(action kubetesting.Action) (handled bool, ret runtime.Object, err error) {
+		return true, liveDeploy, nil
+	})
+
+	aggregate, resourceHealths, err := aggregateHealth(&fakeClientPool, fakeDiscovery, []*unstructured.Unstructured{svc, deploy})
+	assert.Nil(t, err)
+	assert.Equal(t, HealthStatusDegraded, aggregate)
+	if assert.Equal(t, 2, len(resourceHealths)) {
+		assert.Equal(t, GetResourceKey(svc), resourceHealths[0].Key)
+		assert.Equal(t, HealthStatusHealthy, resourceHealths[0].Health.Status)
+		assert.Equal(t, GetResourceKey(deploy), resourceHealths[1].Key)
+		assert.Equal(t, HealthStatusDegraded, resourceHealths[1].Health.Status)
+	}
+}
+
+func TestObservedGenerationCurrent(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   map[string]interface{}
+		expected bool
+	}{
+		{"matching", map[string]interface{}{"observedGeneration": int64(3)}, true},
+		{"decoded from JSON", map[string]interface{}{"observedGeneration": float64(3)}, true},
+		{"lagging", map[string]interface{}{"observedGeneration": int64(2)}, false},
+		{"missing", map[string]interface{}{"replicas": int64(1)}, true},
+		{"no status", nil, true},
+	}
+	for _, tt := range tests {
+		deploy := fakeDeploymentV1beta2()
+		deploy.SetGeneration(3)
+		if tt.status != nil {
+			deploy.Object["status"] = tt.status
+		}
+		current, err := ObservedGenerationCurrent(deploy)
+		assert.Nil(t, err, tt.name)
+		assert.Equal(t, tt.expected, current, tt.name)
+	}
+
+	deploy := fakeDeploymentV1beta2()
+	deploy.Object["status"] = map[string]interface{}{"observedGeneration": "3"}
+	_, err := ObservedGenerationCurrent(deploy)
+	assert.NotNil(t, err)
+}
+
+func newJob(status map[string]interface{}) *unstructured.Unstructured {
+	job := &unstructured.Unstructured{}
+	job.SetAPIVersion("batch/v1")
+	job.SetKind("Job")
+	job.SetName("migrate")
+	job.SetNamespace(test.TestNamespace)
+	if status != nil {
+		job.Object["status"] = status
+	}
+	return job
+}
+
+func TestJobStatus(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  map[string]interface{}
+		code    HealthStatusCode
+		message string
+	}{
+		{"pending", nil, HealthStatusProgressing, "Job running: 0 active, 0 succeeded, 0 failed"},
+		{"running", map[string]interface{}{"active": int64(1), "failed": int64(1)}, HealthStatusProgressing, "Job running: 1 active, 0 succeeded, 1 failed"},
+		{"complete", map[string]interface{}{
+			"succeeded":  int64(1),
+			"conditions": []interface{}{map[string]interface{}{"type": "Complete", "status": "True"}},
+		}, HealthStatusHealthy, "Job completed: 1 succeeded"},
+		{"failed", map[string]interface{}{
+			"failed": int64(6),
+			"conditions": []interface{}{map[string]interface{}{
+				"type":    "Failed",
+				"status":  "True",
+				"reason":  "BackoffLimitExceeded",
+				"message": "Job has reached the specified backoff limit",
+			}},
+		}, HealthStatusDegraded, "Job failed: 6 failed, 0 succeeded: Job has reached the specified backoff limit"},
+		{"condition not true", map[string]interface{}{
+			"active":     int64(1),
+			"conditions": []interface{}{map[string]interface{}{"type": "Failed", "status": "False"}},
+		}, HealthStatusProgressing, "Job running: 1 active, 0 succeeded, 0 failed"},
+	}
+	for _, tt := range tests {
+		health, err := JobStatus(newJob(tt.status))
+		assert.Nil(t, err, tt.name)
+		assert.Equal(t, tt.code, health.Status, tt.name)
+		assert.Equal(t, tt.message, health.Message, tt.name)
+	}
+}
+
+func TestCronJobStatus(t *testing.T) {
+	cronJob := newJob(nil)
+	cronJob.SetAPIVersion("batch/v1beta1")
+	cronJob.SetKind("CronJob")
+	health, err := GetResourceHealth(cronJob)
+	assert.Nil(t, err)
+	assert.Equal(t, HealthStatusHealthy, health.Status)
+	assert.Equal(t, "Not scheduled yet, active jobs: 0", health.Message)
+
+	cronJob.Object["status"] = map[string]interface{}{
+		"lastScheduleTime": "2018-03-01T10:00:00Z",
+		"active":           []interface{}{map[string]interface{}{"kind": "Job", "name": "migrate-1519898400"}},
+	}
+	health, err = JobStatus(cronJob)
+	assert.Nil(t, err)
+	assert.Equal(t, "Last scheduled at 2018-03-01T10:00:00Z, active jobs: 1", health.Message)
+
+	_, err = JobStatus(fakeDeploymentV1beta2())
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,157 @@
+package kube
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+const (
+	// AnnotationHelmHook lists the phases in which Helm runs a hook, separated by commas
+	AnnotationHelmHook = "helm.sh/hook"
+	// AnnotationHelmHookWeight orders the hooks of a phase
+	AnnotationHelmHookWeight = "helm.sh/hook-weight"
+	// AnnotationHelmHookDeletePolicy lists when Helm deletes the resources of a hook, separated by commas
+	AnnotationHelmHookDeletePolicy = "helm.sh/hook-delete-policy"
+)
+
+// HelmHookPhase is a phase of a Helm release in which hooks run
+type HelmHookPhase string
+
+// Phases of a Helm release in which hooks run
+const (
+	// HelmHookPreInstall runs after the templates are rendered, before any resource is created
+	HelmHookPreInstall HelmHookPhase = "pre-install"
+	// HelmHookPostInstall runs after all resources of a new release are created
+	HelmHookPostInstall HelmHookPhase = "post-install"
+	// HelmHookPreDelete runs before any resource of a release is deleted
+	HelmHookPreDelete HelmHookPhase = "pre-delete"
+	// HelmHookPostDelete runs after all resources of a release are deleted
+	HelmHookPostDelete HelmHookPhase = "post-delete"
+	// HelmHookPreUpgrade runs after the templates of an upgrade are rendered, before any resource is updated
+	HelmHookPreUpgrade HelmHookPhase = "pre-upgrade"
+	// HelmHookPostUpgrade runs after all resources of an upgrade are updated
+	HelmHookPostUpgrade HelmHookPhase = "post-upgrade"
+	// HelmHookPreRollback runs after the templates of a rollback are rendered, before any resource is
+	// rolled back
+	HelmHookPreRollback HelmHookPhase = "pre-rollback"
+	// HelmHookPostRollback runs after all resources of a rollback are rolled back
+	HelmHookPostRollback HelmHookPhase = "post-rollback"
+	// HelmHookCRDInstall installs CRDs before the rest of a Helm 2 chart is validated
+	HelmHookCRDInstall HelmHookPhase = "crd-install"
+	// HelmHookTest marks resources run by `helm test`
+	HelmHookTest HelmHookPhase = "test"
+	// HelmHookTestSuccess marks resources run by `helm test` in Helm 2 charts, which are expected to succeed
+	HelmHookTestSuccess HelmHookPhase = "test-success"
+	// HelmHookTestFailure marks resources run by `helm test` in Helm 2 charts, which are expected to fail
+	HelmHookTestFailure HelmHookPhase = "test-failure"
+)
+
+// HelmHook is a resource rendered by `helm template` which Helm runs as a hook rather than installing
+// it with the rest of the release
+type HelmHook struct {
+	// Phases are the phases in which the hook runs
+	Phases []HelmHookPhase
+	// Weight orders the hooks of a phase, lower weights first. Defaults to 0.
+	Weight int
+	// DeletePolicies are the policies by which Helm deletes the resources of the hook (e.g.
+	// "hook-succeeded")
+	DeletePolicies []string
+}
+
+// ParseHelmHooks returns the Helm hook an object is annotated as, or nil if it is not a hook
+func ParseHelmHooks(obj *unstructured.Unstructured) (*HelmHook, error) {
+	annotations := obj.GetAnnotations()
+	phases := splitAnnotationList(annotations[AnnotationHelmHook])
+	if len(phases) == 0 {
+		return nil, nil
+	}
+	hook := HelmHook{DeletePolicies: splitAnnotationList(annotations[AnnotationHelmHookDeletePolicy])}
+	for _, phase := range phases {
+		hook.Phases = append(hook.Phases, HelmHookPhase(phase))
+	}
+	if weight := strings.TrimSpace(annotations[AnnotationHelmHookWeight]); weight != "" {
+		var err error
+		hook.Weight, err = strconv.Atoi(weight)
+		if err != nil {
+			return nil, fmt.Errorf("%s %q has an invalid hook weight %q", obj.GetKind(), obj.GetName(), weight)
+		}
+	}
+	return &hook, nil
+}
+
+// IsTest returns whether the hook is run by `helm test`
+func (h *HelmHook) IsTest() bool {
+	for _, phase := range h.Phases {
+		switch phase {
+		case HelmHookTest, HelmHookTestSuccess, HelmHookTestFailure:
+			return true
+		}
+	}
+	return false
+}
+
+// IsHelmTestHook returns whether an object is a Helm test, which is not part of the release
+func IsHelmTestHook(obj *unstructured.Unstructured) bool {
+	hook, err := ParseHelmHooks(obj)
+	return err == nil && hook != nil && hook.IsTest()
+}
+
+// helmHookWeight returns the hook weight of an object, which is 0 for objects which are not hooks or
+// whose weight is invalid, as with Helm
+func helmHookWeight(obj *unstructured.Unstructured) int {
+	hook, err := ParseHelmHooks(obj)
+	if err != nil || hook == nil {
+		return 0
+	}
+	return hook.Weight
+}
+
+// HelmHooksForPhase returns the hooks which run in a phase in the order Helm runs them: by ascending
+// hook weight, and objects of the same weight in kind priority order
+func HelmHooksForPhase(objs []*unstructured.Unstructured, phase HelmHookPhase) []*unstructured.Unstructured {
+	var hooks []*unstructured.Unstructured
+	for _, obj := range objs {
+		hook, err := ParseHelmHooks(obj)
+		if err != nil || hook == nil {
+			continue
+		}
+		for _, hookPhase := range hook.Phases {
+			if hookPhase == phase {
+				hooks = append(hooks, obj)
+				break
+			}
+		}
+	}
+	hooks = sortByKindPriority(hooks, nil)
+	sort.SliceStable(hooks, func(i, j int) bool {
+		return helmHookWeight(hooks[i]) < helmHookWeight(hooks[j])
+	})
+	return hooks
+}
+
+// withoutHelmTests returns the objects which are not Helm tests
+func withoutHelmTests(objs []*unstructured.Unstructured) []*unstructured.Unstructured {
+	var result []*unstructured.Unstructured
+	for _, obj := range objs {
+		if IsHelmTestHook(obj) {
+			continue
+		}
+		result = append(result, obj)
+	}
+	return result
+}
+
+// splitAnnotationList splits the comma separated values of an annotation, ignoring empty values
+func splitAnnotationList(value string) []string {
+	var values []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			values = append(values, item)
+		}
+	}
+	return values
+}
@@ -0,0 +1,94 @@
+package kube
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/rest"
+)
+
+func newHelmHook(kind string, name string, annotations map[string]string) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{}
+	obj.SetAPIVersion("v1")
+	obj.SetKind(kind)
+	obj.SetName(name)
+	obj.SetAnnotations(annotations)
+	return obj
+}
+
+func TestParseHelmHooks(t *testing.T) {
+	hook, err := ParseHelmHooks(newHelmHook("Job", "db-migrate", map[string]string{
+		AnnotationHelmHook:             "pre-install, pre-upgrade",
+		AnnotationHelmHookWeight:       "-5",
+		AnnotationHelmHookDeletePolicy: "before-hook-creation,hook-succeeded",
+	}))
+	assert.Nil(t, err)
+	if assert.NotNil(t, hook) {
+		assert.Equal(t, []HelmHookPhase{HelmHookPreInstall, HelmHookPreUpgrade}, hook.Phases)
+		assert.Equal(t, -5, hook.Weight)
+		assert.Equal(t, []string{"before-hook-creation", "hook-succeeded"}, hook.DeletePolicies)
+		assert.False(t, hook.IsTest())
+	}
+
+	hook, err = ParseHelmHooks(newHelmHook("Pod", "chart-test", map[string]string{AnnotationHelmHook: "test-success"}))
+	assert.Nil(t, err)
+	if assert.NotNil(t, hook) {
+		assert.Equal(t, 0, hook.Weight)
+		assert.True(t, hook.IsTest())
+	}
+
+	hook, err = ParseHelmHooks(newHelmHook("ConfigMap", "config", nil))
+	assert.Nil(t, err)
+	assert.Nil(t, hook)
+
+	_, err = ParseHelmHooks(newHelmHook("Job", "db-migrate", map[string]string{AnnotationHelmHook: "pre-install", AnnotationHelmHookWeight: "first"}))
+	assert.NotNil(t, err)
+}
+
+func TestApplyManifestsExcludeHelmTests(t *testing.T) {
+	applied, restore := fakeKubectl(t)
+	defer restore()
+	objs := []*unstructured.Unstructured{
+		newHelmHook("ConfigMap", "config", nil),
+		newHelmHook("Pod", "chart-test", map[string]string{AnnotationHelmHook: "test"}),
+	}
+
+	results, err := ApplyManifests(&rest.Config{}, objs, "default", ApplyOpts{ExcludeHelmTests: true})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(results))
+	if assert.Equal(t, 1, len(*applied)) {
+		assert.Equal(t, "config", (*applied)[0].GetName())
+	}
+}
+
+func TestHelmHooksForPhase(t *testing.T) {
+	objs := []*unstructured.Unstructured{
+		newHelmHook("Job", "migrate", map[string]string{AnnotationHelmHook: "pre-install", AnnotationHelmHookWeight: "5"}),
+		newHelmHook("Job", "backup", map[string]string{AnnotationHelmHook: "pre-install,pre-upgrade", AnnotationHelmHookWeight: "-1"}),
+		newHelmHook("Job", "notify", map[string]string{AnnotationHelmHook: "post-install"}),
+		newHelmHook("ConfigMap", "migrate-config", map[string]string{AnnotationHelmHook: "pre-install", AnnotationHelmHookWeight: "5"}),
+		newHelmHook("Job", "seed", map[string]string{AnnotationHelmHook: "pre-install"}),
+		newHelmHook("ConfigMap", "config", nil),
+	}
+	var names []string
+	for _, obj := range HelmHooksForPhase(objs, HelmHookPreInstall) {
+		names = append(names, obj.GetName())
+	}
+	assert.Equal(t, []string{"backup", "seed", "migrate-config", "migrate"}, names)
+}
+
+func TestSortByKindPriorityHelmHookWeight(t *testing.T) {
+	objs := []*unstructured.Unstructured{
+		newHelmHook("Job", "second", map[string]string{AnnotationHelmHook: "pre-install", AnnotationHelmHookWeight: "10"}),
+		newHelmHook("Job", "unweighted", nil),
+		newHelmHook("Job", "first", map[string]string{AnnotationHelmHook: "pre-install", AnnotationHelmHookWeight: "-10"}),
+		newHelmHook("ConfigMap", "config", map[string]string{AnnotationHelmHook: "pre-install", AnnotationHelmHookWeight: "20"}),
+	}
+	var names []string
+	for _, obj := range sortByKindPriority(objs, nil) {
+		names = append(names, obj.GetName())
+	}
+	// the weight only orders objects of kinds with the same priority
+	assert.Equal(t, []string{"config", "first", "unweighted", "second"}, names)
+}
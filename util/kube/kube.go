@@ -5,31 +5,45 @@ package kube
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"math"
+	"net/http"
 	"net/url"
 	"os"
 	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
+	apiv1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/equality"
 	apierr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/version"
 	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/discovery"
 	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
 )
 
 const (
 	listVerb             = "list"
+	watchVerb            = "watch"
 	deleteVerb           = "delete"
 	deleteCollectionVerb = "deletecollection"
 )
@@ -46,6 +60,30 @@ func init() {
 	}
 }
 
+// ResourceKey uniquely identifies a resource in a cluster. The API version is deliberately not part
+// of the key, since the same object may be served under several versions of its group.
+type ResourceKey struct {
+	Group     string
+	Kind      string
+	Namespace string
+	Name      string
+}
+
+// NewResourceKey returns a ResourceKey from its parts
+func NewResourceKey(group string, kind string, namespace string, name string) ResourceKey {
+	return ResourceKey{Group: group, Kind: kind, Namespace: namespace, Name: name}
+}
+
+// GetResourceKey returns the ResourceKey of an unstructured object
+func GetResourceKey(obj *unstructured.Unstructured) ResourceKey {
+	gvk := obj.GroupVersionKind()
+	return NewResourceKey(gvk.Group, gvk.Kind, obj.GetNamespace(), obj.GetName())
+}
+
+func (k ResourceKey) String() string {
+	return fmt.Sprintf("%s/%s/%s/%s", k.Group, k.Kind, k.Namespace, k.Name)
+}
+
 // TestConfig tests to make sure the REST config is usable
 func TestConfig(config *rest.Config) error {
 	kubeclientset, err := kubernetes.NewForConfig(config)
@@ -59,6 +97,44 @@ func TestConfig(config *rest.Config) error {
 	return nil
 }
 
+// SummarizeConfig returns a summary of a REST config which is safe to log. It names the server, the
+// authentication methods and whether TLS verification is disabled or a proxy is used, but never
+// includes tokens, passwords or key data.
+func SummarizeConfig(config *rest.Config) string {
+	var authMethods []string
+	if config.BearerToken != "" {
+		authMethods = append(authMethods, "token")
+	}
+	if len(config.TLSClientConfig.CertData) > 0 || config.TLSClientConfig.CertFile != "" {
+		authMethods = append(authMethods, "client-certificate")
+	}
+	if config.Username != "" || config.Password != "" {
+		authMethods = append(authMethods, "basic")
+	}
+	if config.AuthProvider != nil {
+		authMethods = append(authMethods, fmt.Sprintf("auth-provider(%s)", config.AuthProvider.Name))
+	}
+	if len(authMethods) == 0 {
+		authMethods = append(authMethods, "none")
+	}
+	summary := fmt.Sprintf("host=%s insecure=%t auth=%s proxy=%t", config.Host, config.TLSClientConfig.Insecure, strings.Join(authMethods, ","), usesProxy(config))
+	if config.Impersonate.UserName != "" {
+		summary += fmt.Sprintf(" impersonate=%s", config.Impersonate.UserName)
+	}
+	return summary
+}
+
+// usesProxy returns whether requests to the server of a config are sent through a proxy configured
+// in the environment
+func usesProxy(config *rest.Config) bool {
+	serverURL, err := url.Parse(config.Host)
+	if err != nil || serverURL.Host == "" {
+		return false
+	}
+	proxyURL, err := http.ProxyFromEnvironment(&http.Request{URL: serverURL})
+	return err == nil && proxyURL != nil
+}
+
 // ToUnstructured converts a concrete K8s API type to a un unstructured object
 func ToUnstructured(obj interface{}) (*unstructured.Unstructured, error) {
 	uObj, err := runtime.NewTestUnstructuredConverter(equality.Semantic).ToUnstructured(obj)
@@ -110,37 +186,153 @@ func GetLiveResource(dclient dynamic.Interface, obj *unstructured.Unstructured,
 	return liveObj, nil
 }
 
-func WatchResourcesWithLabel(ctx context.Context, config *rest.Config, namespace string, labelName string) (chan watch.Event, error) {
+// CheckResourceVersion returns a StaleObjectError if an object, as read before a write, no longer has
+// the resource version of its live counterpart, e.g. as observed by a watch, so the write can be skipped
+// rather than being rejected by the server. A nil live object means it was deleted.
+func CheckResourceVersion(obj *unstructured.Unstructured, live *unstructured.Unstructured) error {
+	var liveVersion string
+	if live != nil {
+		liveVersion = live.GetResourceVersion()
+	}
+	if live == nil || liveVersion != obj.GetResourceVersion() {
+		return &StaleObjectError{Key: GetResourceKey(obj), ResourceVersion: obj.GetResourceVersion(), LiveResourceVersion: liveVersion}
+	}
+	return nil
+}
+
+// VerifyResourceVersion gets the live counterpart of an object and returns a StaleObjectError if its
+// resource version changed since the object was read. The server enforces this on updates anyway, so
+// this only saves preparing and sending a write which would fail.
+func VerifyResourceVersion(dclient dynamic.Interface, obj *unstructured.Unstructured, apiResource *metav1.APIResource, namespace string) error {
+	live, err := GetLiveResource(dclient, obj, apiResource, namespace)
+	if err != nil {
+		return err
+	}
+	return CheckResourceVersion(obj, live)
+}
+
+// GroupVersionResourceInfo is an API resource along with the group version kind it is served under
+type GroupVersionResourceInfo struct {
+	GroupVersionKind schema.GroupVersionKind
+	APIResource      metav1.APIResource
+}
+
+// APIResourcesSupportingVerb returns the API resources which support the given verb. Subresources
+// (e.g. deployments/scale) are excluded.
+func APIResourcesSupportingVerb(disco discovery.DiscoveryInterface, verb string) ([]GroupVersionResourceInfo, error) {
+	serverResources, err := disco.ServerResources()
+	if err != nil {
+		return nil, err
+	}
+	var infos []GroupVersionResourceInfo
+	for _, apiResourcesList := range serverResources {
+		for _, apiResource := range apiResourcesList.APIResources {
+			if strings.Contains(apiResource.Name, "/") || !supportsVerb(apiResource, verb) {
+				continue
+			}
+			infos = append(infos, GroupVersionResourceInfo{
+				GroupVersionKind: schema.FromAPIVersionAndKind(apiResourcesList.GroupVersion, apiResource.Kind),
+				APIResource:      apiResource,
+			})
+		}
+	}
+	return infos, nil
+}
+
+func supportsVerb(apiResource metav1.APIResource, verb string) bool {
+	for _, v := range apiResource.Verbs {
+		if v == verb {
+			return true
+		}
+	}
+	return false
+}
+
+// ResourceVersions are the resource versions of the lists of several kinds of resources
+type ResourceVersions map[schema.GroupVersionKind]string
+
+// ListResourcesForWatch returns all resources with the specified label, of every kind which can be
+// watched, along with the resource version of the list of each kind. Each kind is listed a page at a
+// time. Passing the versions to WatchResourcesWithLabel starts the watches where the lists ended, so no
+// change made in between is missed.
+func ListResourcesForWatch(ctx context.Context, config *rest.Config, namespace string, labelName string) ([]*unstructured.Unstructured, ResourceVersions, error) {
+	if err := ValidateLabelSelector(labelName, ""); err != nil {
+		return nil, nil, err
+	}
+	dynClientPool := dynamic.NewDynamicClientPool(config)
+	disco, err := discovery.NewDiscoveryClientForConfig(config)
+	if err != nil {
+		return nil, nil, err
+	}
+	return listResourcesForWatch(ctx, dynClientPool, disco, namespace, labelName, DefaultBulkOptions.MaxConcurrency)
+}
+
+func listResourcesForWatch(ctx context.Context, dynClientPool dynamic.ClientPool, disco discovery.DiscoveryInterface, namespace string, labelName string, maxConcurrency int) ([]*unstructured.Unstructured, ResourceVersions, error) {
+	infos, err := APIResourcesSupportingVerb(disco, watchVerb)
+	if err != nil {
+		return nil, nil, err
+	}
+	var lock sync.Mutex
+	var asyncErr error
+	var result []*unstructured.Unstructured
+	versions := make(ResourceVersions)
+	forEachConcurrently(len(infos), maxConcurrency, func(i int) {
+		if ctx.Err() != nil || !supportsVerb(infos[i].APIResource, listVerb) {
+			return
+		}
+		dclient, err := dynClientPool.ClientForGroupVersionKind(infos[i].GroupVersionKind)
+		var items []*unstructured.Unstructured
+		var resourceVersion string
+		if err == nil {
+			items, resourceVersion, _, err = listPaged(dclient.Resource(&infos[i].APIResource, namespace), metav1.ListOptions{LabelSelector: labelName}, 0)
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		if err != nil {
+			asyncErr = err
+			return
+		}
+		versions[infos[i].GroupVersionKind] = resourceVersion
+		result = append(result, items...)
+	})
+	if asyncErr != nil {
+		return nil, nil, asyncErr
+	}
+	if ctx.Err() != nil {
+		return nil, nil, ctx.Err()
+	}
+	return result, versions, nil
+}
+
+// WatchResourcesWithLabel watches all resources with the specified label. The watch of each kind starts
+// from its resource version in versions, as returned by ListResourcesForWatch, or from the current state
+// of the cluster for kinds without a version.
+func WatchResourcesWithLabel(ctx context.Context, config *rest.Config, namespace string, labelName string, versions ResourceVersions) (chan watch.Event, error) {
+	if err := ValidateLabelSelector(labelName, ""); err != nil {
+		return nil, err
+	}
 	log.Infof("Start watching for resources changes with label %s in cluster %s", labelName, config.Host)
 	dynClientPool := dynamic.NewDynamicClientPool(config)
 	disco, err := discovery.NewDiscoveryClientForConfig(config)
 	if err != nil {
 		return nil, err
 	}
-	serverResources, err := disco.ServerResources()
+	return watchResourcesWithLabel(ctx, dynClientPool, disco, config.Host, namespace, labelName, versions)
+}
+
+func watchResourcesWithLabel(ctx context.Context, dynClientPool dynamic.ClientPool, disco discovery.DiscoveryInterface, cluster string, namespace string, labelName string, versions ResourceVersions) (chan watch.Event, error) {
+	infos, err := APIResourcesSupportingVerb(disco, watchVerb)
 	if err != nil {
 		return nil, err
 	}
 
 	resources := make([]dynamic.ResourceInterface, 0)
-	for _, apiResourcesList := range serverResources {
-		for i := range apiResourcesList.APIResources {
-			apiResource := apiResourcesList.APIResources[i]
-			watchSupported := false
-			for _, verb := range apiResource.Verbs {
-				if verb == "watch" {
-					watchSupported = true
-					break
-				}
-			}
-			if watchSupported {
-				dclient, err := dynClientPool.ClientForGroupVersionKind(schema.FromAPIVersionAndKind(apiResourcesList.GroupVersion, apiResource.Kind))
-				if err != nil {
-					return nil, err
-				}
-				resources = append(resources, dclient.Resource(&apiResource, namespace))
-			}
+	for i := range infos {
+		dclient, err := dynClientPool.ClientForGroupVersionKind(infos[i].GroupVersionKind)
+		if err != nil {
+			return nil, err
 		}
+		resources = append(resources, dclient.Resource(&infos[i].APIResource, namespace))
 	}
 	ch := make(chan watch.Event)
 	go func() {
@@ -148,75 +340,143 @@ func WatchResourcesWithLabel(ctx context.Context, config *rest.Config, namespace
 		wg.Add(len(resources))
 		for i := 0; i < len(resources); i++ {
 			resource := resources[i]
+			listOpts := metav1.ListOptions{LabelSelector: labelName, ResourceVersion: versions[infos[i].GroupVersionKind]}
 			go func() {
 				defer wg.Done()
-				watch, err := resource.Watch(metav1.ListOptions{LabelSelector: labelName})
+				watch, err := resource.Watch(listOpts)
+				if err != nil {
+					return
+				}
 				go func() {
 					select {
 					case <-ctx.Done():
 						watch.Stop()
 					}
 				}()
-				if err == nil {
-					for event := range watch.ResultChan() {
-						ch <- event
-					}
+				for event := range watch.ResultChan() {
+					ch <- event
 				}
 			}()
 		}
 		wg.Wait()
 		close(ch)
-		log.Infof("Stop watching for resources changes with label %s in cluster %s", labelName, config.ServerName)
+		log.Infof("Stop watching for resources changes with label %s in cluster %s", labelName, cluster)
 	}()
 	return ch, nil
 }
 
-// GetResourcesWithLabel returns all kubernetes resources with specified label
-func GetResourcesWithLabel(config *rest.Config, namespace string, labelName string, labelValue string) ([]*unstructured.Unstructured, error) {
+// GetResourcesWithLabel returns all kubernetes resources with specified label. If the context is done
+// before all resources are listed, the resources listed so far are returned along with the context error.
+// Nil bulk options use DefaultBulkOptions.
+func GetResourcesWithLabel(ctx context.Context, config *rest.Config, namespace string, labelName string, labelValue string, bulk *BulkOptions) ([]*unstructured.Unstructured, error) {
+	if err := ValidateLabelSelector(labelName, labelValue); err != nil {
+		return nil, err
+	}
+	bulkOpts := bulk.withDefaults()
+	config = withWarningsLogged(bulkOpts.restConfig(config), "listing resources", bulkOpts.WarningHandler)
 	dynClientPool := dynamic.NewDynamicClientPool(config)
-	disco, err := discovery.NewDiscoveryClientForConfig(config)
+	disco, err := bulkOpts.discovery(config)
+	if err != nil {
+		return nil, err
+	}
+	return getResourcesWithLabel(ctx, dynClientPool, disco, namespace, labelName, labelValue, bulkOpts.MaxConcurrency)
+}
+
+func getResourcesWithLabel(ctx context.Context, dynClientPool dynamic.ClientPool, disco discovery.DiscoveryInterface, namespace string, labelName string, labelValue string, maxConcurrency int) ([]*unstructured.Unstructured, error) {
+	return getResourcesWithLabelInNamespaces(ctx, dynClientPool, disco, []string{namespace}, labelName, labelValue, maxConcurrency)
+}
+
+// GetResourcesWithLabelInNamespaces is like GetResourcesWithLabel, but only lists namespaced resources
+// in the given namespaces, issuing a list per namespace rather than a single list across the cluster.
+// Cluster scoped resources are listed once. No namespaces lists resources in all namespaces.
+func GetResourcesWithLabelInNamespaces(ctx context.Context, config *rest.Config, namespaces []string, labelName string, labelValue string, bulk *BulkOptions) ([]*unstructured.Unstructured, error) {
+	if err := ValidateLabelSelector(labelName, labelValue); err != nil {
+		return nil, err
+	}
+	bulkOpts := bulk.withDefaults()
+	config = withWarningsLogged(bulkOpts.restConfig(config), "listing resources", bulkOpts.WarningHandler)
+	dynClientPool := dynamic.NewDynamicClientPool(config)
+	disco, err := bulkOpts.discovery(config)
 	if err != nil {
 		return nil, err
 	}
-	resources, err := disco.ServerResources()
+	return getResourcesWithLabelInNamespaces(ctx, dynClientPool, disco, namespaces, labelName, labelValue, bulkOpts.MaxConcurrency)
+}
+
+func getResourcesWithLabelInNamespaces(ctx context.Context, dynClientPool dynamic.ClientPool, disco discovery.DiscoveryInterface, namespaces []string, labelName string, labelValue string, maxConcurrency int) ([]*unstructured.Unstructured, error) {
+	infos, err := APIResourcesSupportingVerb(disco, listVerb)
 	if err != nil {
 		return nil, err
 	}
+	if len(namespaces) == 0 {
+		namespaces = []string{""}
+	}
 
 	var resourceInterfaces []dynamic.ResourceInterface
 
-	for _, apiResourcesList := range resources {
-		for i := range apiResourcesList.APIResources {
-			apiResource := apiResourcesList.APIResources[i]
-			listSupported := false
-			for _, verb := range apiResource.Verbs {
-				if verb == listVerb {
-					listSupported = true
-					break
-				}
-			}
-			if listSupported {
-				dclient, err := dynClientPool.ClientForGroupVersionKind(schema.FromAPIVersionAndKind(apiResourcesList.GroupVersion, apiResource.Kind))
-				if err != nil {
-					return nil, err
-				}
-				resourceInterfaces = append(resourceInterfaces, dclient.Resource(&apiResource, namespace))
-			}
+	for i := range infos {
+		dclient, err := dynClientPool.ClientForGroupVersionKind(infos[i].GroupVersionKind)
+		if err != nil {
+			return nil, err
+		}
+		if !infos[i].APIResource.Namespaced {
+			resourceInterfaces = append(resourceInterfaces, dclient.Resource(&infos[i].APIResource, ""))
+			continue
+		}
+		for _, namespace := range namespaces {
+			resourceInterfaces = append(resourceInterfaces, dclient.Resource(&infos[i].APIResource, namespace))
+		}
+	}
+
+	return listResourcesWithLabel(ctx, resourceInterfaces, labelName, labelValue, maxConcurrency)
+}
+
+// DefaultListTimeout is the timeout of list requests which do not set one, so a slow list does not keep
+// the connection open indefinitely. It is sent as ListOptions.TimeoutSeconds, but the API server only
+// honors that for watches, so the functions which take BulkOptions also have the client give up on
+// requests after it (see BulkOptions.Timeout).
+var DefaultListTimeout = 5 * time.Minute
+
+// withListTimeout returns the list options with the timeout set to DefaultListTimeout, unless a timeout
+// is set already
+func withListTimeout(listOpts metav1.ListOptions) metav1.ListOptions {
+	if listOpts.TimeoutSeconds == nil && DefaultListTimeout > 0 {
+		timeoutSeconds := int64(math.Ceil(DefaultListTimeout.Seconds()))
+		listOpts.TimeoutSeconds = &timeoutSeconds
+	}
+	return listOpts
+}
+
+// listResourcesWithLabel concurrently lists the resources with the specified label using each of the
+// resource clients, making at most maxConcurrency requests at once. If the context is done before all
+// lists complete, the resources listed so far are returned together with the context's error.
+func listResourcesWithLabel(ctx context.Context, resourceInterfaces []dynamic.ResourceInterface, labelName string, labelValue string, maxConcurrency int) ([]*unstructured.Unstructured, error) {
+	listOpts := metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("%s=%s", labelName, labelValue),
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		// have the server give up on requests which would outlive the context
+		timeoutSeconds := int64(math.Ceil(time.Until(deadline).Seconds()))
+		if timeoutSeconds < 1 {
+			timeoutSeconds = 1
 		}
+		listOpts.TimeoutSeconds = &timeoutSeconds
 	}
+	listOpts = withListTimeout(listOpts)
 
+	var lock sync.Mutex
 	var asyncErr error
 	var result []*unstructured.Unstructured
 
-	var wg sync.WaitGroup
-	wg.Add(len(resourceInterfaces))
-	for i := range resourceInterfaces {
-		client := resourceInterfaces[i]
-		go func() {
-			defer wg.Done()
-			list, err := client.List(metav1.ListOptions{
-				LabelSelector: fmt.Sprintf("%s=%s", labelName, labelValue),
-			})
+	done := make(chan struct{})
+	go func() {
+		forEachConcurrently(len(resourceInterfaces), maxConcurrency, func(i int) {
+			if ctx.Err() != nil {
+				return
+			}
+			list, err := resourceInterfaces[i].List(listOpts)
+			lock.Lock()
+			defer lock.Unlock()
 			if err != nil {
 				asyncErr = err
 				return
@@ -224,29 +484,92 @@ func GetResourcesWithLabel(config *rest.Config, namespace string, labelName stri
 			// apply client side filtering since not every kubernetes API supports label filtering
 			for i := range list.(*unstructured.UnstructuredList).Items {
 				item := list.(*unstructured.UnstructuredList).Items[i]
-				labels := item.GetLabels()
-				if labels != nil {
-					if value, ok := labels[labelName]; ok && value == labelValue {
-						result = append(result, &item)
-					}
+				if MatchesLabels(&item, map[string]string{labelName: labelValue}) {
+					result = append(result, &item)
 				}
 			}
-		}()
+		})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		lock.Lock()
+		defer lock.Unlock()
+		partial := make([]*unstructured.Unstructured, len(result))
+		copy(partial, result)
+		return partial, ctx.Err()
 	}
-	wg.Wait()
 	return result, asyncErr
 }
 
-// DeleteResourceWithLabel delete all resources which match to specified label selector
-func DeleteResourceWithLabel(config *rest.Config, namespace string, labelName string, labelValue string) error {
+// DeleteOpts are options for deleting resources
+type DeleteOpts struct {
+	// Wait blocks until all of the deleted resources are gone from the cluster. Ignored by DeleteResource.
+	Wait bool
+	// WaitTimeout bounds the time spent waiting for deletion. Zero waits until the context is done.
+	WaitTimeout time.Duration
+	// GracePeriodSeconds, if set, overrides the time the deleted resources are given to terminate
+	// gracefully, e.g. to give pods longer to drain. Zero deletes immediately, which force deletes pods:
+	// their containers may keep running on the node after the API object is gone, so a replacement pod
+	// of a StatefulSet can run alongside them and corrupt data they share. Nil uses the default grace
+	// period of each resource.
+	GracePeriodSeconds *int64
+}
+
+// deleteOptions returns the options of the delete requests, which delete dependents in the foreground
+func (o DeleteOpts) deleteOptions() *metav1.DeleteOptions {
+	propagationPolicy := metav1.DeletePropagationForeground
+	return &metav1.DeleteOptions{
+		PropagationPolicy:  &propagationPolicy,
+		GracePeriodSeconds: o.GracePeriodSeconds,
+	}
+}
+
+// DeletionTimeoutError is returned when resources remain in the cluster after waiting for their deletion
+type DeletionTimeoutError struct {
+	// Remaining are the resources which were still present when the wait ended
+	Remaining []*unstructured.Unstructured
+	cause     error
+}
+
+func (e *DeletionTimeoutError) Error() string {
+	return fmt.Sprintf("%d resources still present after deletion: %v", len(e.Remaining), e.cause)
+}
+
+// DeleteResourceWithLabel delete all resources which match to specified label selector, and returns
+// the keys of the deleted resources. Resources of types supporting deletecollection are listed before
+// they are deleted, so resources created in between are deleted without being reported. Nil bulk
+// options use DefaultBulkOptions.
+func DeleteResourceWithLabel(ctx context.Context, config *rest.Config, namespace string, labelName string, labelValue string, opts DeleteOpts, bulk *BulkOptions) ([]ResourceKey, error) {
+	if err := ValidateLabelSelector(labelName, labelValue); err != nil {
+		return nil, err
+	}
+	bulkOpts := bulk.withDefaults()
+	config = bulkOpts.restConfig(config)
 	dynClientPool := dynamic.NewDynamicClientPool(config)
-	disco, err := discovery.NewDiscoveryClientForConfig(config)
+	disco, err := bulkOpts.discovery(config)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	resources, err := disco.ServerResources()
+	deleted, err := deleteResourcesWithLabel(dynClientPool, disco, namespace, labelName, labelValue, opts, bulkOpts.MaxConcurrency)
+	if err != nil || !opts.Wait {
+		return deleted, err
+	}
+	if opts.WaitTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.WaitTimeout)
+		defer cancel()
+	}
+	return deleted, waitForDeletion(ctx, deletionPollInterval, func() ([]*unstructured.Unstructured, error) {
+		return GetResourcesWithLabel(ctx, config, namespace, labelName, labelValue, bulk)
+	})
+}
+
+func deleteResourcesWithLabel(dynClientPool dynamic.ClientPool, disco discovery.DiscoveryInterface, namespace string, labelName string, labelValue string, opts DeleteOpts, maxConcurrency int) ([]ResourceKey, error) {
+	infos, err := APIResourcesSupportingVerb(disco, deleteVerb)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	var resourceInterfaces []struct {
@@ -254,98 +577,165 @@ func DeleteResourceWithLabel(config *rest.Config, namespace string, labelName st
 		bool
 	}
 
-	for _, apiResourcesList := range resources {
-		for i := range apiResourcesList.APIResources {
-			apiResource := apiResourcesList.APIResources[i]
-			deleteCollectionSupported := false
-			deleteSupported := false
-			for _, verb := range apiResource.Verbs {
-				if verb == deleteCollectionVerb {
-					deleteCollectionSupported = true
-				} else if verb == deleteVerb {
-					deleteSupported = true
-				}
-			}
-			dclient, err := dynClientPool.ClientForGroupVersionKind(schema.FromAPIVersionAndKind(apiResourcesList.GroupVersion, apiResource.Kind))
-			if err != nil {
-				return err
-			}
-
-			if deleteCollectionSupported || deleteSupported {
-				resourceInterfaces = append(resourceInterfaces, struct {
-					dynamic.ResourceInterface
-					bool
-				}{dclient.Resource(&apiResource, namespace), deleteCollectionSupported})
-			}
+	for i := range infos {
+		dclient, err := dynClientPool.ClientForGroupVersionKind(infos[i].GroupVersionKind)
+		if err != nil {
+			return nil, err
 		}
+		resourceInterfaces = append(resourceInterfaces, struct {
+			dynamic.ResourceInterface
+			bool
+		}{dclient.Resource(&infos[i].APIResource, namespace), supportsVerb(infos[i].APIResource, deleteCollectionVerb)})
 	}
 
+	var lock sync.Mutex
 	var asyncErr error
-	propagationPolicy := metav1.DeletePropagationForeground
-
-	var wg sync.WaitGroup
-	wg.Add(len(resourceInterfaces))
+	var deleted []ResourceKey
+	deleteOpts := opts.deleteOptions()
+	listOpts := withListTimeout(metav1.ListOptions{LabelSelector: fmt.Sprintf("%s=%s", labelName, labelValue)})
 
-	for i := range resourceInterfaces {
+	forEachConcurrently(len(resourceInterfaces), maxConcurrency, func(i int) {
 		client := resourceInterfaces[i].ResourceInterface
-		deleteCollectionSupported := resourceInterfaces[i].bool
-
-		go func() {
-			defer wg.Done()
-			if deleteCollectionSupported {
-				err = client.DeleteCollection(&metav1.DeleteOptions{
-					PropagationPolicy: &propagationPolicy,
-				}, metav1.ListOptions{LabelSelector: fmt.Sprintf("%s=%s", labelName, labelValue)})
-				if err != nil && !apierr.IsNotFound(err) {
-					asyncErr = err
-				}
-			} else {
-				items, err := client.List(metav1.ListOptions{LabelSelector: fmt.Sprintf("%s=%s", labelName, labelValue)})
-				if err != nil {
-					asyncErr = err
-					return
-				}
-				for _, item := range items.(*unstructured.UnstructuredList).Items {
+		gvk := infos[i].GroupVersionKind
+		var keys []ResourceKey
+		var err error
+		if resourceInterfaces[i].bool {
+			// list the resources first, since deletecollection does not return what it deleted
+			var res runtime.Object
+			res, err = client.List(listOpts)
+			if err == nil {
+				for _, item := range res.(*unstructured.UnstructuredList).Items {
 					// apply client side filtering since not every kubernetes API supports label filtering
-					labels := item.GetLabels()
-					if labels != nil {
-						if value, ok := labels[labelName]; ok && value == labelValue {
-							err = client.Delete(item.GetName(), &metav1.DeleteOptions{
-								PropagationPolicy: &propagationPolicy,
-							})
-							if err != nil && !apierr.IsNotFound(err) {
-								asyncErr = err
-								return
-							}
-						}
+					if MatchesLabels(&item, map[string]string{labelName: labelValue}) {
+						keys = append(keys, NewResourceKey(gvk.Group, gvk.Kind, item.GetNamespace(), item.GetName()))
 					}
 				}
 			}
-		}()
+			if err == nil && len(keys) > 0 {
+				err = client.DeleteCollection(deleteOpts, listOpts)
+			}
+			if apierr.IsNotFound(err) {
+				err = nil
+			}
+		} else {
+			keys, err = deletePagedWithLabel(client, gvk.GroupKind(), labelName, labelValue, deleteOpts)
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		if err != nil {
+			asyncErr = err
+			return
+		}
+		deleted = append(deleted, keys...)
+	})
+	return deleted, asyncErr
+}
+
+// deleteListPageSize is the number of resources requested per page when listing resources to delete
+const deleteListPageSize = 500
+
+// deletePagedWithLabel deletes the resources with the specified label one by one, for resource types
+// which do not support deletecollection. Resources are listed a page at a time and each page is deleted
+// before the next one is requested, to bound the memory used on large namespaces. The resources are
+// deleted serially, since callers already delete the resources of several types concurrently. The keys
+// of the deleted resources, which are of the given group kind, are returned.
+func deletePagedWithLabel(client dynamic.ResourceInterface, gk schema.GroupKind, labelName string, labelValue string, deleteOpts *metav1.DeleteOptions) ([]ResourceKey, error) {
+	listOpts := withListTimeout(metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("%s=%s", labelName, labelValue),
+		Limit:         deleteListPageSize,
+	})
+	var deleted []ResourceKey
+	for {
+		res, err := client.List(listOpts)
+		if err != nil {
+			return deleted, err
+		}
+		list := res.(*unstructured.UnstructuredList)
+
+		for i := range list.Items {
+			item := &list.Items[i]
+			// apply client side filtering since not every kubernetes API supports label filtering
+			if !MatchesLabels(item, map[string]string{labelName: labelValue}) {
+				continue
+			}
+			err := client.Delete(item.GetName(), deleteOpts)
+			if err == nil {
+				deleted = append(deleted, NewResourceKey(gk.Group, gk.Kind, item.GetNamespace(), item.GetName()))
+			} else if !apierr.IsNotFound(err) {
+				return deleted, err
+			}
+		}
+		if list.GetContinue() == "" {
+			return deleted, nil
+		}
+		listOpts.Continue = list.GetContinue()
 	}
-	wg.Wait()
-	return asyncErr
 }
 
-// GetLiveResources returns the corresponding live resource from a list of resources
-func GetLiveResources(config *rest.Config, objs []*unstructured.Unstructured, namespace string) ([]*unstructured.Unstructured, error) {
-	liveObjs := make([]*unstructured.Unstructured, len(objs))
+// deletionPollInterval is the interval at which resources are polled while waiting for their deletion
+var deletionPollInterval = 2 * time.Second
+
+// waitForDeletion polls the supplied list function until it no longer returns any resources, or the
+// context is done, in which case a DeletionTimeoutError with the remaining resources is returned.
+func waitForDeletion(ctx context.Context, interval time.Duration, list func() ([]*unstructured.Unstructured, error)) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		remaining, err := list()
+		if err != nil {
+			return err
+		}
+		if len(remaining) == 0 {
+			return nil
+		}
+		log.Debugf("Waiting for deletion of %d resources", len(remaining))
+		select {
+		case <-ctx.Done():
+			return &DeletionTimeoutError{Remaining: remaining, cause: ctx.Err()}
+		case <-ticker.C:
+		}
+	}
+}
+
+// GetLiveOpts are options for getting live resources
+type GetLiveOpts struct {
+	// IgnoreUnknownKinds treats objects whose kind is not served by the API server as missing, rather
+	// than failing the whole batch
+	IgnoreUnknownKinds bool
+}
+
+// GetLiveResources returns the corresponding live resource from a list of resources. Namespaced objects
+// which do not specify a namespace are looked up in the given namespace.
+func GetLiveResources(config *rest.Config, objs []*unstructured.Unstructured, namespace string, opts GetLiveOpts) ([]*unstructured.Unstructured, error) {
 	dynClientPool := dynamic.NewDynamicClientPool(config)
 	disco, err := discovery.NewDiscoveryClientForConfig(config)
 	if err != nil {
 		return nil, err
 	}
+	return getLiveResources(dynClientPool, disco, objs, namespace, opts)
+}
+
+func getLiveResources(dynClientPool dynamic.ClientPool, disco discovery.DiscoveryInterface, objs []*unstructured.Unstructured, namespace string, opts GetLiveOpts) ([]*unstructured.Unstructured, error) {
+	return getLiveResourcesWithResolver(dynClientPool, discoveryResolver(disco), objs, namespace, opts)
+}
+
+func getLiveResourcesWithResolver(dynClientPool dynamic.ClientPool, resolve apiResourceResolver, objs []*unstructured.Unstructured, namespace string, opts GetLiveOpts) ([]*unstructured.Unstructured, error) {
+	liveObjs := make([]*unstructured.Unstructured, len(objs))
 	for i, obj := range objs {
 		gvk := obj.GroupVersionKind()
-		dclient, err := dynClientPool.ClientForGroupVersionKind(gvk)
+		apiResource, err := resolve(gvk)
 		if err != nil {
+			if opts.IgnoreUnknownKinds && IsUnknownKindError(err) {
+				log.Warnf("Treating %s/%s as missing: %v", obj.GetKind(), obj.GetName(), err)
+				continue
+			}
 			return nil, err
 		}
-		apiResource, err := ServerResourceForGroupVersionKind(disco, gvk)
+		dclient, err := dynClientPool.ClientForGroupVersionKind(gvk)
 		if err != nil {
 			return nil, err
 		}
-		liveObj, err := GetLiveResource(dclient, obj, apiResource, namespace)
+		liveObj, err := GetLiveResource(dclient, obj, apiResource, liveResourceNamespace(apiResource, obj, namespace))
 		if err != nil {
 			return nil, err
 		}
@@ -354,96 +744,784 @@ func GetLiveResources(config *rest.Config, objs []*unstructured.Unstructured, na
 	return liveObjs, nil
 }
 
-// See: https://github.com/ksonnet/ksonnet/blob/master/utils/client.go
-func ServerResourceForGroupVersionKind(disco discovery.DiscoveryInterface, gvk schema.GroupVersionKind) (*metav1.APIResource, error) {
-	resources, err := disco.ServerResourcesForGroupVersion(gvk.GroupVersion().String())
+// liveResourceNamespace returns the namespace to get the live counterpart of an object from. Cluster
+// scoped objects are fetched without a namespace, and namespaced objects from their own namespace if
+// they specify one, or the default namespace otherwise.
+func liveResourceNamespace(apiResource *metav1.APIResource, obj *unstructured.Unstructured, namespace string) string {
+	if !apiResource.Namespaced {
+		return ""
+	}
+	if obj.GetNamespace() != "" {
+		return obj.GetNamespace()
+	}
+	return namespace
+}
+
+// GetLiveResourcesConcurrent returns the corresponding live resource from a list of resources, fetching
+// several resources at once. Nil bulk options use DefaultBulkOptions.
+func GetLiveResourcesConcurrent(config *rest.Config, objs []*unstructured.Unstructured, namespace string, opts GetLiveOpts, bulk *BulkOptions) ([]*unstructured.Unstructured, error) {
+	bulkOpts := bulk.withDefaults()
+	config = bulkOpts.restConfig(config)
+	dynClientPool := dynamic.NewDynamicClientPool(config)
+	disco, err := bulkOpts.discovery(config)
 	if err != nil {
 		return nil, err
 	}
-	for _, r := range resources.APIResources {
-		if r.Kind == gvk.Kind {
-			log.Debugf("Chose API '%s' for %s", r.Name, gvk)
-			return &r, nil
+	liveObjs := make([]*unstructured.Unstructured, len(objs))
+	var lock sync.Mutex
+	var asyncErr error
+	forEachConcurrently(len(objs), bulkOpts.MaxConcurrency, func(i int) {
+		res, err := getLiveResources(dynClientPool, disco, objs[i:i+1], namespace, opts)
+		if err != nil {
+			lock.Lock()
+			asyncErr = err
+			lock.Unlock()
+			return
 		}
+		liveObjs[i] = res[0]
+	})
+	if asyncErr != nil {
+		return nil, asyncErr
 	}
-	return nil, fmt.Errorf("Server is unable to handle %s", gvk)
-}
-
-type listResult struct {
-	Items []*unstructured.Unstructured `json:"items"`
+	return liveObjs, nil
 }
 
-// ListResources returns a list of resources of a particular API type using the dynamic client
-func ListResources(dclient dynamic.Interface, apiResource metav1.APIResource, namespace string, listOpts metav1.ListOptions) ([]*unstructured.Unstructured, error) {
-	reIf := dclient.Resource(&apiResource, namespace)
-	liveObjs, err := reIf.List(listOpts)
+// ResourcesExist returns whether each of the objects exists in the cluster. Rather than getting every
+// object, the objects of the same kind in the same namespace are listed at once, which is much cheaper
+// for large sets of objects. Namespaced objects which do not specify a namespace are looked up in the
+// given namespace. Objects of kinds which are not served by the API server do not exist.
+func ResourcesExist(config *rest.Config, objs []*unstructured.Unstructured, namespace string) (map[ResourceKey]bool, error) {
+	dynClientPool := dynamic.NewDynamicClientPool(config)
+	disco, err := discovery.NewDiscoveryClientForConfig(config)
 	if err != nil {
-		return nil, errors.WithStack(err)
+		return nil, err
 	}
-	liveObjsBytes, err := json.Marshal(liveObjs)
+	return resourcesExist(dynClientPool, disco, objs, namespace)
+}
+
+func resourcesExist(dynClientPool dynamic.ClientPool, disco discovery.DiscoveryInterface, objs []*unstructured.Unstructured, namespace string) (map[ResourceKey]bool, error) {
+	defaulted, err := withDefaultNamespace(disco, objs, namespace)
 	if err != nil {
-		return nil, errors.WithStack(err)
+		return nil, err
 	}
-	var objList listResult
-	err = json.Unmarshal(liveObjsBytes, &objList)
-	if err != nil {
-		return nil, errors.WithStack(err)
+	// the results are keyed by the objects as given, which may not specify their namespace
+	givenKeys := make(map[ResourceKey]ResourceKey)
+	for i, obj := range defaulted {
+		givenKeys[GetResourceKey(obj)] = GetResourceKey(objs[i])
 	}
-	return objList.Items, nil
-}
-
-// ListAllResources iterates the list of API resources, and returns all resources with the given filters
-func ListAllResources(config *rest.Config, apiResources []metav1.APIResource, namespace string, listOpts metav1.ListOptions) ([]*unstructured.Unstructured, error) {
-	// itemMap dedups items when there is duplication of a resource in multiple API types
-	// e.g. extensions/v1beta1/namespaces/default/deployments and apps/v1/namespaces/default/deployments
-	itemMap := make(map[string]*unstructured.Unstructured)
-
-	for _, apiResource := range apiResources {
-		dynConfig := *config
-		dynConfig.GroupVersion = &schema.GroupVersion{
-			Group:   apiResource.Group,
-			Version: apiResource.Kind,
+	exists := make(map[ResourceKey]bool)
+	for _, group := range groupByKindAndNamespace(defaulted) {
+		for _, obj := range group.objs {
+			exists[givenKeys[GetResourceKey(obj)]] = false
 		}
-		dclient, err := dynamic.NewClient(&dynConfig)
+		apiResource, err := ServerResourceForGroupVersionKind(disco, group.gvk)
 		if err != nil {
-			return nil, errors.WithStack(err)
+			if IsUnknownKindError(err) {
+				continue
+			}
+			return nil, err
 		}
-		resList, err := ListResources(dclient, apiResource, namespace, listOpts)
+		dclient, err := dynClientPool.ClientForGroupVersionKind(group.gvk)
 		if err != nil {
-			return nil, errors.WithStack(err)
+			return nil, err
 		}
-		for _, liveObj := range resList {
-			itemMap[string(liveObj.GetUID())] = liveObj
+		listNamespace := group.namespace
+		if !apiResource.Namespaced {
+			listNamespace = ""
 		}
+		listOpts, err := narrowingListOptions(group.objs)
+		if err != nil {
+			return nil, err
+		}
+		liveObjs, err := ListResources(dclient, *apiResource, listNamespace, listOpts)
+		if err != nil {
+			return nil, err
+		}
+		liveKeys := make(map[ResourceKey]bool)
+		for _, liveObj := range liveObjs {
+			liveKeys[GetResourceKey(liveObj)] = true
+		}
+		for _, obj := range group.objs {
+			key := GetResourceKey(obj)
+			if liveKeys[key] {
+				exists[givenKeys[key]] = true
+			}
+		}
+	}
+	return exists, nil
+}
+
+// ServerResourceForGroupVersionKind returns the API resource serving a group version kind, or an
+// UnknownKindError if the API server does not serve it. Subresources are never returned.
+// See: https://github.com/ksonnet/ksonnet/blob/master/utils/client.go
+func ServerResourceForGroupVersionKind(disco discovery.DiscoveryInterface, gvk schema.GroupVersionKind) (*metav1.APIResource, error) {
+	resources, err := disco.ServerResourcesForGroupVersion(gvk.GroupVersion().String())
+	if err != nil {
+		if apierr.IsNotFound(err) {
+			return nil, &UnknownKindError{GroupVersionKind: gvk}
+		}
+		return nil, err
+	}
+	for i := range resources.APIResources {
+		// copy the resource, so the result does not alias the discovery results
+		r := resources.APIResources[i]
+		if r.Kind == gvk.Kind {
+			log.Debugf("Chose API '%s' for %s", r.Name, gvk)
+			return &r, nil
+		}
+	}
+	return nil, &UnknownKindError{GroupVersionKind: gvk}
+}
+
+// PreferredVersionForGroup returns the version of an API group which is preferred by the API server
+func PreferredVersionForGroup(disco discovery.DiscoveryInterface, group string) (string, error) {
+	groups, err := disco.ServerGroups()
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	for _, g := range groups.Groups {
+		if g.Name != group {
+			continue
+		}
+		if g.PreferredVersion.Version != "" {
+			return g.PreferredVersion.Version, nil
+		}
+		if len(g.Versions) > 0 {
+			return g.Versions[0].Version, nil
+		}
+		return "", fmt.Errorf("API group '%s' does not serve any versions", group)
+	}
+	return "", fmt.Errorf("API group '%s' is not served by the server", group)
+}
+
+// ValidateNamespacing verifies the namespace of an object is consistent with the scope of its kind.
+// Namespaced objects must either specify a namespace, or have one supplied through defaultNamespace.
+// Cluster-scoped objects must not specify a namespace.
+func ValidateNamespacing(disco discovery.DiscoveryInterface, obj *unstructured.Unstructured, defaultNamespace string) error {
+	gvk := obj.GroupVersionKind()
+	groupResources, err := discovery.GetAPIGroupResources(disco)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	mapper := discovery.NewRESTMapper(groupResources, dynamic.VersionInterfaces)
+	mapping, err := mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	if err != nil {
+		return fmt.Errorf("Unable to determine scope of %s '%s': %v", gvk, obj.GetName(), err)
+	}
+	if mapping.Scope.Name() == meta.RESTScopeNameNamespace {
+		if obj.GetNamespace() == "" && defaultNamespace == "" {
+			return fmt.Errorf("%s '%s' is namespaced but no namespace was specified", gvk.Kind, obj.GetName())
+		}
+	} else if obj.GetNamespace() != "" {
+		return fmt.Errorf("%s '%s' is cluster-scoped but specifies namespace '%s'", gvk.Kind, obj.GetName(), obj.GetNamespace())
+	}
+	return nil
+}
+
+type listResult struct {
+	Items []*unstructured.Unstructured `json:"items"`
+}
+
+// ListResources returns a list of resources of a particular API type using the dynamic client. Unless
+// the list options set a timeout, DefaultListTimeout is requested, but since the API server does not end
+// plain lists after it, the request is only bounded by the timeout of the client's REST config.
+func ListResources(dclient dynamic.Interface, apiResource metav1.APIResource, namespace string, listOpts metav1.ListOptions) ([]*unstructured.Unstructured, error) {
+	reIf := dclient.Resource(&apiResource, namespace)
+	liveObjs, err := reIf.List(withListTimeout(listOpts))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	liveObjsBytes, err := json.Marshal(liveObjs)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	var objList listResult
+	err = json.Unmarshal(liveObjsBytes, &objList)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return objList.Items, nil
+}
+
+// listPageSize is the number of resources requested per page by ListResourcesPaged, unless the list
+// options set a limit
+const listPageSize = 500
+
+// ListResourcesPaged lists the resources of an API type a page at a time, and stops once maxItems
+// resources were collected, which bounds the memory used and the time spent on huge namespaces. The
+// returned flag reports whether the list was truncated. Pages are requested with the limit of the list
+// options, or listPageSize, but never larger than the number of resources still needed. A maxItems of
+// zero lists all resources.
+func ListResourcesPaged(dclient dynamic.Interface, apiResource metav1.APIResource, namespace string, listOpts metav1.ListOptions, maxItems int) ([]*unstructured.Unstructured, bool, error) {
+	items, _, truncated, err := listPaged(dclient.Resource(&apiResource, namespace), listOpts, maxItems)
+	return items, truncated, err
+}
+
+// listPaged lists resources a page at a time like ListResourcesPaged, and also returns the resource
+// version of the list. All pages of a list are served from the same snapshot, so this is the version
+// of the last page.
+func listPaged(reIf dynamic.ResourceInterface, listOpts metav1.ListOptions, maxItems int) ([]*unstructured.Unstructured, string, bool, error) {
+	listOpts = withListTimeout(listOpts)
+	pageSize := listOpts.Limit
+	if pageSize <= 0 {
+		pageSize = listPageSize
+	}
+	var items []*unstructured.Unstructured
+	for {
+		listOpts.Limit = pageSize
+		if remaining := int64(maxItems - len(items)); maxItems > 0 && remaining < pageSize {
+			listOpts.Limit = remaining
+		}
+		res, err := reIf.List(listOpts)
+		if err != nil {
+			return nil, "", false, errors.WithStack(err)
+		}
+		list, ok := res.(*unstructured.UnstructuredList)
+		if !ok {
+			return nil, "", false, fmt.Errorf("unexpected list type %T", res)
+		}
+		for i := range list.Items {
+			// servers which do not support paging ignore the limit and return all resources at once
+			if maxItems > 0 && len(items) == maxItems {
+				return items, list.GetResourceVersion(), true, nil
+			}
+			items = append(items, &list.Items[i])
+		}
+		if list.GetContinue() == "" {
+			return items, list.GetResourceVersion(), false, nil
+		}
+		if maxItems > 0 && len(items) >= maxItems {
+			return items, list.GetResourceVersion(), true, nil
+		}
+		listOpts.Continue = list.GetContinue()
+	}
+}
+
+// ListAllOpts are options for listing resources across many API types
+type ListAllOpts struct {
+	// Strict aborts listing on the first API type which fails to list. Otherwise, errors are aggregated
+	// and returned alongside the resources of all API types which were listed successfully.
+	Strict bool
+	// MaxItems caps the number of resources returned across all API types, which are then listed a page
+	// at a time. The resources first by key are kept. Zero returns all resources.
+	MaxItems int
+}
+
+// ListAllResources iterates the list of API resources, and returns all resources with the given filters.
+// Nil bulk options use DefaultBulkOptions. If opts.MaxItems is set, the resources may be truncated, which
+// ListAllResourcesPaged reports.
+func ListAllResources(config *rest.Config, apiResources []metav1.APIResource, namespace string, listOpts metav1.ListOptions, opts ListAllOpts, bulk *BulkOptions) ([]*unstructured.Unstructured, error) {
+	resources, _, err := ListAllResourcesPaged(config, apiResources, namespace, listOpts, opts, bulk)
+	return resources, err
+}
 
-	}
-	resources := make([]*unstructured.Unstructured, len(itemMap))
-	i := 0
-	for _, obj := range itemMap {
-		resources[i] = obj
-		i++
-	}
-	return resources, nil
-}
-
-// ApplyResource performs an apply of a unstructured resource
-func ApplyResource(config *rest.Config, obj *unstructured.Unstructured, namespace string) (*unstructured.Unstructured, error) {
+// ListAllResourcesPaged is ListAllResources, but additionally returns whether the resources were
+// truncated to opts.MaxItems
+func ListAllResourcesPaged(config *rest.Config, apiResources []metav1.APIResource, namespace string, listOpts metav1.ListOptions, opts ListAllOpts, bulk *BulkOptions) ([]*unstructured.Unstructured, bool, error) {
+	bulkOpts := bulk.withDefaults()
+	config = withWarningsLogged(bulkOpts.restConfig(config), "listing resources", bulkOpts.WarningHandler)
+	clientForResource := func(apiResource metav1.APIResource) (dynamic.Interface, error) {
+		dynConfig := *config
+		dynConfig.GroupVersion = &schema.GroupVersion{
+			Group:   apiResource.Group,
+			Version: apiResource.Kind,
+		}
+		return dynamic.NewClient(&dynConfig)
+	}
+	return listAllResources(clientForResource, apiResources, namespace, listOpts, opts, bulkOpts.MaxConcurrency)
+}
+
+func listAllResources(clientForResource func(metav1.APIResource) (dynamic.Interface, error), apiResources []metav1.APIResource, namespace string, listOpts metav1.ListOptions, opts ListAllOpts, maxConcurrency int) ([]*unstructured.Unstructured, bool, error) {
+	// itemMap dedups items when there is duplication of a resource in multiple API types
+	// e.g. extensions/v1beta1/namespaces/default/deployments and apps/v1/namespaces/default/deployments
+	itemMap := make(map[string]*unstructured.Unstructured)
+	var errs []error
+	var strictErr error
+	var truncated bool
+	var lock sync.Mutex
+
+	forEachConcurrently(len(apiResources), maxConcurrency, func(i int) {
+		apiResource := apiResources[i]
+		lock.Lock()
+		aborted := strictErr != nil
+		remaining := opts.MaxItems - len(itemMap)
+		if opts.MaxItems > 0 && remaining <= 0 {
+			truncated = true
+			aborted = true
+		}
+		lock.Unlock()
+		if aborted {
+			return
+		}
+		dclient, err := clientForResource(apiResource)
+		var resList []*unstructured.Unstructured
+		var resTruncated bool
+		if err == nil {
+			if opts.MaxItems > 0 {
+				resList, resTruncated, err = ListResourcesPaged(dclient, apiResource, namespace, listOpts, remaining)
+			} else {
+				resList, err = ListResources(dclient, apiResource, namespace, listOpts)
+			}
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		truncated = truncated || resTruncated
+		for _, liveObj := range resList {
+			itemMap[string(liveObj.GetUID())] = liveObj
+		}
+		if err != nil {
+			if opts.Strict {
+				if strictErr == nil {
+					strictErr = errors.WithStack(err)
+				}
+				return
+			}
+			log.Warnf("Failed to list %s/%s: %v", apiResource.Group, apiResource.Name, err)
+			errs = append(errs, fmt.Errorf("%s/%s: %v", apiResource.Group, apiResource.Name, err))
+		}
+	})
+	if strictErr != nil {
+		return nil, false, strictErr
+	}
+	resources := make([]*unstructured.Unstructured, len(itemMap))
+	i := 0
+	for _, obj := range itemMap {
+		resources[i] = obj
+		i++
+	}
+	// API types listed concurrently may together exceed the cap, and are sorted so the same resources
+	// are kept on every call
+	sort.Slice(resources, func(i, j int) bool {
+		keyI, keyJ := GetResourceKey(resources[i]).String(), GetResourceKey(resources[j]).String()
+		if keyI != keyJ {
+			return keyI < keyJ
+		}
+		return resources[i].GetUID() < resources[j].GetUID()
+	})
+	if opts.MaxItems > 0 && len(resources) > opts.MaxItems {
+		resources = resources[:opts.MaxItems]
+		truncated = true
+	}
+	return resources, truncated, utilerrors.NewAggregate(errs)
+}
+
+// ListResourcesInGroups lists all resources of the listable API types in the given API groups (e.g.
+// "apps" and "batch"), which is cheaper than listing every API type for focused queries. The core
+// group is the empty string. Subresources are never listed.
+func ListResourcesInGroups(config *rest.Config, groups []string, namespace string, listOpts metav1.ListOptions) ([]*unstructured.Unstructured, error) {
+	config = withWarningsLogged(config, "listing resources", nil)
+	dynClientPool := dynamic.NewDynamicClientPool(config)
+	disco, err := discovery.NewDiscoveryClientForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return listResourcesInGroups(dynClientPool, disco, groups, namespace, listOpts)
+}
+
+func listResourcesInGroups(dynClientPool dynamic.ClientPool, disco discovery.DiscoveryInterface, groups []string, namespace string, listOpts metav1.ListOptions) ([]*unstructured.Unstructured, error) {
+	groupSet := make(map[string]bool)
+	for _, group := range groups {
+		groupSet[group] = true
+	}
+	return listServedResources(dynClientPool, disco, func(gvk schema.GroupVersionKind) bool {
+		return groupSet[gvk.Group]
+	}, namespace, listOpts, DefaultBulkOptions.MaxConcurrency)
+}
+
+// listServedResources lists the resources of every API type discovery serves which supports listing,
+// and which include accepts (all of them if it is nil)
+func listServedResources(dynClientPool dynamic.ClientPool, disco discovery.DiscoveryInterface, include func(schema.GroupVersionKind) bool, namespace string, listOpts metav1.ListOptions, maxConcurrency int) ([]*unstructured.Unstructured, error) {
+	infos, err := APIResourcesSupportingVerb(disco, listVerb)
+	if err != nil {
+		return nil, err
+	}
+	apiResources := make([]metav1.APIResource, 0)
+	for _, info := range infos {
+		if include != nil && !include(info.GroupVersionKind) {
+			continue
+		}
+		// discovery leaves the group and version of resources empty when they match the group version
+		// they are listed under
+		apiResource := info.APIResource
+		apiResource.Group = info.GroupVersionKind.Group
+		apiResource.Version = info.GroupVersionKind.Version
+		apiResources = append(apiResources, apiResource)
+	}
+	clientForResource := func(apiResource metav1.APIResource) (dynamic.Interface, error) {
+		return dynClientPool.ClientForGroupVersionKind(schema.GroupVersionKind{
+			Group:   apiResource.Group,
+			Version: apiResource.Version,
+			Kind:    apiResource.Kind,
+		})
+	}
+	resources, _, err := listAllResources(clientForResource, apiResources, namespace, listOpts, ListAllOpts{}, maxConcurrency)
+	return resources, err
+}
+
+// ListManagedResources finds the resources in all namespaces, and the cluster scoped resources, which
+// carry the application instance label, and returns them keyed by the value of the label (the name of
+// the application). Nil bulk options use DefaultBulkOptions. As with ListAllResources, errors listing
+// individual API types are aggregated and returned alongside the resources which were listed.
+func ListManagedResources(config *rest.Config, appLabelKey string, bulk *BulkOptions) (map[string][]*unstructured.Unstructured, error) {
+	if err := ValidateLabelSelector(appLabelKey, ""); err != nil {
+		return nil, err
+	}
+	bulkOpts := bulk.withDefaults()
+	config = withWarningsLogged(bulkOpts.restConfig(config), "listing resources", bulkOpts.WarningHandler)
+	dynClientPool := dynamic.NewDynamicClientPool(config)
+	disco, err := bulkOpts.discovery(config)
+	if err != nil {
+		return nil, err
+	}
+	return listManagedResources(dynClientPool, disco, appLabelKey, bulkOpts.MaxConcurrency)
+}
+
+func listManagedResources(dynClientPool dynamic.ClientPool, disco discovery.DiscoveryInterface, appLabelKey string, maxConcurrency int) (map[string][]*unstructured.Unstructured, error) {
+	// the selector only requires the label to exist, listing the resources of all applications at once
+	listOpts := metav1.ListOptions{LabelSelector: appLabelKey}
+	objs, err := listServedResources(dynClientPool, disco, nil, "", listOpts, maxConcurrency)
+	resourcesByApp := make(map[string][]*unstructured.Unstructured)
+	for _, obj := range objs {
+		if appName, ok := obj.GetLabels()[appLabelKey]; ok {
+			resourcesByApp[appName] = append(resourcesByApp[appName], obj)
+		}
+	}
+	return resourcesByApp, err
+}
+
+// FindOrphanedResources finds the resources carrying the application instance label whose application
+// is not one of the known applications, which are typically left over from applications deleted
+// without pruning. The resources are returned keyed by the name of their stale application. The
+// application of a resource is the one IsTracked reports for the tracking method and the label, or the
+// value of the label if it reports none. With the annotation tracking methods, resources which are not tracked by
+// an application are not orphans, even though they carry the label.
+func FindOrphanedResources(config *rest.Config, appLabelKey string, knownApps []string, trackingMethod string, bulk *BulkOptions) (map[string][]*unstructured.Unstructured, error) {
+	if err := ValidateLabelSelector(appLabelKey, ""); err != nil {
+		return nil, err
+	}
+	bulkOpts := bulk.withDefaults()
+	config = withWarningsLogged(bulkOpts.restConfig(config), "listing resources", bulkOpts.WarningHandler)
+	dynClientPool := dynamic.NewDynamicClientPool(config)
+	disco, err := bulkOpts.discovery(config)
+	if err != nil {
+		return nil, err
+	}
+	return findOrphanedResources(dynClientPool, disco, appLabelKey, knownApps, trackingMethod, bulkOpts.MaxConcurrency)
+}
+
+func findOrphanedResources(dynClientPool dynamic.ClientPool, disco discovery.DiscoveryInterface, appLabelKey string, knownApps []string, trackingMethod string, maxConcurrency int) (map[string][]*unstructured.Unstructured, error) {
+	labeledByApp, err := listManagedResources(dynClientPool, disco, appLabelKey, maxConcurrency)
+	if labeledByApp == nil {
+		return nil, err
+	}
+	resourcesByApp := make(map[string][]*unstructured.Unstructured)
+	for labelApp, objs := range labeledByApp {
+		for _, obj := range objs {
+			appName := labelApp
+			if tracked, trackedApp := IsTracked(obj, trackingMethod, appLabelKey); tracked {
+				appName = trackedApp
+			} else if usesTrackingAnnotation(trackingMethod) {
+				continue
+			}
+			resourcesByApp[appName] = append(resourcesByApp[appName], obj)
+		}
+	}
+	for _, app := range knownApps {
+		delete(resourcesByApp, app)
+	}
+	return resourcesByApp, err
+}
+
+// ApplyOpts are options for applying resources
+type ApplyOpts struct {
+	// CreateNamespace creates the target namespace of namespaced objects if it does not yet exist
+	CreateNamespace bool
+	// NamespaceLabels are the labels set on a namespace created by CreateNamespace
+	NamespaceLabels map[string]string
+	// NamespaceAnnotations are the annotations set on a namespace created by CreateNamespace
+	NamespaceAnnotations map[string]string
+	// SyncRevision, if set, is recorded in an annotation of the applied object
+	SyncRevision string
+	// SyncTimestamp records the time of the apply in an annotation of the applied object
+	SyncTimestamp bool
+	// AppInstance, if set, records that the applied object is tracked by the application, so pruning
+	// can verify the object still belongs to the application. See SetTrackingID.
+	AppInstance string
+	// TrackingMethod is how AppInstance is recorded, one of the TrackingMethod constants. Defaults to
+	// TrackingMethodLabel.
+	TrackingMethod string
+	// AnnotationFilter lists prefixes of annotation keys which are removed from the object before it is
+	// applied, so applies do not fight other tools over operational annotations. See DefaultAnnotationFilter.
+	AnnotationFilter []string
+	// ServerSide applies the object using server-side apply, which tracks the owner (field manager) of
+	// every field on the API server instead of in the last-applied-configuration annotation
+	ServerSide bool
+	// ForceConflicts takes ownership of fields which are owned by other field managers when applying
+	// server-side. This silently overwrites changes made by other controllers or users (e.g. a replica
+	// count managed by an autoscaler), so it should only be set when the user explicitly opts in.
+	// Without it, an apply which conflicts with another manager fails with an ApplyConflictError.
+	// Ignored unless ServerSide is set.
+	ForceConflicts bool
+	// KubeconfigPath, if set, has kubectl connect to the cluster using this kubeconfig file rather than
+	// flags derived from the REST config, which cannot represent every kubeconfig (e.g. exec plugins).
+	// A kubeconfig generated by GenerateKubeconfig may be shared by applies to several clusters.
+	KubeconfigPath string
+	// KubeContext is the context of the kubeconfig file to use. Defaults to the current context.
+	KubeContext string
+	// Subresource, if set, applies only the given subresource of the object (e.g. "status"), so that
+	// controllers can update the status of objects declaratively. The rest of the object is ignored.
+	// Requires ServerSide, Kubernetes and kubectl 1.24 or newer, and is only supported when applying with
+	// kubectl.
+	Subresource string
+	// KindPriorities is the order in which ApplyManifests applies objects by kind. Defaults to
+	// DefaultKindPriorities.
+	KindPriorities KindPriorities
+	// Preflight has ApplyManifests verify the user is permitted to create and update every kind of
+	// object before applying any of them
+	Preflight bool
+	// RecreateOnImmutable deletes and recreates an object whose apply fails because it changes immutable
+	// fields. Kinds whose deletion loses data (see DataLossKinds) are not recreated unless
+	// AllowDataLoss is also set. Server-side applies are never recreated, since the recreated object
+	// would not be owned by the field manager of the apply.
+	RecreateOnImmutable bool
+	// ConfirmRecreate, if set, is called before an object is deleted to be recreated, and the object is
+	// only recreated if it returns true
+	ConfirmRecreate func(obj *unstructured.Unstructured) bool
+	// AllowDataLoss permits RecreateOnImmutable to recreate kinds listed in DataLossKinds
+	AllowDataLoss bool
+	// RecordEvents records the outcome of applying an object as a Kubernetes event on the object
+	RecordEvents bool
+	// ExcludeHelmTests has ApplyManifests skip the Helm test hooks rendered by `helm template`, which
+	// are run by `helm test` rather than installed with the release
+	ExcludeHelmTests bool
+	// WarningHandler, if set, receives the warnings returned by the API server while applying an object
+	// in-process (see ApplyResourceNative), such as the deprecation warnings of APIs scheduled for
+	// removal. Warnings are logged either way.
+	WarningHandler WarningHandler
+}
+
+// DataLossKinds are the kinds whose deletion deletes the data they hold, which are therefore not
+// recreated by RecreateOnImmutable unless explicitly allowed
+var DataLossKinds = []schema.GroupKind{
+	{Kind: "PersistentVolumeClaim"},
+	{Kind: "PersistentVolume"},
+}
+
+// runKubectl executes kubectl with the given arguments, feeding stdin to the process, and returns
+// its output. It is declared as a variable so it can be substituted in tests.
+var runKubectl = func(args []string, stdin []byte) ([]byte, error) {
+	cmd := exec.Command("kubectl", args...)
+	cmd.Env = kubectlEnv(os.Environ())
+	return runCommand(cmd, stdin)
+}
+
+// kubectlMinVersion is the oldest minor version of kubectl 1.x which supports the flags used to apply
+// resources
+const kubectlMinVersion = 9
+
+// CanApplyViaKubectl verifies that kubectl is installed, can be run, and is recent enough to apply
+// resources, so a missing or outdated kubectl is reported when starting up rather than on the first
+// sync. The returned error explains how to fix the problem.
+func CanApplyViaKubectl() error {
+	clientVersion, major, minor, err := kubectlClientVersion()
+	if err != nil {
+		return err
+	}
+	if !isAtLeastVersion(major, minor, kubectlMinVersion) {
+		return fmt.Errorf("kubectl %s is not supported: upgrade kubectl to 1.%d or newer", clientVersion.GitVersion, kubectlMinVersion)
+	}
+	return nil
+}
+
+// kubectlClientVersion returns the version of kubectl, along with its major and minor version
+func kubectlClientVersion() (*version.Info, int, int, error) {
+	out, err := runKubectl([]string{"version", "--client", "-o", "json"}, nil)
+	if err != nil {
+		if execErr, ok := err.(*exec.Error); ok && execErr.Err == exec.ErrNotFound {
+			return nil, 0, 0, fmt.Errorf("kubectl was not found in PATH: install kubectl 1.%d or newer, or use the native apply", kubectlMinVersion)
+		}
+		return nil, 0, 0, fmt.Errorf("failed to run kubectl: %v", err)
+	}
+	var versions struct {
+		ClientVersion *version.Info `json:"clientVersion"`
+	}
+	if err = json.Unmarshal(out, &versions); err != nil || versions.ClientVersion == nil {
+		return nil, 0, 0, fmt.Errorf("failed to determine the version of kubectl from its output: %s", strings.TrimSpace(string(out)))
+	}
+	major, minor, err := parseServerVersion(versions.ClientVersion)
+	if err != nil {
+		return nil, 0, 0, fmt.Errorf("failed to determine the version of kubectl: %v", err)
+	}
+	return versions.ClientVersion, major, minor, nil
+}
+
+// runCommand runs a command, feeding stdin to the process, and returns its standard output. If the
+// command fails, its standard error is returned as the error. Both outputs are collected into buffers
+// while the command runs, so it can not block on a full pipe however much it writes to either.
+func runCommand(cmd *exec.Cmd, stdin []byte) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd.Stdin = bytes.NewReader(stdin)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		if _, ok := err.(*exec.ExitError); ok {
+			return nil, errors.New(stderr.String())
+		}
+		return nil, err
+	}
+	return stdout.Bytes(), nil
+}
+
+// kubectlEnv returns the environment to run kubectl with. The locale is forced to C, since the output
+// of kubectl is matched against English messages and must not be localized.
+func kubectlEnv(environ []string) []string {
+	env := make([]string, 0, len(environ)+2)
+	for _, variable := range environ {
+		if strings.HasPrefix(variable, "LANG=") || strings.HasPrefix(variable, "LC_ALL=") {
+			continue
+		}
+		env = append(env, variable)
+	}
+	return append(env, "LANG=C", "LC_ALL=C")
+}
+
+// webhookRetryBackoff is the backoff of retrying an apply which failed because an admission webhook
+// could not be called, which is usually transient while the webhook is being rolled out
+var webhookRetryBackoff = wait.Backoff{
+	Steps:    5,
+	Duration: 1 * time.Second,
+	Factor:   2,
+	Jitter:   0.1,
+}
+
+// ApplyResource performs an apply of a unstructured resource. If opts.KubeconfigPath is set, the config
+// may be nil, in which case it is loaded from the kubeconfig file.
+func ApplyResource(config *rest.Config, obj *unstructured.Unstructured, namespace string, opts ApplyOpts) (*unstructured.Unstructured, error) {
+	config, err := applyConfig(config, opts)
+	if err != nil {
+		return nil, err
+	}
+	kubeclientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return applyResource(kubeclientset, config, obj, namespace, opts)
+}
+
+// ApplyResourceToNamespace applies an object to the given namespace, overriding the namespace in its
+// metadata, so the same manifests can be deployed to several namespaces. The caller's object is not
+// modified, and the namespace is ignored for cluster scoped objects.
+func ApplyResourceToNamespace(config *rest.Config, obj *unstructured.Unstructured, namespace string, opts ApplyOpts) (*unstructured.Unstructured, error) {
+	config, err := applyConfig(config, opts)
+	if err != nil {
+		return nil, err
+	}
+	kubeclientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return applyResourceToNamespace(kubeclientset, config, obj, namespace, opts)
+}
+
+func applyResourceToNamespace(kubeclientset kubernetes.Interface, config *rest.Config, obj *unstructured.Unstructured, namespace string, opts ApplyOpts) (*unstructured.Unstructured, error) {
+	apiResource, err := ServerResourceForGroupVersionKind(kubeclientset.Discovery(), obj.GroupVersionKind())
+	if err != nil {
+		return nil, err
+	}
+	obj = obj.DeepCopy()
+	if apiResource.Namespaced {
+		obj.SetNamespace(namespace)
+	}
+	return applyResource(kubeclientset, config, obj, namespace, opts)
+}
+
+// applyConfig returns the REST config to apply with, loading it from opts.KubeconfigPath if it is nil
+func applyConfig(config *rest.Config, opts ApplyOpts) (*rest.Config, error) {
+	if config != nil || opts.KubeconfigPath == "" {
+		return config, nil
+	}
+	return clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+		&clientcmd.ClientConfigLoadingRules{ExplicitPath: opts.KubeconfigPath},
+		&clientcmd.ConfigOverrides{CurrentContext: opts.KubeContext},
+	).ClientConfig()
+}
+
+func applyResource(kubeclientset kubernetes.Interface, config *rest.Config, obj *unstructured.Unstructured, namespace string, opts ApplyOpts) (*unstructured.Unstructured, error) {
+	liveObj, err := applyResourceWithKubectl(kubeclientset, config, obj, namespace, opts)
+	if opts.RecordEvents {
+		recordApplyEvent(kubeclientset, obj, liveObj, namespace, err)
+	}
+	return liveObj, err
+}
+
+func applyResourceWithKubectl(kubeclientset kubernetes.Interface, config *rest.Config, obj *unstructured.Unstructured, namespace string, opts ApplyOpts) (*unstructured.Unstructured, error) {
 	log.Infof("Applying resource %s/%s in cluster: %s, namespace: %s", obj.GetKind(), obj.GetName(), config.Host, namespace)
-	cmdArgs, err := formulateKubectlOptions(config)
+	if opts.CreateNamespace {
+		err := ensureNamespace(kubeclientset, obj, namespace, opts)
+		if err != nil {
+			return nil, err
+		}
+	}
+	cmdArgs, err := kubectlConnectionArgs(config, opts)
 	if err != nil {
 		return nil, err
 	}
-	manifestBytes, err := json.Marshal(obj)
+	decorated, err := decorateForSync(kubeclientset.Discovery(), obj, namespace, opts)
 	if err != nil {
 		return nil, err
 	}
-	cmdArgs = append(cmdArgs, "-n", namespace, "apply", "-o", "json", "-f", "-")
-	cmd := exec.Command("kubectl", cmdArgs...)
-	cmd.Stdin = bytes.NewReader(manifestBytes)
-	out, err := cmd.Output()
+	manifestBytes, err := json.Marshal(decorated)
 	if err != nil {
-		exErr := err.(*exec.ExitError)
-		return nil, fmt.Errorf("failed to apply '%s': %s", obj.GetName(), exErr.Stderr)
+		return nil, err
+	}
+	applyArgs, err := kubectlApplyArgs(kubeclientset.Discovery(), config.Host, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to apply '%s': %v", obj.GetName(), err)
+	}
+	applyCmd := append(append(cmdArgs, "-n", namespace), append(applyArgs, "-o", "json", "-f", "-")...)
+	var out []byte
+	// the condition never fails, so the backoff only ends early once the apply did not hit an unavailable
+	// webhook, and err holds the outcome of the last attempt either way
+	_ = wait.ExponentialBackoff(webhookRetryBackoff, func() (bool, error) {
+		out, err = runKubectl(applyCmd, manifestBytes)
+		if err != nil && IsWebhookError(err) {
+			log.Warnf("Failed to apply %s/%s due to an unavailable admission webhook: %v", obj.GetKind(), obj.GetName(), err)
+			return false, nil
+		}
+		return true, nil
+	})
+	if err != nil && isAnnotationTooLong(err.Error()) {
+		// kubectl apply stores the entire object in the last-applied-configuration annotation, which
+		// is not possible for very large objects. Fall back to replacing (or creating) the object.
+		log.Warnf("Object %s/%s is too large to apply, falling back to replace: %v", obj.GetKind(), obj.GetName(), err)
+		out, err = runKubectl(append(cmdArgs, "-n", namespace, "replace", "-o", "json", "-f", "-"), manifestBytes)
+		if err != nil && isNotFoundOutput(err.Error()) {
+			out, err = runKubectl(append(cmdArgs, "-n", namespace, "create", "-o", "json", "-f", "-"), manifestBytes)
+		}
+	}
+	if err != nil && opts.RecreateOnImmutable && !opts.ServerSide && IsImmutableKubectlOutput(err.Error()) {
+		if recreateErr := canRecreate(obj, opts); recreateErr != nil {
+			log.Warnf("Not recreating %s/%s: %v", obj.GetKind(), obj.GetName(), recreateErr)
+			return nil, &ApplyError{Category: ApplyErrorImmutable, Err: fmt.Errorf("failed to apply '%s': %s: %v", obj.GetName(), err, recreateErr)}
+		}
+		log.Warnf("Object %s/%s changes immutable fields, recreating it: %v", obj.GetKind(), obj.GetName(), err)
+		// the last applied configuration is saved, so the recreated object can be applied again
+		out, err = runKubectl(append(cmdArgs, "-n", namespace, "replace", "--force", "--save-config", "-o", "json", "-f", "-"), manifestBytes)
+	}
+	if err != nil {
+		applyErr := fmt.Errorf("failed to apply '%s': %s", obj.GetName(), err)
+		category := ClassifyApplyError(err)
+		if isServiceUnavailable(err) || IsWebhookError(err) {
+			return nil, &ApplyError{Category: category, Err: &RetryableError{Err: applyErr}}
+		}
+		if conflicts, ok := parseApplyConflicts(err.Error()); ok {
+			return nil, &ApplyError{Category: category, Err: &ApplyConflictError{Conflicts: conflicts, Err: applyErr}}
+		}
+		if kind, name, violations, ok := parseSchemaViolations(err.Error()); ok {
+			return nil, &ApplyError{Category: ApplyErrorValidation, Err: &SchemaValidationError{Kind: kind, Name: name, Violations: violations, Err: applyErr}}
+		}
+		return nil, &ApplyError{Category: category, Err: applyErr}
 	}
 	var liveObj unstructured.Unstructured
 	err = json.Unmarshal(out, &liveObj)
@@ -453,6 +1531,233 @@ func ApplyResource(config *rest.Config, obj *unstructured.Unstructured, namespac
 	return &liveObj, nil
 }
 
+// canRecreate returns an error explaining why an object must not be deleted and recreated, or nil if it
+// may be
+func canRecreate(obj *unstructured.Unstructured, opts ApplyOpts) error {
+	gk := obj.GroupVersionKind().GroupKind()
+	for _, dataLossKind := range DataLossKinds {
+		if gk == dataLossKind && !opts.AllowDataLoss {
+			return fmt.Errorf("deleting %s '%s' would lose its data", gk.Kind, obj.GetName())
+		}
+	}
+	if opts.ConfirmRecreate != nil && !opts.ConfirmRecreate(obj) {
+		return fmt.Errorf("recreating %s '%s' was not confirmed", gk.Kind, obj.GetName())
+	}
+	return nil
+}
+
+// kubectlApplyArgs returns the kubectl apply command and its flags for the options, verifying the server
+// supports server-side apply, and the server and kubectl support applying subresources, if requested.
+// The version of the server is requested once per cluster, rather than for every applied object.
+func kubectlApplyArgs(disco discovery.DiscoveryInterface, cluster string, opts ApplyOpts) ([]string, error) {
+	applyArgs := []string{"apply"}
+	if opts.ServerSide {
+		serverVersion, err := defaultServerVersionCache.get(disco, cluster)
+		if err != nil {
+			return nil, err
+		}
+		major, minor, err := parseServerVersion(serverVersion)
+		if err != nil {
+			return nil, err
+		}
+		if !isAtLeastVersion(major, minor, serverSideApplyMinVersion) {
+			return nil, fmt.Errorf("server-side apply requires Kubernetes 1.%d or newer", serverSideApplyMinVersion)
+		}
+		applyArgs = append(applyArgs, "--server-side")
+		if opts.ForceConflicts {
+			applyArgs = append(applyArgs, "--force-conflicts")
+		}
+	}
+	if opts.Subresource != "" {
+		// kubectl rejects --subresource without --server-side
+		if !opts.ServerSide {
+			return nil, fmt.Errorf("applying the %s subresource requires server-side apply", opts.Subresource)
+		}
+		serverVersion, err := defaultServerVersionCache.get(disco, cluster)
+		if err != nil {
+			return nil, err
+		}
+		major, minor, err := parseServerVersion(serverVersion)
+		if err != nil {
+			return nil, err
+		}
+		if !isAtLeastVersion(major, minor, subresourceApplyMinVersion) {
+			return nil, fmt.Errorf("applying the %s subresource requires Kubernetes 1.%d or newer", opts.Subresource, subresourceApplyMinVersion)
+		}
+		clientVersion, major, minor, err := kubectlClientVersion()
+		if err != nil {
+			return nil, err
+		}
+		if !isAtLeastVersion(major, minor, subresourceApplyMinVersion) {
+			return nil, fmt.Errorf("applying the %s subresource requires kubectl 1.%d or newer, kubectl is %s", opts.Subresource, subresourceApplyMinVersion, clientVersion.GitVersion)
+		}
+		applyArgs = append(applyArgs, "--subresource", opts.Subresource)
+	}
+	return applyArgs, nil
+}
+
+// kubectlConnectionArgs returns the kubectl flags used to connect to the cluster
+func kubectlConnectionArgs(config *rest.Config, opts ApplyOpts) ([]string, error) {
+	if opts.KubeconfigPath == "" {
+		return formulateKubectlOptions(config)
+	}
+	args := []string{"--kubeconfig", opts.KubeconfigPath}
+	if opts.KubeContext != "" {
+		args = append(args, "--context", opts.KubeContext)
+	}
+	return args, nil
+}
+
+// serverSideApplyMinVersion is the minor version of Kubernetes 1.x in which server-side apply became
+// generally available
+const serverSideApplyMinVersion = 16
+
+// subresourceApplyMinVersion is the minor version of Kubernetes 1.x from which kubectl can apply a
+// subresource of an object
+const subresourceApplyMinVersion = 24
+
+// SupportsServerSideApply returns whether the API server supports server-side apply, based on its version
+func SupportsServerSideApply(config *rest.Config) (bool, error) {
+	disco, err := discovery.NewDiscoveryClientForConfig(config)
+	if err != nil {
+		return false, err
+	}
+	return supportsServerSideApply(disco)
+}
+
+func supportsServerSideApply(disco discovery.DiscoveryInterface) (bool, error) {
+	return isServerAtLeastVersion(disco, serverSideApplyMinVersion)
+}
+
+// isServerAtLeastVersion returns whether the API server is Kubernetes 1.minMinor or newer
+func isServerAtLeastVersion(disco discovery.DiscoveryInterface, minMinor int) (bool, error) {
+	serverVersion, err := disco.ServerVersion()
+	if err != nil {
+		return false, err
+	}
+	major, minor, err := parseServerVersion(serverVersion)
+	if err != nil {
+		return false, err
+	}
+	return isAtLeastVersion(major, minor, minMinor), nil
+}
+
+// serverVersionTTL is the time for which the version of a server is cached
+const serverVersionTTL = 10 * time.Minute
+
+// serverVersionCache holds the versions of API servers by their host, so applying every object of a sync
+// does not request the version again
+type serverVersionCache struct {
+	lock     sync.Mutex
+	versions map[string]cachedServerVersion
+}
+
+type cachedServerVersion struct {
+	info    *version.Info
+	expires time.Time
+}
+
+func newServerVersionCache() *serverVersionCache {
+	return &serverVersionCache{versions: make(map[string]cachedServerVersion)}
+}
+
+// get returns the cached version of the server of a cluster, requesting it from discovery if it is not
+// cached or has expired
+func (c *serverVersionCache) get(disco discovery.DiscoveryInterface, cluster string) (*version.Info, error) {
+	c.lock.Lock()
+	cached, ok := c.versions[cluster]
+	c.lock.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.info, nil
+	}
+	info, err := disco.ServerVersion()
+	if err != nil {
+		return nil, err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.versions[cluster] = cachedServerVersion{info: info, expires: time.Now().Add(serverVersionTTL)}
+	return info, nil
+}
+
+var defaultServerVersionCache = newServerVersionCache()
+
+// isAtLeastVersion returns whether a server version is at least version 1.minMinor
+func isAtLeastVersion(major int, minor int, minMinor int) bool {
+	return major > 1 || (major == 1 && minor >= minMinor)
+}
+
+// parseServerVersion returns the major and minor version of the API server. Managed clusters report
+// minor versions such as "16+", so any suffix is ignored. The version is parsed from the git version
+// (e.g. "v1.16.3") if the major or minor version is not reported at all.
+func parseServerVersion(info *version.Info) (int, int, error) {
+	majorStr, minorStr := info.Major, info.Minor
+	if majorStr == "" || minorStr == "" {
+		parts := strings.SplitN(strings.TrimPrefix(info.GitVersion, "v"), ".", 3)
+		if len(parts) < 2 {
+			return 0, 0, fmt.Errorf("failed to parse server version '%s'", info.GitVersion)
+		}
+		majorStr, minorStr = parts[0], parts[1]
+	}
+	major, err := strconv.Atoi(strings.TrimRight(majorStr, "+"))
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to parse server major version '%s'", majorStr)
+	}
+	minor, err := strconv.Atoi(strings.TrimRight(minorStr, "+"))
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to parse server minor version '%s'", minorStr)
+	}
+	return major, minor, nil
+}
+
+// isAnnotationTooLong returns whether kubectl output indicates the total size of an object's
+// annotations exceeded the limit enforced by the API server
+func isAnnotationTooLong(output string) bool {
+	return strings.Contains(output, "metadata.annotations: Too long")
+}
+
+// isNotFoundOutput returns whether kubectl output indicates an object does not exist
+func isNotFoundOutput(output string) bool {
+	return strings.Contains(output, "(NotFound)")
+}
+
+// ensureNamespace creates the namespace an object will be applied into, if the object is namespaced
+// and the namespace does not exist. Cluster-scoped objects are ignored.
+func ensureNamespace(kubeclientset kubernetes.Interface, obj *unstructured.Unstructured, namespace string, opts ApplyOpts) error {
+	apiResource, err := ServerResourceForGroupVersionKind(kubeclientset.Discovery(), obj.GroupVersionKind())
+	if err != nil {
+		return err
+	}
+	if !apiResource.Namespaced {
+		return nil
+	}
+	if obj.GetNamespace() != "" {
+		namespace = obj.GetNamespace()
+	}
+	if namespace == "" {
+		return nil
+	}
+	_, err = kubeclientset.CoreV1().Namespaces().Get(namespace, metav1.GetOptions{})
+	if err == nil {
+		return nil
+	}
+	if !apierr.IsNotFound(err) {
+		return errors.WithStack(err)
+	}
+	log.Infof("Creating namespace %s", namespace)
+	_, err = kubeclientset.CoreV1().Namespaces().Create(&apiv1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        namespace,
+			Labels:      opts.NamespaceLabels,
+			Annotations: opts.NamespaceAnnotations,
+		},
+	})
+	if err != nil && !apierr.IsAlreadyExists(err) {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
 func writeTempFile(prefix string, data []byte) (string, error) {
 	f, err := ioutil.TempFile(kubectlTempDir, prefix)
 	if err != nil {
@@ -508,26 +1813,23 @@ func formulateKubectlOptions(config *rest.Config) ([]string, error) {
 // (i.e. CAData, CertData, KeyData). It then creates them as temporary local files (which can
 // later be used as arguments to a kubectl command), and updates the config with paths.
 func GenerateTLSFiles(config *rest.Config) error {
-	var host string
-	if serverURL, err := url.Parse(config.Host); err != nil {
-		host = serverURL.Host
-	}
+	prefix := tlsFilePrefix(config)
 	if len(config.TLSClientConfig.CAData) > 0 && config.TLSClientConfig.CAFile == "" {
-		fileName, err := writeTempFile(fmt.Sprintf("%s-ca.crt-", host), config.TLSClientConfig.CAData)
+		fileName, err := writeTempFile(prefix+"ca.crt-", config.TLSClientConfig.CAData)
 		if err != nil {
 			return err
 		}
 		config.TLSClientConfig.CAFile = fileName
 	}
 	if len(config.TLSClientConfig.CertData) > 0 && config.TLSClientConfig.CertFile == "" {
-		fileName, err := writeTempFile(fmt.Sprintf("%s-client.crt-", host), config.TLSClientConfig.CertData)
+		fileName, err := writeTempFile(prefix+"client.crt-", config.TLSClientConfig.CertData)
 		if err != nil {
 			return err
 		}
 		config.TLSClientConfig.CertFile = fileName
 	}
 	if len(config.TLSClientConfig.KeyData) > 0 && config.TLSClientConfig.KeyFile == "" {
-		fileName, err := writeTempFile(fmt.Sprintf("%s-client.key-", host), config.TLSClientConfig.KeyData)
+		fileName, err := writeTempFile(prefix+"client.key-", config.TLSClientConfig.KeyData)
 		if err != nil {
 			return err
 		}
@@ -536,6 +1838,20 @@ func GenerateTLSFiles(config *rest.Config) error {
 	return nil
 }
 
+// tlsFilePrefix returns the prefix of the names of the TLS files generated for a config. It includes
+// the server host and a short hash of the CA and client certificate, so the files of different
+// clusters (or different users of the same cluster) can be told apart on disk.
+func tlsFilePrefix(config *rest.Config) string {
+	var host string
+	if serverURL, err := url.Parse(config.Host); err == nil {
+		host = serverURL.Host
+	}
+	hash := sha256.New()
+	_, _ = hash.Write(config.TLSClientConfig.CAData)
+	_, _ = hash.Write(config.TLSClientConfig.CertData)
+	return fmt.Sprintf("%s-%x-", host, hash.Sum(nil)[:4])
+}
+
 func deleteFile(path string) error {
 	if _, err := os.Stat(path); os.IsNotExist(err) {
 		return nil
@@ -1,23 +1,45 @@
 package kube
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/argoproj/argo-cd/common"
 	argoappv1 "github.com/argoproj/argo-cd/pkg/apis/application/v1alpha1"
 	"github.com/argoproj/argo-cd/test"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	appsv1beta1 "k8s.io/api/apps/v1beta1"
 	appsv1beta2 "k8s.io/api/apps/v1beta2"
 	apiv1 "k8s.io/api/core/v1"
 	extv1beta1 "k8s.io/api/extensions/v1beta1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	apierr "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/version"
+	"k8s.io/apimachinery/pkg/watch"
 	fakediscovery "k8s.io/client-go/discovery/fake"
+	"k8s.io/client-go/dynamic"
 	fakedynamic "k8s.io/client-go/dynamic/fake"
 	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
 	kubetesting "k8s.io/client-go/testing"
 )
 
@@ -62,6 +84,16 @@ func resourceList() []*metav1.APIResourceList {
 	}
 }
 
+// clusterScopedResourceList returns the resources of resourceList along with a cluster scoped kind
+func clusterScopedResourceList() []*metav1.APIResourceList {
+	return append(resourceList(), &metav1.APIResourceList{
+		GroupVersion: rbacv1.SchemeGroupVersion.String(),
+		APIResources: []metav1.APIResource{
+			{Name: "clusterroles", Namespaced: false, Kind: "ClusterRole"},
+		},
+	})
+}
+
 func TestListAPIResources(t *testing.T) {
 	kubeclientset := fake.NewSimpleClientset(test.DemoService(), test.DemoDeployment())
 	fakeDiscovery, ok := kubeclientset.Discovery().(*fakediscovery.FakeDiscovery)
@@ -96,6 +128,36 @@ func TestGetLiveResource(t *testing.T) {
 	assert.Equal(t, uObj.GetName(), liveObj.GetName())
 }
 
+func TestVerifyResourceVersion(t *testing.T) {
+	live := MustToUnstructured(test.DemoService())
+	live.SetResourceVersion("10")
+	fakeDynClient := fakedynamic.FakeClient{
+		Fake: &kubetesting.Fake{},
+	}
+	fakeDynClient.Fake.AddReactor("get", "*", func(action kubetesting.Action) (handled bool, ret runtime.Object, err error) {
+		if live == nil {
+			return true, nil, apierr.NewNotFound(schema.GroupResource{Resource: "services"}, action.(kubetesting.GetAction).GetName())
+		}
+		return true, live.DeepCopy(), nil
+	})
+	apiResource := &metav1.APIResource{Name: "services", Namespaced: true, Kind: "Service"}
+
+	obj := live.DeepCopy()
+	assert.Nil(t, VerifyResourceVersion(&fakeDynClient, obj, apiResource, test.TestNamespace))
+
+	// the object was modified by someone else since it was read
+	live.SetResourceVersion("11")
+	err := VerifyResourceVersion(&fakeDynClient, obj, apiResource, test.TestNamespace)
+	assert.True(t, IsStaleObjectError(err))
+	assert.Equal(t, "11", err.(*StaleObjectError).LiveResourceVersion)
+	assert.Contains(t, err.Error(), "is stale")
+
+	live = nil
+	err = VerifyResourceVersion(&fakeDynClient, obj, apiResource, test.TestNamespace)
+	assert.True(t, IsStaleObjectError(err))
+	assert.Contains(t, err.Error(), "was deleted")
+}
+
 func TestListResources(t *testing.T) {
 	kubeclientset := fake.NewSimpleClientset(test.DemoService(), test.DemoDeployment())
 	fakeDynClient := fakedynamic.FakeClient{
@@ -124,3 +186,1393 @@ func TestListResources(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, 1, len(resList))
 }
+
+func TestValidateNamespacing(t *testing.T) {
+	kubeclientset := fake.NewSimpleClientset()
+	fakeDiscovery, ok := kubeclientset.Discovery().(*fakediscovery.FakeDiscovery)
+	assert.True(t, ok)
+	fakeDiscovery.Fake.Resources = clusterScopedResourceList()
+
+	svc := MustToUnstructured(test.DemoService())
+	assert.Nil(t, ValidateNamespacing(fakeDiscovery, svc, ""))
+
+	svc.SetNamespace("")
+	err := ValidateNamespacing(fakeDiscovery, svc, "")
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "no namespace was specified")
+	assert.Nil(t, ValidateNamespacing(fakeDiscovery, svc, test.TestNamespace))
+
+	clusterRole := MustToUnstructured(&rbacv1.ClusterRole{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "rbac.authorization.k8s.io/v1", Kind: "ClusterRole"},
+		ObjectMeta: metav1.ObjectMeta{Name: "demo"},
+	})
+	assert.Nil(t, ValidateNamespacing(fakeDiscovery, clusterRole, test.TestNamespace))
+
+	clusterRole.SetNamespace(test.TestNamespace)
+	err = ValidateNamespacing(fakeDiscovery, clusterRole, "")
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "is cluster-scoped")
+}
+
+func TestApplyResourceCreateNamespace(t *testing.T) {
+	kubeclientset := fake.NewSimpleClientset()
+	fakeDiscovery, ok := kubeclientset.Discovery().(*fakediscovery.FakeDiscovery)
+	assert.True(t, ok)
+	fakeDiscovery.Fake.Resources = resourceList()
+
+	defer func(orig func([]string, []byte) ([]byte, error)) { runKubectl = orig }(runKubectl)
+	runKubectl = func(args []string, stdin []byte) ([]byte, error) {
+		// the namespace must exist by the time kubectl is invoked
+		ns, err := kubeclientset.CoreV1().Namespaces().Get(test.TestNamespace, metav1.GetOptions{})
+		assert.Nil(t, err)
+		assert.Equal(t, "bar", ns.Labels["foo"])
+		return stdin, nil
+	}
+
+	svc := MustToUnstructured(test.DemoService())
+	opts := ApplyOpts{CreateNamespace: true, NamespaceLabels: map[string]string{"foo": "bar"}}
+	liveObj, err := applyResource(kubeclientset, &rest.Config{}, svc, test.TestNamespace, opts)
+	assert.Nil(t, err)
+	assert.Equal(t, svc.GetName(), liveObj.GetName())
+
+	// applying again with an existing namespace is a no-op for the namespace
+	_, err = applyResource(kubeclientset, &rest.Config{}, svc, test.TestNamespace, opts)
+	assert.Nil(t, err)
+}
+
+func TestPreferredVersionForGroup(t *testing.T) {
+	kubeclientset := fake.NewSimpleClientset()
+	fakeDiscovery, ok := kubeclientset.Discovery().(*fakediscovery.FakeDiscovery)
+	assert.True(t, ok)
+	fakeDiscovery.Fake.Resources = resourceList()
+
+	version, err := PreferredVersionForGroup(fakeDiscovery, "apps")
+	assert.Nil(t, err)
+	assert.Equal(t, "v1beta2", version)
+
+	version, err = PreferredVersionForGroup(fakeDiscovery, "")
+	assert.Nil(t, err)
+	assert.Equal(t, "v1", version)
+
+	_, err = PreferredVersionForGroup(fakeDiscovery, "does-not-exist.io")
+	assert.NotNil(t, err)
+}
+
+func TestListAllResourcesAggregatesErrors(t *testing.T) {
+	fakeDynClient := fakedynamic.FakeClient{
+		Fake: &kubetesting.Fake{},
+	}
+	listReactor := func(kind string, names ...string) kubetesting.ReactionFunc {
+		return func(action kubetesting.Action) (handled bool, ret runtime.Object, err error) {
+			list := unstructured.UnstructuredList{Object: map[string]interface{}{"kind": kind + "List", "apiVersion": "v1"}}
+			for _, name := range names {
+				item := unstructured.Unstructured{}
+				item.SetAPIVersion("v1")
+				item.SetKind(kind)
+				item.SetName(name)
+				item.SetUID(types.UID(kind + "-" + name))
+				list.Items = append(list.Items, item)
+			}
+			return true, &list, nil
+		}
+	}
+	fakeDynClient.Fake.AddReactor("list", "services", listReactor("Service", "svc1", "svc2"))
+	fakeDynClient.Fake.AddReactor("list", "configmaps", listReactor("ConfigMap", "cm1"))
+	fakeDynClient.Fake.AddReactor("list", "secrets", func(action kubetesting.Action) (handled bool, ret runtime.Object, err error) {
+		return true, nil, fmt.Errorf("the server is currently unable to handle the request")
+	})
+	clientForResource := func(metav1.APIResource) (dynamic.Interface, error) {
+		return &fakeDynClient, nil
+	}
+	apiResources := []metav1.APIResource{
+		{Name: "services", Namespaced: true, Version: "v1", Kind: "Service"},
+		{Name: "secrets", Namespaced: true, Version: "v1", Kind: "Secret"},
+		{Name: "configmaps", Namespaced: true, Version: "v1", Kind: "ConfigMap"},
+	}
+
+	resources, _, err := listAllResources(clientForResource, apiResources, test.TestNamespace, metav1.ListOptions{}, ListAllOpts{}, DefaultBulkOptions.MaxConcurrency)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "secrets")
+	assert.Equal(t, 3, len(resources))
+
+	resources, _, err = listAllResources(clientForResource, apiResources, test.TestNamespace, metav1.ListOptions{}, ListAllOpts{Strict: true}, DefaultBulkOptions.MaxConcurrency)
+	assert.NotNil(t, err)
+	assert.Nil(t, resources)
+}
+
+func TestApplyResourceFallbackToReplace(t *testing.T) {
+	defer func(orig func([]string, []byte) ([]byte, error)) { runKubectl = orig }(runKubectl)
+	var verbs []string
+	runKubectl = func(args []string, stdin []byte) ([]byte, error) {
+		var verb string
+		for _, subcommand := range []string{"apply", "replace", "create"} {
+			if hasArg(args, subcommand) {
+				verb = subcommand
+				break
+			}
+		}
+		verbs = append(verbs, verb)
+		switch verb {
+		case "apply":
+			return nil, fmt.Errorf(`The ConfigMap "demo" is invalid: metadata.annotations: Too long: must have at most 262144 characters`)
+		case "replace":
+			return nil, fmt.Errorf(`Error from server (NotFound): error when replacing "STDIN": configmaps "demo" not found`)
+		}
+		return stdin, nil
+	}
+
+	svc := MustToUnstructured(test.DemoService())
+	liveObj, err := applyResource(fake.NewSimpleClientset(), &rest.Config{}, svc, test.TestNamespace, ApplyOpts{})
+	assert.Nil(t, err)
+	assert.Equal(t, svc.GetName(), liveObj.GetName())
+	assert.Equal(t, []string{"apply", "replace", "create"}, verbs)
+}
+
+func TestWaitForDeletion(t *testing.T) {
+	svc := MustToUnstructured(test.DemoService())
+	polls := 0
+	err := waitForDeletion(context.Background(), time.Millisecond, func() ([]*unstructured.Unstructured, error) {
+		polls++
+		if polls < 3 {
+			return []*unstructured.Unstructured{svc}, nil
+		}
+		return nil, nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, polls)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err = waitForDeletion(ctx, time.Millisecond, func() ([]*unstructured.Unstructured, error) {
+		return []*unstructured.Unstructured{svc}, nil
+	})
+	if assert.IsType(t, &DeletionTimeoutError{}, err) {
+		assert.Equal(t, []*unstructured.Unstructured{svc}, err.(*DeletionTimeoutError).Remaining)
+	}
+}
+
+func TestListResourcesWithLabelCancelled(t *testing.T) {
+	// separate fakes are used, since a fake holds a lock while invoking its reactors
+	fakeSvcClient := fakedynamic.FakeClient{
+		Fake: &kubetesting.Fake{},
+	}
+	fakeDeployClient := fakedynamic.FakeClient{
+		Fake: &kubetesting.Fake{},
+	}
+	release := make(chan struct{})
+	defer close(release)
+	fakeSvcClient.Fake.AddReactor("list", "services", func(action kubetesting.Action) (handled bool, ret runtime.Object, err error) {
+		svc := MustToUnstructured(test.DemoService())
+		return true, &unstructured.UnstructuredList{Items: []unstructured.Unstructured{*svc}}, nil
+	})
+	fakeDeployClient.Fake.AddReactor("list", "deployments", func(action kubetesting.Action) (handled bool, ret runtime.Object, err error) {
+		<-release
+		return true, &unstructured.UnstructuredList{}, nil
+	})
+	clients := []dynamic.ResourceInterface{
+		fakeSvcClient.Resource(&metav1.APIResource{Name: "services", Namespaced: true}, test.TestNamespace),
+		fakeDeployClient.Resource(&metav1.APIResource{Name: "deployments", Namespaced: true}, test.TestNamespace),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	result, err := listResourcesWithLabel(ctx, clients, common.LabelKeyAppInstance, test.TestAppInstanceName, DefaultBulkOptions.MaxConcurrency)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.True(t, time.Since(start) < 5*time.Second)
+	if assert.Equal(t, 1, len(result)) {
+		assert.Equal(t, "Service", result[0].GetKind())
+	}
+}
+
+func TestAPIResourcesSupportingVerb(t *testing.T) {
+	fakeDiscovery := &fakediscovery.FakeDiscovery{Fake: &kubetesting.Fake{}}
+	fakeDiscovery.Resources = []*metav1.APIResourceList{
+		{
+			GroupVersion: apiv1.SchemeGroupVersion.String(),
+			APIResources: []metav1.APIResource{
+				{Name: "pods", Namespaced: true, Kind: "Pod", Verbs: []string{"create", "delete", "get", "list", "watch"}},
+				{Name: "pods/log", Namespaced: true, Kind: "Pod", Verbs: []string{"get"}},
+				{Name: "bindings", Namespaced: true, Kind: "Binding", Verbs: []string{"create"}},
+			},
+		},
+		{
+			GroupVersion: appsv1beta2.SchemeGroupVersion.String(),
+			APIResources: []metav1.APIResource{
+				{Name: "deployments", Namespaced: true, Kind: "Deployment", Verbs: []string{"get", "list", "watch"}},
+				{Name: "deployments/scale", Namespaced: true, Kind: "Scale", Verbs: []string{"get", "watch"}},
+			},
+		},
+	}
+
+	infos, err := APIResourcesSupportingVerb(fakeDiscovery, "watch")
+	assert.Nil(t, err)
+	if assert.Equal(t, 2, len(infos)) {
+		assert.Equal(t, "pods", infos[0].APIResource.Name)
+		assert.Equal(t, apiv1.SchemeGroupVersion.WithKind("Pod"), infos[0].GroupVersionKind)
+		assert.Equal(t, "deployments", infos[1].APIResource.Name)
+		assert.Equal(t, appsv1beta2.SchemeGroupVersion.WithKind("Deployment"), infos[1].GroupVersionKind)
+	}
+
+	infos, err = APIResourcesSupportingVerb(fakeDiscovery, "create")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(infos))
+}
+
+// pagedResourceClient serves a fixed set of pages to List requests and records deletes
+type pagedResourceClient struct {
+	dynamic.ResourceInterface
+	pages         []*unstructured.UnstructuredList
+	lock          sync.Mutex
+	deleted       []string
+	deleteOptions []*metav1.DeleteOptions
+}
+
+func (c *pagedResourceClient) List(opts metav1.ListOptions) (runtime.Object, error) {
+	page := 0
+	if opts.Continue != "" {
+		n, err := fmt.Sscanf(opts.Continue, "page-%d", &page)
+		if err != nil || n != 1 || page >= len(c.pages) {
+			return nil, fmt.Errorf("invalid continue token '%s'", opts.Continue)
+		}
+	}
+	return c.pages[page], nil
+}
+
+func (c *pagedResourceClient) Delete(name string, opts *metav1.DeleteOptions) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.deleted = append(c.deleted, name)
+	c.deleteOptions = append(c.deleteOptions, opts)
+	return nil
+}
+
+func TestDeletePagedWithLabel(t *testing.T) {
+	newPod := func(name string, appName string) unstructured.Unstructured {
+		pod := MustToUnstructured(test.DemoService())
+		pod.SetKind("Pod")
+		pod.SetName(name)
+		pod.SetLabels(map[string]string{common.LabelApplicationName: appName})
+		return *pod
+	}
+	firstPage := &unstructured.UnstructuredList{
+		Object: map[string]interface{}{},
+		Items:  []unstructured.Unstructured{newPod("pod-1", "guestbook"), newPod("pod-2", "guestbook")},
+	}
+	firstPage.SetContinue("page-1")
+	secondPage := &unstructured.UnstructuredList{
+		Object: map[string]interface{}{},
+		Items:  []unstructured.Unstructured{newPod("pod-3", "guestbook"), newPod("pod-4", "other")},
+	}
+	client := &pagedResourceClient{pages: []*unstructured.UnstructuredList{firstPage, secondPage}}
+
+	deleted, err := deletePagedWithLabel(client, schema.GroupKind{Kind: "Pod"}, common.LabelApplicationName, "guestbook", &metav1.DeleteOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"pod-1", "pod-2", "pod-3"}, client.deleted)
+	assert.ElementsMatch(t, []ResourceKey{
+		NewResourceKey("", "Pod", test.TestNamespace, "pod-1"),
+		NewResourceKey("", "Pod", test.TestNamespace, "pod-2"),
+		NewResourceKey("", "Pod", test.TestNamespace, "pod-3"),
+	}, deleted)
+}
+
+func TestDeleteGracePeriod(t *testing.T) {
+	gracePeriod := int64(0)
+	opts := DeleteOpts{GracePeriodSeconds: &gracePeriod}
+	page := &unstructured.UnstructuredList{Object: map[string]interface{}{}}
+	svc := MustToUnstructured(test.DemoService())
+	svc.SetLabels(map[string]string{common.LabelApplicationName: "guestbook"})
+	page.Items = append(page.Items, *svc)
+	client := &pagedResourceClient{pages: []*unstructured.UnstructuredList{page}}
+
+	_, err := deletePagedWithLabel(client, schema.GroupKind{Kind: "Service"}, common.LabelApplicationName, "guestbook", opts.deleteOptions())
+	assert.Nil(t, err)
+	if assert.Equal(t, 1, len(client.deleteOptions)) {
+		assert.Equal(t, int64(0), *client.deleteOptions[0].GracePeriodSeconds)
+		assert.Equal(t, metav1.DeletePropagationForeground, *client.deleteOptions[0].PropagationPolicy)
+	}
+
+	// the grace period is sent with the delete request of a single resource
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "DELETE", r.Method)
+		body, err = ioutil.ReadAll(r.Body)
+		assert.Nil(t, err)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"apiVersion":"v1","kind":"Status","status":"Success"}`))
+	}))
+	defer server.Close()
+	fakeDiscovery := &fakediscovery.FakeDiscovery{Fake: &kubetesting.Fake{}}
+	fakeDiscovery.Resources = resourceList()
+	dynClientPool := dynamic.NewDynamicClientPool(&rest.Config{Host: server.URL})
+	err = deleteResource(dynClientPool, fakeDiscovery, MustToUnstructured(test.DemoService()), opts)
+	assert.Nil(t, err)
+	var deleteOptions metav1.DeleteOptions
+	assert.Nil(t, json.Unmarshal(body, &deleteOptions))
+	if assert.NotNil(t, deleteOptions.GracePeriodSeconds) {
+		assert.Equal(t, int64(0), *deleteOptions.GracePeriodSeconds)
+	}
+}
+
+func TestDeleteResourcesWithLabel(t *testing.T) {
+	fakeDiscovery := &fakediscovery.FakeDiscovery{Fake: &kubetesting.Fake{}}
+	fakeDiscovery.Resources = []*metav1.APIResourceList{{
+		GroupVersion: apiv1.SchemeGroupVersion.String(),
+		APIResources: []metav1.APIResource{
+			{Name: "services", Namespaced: true, Kind: "Service", Verbs: []string{"list", "delete", "deletecollection"}},
+			{Name: "pods", Namespaced: true, Kind: "Pod", Verbs: []string{"list", "delete"}},
+		},
+	}}
+	newItem := func(name string, appName string) unstructured.Unstructured {
+		item := unstructured.Unstructured{}
+		item.SetName(name)
+		item.SetNamespace(test.TestNamespace)
+		item.SetLabels(map[string]string{common.LabelApplicationName: appName})
+		return item
+	}
+	items := map[string][]unstructured.Unstructured{
+		"services": {newItem("guestbook-ui", "guestbook"), newItem("other-ui", "other")},
+		"pods":     {newItem("guestbook-ui-1", "guestbook"), newItem("guestbook-ui-2", "guestbook")},
+	}
+	var lock sync.Mutex
+	var actions []string
+	fakeClientPool := fakedynamic.FakeClientPool{}
+	fakeClientPool.AddReactor("*", "*", func(action kubetesting.Action) (bool, runtime.Object, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		actions = append(actions, action.GetVerb()+" "+action.GetResource().Resource)
+		if action.GetVerb() == "list" {
+			list := &unstructured.UnstructuredList{Object: map[string]interface{}{}, Items: items[action.GetResource().Resource]}
+			return true, list, nil
+		}
+		return true, nil, nil
+	})
+
+	deleted, err := deleteResourcesWithLabel(&fakeClientPool, fakeDiscovery, test.TestNamespace, common.LabelApplicationName, "guestbook", DeleteOpts{}, 1)
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []ResourceKey{
+		NewResourceKey("", "Service", test.TestNamespace, "guestbook-ui"),
+		NewResourceKey("", "Pod", test.TestNamespace, "guestbook-ui-1"),
+		NewResourceKey("", "Pod", test.TestNamespace, "guestbook-ui-2"),
+	}, deleted)
+	assert.Contains(t, actions, "delete-collection services")
+}
+
+func TestGetLiveResourcesUnknownKind(t *testing.T) {
+	fakeDiscovery := &fakediscovery.FakeDiscovery{Fake: &kubetesting.Fake{}}
+	fakeDiscovery.Resources = resourceList()
+	fakeClientPool := fakedynamic.FakeClientPool{}
+	fakeClientPool.AddReactor("get", "services", func(action kubetesting.Action) (handled bool, ret runtime.Object, err error) {
+		return true, MustToUnstructured(test.DemoService()), nil
+	})
+
+	svc := MustToUnstructured(test.DemoService())
+	widget := &unstructured.Unstructured{}
+	widget.SetAPIVersion("v1")
+	widget.SetKind("Widget")
+	widget.SetName("obsolete")
+	objs := []*unstructured.Unstructured{svc, widget}
+
+	_, err := getLiveResources(&fakeClientPool, fakeDiscovery, objs, test.TestNamespace, GetLiveOpts{})
+	assert.True(t, IsUnknownKindError(err))
+
+	liveObjs, err := getLiveResources(&fakeClientPool, fakeDiscovery, objs, test.TestNamespace, GetLiveOpts{IgnoreUnknownKinds: true})
+	assert.Nil(t, err)
+	if assert.Equal(t, 2, len(liveObjs)) {
+		assert.Equal(t, svc.GetName(), liveObjs[0].GetName())
+		assert.Nil(t, liveObjs[1])
+	}
+}
+
+func TestGetLiveResourcesScope(t *testing.T) {
+	fakeDiscovery := &fakediscovery.FakeDiscovery{Fake: &kubetesting.Fake{}}
+	fakeDiscovery.Resources = []*metav1.APIResourceList{
+		{
+			GroupVersion: apiv1.SchemeGroupVersion.String(),
+			APIResources: []metav1.APIResource{
+				{Name: "configmaps", Namespaced: true, Kind: "ConfigMap"},
+			},
+		},
+		{
+			GroupVersion: rbacv1.SchemeGroupVersion.String(),
+			APIResources: []metav1.APIResource{
+				{Name: "clusterroles", Namespaced: false, Kind: "ClusterRole"},
+			},
+		},
+	}
+	namespaces := make(map[string]string)
+	fakeClientPool := fakedynamic.FakeClientPool{}
+	fakeClientPool.AddReactor("get", "*", func(action kubetesting.Action) (handled bool, ret runtime.Object, err error) {
+		name := action.(kubetesting.GetAction).GetName()
+		namespaces[name] = action.GetNamespace()
+		obj := &unstructured.Unstructured{}
+		obj.SetName(name)
+		obj.SetNamespace(action.GetNamespace())
+		return true, obj, nil
+	})
+
+	configMap := MustToUnstructured(&apiv1.ConfigMap{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "ConfigMap"},
+		ObjectMeta: metav1.ObjectMeta{Name: "guestbook-config", Namespace: "other"},
+	})
+	defaulted := MustToUnstructured(&apiv1.ConfigMap{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "ConfigMap"},
+		ObjectMeta: metav1.ObjectMeta{Name: "guestbook-defaults"},
+	})
+	clusterRole := MustToUnstructured(&rbacv1.ClusterRole{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "rbac.authorization.k8s.io/v1", Kind: "ClusterRole"},
+		ObjectMeta: metav1.ObjectMeta{Name: "guestbook-reader"},
+	})
+
+	liveObjs, err := getLiveResources(&fakeClientPool, fakeDiscovery, []*unstructured.Unstructured{configMap, defaulted, clusterRole}, test.TestNamespace, GetLiveOpts{})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(liveObjs))
+	assert.Equal(t, map[string]string{
+		"guestbook-config":   "other",
+		"guestbook-defaults": test.TestNamespace,
+		"guestbook-reader":   "",
+	}, namespaces)
+}
+
+// newServerSideClientset returns a fake clientset of a server which supports server-side apply
+func newServerSideClientset() *fake.Clientset {
+	kubeclientset := fake.NewSimpleClientset()
+	kubeclientset.Discovery().(*fakediscovery.FakeDiscovery).FakedServerVersion = &version.Info{Major: "1", Minor: "18"}
+	return kubeclientset
+}
+
+// emptyServerVersionCache replaces the cached server versions with an empty cache, and returns a
+// function restoring them
+func emptyServerVersionCache() func() {
+	orig := defaultServerVersionCache
+	defaultServerVersionCache = newServerVersionCache()
+	return func() { defaultServerVersionCache = orig }
+}
+
+func TestSupportsServerSideApply(t *testing.T) {
+	defer emptyServerVersionCache()()
+
+	for _, serverVersion := range []struct {
+		info      version.Info
+		supported bool
+	}{
+		{version.Info{Major: "1", Minor: "14"}, false},
+		{version.Info{Major: "1", Minor: "18"}, true},
+		{version.Info{Major: "1", Minor: "16+", GitVersion: "v1.16.15-gke.6000"}, true},
+		{version.Info{GitVersion: "v1.15.3"}, false},
+	} {
+		info := serverVersion.info
+		fakeDiscovery := &fakediscovery.FakeDiscovery{Fake: &kubetesting.Fake{}, FakedServerVersion: &info}
+		supported, err := supportsServerSideApply(fakeDiscovery)
+		assert.Nil(t, err)
+		assert.Equal(t, serverVersion.supported, supported, "%+v", info)
+	}
+
+	kubeclientset := fake.NewSimpleClientset()
+	kubeclientset.Discovery().(*fakediscovery.FakeDiscovery).FakedServerVersion = &version.Info{Major: "1", Minor: "14"}
+	_, err := applyResource(kubeclientset, &rest.Config{}, MustToUnstructured(test.DemoService()), test.TestNamespace, ApplyOpts{ServerSide: true})
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "server-side apply requires Kubernetes 1.16 or newer")
+}
+
+func TestApplyResourceForceConflicts(t *testing.T) {
+	defer emptyServerVersionCache()()
+	var applyArgs []string
+	defer func(orig func([]string, []byte) ([]byte, error)) { runKubectl = orig }(runKubectl)
+	runKubectl = func(args []string, stdin []byte) ([]byte, error) {
+		applyArgs = args
+		return stdin, nil
+	}
+	obj := MustToUnstructured(test.DemoService())
+
+	_, err := applyResource(newServerSideClientset(), &rest.Config{}, obj, test.TestNamespace, ApplyOpts{ServerSide: true})
+	assert.Nil(t, err)
+	assert.Contains(t, applyArgs, "--server-side")
+	assert.NotContains(t, applyArgs, "--force-conflicts")
+
+	_, err = applyResource(newServerSideClientset(), &rest.Config{}, obj, test.TestNamespace, ApplyOpts{ServerSide: true, ForceConflicts: true})
+	assert.Nil(t, err)
+	assert.Contains(t, applyArgs, "--server-side")
+	assert.Contains(t, applyArgs, "--force-conflicts")
+
+	_, err = applyResource(fake.NewSimpleClientset(), &rest.Config{}, obj, test.TestNamespace, ApplyOpts{})
+	assert.Nil(t, err)
+	assert.NotContains(t, applyArgs, "--server-side")
+	assert.NotContains(t, applyArgs, "--force-conflicts")
+
+	runKubectl = func(args []string, stdin []byte) ([]byte, error) {
+		return nil, fmt.Errorf(`error: Apply failed with 1 conflict: conflict with "kubectl-client-side-apply" using v1: .spec.type`)
+	}
+	_, err = applyResource(newServerSideClientset(), &rest.Config{}, obj, test.TestNamespace, ApplyOpts{ServerSide: true})
+	assert.True(t, IsApplyConflictError(err))
+	assert.Equal(t, []string{".spec.type"}, errors.Cause(err).(*ApplyConflictError).Conflicts)
+}
+
+func TestApplyResourceSubresource(t *testing.T) {
+	defer emptyServerVersionCache()()
+	var applyArgs []string
+	kubectlVersion := "25"
+	defer func(orig func([]string, []byte) ([]byte, error)) { runKubectl = orig }(runKubectl)
+	runKubectl = func(args []string, stdin []byte) ([]byte, error) {
+		if args[0] == "version" {
+			return []byte(fmt.Sprintf(`{"clientVersion": {"major": "1", "minor": "%s", "gitVersion": "v1.%s.0"}}`, kubectlVersion, kubectlVersion)), nil
+		}
+		applyArgs = args
+		return stdin, nil
+	}
+	obj := MustToUnstructured(test.DemoService())
+	newClientset := func(minor string) *fake.Clientset {
+		kubeclientset := fake.NewSimpleClientset()
+		kubeclientset.Discovery().(*fakediscovery.FakeDiscovery).FakedServerVersion = &version.Info{Major: "1", Minor: minor}
+		return kubeclientset
+	}
+
+	_, err := applyResource(newClientset("25"), &rest.Config{}, obj, test.TestNamespace, ApplyOpts{ServerSide: true, Subresource: "status"})
+	assert.Nil(t, err)
+	assert.Contains(t, strings.Join(applyArgs, " "), "apply --server-side --subresource status")
+
+	applyArgs = nil
+	_, err = applyResource(newClientset("25"), &rest.Config{}, obj, test.TestNamespace, ApplyOpts{Subresource: "status"})
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "applying the status subresource requires server-side apply")
+	assert.Nil(t, applyArgs)
+
+	// server versions are cached by host
+	_, err = applyResource(newServerSideClientset(), &rest.Config{Host: "https://old.example.com"}, obj, test.TestNamespace, ApplyOpts{ServerSide: true, Subresource: "status"})
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "applying the status subresource requires Kubernetes 1.24 or newer")
+	assert.Nil(t, applyArgs)
+
+	kubectlVersion = "23"
+	_, err = applyResource(newClientset("25"), &rest.Config{}, obj, test.TestNamespace, ApplyOpts{ServerSide: true, Subresource: "status"})
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "applying the status subresource requires kubectl 1.24 or newer, kubectl is v1.23.0")
+	assert.Nil(t, applyArgs)
+}
+
+func TestApplyResourceServerVersionCached(t *testing.T) {
+	defer emptyServerVersionCache()()
+	defer func(orig func([]string, []byte) ([]byte, error)) { runKubectl = orig }(runKubectl)
+	runKubectl = func(args []string, stdin []byte) ([]byte, error) {
+		return stdin, nil
+	}
+	kubeclientset := newServerSideClientset()
+	config := &rest.Config{Host: "https://cluster.example.com"}
+	versionRequests := func() int {
+		count := 0
+		for _, action := range kubeclientset.Discovery().(*fakediscovery.FakeDiscovery).Actions() {
+			if action.GetResource().Resource == "version" {
+				count++
+			}
+		}
+		return count
+	}
+
+	for i := 0; i < 3; i++ {
+		_, err := applyResource(kubeclientset, config, MustToUnstructured(test.DemoService()), test.TestNamespace, ApplyOpts{ServerSide: true})
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, 1, versionRequests())
+
+	// the version of another cluster is requested separately
+	_, err := applyResource(kubeclientset, &rest.Config{Host: "https://other.example.com"}, MustToUnstructured(test.DemoService()), test.TestNamespace, ApplyOpts{ServerSide: true})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, versionRequests())
+}
+
+func TestApplyResourceToNamespace(t *testing.T) {
+	applied, restore := fakeKubectl(t)
+	defer restore()
+	kubeclientset := fake.NewSimpleClientset()
+	kubeclientset.Discovery().(*fakediscovery.FakeDiscovery).Resources = clusterScopedResourceList()
+
+	svc := MustToUnstructured(test.DemoService())
+	svc.SetNamespace("template")
+	_, err := applyResourceToNamespace(kubeclientset, &rest.Config{}, svc, "staging", ApplyOpts{})
+	assert.Nil(t, err)
+	clusterRole := MustToUnstructured(&rbacv1.ClusterRole{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "rbac.authorization.k8s.io/v1", Kind: "ClusterRole"},
+		ObjectMeta: metav1.ObjectMeta{Name: "guestbook-reader"},
+	})
+	_, err = applyResourceToNamespace(kubeclientset, &rest.Config{}, clusterRole, "staging", ApplyOpts{})
+	assert.Nil(t, err)
+
+	if assert.Equal(t, 2, len(*applied)) {
+		assert.Equal(t, "staging", (*applied)[0].GetNamespace())
+		assert.Equal(t, "", (*applied)[1].GetNamespace())
+	}
+	assert.Equal(t, "template", svc.GetNamespace())
+}
+
+func TestApplyResourceKubeconfigContext(t *testing.T) {
+	var applyArgs []string
+	defer func(orig func([]string, []byte) ([]byte, error)) { runKubectl = orig }(runKubectl)
+	runKubectl = func(args []string, stdin []byte) ([]byte, error) {
+		applyArgs = args
+		return stdin, nil
+	}
+	obj := MustToUnstructured(test.DemoService())
+
+	_, err := applyResource(fake.NewSimpleClientset(), &rest.Config{}, obj, test.TestNamespace, ApplyOpts{KubeconfigPath: "/tmp/kubeconfig", KubeContext: "staging"})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"--kubeconfig", "/tmp/kubeconfig", "--context", "staging", "-n", test.TestNamespace, "apply"}, applyArgs[:7])
+	assert.NotContains(t, applyArgs, "--server")
+}
+
+func TestRunKubectlLocale(t *testing.T) {
+	// a kubectl stand-in which fails with a localized message unless the locale is C
+	dir, err := ioutil.TempDir("", "kubectl")
+	assert.Nil(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+	script := `#!/bin/sh
+if [ "$LC_ALL" != "C" ] || [ "$LANG" != "C" ]; then
+  echo 'Fehler vom Server (NotFound): services "demo" nicht gefunden' >&2
+  exit 1
+fi
+cat
+`
+	err = ioutil.WriteFile(filepath.Join(dir, "kubectl"), []byte(script), 0755)
+	assert.Nil(t, err)
+
+	defer func(path string, lang string) {
+		_ = os.Setenv("PATH", path)
+		_ = os.Setenv("LANG", lang)
+	}(os.Getenv("PATH"), os.Getenv("LANG"))
+	_ = os.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	_ = os.Setenv("LANG", "de_DE.UTF-8")
+
+	obj := MustToUnstructured(test.DemoService())
+	liveObj, err := applyResource(fake.NewSimpleClientset(), &rest.Config{}, obj, test.TestNamespace, ApplyOpts{})
+	assert.Nil(t, err)
+	if assert.NotNil(t, liveObj) {
+		assert.Equal(t, obj.GetName(), liveObj.GetName())
+	}
+}
+
+func TestCanApplyViaKubectl(t *testing.T) {
+	defer func(orig func([]string, []byte) ([]byte, error)) { runKubectl = orig }(runKubectl)
+	output := `{"clientVersion": {"major": "1", "minor": "14", "gitVersion": "v1.14.0"}}`
+	runKubectl = func(args []string, stdin []byte) ([]byte, error) {
+		assert.Equal(t, []string{"version", "--client", "-o", "json"}, args)
+		return []byte(output), nil
+	}
+	assert.Nil(t, CanApplyViaKubectl())
+
+	output = `{"clientVersion": {"major": "1", "minor": "8", "gitVersion": "v1.8.4"}}`
+	err := CanApplyViaKubectl()
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "v1.8.4 is not supported")
+}
+
+func TestCanApplyViaKubectlNotInstalled(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kubectl")
+	assert.Nil(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+	defer func(path string) { _ = os.Setenv("PATH", path) }(os.Getenv("PATH"))
+	assert.Nil(t, os.Setenv("PATH", dir))
+
+	err = CanApplyViaKubectl()
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "kubectl was not found in PATH")
+}
+
+func TestRunCommandLargeOutput(t *testing.T) {
+	// writes 2MB to stdout and stderr at the same time, which is far more than a pipe can buffer
+	script := "head -c 2000000 /dev/zero | tr '\\0' x | tee /dev/stderr; exit $0"
+
+	out, err := runCommand(exec.Command("sh", "-c", script, "0"), nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 2000000, len(out))
+
+	_, err = runCommand(exec.Command("sh", "-c", script, "1"), nil)
+	if assert.NotNil(t, err) {
+		assert.Equal(t, 2000000, len(err.Error()))
+	}
+}
+
+func TestServerResourceForGroupVersionKind(t *testing.T) {
+	fakeDiscovery := &fakediscovery.FakeDiscovery{Fake: &kubetesting.Fake{}}
+	fakeDiscovery.Resources = []*metav1.APIResourceList{
+		{
+			GroupVersion: appsv1beta2.SchemeGroupVersion.String(),
+			APIResources: []metav1.APIResource{
+				{Name: "deployments", Namespaced: true, Kind: "Deployment"},
+				{Name: "daemonsets", Namespaced: true, Kind: "DaemonSet"},
+				{Name: "statefulsets", Namespaced: true, Kind: "StatefulSet"},
+			},
+		},
+	}
+
+	for _, kind := range []string{"Deployment", "DaemonSet", "StatefulSet"} {
+		apiResource, err := ServerResourceForGroupVersionKind(fakeDiscovery, appsv1beta2.SchemeGroupVersion.WithKind(kind))
+		assert.Nil(t, err)
+		assert.Equal(t, kind, apiResource.Kind)
+		assert.Equal(t, strings.ToLower(kind)+"s", apiResource.Name)
+	}
+
+	apiResource, err := ServerResourceForGroupVersionKind(fakeDiscovery, appsv1beta2.SchemeGroupVersion.WithKind("DaemonSet"))
+	assert.Nil(t, err)
+	apiResource.Name = "modified"
+	assert.Equal(t, "daemonsets", fakeDiscovery.Resources[0].APIResources[1].Name)
+}
+
+func TestListResourcesInGroups(t *testing.T) {
+	fakeDiscovery := &fakediscovery.FakeDiscovery{Fake: &kubetesting.Fake{}}
+	fakeDiscovery.Resources = []*metav1.APIResourceList{
+		{
+			GroupVersion: apiv1.SchemeGroupVersion.String(),
+			APIResources: []metav1.APIResource{
+				{Name: "services", Namespaced: true, Kind: "Service", Verbs: []string{"get", "list"}},
+			},
+		},
+		{
+			GroupVersion: appsv1beta2.SchemeGroupVersion.String(),
+			APIResources: []metav1.APIResource{
+				{Name: "deployments", Namespaced: true, Kind: "Deployment", Verbs: []string{"get", "list"}},
+				{Name: "deployments/scale", Namespaced: true, Kind: "Scale", Verbs: []string{"get", "list"}},
+				{Name: "controllerrevisions", Namespaced: true, Kind: "ControllerRevision", Verbs: []string{"get"}},
+			},
+		},
+	}
+	fakeClientPool := fakedynamic.FakeClientPool{}
+	fakeClientPool.AddReactor("list", "*", func(action kubetesting.Action) (bool, runtime.Object, error) {
+		resource := action.GetResource()
+		item := unstructured.Unstructured{}
+		item.SetName("demo")
+		item.SetUID(types.UID(resource.Resource))
+		item.SetAPIVersion(resource.GroupVersion().String())
+		item.SetKind("Demo")
+		return true, &unstructured.UnstructuredList{Items: []unstructured.Unstructured{item}}, nil
+	})
+
+	objs, err := listResourcesInGroups(&fakeClientPool, fakeDiscovery, []string{"apps"}, test.TestNamespace, metav1.ListOptions{})
+	assert.Nil(t, err)
+	if assert.Equal(t, 1, len(objs)) {
+		assert.Equal(t, "deployments", string(objs[0].GetUID()))
+	}
+	var listed []string
+	for _, action := range fakeClientPool.Actions() {
+		if action.GetVerb() == "list" {
+			listed = append(listed, action.GetResource().Resource)
+		}
+	}
+	assert.Equal(t, []string{"deployments"}, listed)
+}
+
+// newManagedResourcesFixture returns a cluster with resources of two applications, guestbook and
+// helm-guestbook, as well as a resource without the application label
+func newManagedResourcesFixture() (*fakedynamic.FakeClientPool, *fakediscovery.FakeDiscovery, *[]string) {
+	fakeDiscovery := &fakediscovery.FakeDiscovery{Fake: &kubetesting.Fake{}}
+	fakeDiscovery.Resources = []*metav1.APIResourceList{
+		{
+			GroupVersion: apiv1.SchemeGroupVersion.String(),
+			APIResources: []metav1.APIResource{
+				{Name: "services", Namespaced: true, Kind: "Service", Verbs: []string{"list"}},
+			},
+		},
+		{
+			GroupVersion: rbacv1.SchemeGroupVersion.String(),
+			APIResources: []metav1.APIResource{
+				{Name: "clusterroles", Namespaced: false, Kind: "ClusterRole", Verbs: []string{"list"}},
+			},
+		},
+	}
+	newItem := func(kind string, name string, namespace string, app string) unstructured.Unstructured {
+		item := unstructured.Unstructured{}
+		item.SetKind(kind)
+		item.SetName(name)
+		item.SetNamespace(namespace)
+		item.SetUID(types.UID(kind + "/" + name))
+		if app != "" {
+			item.SetLabels(map[string]string{common.LabelApplicationName: app})
+		}
+		return item
+	}
+	items := map[string][]unstructured.Unstructured{
+		"services": {
+			newItem("Service", "guestbook-ui", "default", "guestbook"),
+			newItem("Service", "helm-guestbook", "apps", "helm-guestbook"),
+			newItem("Service", "kubernetes", "default", ""),
+		},
+		"clusterroles": {
+			newItem("ClusterRole", "guestbook-reader", "", "guestbook"),
+		},
+	}
+	var namespaces []string
+	fakeClientPool := &fakedynamic.FakeClientPool{}
+	fakeClientPool.AddReactor("list", "*", func(action kubetesting.Action) (bool, runtime.Object, error) {
+		namespaces = append(namespaces, action.GetNamespace())
+		list := &unstructured.UnstructuredList{}
+		for _, item := range items[action.GetResource().Resource] {
+			if action.GetNamespace() == "" || item.GetNamespace() == action.GetNamespace() {
+				list.Items = append(list.Items, item)
+			}
+		}
+		return true, list, nil
+	})
+	return fakeClientPool, fakeDiscovery, &namespaces
+}
+
+func TestGetResourcesWithLabelInNamespaces(t *testing.T) {
+	fakeClientPool, fakeDiscovery, namespaces := newManagedResourcesFixture()
+	objs, err := getResourcesWithLabelInNamespaces(context.Background(), fakeClientPool, fakeDiscovery, []string{"default", "other"}, common.LabelApplicationName, "guestbook", 1)
+	assert.Nil(t, err)
+	var names []string
+	for _, obj := range objs {
+		names = append(names, obj.GetName())
+	}
+	assert.ElementsMatch(t, []string{"guestbook-ui", "guestbook-reader"}, names)
+	// services are listed in each of the namespaces, and cluster roles once across the cluster
+	assert.ElementsMatch(t, []string{"default", "other", ""}, *namespaces)
+}
+
+func TestListManagedResources(t *testing.T) {
+	fakeClientPool, fakeDiscovery, namespaces := newManagedResourcesFixture()
+	resourcesByApp, err := listManagedResources(fakeClientPool, fakeDiscovery, common.LabelApplicationName, 1)
+	assert.Nil(t, err)
+	names := make(map[string][]string)
+	for app, objs := range resourcesByApp {
+		for _, obj := range objs {
+			names[app] = append(names[app], obj.GetName())
+		}
+	}
+	assert.Equal(t, 2, len(names))
+	assert.ElementsMatch(t, []string{"guestbook-ui", "guestbook-reader"}, names["guestbook"])
+	assert.ElementsMatch(t, []string{"helm-guestbook"}, names["helm-guestbook"])
+	assert.Equal(t, []string{"", ""}, *namespaces)
+}
+
+func TestFindOrphanedResources(t *testing.T) {
+	// helm-guestbook was deleted without pruning its resources
+	fakeClientPool, fakeDiscovery, _ := newManagedResourcesFixture()
+	orphans, err := findOrphanedResources(fakeClientPool, fakeDiscovery, common.LabelApplicationName, []string{"guestbook"}, TrackingMethodLabel, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(orphans))
+	if assert.Equal(t, 1, len(orphans["helm-guestbook"])) {
+		assert.Equal(t, "helm-guestbook", orphans["helm-guestbook"][0].GetName())
+		assert.Equal(t, "apps", orphans["helm-guestbook"][0].GetNamespace())
+	}
+}
+
+func TestFindOrphanedResourcesTrackingAnnotation(t *testing.T) {
+	fakeDiscovery := &fakediscovery.FakeDiscovery{Fake: &kubetesting.Fake{}}
+	fakeDiscovery.Resources = []*metav1.APIResourceList{{
+		GroupVersion: apiv1.SchemeGroupVersion.String(),
+		APIResources: []metav1.APIResource{{Name: "pods", Namespaced: true, Kind: "Pod", Verbs: []string{"list"}}},
+	}}
+	// the pod of the deleted application is tracked, and the other pod inherited its labels and
+	// annotations from a template
+	tracked := MustToUnstructured(test.DemoService())
+	tracked.SetKind("Pod")
+	tracked.SetName("tracked")
+	tracked.SetUID("tracked")
+	tracked.SetLabels(map[string]string{common.LabelApplicationName: "helm-guestbook"})
+	SetTrackingID(tracked, TrackingMethodAnnotation, "helm-guestbook", "", "")
+	copied := tracked.DeepCopy()
+	copied.SetName("copied")
+	copied.SetUID("copied")
+	fakeClientPool := &fakedynamic.FakeClientPool{}
+	fakeClientPool.AddReactor("list", "*", func(action kubetesting.Action) (bool, runtime.Object, error) {
+		return true, &unstructured.UnstructuredList{Items: []unstructured.Unstructured{*tracked, *copied}}, nil
+	})
+
+	orphans, err := findOrphanedResources(fakeClientPool, fakeDiscovery, common.LabelApplicationName, nil, TrackingMethodAnnotation, 1)
+	assert.Nil(t, err)
+	if assert.Equal(t, 1, len(orphans["helm-guestbook"])) {
+		assert.Equal(t, "tracked", orphans["helm-guestbook"][0].GetName())
+	}
+
+	orphans, err = findOrphanedResources(fakeClientPool, fakeDiscovery, common.LabelApplicationName, nil, TrackingMethodLabel, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(orphans["helm-guestbook"]))
+}
+
+func TestGenerateTLSFilesNames(t *testing.T) {
+	generate := func(host string, caData string) string {
+		config := &rest.Config{Host: host, TLSClientConfig: rest.TLSClientConfig{CAData: []byte(caData)}}
+		err := GenerateTLSFiles(config)
+		assert.Nil(t, err)
+		defer func() { _ = DeleteTLSFiles(config) }()
+		return filepath.Base(config.TLSClientConfig.CAFile)
+	}
+	prod := generate("https://prod.example.com:6443", "prod-ca")
+	staging := generate("https://staging.example.com:6443", "staging-ca")
+	assert.True(t, strings.HasPrefix(prod, "prod.example.com:6443-"))
+	assert.True(t, strings.HasPrefix(staging, "staging.example.com:6443-"))
+
+	// the same cluster always gets the same name pattern, and a different CA gets a different one
+	pattern := func(name string) string {
+		return name[:strings.LastIndex(name, "-")]
+	}
+	assert.Equal(t, pattern(prod), pattern(generate("https://prod.example.com:6443", "prod-ca")))
+	assert.NotEqual(t, pattern(prod), pattern(generate("https://prod.example.com:6443", "rotated-ca")))
+}
+
+func TestSummarizeConfig(t *testing.T) {
+	config := &rest.Config{
+		Host:        "https://prod.example.com:6443",
+		BearerToken: "secret-token",
+		Username:    "admin",
+		Password:    "secret-password",
+		TLSClientConfig: rest.TLSClientConfig{
+			Insecure: true,
+			CertData: []byte("secret-cert"),
+			KeyData:  []byte("secret-key"),
+		},
+	}
+	summary := SummarizeConfig(config)
+	assert.Contains(t, summary, "host=https://prod.example.com:6443")
+	assert.Contains(t, summary, "insecure=true")
+	assert.Contains(t, summary, "auth=token,client-certificate,basic")
+	for _, secret := range []string{"secret-token", "secret-password", "secret-cert", "secret-key"} {
+		assert.NotContains(t, summary, secret)
+	}
+
+	assert.Contains(t, SummarizeConfig(&rest.Config{Host: "https://prod.example.com:6443"}), "auth=none")
+}
+
+func TestResourcesExist(t *testing.T) {
+	fakeDiscovery := &fakediscovery.FakeDiscovery{Fake: &kubetesting.Fake{}}
+	fakeDiscovery.Resources = resourceList()
+	newDeployment := func(name string) *unstructured.Unstructured {
+		deploy := fakeDeploymentV1beta2()
+		deploy.SetName(name)
+		deploy.SetLabels(map[string]string{common.LabelApplicationName: "guestbook", "component": name})
+		return deploy
+	}
+	frontend := newDeployment("frontend")
+	backend := newDeployment("backend")
+	redis := newDeployment("redis")
+	fakeClientPool := fakedynamic.FakeClientPool{}
+	fakeClientPool.AddReactor("list", "deployments", func(action kubetesting.Action) (bool, runtime.Object, error) {
+		return true, &unstructured.UnstructuredList{Items: []unstructured.Unstructured{*frontend, *redis}}, nil
+	})
+	unknown := &unstructured.Unstructured{}
+	unknown.SetAPIVersion("v1")
+	unknown.SetKind("Widget")
+	unknown.SetName("demo")
+
+	exists, err := resourcesExist(&fakeClientPool, fakeDiscovery, []*unstructured.Unstructured{frontend, backend, unknown}, test.TestNamespace)
+	assert.Nil(t, err)
+	assert.Equal(t, map[ResourceKey]bool{
+		GetResourceKey(frontend): true,
+		GetResourceKey(backend):  false,
+		GetResourceKey(unknown):  false,
+	}, exists)
+
+	// the deployments are listed at once, narrowed by their common label
+	lists := 0
+	for _, action := range fakeClientPool.Actions() {
+		if listAction, ok := action.(kubetesting.ListAction); ok {
+			lists++
+			assert.Equal(t, common.LabelApplicationName+"=guestbook", listAction.GetListRestrictions().Labels.String())
+		}
+	}
+	assert.Equal(t, 1, lists)
+}
+
+func TestResourcesExistWithoutNamespace(t *testing.T) {
+	fakeDiscovery := &fakediscovery.FakeDiscovery{Fake: &kubetesting.Fake{}}
+	fakeDiscovery.Resources = resourceList()
+	live := fakeDeploymentV1beta2()
+	live.SetNamespace("other-namespace")
+	fakeClientPool := fakedynamic.FakeClientPool{}
+	fakeClientPool.AddReactor("list", "deployments", func(action kubetesting.Action) (bool, runtime.Object, error) {
+		var items []unstructured.Unstructured
+		if ns := action.GetNamespace(); ns == "" || ns == live.GetNamespace() {
+			items = append(items, *live)
+		}
+		return true, &unstructured.UnstructuredList{Items: items}, nil
+	})
+	desired := fakeDeploymentV1beta2()
+	desired.SetNamespace("")
+
+	// a deployment of the same name in another namespace is not the desired deployment
+	exists, err := resourcesExist(&fakeClientPool, fakeDiscovery, []*unstructured.Unstructured{desired}, test.TestNamespace)
+	assert.Nil(t, err)
+	assert.Equal(t, map[ResourceKey]bool{GetResourceKey(desired): false}, exists)
+
+	exists, err = resourcesExist(&fakeClientPool, fakeDiscovery, []*unstructured.Unstructured{desired}, "other-namespace")
+	assert.Nil(t, err)
+	assert.Equal(t, map[ResourceKey]bool{GetResourceKey(desired): true}, exists)
+}
+
+func TestWatchResourcesWithLabelResourceVersion(t *testing.T) {
+	fakeDiscovery := &fakediscovery.FakeDiscovery{Fake: &kubetesting.Fake{}}
+	fakeDiscovery.Resources = []*metav1.APIResourceList{
+		{
+			GroupVersion: apiv1.SchemeGroupVersion.String(),
+			APIResources: []metav1.APIResource{
+				{Name: "services", Namespaced: true, Kind: "Service", Verbs: []string{"list", "watch"}},
+				{Name: "configmaps", Namespaced: true, Kind: "ConfigMap", Verbs: []string{"list", "watch"}},
+				{Name: "secrets", Namespaced: true, Kind: "Secret", Verbs: []string{"list", "watch"}},
+			},
+		},
+	}
+	var lock sync.Mutex
+	watchVersions := make(map[string]string)
+	fakeClientPool := &fakedynamic.FakeClientPool{}
+	fakeClientPool.AddWatchReactor("*", func(action kubetesting.Action) (bool, watch.Interface, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		watchVersions[action.GetResource().Resource] = action.(kubetesting.WatchAction).GetWatchRestrictions().ResourceVersion
+		return true, watch.NewEmptyWatch(), nil
+	})
+	versions := ResourceVersions{
+		apiv1.SchemeGroupVersion.WithKind("Service"):   "42",
+		apiv1.SchemeGroupVersion.WithKind("ConfigMap"): "43",
+	}
+
+	ch, err := watchResourcesWithLabel(context.Background(), fakeClientPool, fakeDiscovery, "", "", common.LabelApplicationName, versions)
+	assert.Nil(t, err)
+	for range ch {
+	}
+	// kinds without a version are watched from the current state
+	assert.Equal(t, map[string]string{"services": "42", "configmaps": "43", "secrets": ""}, watchVersions)
+}
+
+// hasArg returns whether kubectl was run with an argument, such as its subcommand or a flag
+func hasArg(args []string, arg string) bool {
+	for _, a := range args {
+		if a == arg {
+			return true
+		}
+	}
+	return false
+}
+
+func TestApplyResourceRecreateOnImmutable(t *testing.T) {
+	defer func(orig func([]string, []byte) ([]byte, error)) { runKubectl = orig }(runKubectl)
+	var commands [][]string
+	runKubectl = func(args []string, stdin []byte) ([]byte, error) {
+		commands = append(commands, args[2:])
+		if hasArg(args, "apply") {
+			return nil, fmt.Errorf(`The Service "demo" is invalid: spec.clusterIP: Invalid value: "": field is immutable`)
+		}
+		return stdin, nil
+	}
+	svc := MustToUnstructured(test.DemoService())
+
+	var confirmed []string
+	opts := ApplyOpts{RecreateOnImmutable: true, ConfirmRecreate: func(obj *unstructured.Unstructured) bool {
+		confirmed = append(confirmed, obj.GetName())
+		return true
+	}}
+	liveObj, err := applyResource(fake.NewSimpleClientset(), &rest.Config{}, svc, test.TestNamespace, opts)
+	assert.Nil(t, err)
+	assert.Equal(t, "demo", liveObj.GetName())
+	assert.Equal(t, []string{"demo"}, confirmed)
+	if assert.Equal(t, 2, len(commands)) {
+		assert.Equal(t, []string{"-n", test.TestNamespace, "replace", "--force", "--save-config", "-o", "json", "-f", "-"}, commands[1])
+	}
+
+	// the object is not recreated without confirmation
+	commands = nil
+	opts.ConfirmRecreate = func(obj *unstructured.Unstructured) bool { return false }
+	_, err = applyResource(fake.NewSimpleClientset(), &rest.Config{}, svc, test.TestNamespace, opts)
+	assert.Equal(t, ApplyErrorImmutable, GetApplyErrorCategory(err))
+	assert.Equal(t, 1, len(commands))
+
+	// server-side applies are not recreated, which would drop the field manager
+	defer emptyServerVersionCache()()
+	commands = nil
+	confirmed = nil
+	opts = ApplyOpts{RecreateOnImmutable: true, ServerSide: true, ConfirmRecreate: func(obj *unstructured.Unstructured) bool {
+		confirmed = append(confirmed, obj.GetName())
+		return true
+	}}
+	_, err = applyResource(newServerSideClientset(), &rest.Config{}, svc, test.TestNamespace, opts)
+	assert.Equal(t, ApplyErrorImmutable, GetApplyErrorCategory(err))
+	assert.Nil(t, confirmed)
+	if assert.Equal(t, 1, len(commands)) {
+		assert.True(t, hasArg(commands[0], "--server-side"))
+	}
+}
+
+func TestApplyResourceRecreateGuardsDataLoss(t *testing.T) {
+	defer func(orig func([]string, []byte) ([]byte, error)) { runKubectl = orig }(runKubectl)
+	var commands [][]string
+	runKubectl = func(args []string, stdin []byte) ([]byte, error) {
+		commands = append(commands, args[2:])
+		if hasArg(args, "apply") {
+			return nil, fmt.Errorf(`The PersistentVolumeClaim "data" is invalid: spec: Forbidden: spec is immutable after creation except resources.requests for bound claims`)
+		}
+		return stdin, nil
+	}
+	pvc := MustToUnstructured(&apiv1.PersistentVolumeClaim{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "PersistentVolumeClaim"},
+		ObjectMeta: metav1.ObjectMeta{Name: "data"},
+	})
+
+	_, err := applyResource(fake.NewSimpleClientset(), &rest.Config{}, pvc, test.TestNamespace, ApplyOpts{RecreateOnImmutable: true})
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "would lose its data")
+	assert.Equal(t, 1, len(commands))
+
+	commands = nil
+	_, err = applyResource(fake.NewSimpleClientset(), &rest.Config{}, pvc, test.TestNamespace, ApplyOpts{RecreateOnImmutable: true, AllowDataLoss: true})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(commands))
+}
+
+func TestListResourcesTimeout(t *testing.T) {
+	var timeouts []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		timeouts = append(timeouts, r.URL.Query().Get("timeoutSeconds"))
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"apiVersion":"v1","kind":"ServiceList","metadata":{},"items":[]}`))
+	}))
+	defer server.Close()
+	dclient, err := dynamic.NewClient(&rest.Config{Host: server.URL, ContentConfig: rest.ContentConfig{GroupVersion: &apiv1.SchemeGroupVersion}})
+	assert.Nil(t, err)
+	apiResource := metav1.APIResource{Name: "services", Namespaced: true, Kind: "Service"}
+
+	_, err = ListResources(dclient, apiResource, test.TestNamespace, metav1.ListOptions{})
+	assert.Nil(t, err)
+	// a timeout set by the caller is kept
+	timeoutSeconds := int64(10)
+	_, err = ListResources(dclient, apiResource, test.TestNamespace, metav1.ListOptions{TimeoutSeconds: &timeoutSeconds})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"300", "10"}, timeouts)
+}
+
+// newSlowListServer returns a server which serves config maps, but only answers list requests after the
+// given delay, recording the timeoutSeconds of each list
+func newSlowListServer(delay time.Duration, timeouts *[]string) *httptest.Server {
+	var lock sync.Mutex
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/api":
+			_, _ = w.Write([]byte(`{"kind":"APIVersions","versions":["v1"]}`))
+		case "/apis":
+			_, _ = w.Write([]byte(`{"kind":"APIGroupList","apiVersion":"v1","groups":[]}`))
+		case "/api/v1":
+			_, _ = w.Write([]byte(`{"kind":"APIResourceList","groupVersion":"v1","resources":[` +
+				`{"name":"configmaps","namespaced":true,"kind":"ConfigMap","verbs":["list","delete","deletecollection"]}]}`))
+		default:
+			if r.Method == http.MethodGet {
+				lock.Lock()
+				*timeouts = append(*timeouts, r.URL.Query().Get("timeoutSeconds"))
+				lock.Unlock()
+				time.Sleep(delay)
+			}
+			_, _ = w.Write([]byte(`{"apiVersion":"v1","kind":"ConfigMapList","metadata":{},"items":[]}`))
+		}
+	}))
+}
+
+func TestResourcesWithLabelListTimeout(t *testing.T) {
+	defaultListTimeout := DefaultListTimeout
+	DefaultListTimeout = 100 * time.Millisecond
+	defer func() { DefaultListTimeout = defaultListTimeout }()
+	var timeouts []string
+	server := newSlowListServer(time.Second, &timeouts)
+	defer server.Close()
+	config := &rest.Config{Host: server.URL}
+
+	start := time.Now()
+	_, err := GetResourcesWithLabel(context.Background(), config, test.TestNamespace, common.LabelApplicationName, "guestbook", nil)
+	assert.NotNil(t, err)
+	assert.True(t, time.Since(start) < time.Second)
+
+	start = time.Now()
+	_, err = DeleteResourceWithLabel(context.Background(), config, test.TestNamespace, common.LabelApplicationName, "guestbook", DeleteOpts{}, nil)
+	assert.NotNil(t, err)
+	assert.True(t, time.Since(start) < time.Second)
+
+	// the timeout is requested too, though the API server only honors it for watches
+	assert.Equal(t, []string{"1", "1"}, timeouts)
+}
+
+// newPagingServer returns a server which lists the given number of config maps, a page at a time
+func newPagingServer(t *testing.T, count int, limits *[]string) *httptest.Server {
+	return newKindPagingServer(t, "ConfigMap", "cm-", count, limits)
+}
+
+// newKindPagingServer returns a server which lists the given number of resources of a kind, named with
+// the given prefix, a page at a time
+func newKindPagingServer(t *testing.T, kind string, prefix string, count int, limits *[]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*limits = append(*limits, r.URL.Query().Get("limit"))
+		start, limit := 0, count
+		if cont := r.URL.Query().Get("continue"); cont != "" {
+			var err error
+			start, err = strconv.Atoi(cont)
+			assert.Nil(t, err)
+		}
+		if l := r.URL.Query().Get("limit"); l != "" {
+			var err error
+			limit, err = strconv.Atoi(l)
+			assert.Nil(t, err)
+		}
+		list := unstructured.UnstructuredList{Object: map[string]interface{}{"apiVersion": "v1", "kind": kind + "List"}}
+		for i := start; i < count && i < start+limit; i++ {
+			item := unstructured.Unstructured{}
+			item.SetAPIVersion("v1")
+			item.SetKind(kind)
+			item.SetName(fmt.Sprintf("%s%d", prefix, i))
+			item.SetUID(types.UID(fmt.Sprintf("%s%d", prefix, i)))
+			list.Items = append(list.Items, item)
+		}
+		if start+limit < count {
+			list.SetContinue(strconv.Itoa(start + limit))
+		}
+		data, err := list.MarshalJSON()
+		assert.Nil(t, err)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(data)
+	}))
+}
+
+func TestListResourcesPaged(t *testing.T) {
+	var limits []string
+	server := newPagingServer(t, 20, &limits)
+	defer server.Close()
+	dclient, err := dynamic.NewClient(&rest.Config{Host: server.URL, ContentConfig: rest.ContentConfig{GroupVersion: &apiv1.SchemeGroupVersion}})
+	assert.Nil(t, err)
+	apiResource := metav1.APIResource{Name: "configmaps", Namespaced: true, Kind: "ConfigMap"}
+
+	items, truncated, err := ListResourcesPaged(dclient, apiResource, test.TestNamespace, metav1.ListOptions{}, 5)
+	assert.Nil(t, err)
+	assert.True(t, truncated)
+	assert.Equal(t, 5, len(items))
+	assert.Equal(t, "cm-4", items[4].GetName())
+	assert.Equal(t, []string{"5"}, limits)
+
+	// without a cap, all pages are listed
+	limits = nil
+	items, truncated, err = ListResourcesPaged(dclient, apiResource, test.TestNamespace, metav1.ListOptions{Limit: 8}, 0)
+	assert.Nil(t, err)
+	assert.False(t, truncated)
+	assert.Equal(t, 20, len(items))
+	assert.Equal(t, []string{"8", "8", "8"}, limits)
+
+	// the cap is honoured across pages
+	limits = nil
+	items, truncated, err = ListResourcesPaged(dclient, apiResource, test.TestNamespace, metav1.ListOptions{Limit: 8}, 12)
+	assert.Nil(t, err)
+	assert.True(t, truncated)
+	assert.Equal(t, 12, len(items))
+	assert.Equal(t, []string{"8", "4"}, limits)
+
+	// a cap which is not reached does not truncate
+	limits = nil
+	items, truncated, err = ListResourcesPaged(dclient, apiResource, test.TestNamespace, metav1.ListOptions{}, 20)
+	assert.Nil(t, err)
+	assert.False(t, truncated)
+	assert.Equal(t, 20, len(items))
+}
+
+func TestListResourcesForWatch(t *testing.T) {
+	// config maps are listed in two pages, and services in a single page
+	var limits []string
+	var lock sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		limits = append(limits, r.URL.Query().Get("limit"))
+		lock.Unlock()
+		list := unstructured.UnstructuredList{Object: map[string]interface{}{"apiVersion": "v1", "kind": "ServiceList"}}
+		list.SetResourceVersion("200")
+		names := []string{"svc"}
+		if strings.HasSuffix(r.URL.Path, "/configmaps") {
+			list.SetKind("ConfigMapList")
+			list.SetResourceVersion("100")
+			names = []string{"cm-0", "cm-1"}
+			if r.URL.Query().Get("continue") == "" {
+				list.SetContinue("2")
+			} else {
+				names = []string{"cm-2"}
+			}
+		}
+		for _, name := range names {
+			item := unstructured.Unstructured{}
+			item.SetAPIVersion("v1")
+			item.SetName(name)
+			list.Items = append(list.Items, item)
+		}
+		data, err := list.MarshalJSON()
+		assert.Nil(t, err)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(data)
+	}))
+	defer server.Close()
+	fakeDiscovery := &fakediscovery.FakeDiscovery{Fake: &kubetesting.Fake{Resources: []*metav1.APIResourceList{{
+		GroupVersion: "v1",
+		APIResources: []metav1.APIResource{
+			{Name: "configmaps", Namespaced: true, Kind: "ConfigMap", Verbs: []string{"list", "watch"}},
+			{Name: "services", Namespaced: true, Kind: "Service", Verbs: []string{"list", "watch"}},
+			{Name: "events", Namespaced: true, Kind: "Event", Verbs: []string{"watch"}},
+		},
+	}}}}
+	dynClientPool := dynamic.NewDynamicClientPool(&rest.Config{Host: server.URL})
+
+	objs, versions, err := listResourcesForWatch(context.Background(), dynClientPool, fakeDiscovery, test.TestNamespace, common.LabelApplicationName, 1)
+	assert.Nil(t, err)
+	var names []string
+	for _, obj := range objs {
+		names = append(names, obj.GetName())
+	}
+	assert.ElementsMatch(t, []string{"cm-0", "cm-1", "cm-2", "svc"}, names)
+	assert.Equal(t, ResourceVersions{
+		{Version: "v1", Kind: "ConfigMap"}: "100",
+		{Version: "v1", Kind: "Service"}:   "200",
+	}, versions)
+	// kinds which cannot be listed are skipped, and the lists are paged
+	assert.Equal(t, []string{"500", "500", "500"}, limits)
+}
+
+func TestListAllResourcesMaxItems(t *testing.T) {
+	var limits []string
+	server := newPagingServer(t, 20, &limits)
+	defer server.Close()
+	dclient, err := dynamic.NewClient(&rest.Config{Host: server.URL, ContentConfig: rest.ContentConfig{GroupVersion: &apiv1.SchemeGroupVersion}})
+	assert.Nil(t, err)
+	clientForResource := func(metav1.APIResource) (dynamic.Interface, error) {
+		return dclient, nil
+	}
+	apiResources := []metav1.APIResource{{Name: "configmaps", Namespaced: true, Version: "v1", Kind: "ConfigMap"}}
+
+	resources, truncated, err := listAllResources(clientForResource, apiResources, test.TestNamespace, metav1.ListOptions{}, ListAllOpts{MaxItems: 5}, DefaultBulkOptions.MaxConcurrency)
+	assert.Nil(t, err)
+	assert.True(t, truncated)
+	assert.Equal(t, 5, len(resources))
+
+	resources, truncated, err = listAllResources(clientForResource, apiResources, test.TestNamespace, metav1.ListOptions{}, ListAllOpts{}, DefaultBulkOptions.MaxConcurrency)
+	assert.Nil(t, err)
+	assert.False(t, truncated)
+	assert.Equal(t, 20, len(resources))
+}
+
+func TestListAllResourcesMaxItemsAcrossTypes(t *testing.T) {
+	var limits []string
+	cmServer := newKindPagingServer(t, "ConfigMap", "cm-", 4, &limits)
+	defer cmServer.Close()
+	secretServer := newKindPagingServer(t, "Secret", "secret-", 4, &limits)
+	defer secretServer.Close()
+	clients := map[string]dynamic.Interface{}
+	for kind, url := range map[string]string{"ConfigMap": cmServer.URL, "Secret": secretServer.URL} {
+		dclient, err := dynamic.NewClient(&rest.Config{Host: url, ContentConfig: rest.ContentConfig{GroupVersion: &apiv1.SchemeGroupVersion}})
+		assert.Nil(t, err)
+		clients[kind] = dclient
+	}
+	clientForResource := func(apiResource metav1.APIResource) (dynamic.Interface, error) {
+		return clients[apiResource.Kind], nil
+	}
+	apiResources := []metav1.APIResource{
+		{Name: "secrets", Namespaced: true, Version: "v1", Kind: "Secret"},
+		{Name: "configmaps", Namespaced: true, Version: "v1", Kind: "ConfigMap"},
+	}
+
+	// both types are listed in full before the cap applies, so the kept resources are the first by key
+	for i := 0; i < 5; i++ {
+		resources, truncated, err := listAllResources(clientForResource, apiResources, test.TestNamespace, metav1.ListOptions{}, ListAllOpts{MaxItems: 5}, DefaultBulkOptions.MaxConcurrency)
+		assert.Nil(t, err)
+		assert.True(t, truncated)
+		var names []string
+		for _, obj := range resources {
+			names = append(names, obj.GetName())
+		}
+		assert.Equal(t, []string{"cm-0", "cm-1", "cm-2", "cm-3", "secret-0"}, names)
+	}
+}
@@ -0,0 +1,52 @@
+package kube
+
+import (
+	"io/ioutil"
+	"os"
+
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+)
+
+// GenerateKubeconfig writes a kubeconfig file with a context for each of the given REST configs,
+// named after its key, and returns the path of the file. A single file can then be shared by applies
+// to several clusters (see ApplyOpts.KubeconfigPath and ApplyOpts.KubeContext), rather than generating
+// TLS files for every apply. The file contains credentials, so it is created in memory backed storage
+// where available, and the caller is responsible for deleting it.
+func GenerateKubeconfig(configs map[string]*rest.Config) (string, error) {
+	kubeconfig := clientcmdapi.NewConfig()
+	for name, config := range configs {
+		kubeconfig.Clusters[name] = &clientcmdapi.Cluster{
+			Server:                   config.Host,
+			InsecureSkipTLSVerify:    config.TLSClientConfig.Insecure,
+			CertificateAuthority:     config.TLSClientConfig.CAFile,
+			CertificateAuthorityData: config.TLSClientConfig.CAData,
+		}
+		kubeconfig.AuthInfos[name] = &clientcmdapi.AuthInfo{
+			ClientCertificate:     config.TLSClientConfig.CertFile,
+			ClientCertificateData: config.TLSClientConfig.CertData,
+			ClientKey:             config.TLSClientConfig.KeyFile,
+			ClientKeyData:         config.TLSClientConfig.KeyData,
+			Token:                 config.BearerToken,
+			Username:              config.Username,
+			Password:              config.Password,
+			AuthProvider:          config.AuthProvider,
+		}
+		kubeconfig.Contexts[name] = &clientcmdapi.Context{Cluster: name, AuthInfo: name}
+	}
+	f, err := ioutil.TempFile(kubectlTempDir, "kubeconfig-")
+	if err != nil {
+		return "", err
+	}
+	err = f.Close()
+	if err != nil {
+		return "", err
+	}
+	err = clientcmd.WriteToFile(*kubeconfig, f.Name())
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
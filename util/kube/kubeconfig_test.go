@@ -0,0 +1,41 @@
+package kube
+
+import (
+	"os"
+	"testing"
+
+	"github.com/argoproj/argo-cd/test"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+func TestGenerateKubeconfig(t *testing.T) {
+	path, err := GenerateKubeconfig(map[string]*rest.Config{
+		"prod":    {Host: "https://prod.example.com:6443", BearerToken: "prod-token"},
+		"staging": {Host: "https://staging.example.com:6443", BearerToken: "staging-token"},
+	})
+	assert.Nil(t, err)
+	defer func() { _ = os.Remove(path) }()
+
+	kubeconfig, err := clientcmd.LoadFromFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, "https://prod.example.com:6443", kubeconfig.Clusters["prod"].Server)
+	assert.Equal(t, "staging-token", kubeconfig.AuthInfos["staging"].Token)
+
+	defer func(orig func([]string, []byte) ([]byte, error)) { runKubectl = orig }(runKubectl)
+	var applyArgs [][]string
+	runKubectl = func(args []string, stdin []byte) ([]byte, error) {
+		applyArgs = append(applyArgs, args)
+		return stdin, nil
+	}
+	svc := MustToUnstructured(test.DemoService())
+	for _, context := range []string{"prod", "staging"} {
+		_, err = ApplyResource(nil, svc, test.TestNamespace, ApplyOpts{KubeconfigPath: path, KubeContext: context})
+		assert.Nil(t, err)
+	}
+	if assert.Equal(t, 2, len(applyArgs)) {
+		assert.Equal(t, []string{"--kubeconfig", path, "--context", "prod"}, applyArgs[0][:4])
+		assert.Equal(t, []string{"--kubeconfig", path, "--context", "staging"}, applyArgs[1][:4])
+	}
+}
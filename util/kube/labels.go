@@ -0,0 +1,45 @@
+package kube
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// ValidateLabelSelector verifies a label key and value are valid, so they can be used to build a
+// label selector
+func ValidateLabelSelector(key string, value string) error {
+	if errs := validation.IsQualifiedName(key); len(errs) > 0 {
+		return fmt.Errorf("invalid label key '%s': %s", key, strings.Join(errs, "; "))
+	}
+	if errs := validation.IsValidLabelValue(value); len(errs) > 0 {
+		return fmt.Errorf("invalid value '%s' for label '%s': %s", value, key, strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// SelectorFromMap builds a label selector matching all of the labels in the map. Every key and value is
+// validated first, since an invalid pair would otherwise silently produce a selector matching everything.
+func SelectorFromMap(m map[string]string) (labels.Selector, error) {
+	for key, value := range m {
+		if err := ValidateLabelSelector(key, value); err != nil {
+			return nil, err
+		}
+	}
+	return labels.SelectorFromSet(labels.Set(m)), nil
+}
+
+// MatchesLabels returns whether the object has all of the labels in the map. It is used for client side
+// filtering, since not every kubernetes API supports label filtering.
+func MatchesLabels(obj *unstructured.Unstructured, m map[string]string) bool {
+	objLabels := obj.GetLabels()
+	for key, value := range m {
+		if objValue, ok := objLabels[key]; !ok || objValue != value {
+			return false
+		}
+	}
+	return true
+}
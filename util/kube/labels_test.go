@@ -0,0 +1,51 @@
+package kube
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/argoproj/argo-cd/common"
+	"github.com/argoproj/argo-cd/test"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+func TestValidateLabelSelector(t *testing.T) {
+	assert.Nil(t, ValidateLabelSelector(common.LabelApplicationName, "guestbook"))
+	assert.Nil(t, ValidateLabelSelector("app", ""))
+
+	err := ValidateLabelSelector("my label", "guestbook")
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "invalid label key")
+
+	err = ValidateLabelSelector("example.com/a/b", "guestbook")
+	assert.NotNil(t, err)
+
+	err = ValidateLabelSelector("app", "guest book")
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "invalid value")
+
+	err = ValidateLabelSelector("app", strings.Repeat("a", 64))
+	assert.NotNil(t, err)
+}
+
+func TestSelectorFromMap(t *testing.T) {
+	selector, err := SelectorFromMap(map[string]string{common.LabelApplicationName: "guestbook", "tier": "frontend"})
+	assert.Nil(t, err)
+	assert.Equal(t, common.LabelApplicationName+"=guestbook,tier=frontend", selector.String())
+	assert.True(t, selector.Matches(labels.Set{common.LabelApplicationName: "guestbook", "tier": "frontend", "extra": "label"}))
+	assert.False(t, selector.Matches(labels.Set{common.LabelApplicationName: "guestbook"}))
+
+	_, err = SelectorFromMap(map[string]string{"app": "guestbook", "my label": "frontend"})
+	assert.NotNil(t, err)
+}
+
+func TestMatchesLabels(t *testing.T) {
+	obj := MustToUnstructured(test.DemoService())
+	obj.SetLabels(map[string]string{common.LabelApplicationName: "guestbook", "tier": "frontend"})
+
+	assert.True(t, MatchesLabels(obj, map[string]string{common.LabelApplicationName: "guestbook", "tier": "frontend"}))
+	assert.True(t, MatchesLabels(obj, map[string]string{}))
+	assert.False(t, MatchesLabels(obj, map[string]string{common.LabelApplicationName: "guestbook", "tier": "backend"}))
+	assert.False(t, MatchesLabels(obj, map[string]string{"missing": ""}))
+}
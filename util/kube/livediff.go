@@ -0,0 +1,208 @@
+package kube
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/argoproj/argo-cd/util/diff"
+	"github.com/pkg/errors"
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/rest"
+)
+
+// maxDryRunCacheSize is the number of dry run results kept before the cache is cleared
+const maxDryRunCacheSize = 1000
+
+// dryRunCache holds the results of server-side dry runs by the hash of the desired and live objects
+type dryRunCache struct {
+	lock    sync.Mutex
+	results map[string]*unstructured.Unstructured
+}
+
+func newDryRunCache() *dryRunCache {
+	return &dryRunCache{results: make(map[string]*unstructured.Unstructured)}
+}
+
+func (c *dryRunCache) get(key string) (*unstructured.Unstructured, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	obj, ok := c.results[key]
+	if !ok {
+		return nil, false
+	}
+	return obj.DeepCopy(), true
+}
+
+func (c *dryRunCache) set(key string, obj *unstructured.Unstructured) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if len(c.results) >= maxDryRunCacheSize {
+		c.results = make(map[string]*unstructured.Unstructured)
+	}
+	c.results[key] = obj.DeepCopy()
+}
+
+var defaultDryRunCache = newDryRunCache()
+
+// ComputeLiveDiff returns whether applying the desired object would modify the live object, and a
+// unified diff of the modifications. Rather than comparing the desired object with the live object
+// directly, the desired object is applied with a server-side dry run, so the comparison includes the
+// defaults and admission mutations the API server would add (e.g. a cpu quantity of 0.5 is stored as
+// 500m). Dry run results are cached until either the desired or the live object changes. Requires
+// Kubernetes 1.13 or later, since older servers do not recognize dry runs and would apply the object.
+func ComputeLiveDiff(config *rest.Config, desired *unstructured.Unstructured, namespace string) (bool, string, error) {
+	disco, err := discovery.NewDiscoveryClientForConfig(config)
+	if err != nil {
+		return false, "", err
+	}
+	if err = verifyServerSideDryRun(disco); err != nil {
+		return false, "", err
+	}
+	apiResource, err := ServerResourceForGroupVersionKind(disco, desired.GroupVersionKind())
+	if err != nil {
+		return false, "", err
+	}
+	restClient, err := newUnstructuredRESTClient(config, desired.GroupVersionKind().GroupVersion())
+	if err != nil {
+		return false, "", err
+	}
+	return computeLiveDiff(restClient, apiResource, desired, liveResourceNamespace(apiResource, desired, namespace), config.Host, defaultDryRunCache)
+}
+
+// verifyServerSideDryRun returns an error if the API server is too old to recognize dry runs
+func verifyServerSideDryRun(disco discovery.DiscoveryInterface) error {
+	serverVersion, err := disco.ServerVersion()
+	if err != nil {
+		return err
+	}
+	major, minor, err := parseServerVersion(serverVersion)
+	if err != nil {
+		return err
+	}
+	if !isAtLeastVersion(major, minor, serverSideDryRunMinVersion) {
+		return fmt.Errorf("server-side dry run requires Kubernetes 1.%d or later, server is %s.%s", serverSideDryRunMinVersion, serverVersion.Major, serverVersion.Minor)
+	}
+	return nil
+}
+
+func computeLiveDiff(restClient rest.Interface, apiResource *metav1.APIResource, desired *unstructured.Unstructured, namespace string, cluster string, cache *dryRunCache) (bool, string, error) {
+	result, err := dryRunDiff(restClient, apiResource, desired, namespace, cluster, cache)
+	if err != nil {
+		return false, "", err
+	}
+	return result.modified, result.text, nil
+}
+
+// liveDiff is the outcome of comparing a live object with the result of applying the desired object
+// in a dry run
+type liveDiff struct {
+	// exists is whether the live object exists
+	exists bool
+	// predicted is the object the API server would store
+	predicted *unstructured.Unstructured
+	modified  bool
+	text      string
+}
+
+func dryRunDiff(restClient rest.Interface, apiResource *metav1.APIResource, desired *unstructured.Unstructured, namespace string, cluster string, cache *dryRunCache) (*liveDiff, error) {
+	if desired.GetName() == "" {
+		return nil, fmt.Errorf("resource was supplied without a name")
+	}
+	live := &unstructured.Unstructured{}
+	err := restClient.Get().
+		NamespaceIfScoped(namespace, apiResource.Namespaced).
+		Resource(apiResource.Name).
+		Name(desired.GetName()).
+		Do().
+		Into(live)
+	if err != nil {
+		if !apierr.IsNotFound(err) {
+			return nil, errors.WithStack(err)
+		}
+		live = nil
+	}
+
+	key, err := dryRunCacheKey(cluster, desired, live)
+	if err != nil {
+		return nil, err
+	}
+	predicted, ok := cache.get(key)
+	if !ok {
+		predicted, err = dryRunApply(restClient, apiResource, namespace, desired, live)
+		if err != nil {
+			return nil, err
+		}
+		cache.set(key, predicted)
+	}
+
+	result := &liveDiff{exists: live != nil, predicted: predicted}
+	if live != nil && SemanticEqual(predicted, live) {
+		return result, nil
+	}
+	var liveForDiff *unstructured.Unstructured
+	if live != nil {
+		liveForDiff = withoutServerFields(live)
+	}
+	result.text, err = diff.DiffText(withoutServerFields(predicted), liveForDiff, diff.DiffTextOpts{NoColor: true})
+	if err != nil {
+		return nil, err
+	}
+	result.modified = true
+	return result, nil
+}
+
+// dryRunApply returns the object the API server would store if the desired object was applied. A new
+// object is created, and an existing object is merge patched with the desired object, so fields which
+// only exist in the live object are preserved.
+func dryRunApply(restClient rest.Interface, apiResource *metav1.APIResource, namespace string, desired, live *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+	result := &unstructured.Unstructured{}
+	var req *rest.Request
+	if live == nil {
+		req = restClient.Post().
+			NamespaceIfScoped(namespace, apiResource.Namespaced).
+			Resource(apiResource.Name).
+			Body(desired)
+	} else {
+		patch, err := json.Marshal(desired)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		req = restClient.Patch(types.MergePatchType).
+			NamespaceIfScoped(namespace, apiResource.Namespaced).
+			Resource(apiResource.Name).
+			Name(desired.GetName()).
+			Body(patch)
+	}
+	err := req.Param("dryRun", "All").Do().Into(result)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return result, nil
+}
+
+// dryRunCacheKey returns a hash identifying the dry run of a desired object against a live object.
+// The live object is identified by its resource version, which changes with every modification.
+func dryRunCacheKey(cluster string, desired, live *unstructured.Unstructured) (string, error) {
+	data, err := json.Marshal(desired)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	h := sha256.New()
+	_, _ = h.Write([]byte(cluster))
+	_, _ = h.Write([]byte{0})
+	_, _ = h.Write(data)
+	if live != nil {
+		_, _ = h.Write([]byte{0})
+		_, _ = h.Write([]byte(live.GetUID()))
+		_, _ = h.Write([]byte{0})
+		_, _ = h.Write([]byte(live.GetResourceVersion()))
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,94 @@
+package kube
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/argoproj/argo-cd/test"
+	"github.com/argoproj/argo-cd/util/diff"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/rest"
+)
+
+func newResourceQuota(cpu string) *unstructured.Unstructured {
+	quota := &unstructured.Unstructured{}
+	quota.SetAPIVersion("v1")
+	quota.SetKind("ResourceQuota")
+	quota.SetName("compute-quota")
+	quota.SetNamespace(test.TestNamespace)
+	quota.Object["spec"] = map[string]interface{}{"hard": map[string]interface{}{"cpu": cpu}}
+	return quota
+}
+
+// newDefaultingServer returns a server which stores a resource quota, and canonicalizes the cpu quantity
+// of patches the same way the API server does
+func newDefaultingServer(t *testing.T, dryRuns *int) *httptest.Server {
+	live := newResourceQuota("500m")
+	live.SetUID("1")
+	live.SetResourceVersion("5")
+	live.Object["status"] = map[string]interface{}{"used": map[string]interface{}{"cpu": "100m"}}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.Method {
+		case "GET":
+			data, err := json.Marshal(live)
+			assert.Nil(t, err)
+			_, _ = w.Write(data)
+		case "PATCH":
+			*dryRuns++
+			assert.Equal(t, "All", r.URL.Query().Get("dryRun"))
+			body, err := ioutil.ReadAll(r.Body)
+			assert.Nil(t, err)
+			var patch unstructured.Unstructured
+			assert.Nil(t, patch.UnmarshalJSON(body))
+			cpu, _ := unstructured.NestedString(patch.Object, "spec", "hard", "cpu")
+			quantity := resource.MustParse(cpu)
+			result := live.DeepCopy()
+			result.Object["spec"] = map[string]interface{}{"hard": map[string]interface{}{"cpu": quantity.String()}}
+			data, err := json.Marshal(result)
+			assert.Nil(t, err)
+			_, _ = w.Write(data)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))
+}
+
+func TestComputeLiveDiffServerDefaults(t *testing.T) {
+	var dryRuns int
+	server := newDefaultingServer(t, &dryRuns)
+	defer server.Close()
+	restClient, err := newUnstructuredRESTClient(&rest.Config{Host: server.URL}, schema.GroupVersion{Version: "v1"})
+	assert.Nil(t, err)
+	apiResource := &metav1.APIResource{Name: "resourcequotas", Namespaced: true, Kind: "ResourceQuota"}
+	cache := newDryRunCache()
+
+	// 0.5 and 500m are the same quantity, but a diff of the desired and live objects can not tell
+	desired := newResourceQuota("0.5")
+	assert.True(t, diff.Diff(desired, newResourceQuota("500m")).Modified)
+
+	modified, text, err := computeLiveDiff(restClient, apiResource, desired, test.TestNamespace, server.URL, cache)
+	assert.Nil(t, err)
+	assert.False(t, modified)
+	assert.Empty(t, text)
+
+	// the result of the dry run is cached
+	_, _, err = computeLiveDiff(restClient, apiResource, desired, test.TestNamespace, server.URL, cache)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, dryRuns)
+
+	modified, text, err = computeLiveDiff(restClient, apiResource, newResourceQuota("2"), test.TestNamespace, server.URL, cache)
+	assert.Nil(t, err)
+	assert.True(t, modified)
+	assert.Contains(t, text, "-    cpu: 500m")
+	assert.Contains(t, text, "+    cpu: \"2\"")
+	assert.NotContains(t, text, "resourceVersion")
+	assert.Equal(t, 2, dryRuns)
+}
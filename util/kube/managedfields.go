@@ -0,0 +1,244 @@
+package kube
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// ManagedField is a field of an object owned by a field manager under server-side apply
+type ManagedField struct {
+	// Path is the dot separated path of the field. Elements of lists are written as [key=value] for
+	// lists keyed by fields, and as [value] for sets of values (e.g. spec.containers[name=nginx].image).
+	Path string
+	// segments are the parsed elements of the path
+	segments []fieldSegment
+}
+
+// fieldSegment is one element of the path of a managed field
+type fieldSegment struct {
+	// field is the name of a map field, if the segment selects one
+	field string
+	// key selects the element of a list whose fields have the given values
+	key map[string]interface{}
+	// value selects the element of a list which equals it
+	value   interface{}
+	isValue bool
+}
+
+// ManagedFieldsOf returns the fields of an object which are owned by a field manager, as recorded in
+// metadata.managedFields by the API server. Only leaf fields are returned, sorted by path. Both the
+// FieldsV1 format of Kubernetes 1.18+ and the fields of older servers are understood.
+func ManagedFieldsOf(obj *unstructured.Unstructured, manager string) ([]ManagedField, error) {
+	fieldsByManager, err := managedFieldsByManager(obj)
+	if err != nil {
+		return nil, err
+	}
+	fields := fieldsByManager[manager]
+	sort.Slice(fields, func(i, j int) bool {
+		return fields[i].Path < fields[j].Path
+	})
+	return fields, nil
+}
+
+// managedFieldsByManager returns the leaf fields of an object owned by each of its field managers
+func managedFieldsByManager(obj *unstructured.Unstructured) (map[string][]ManagedField, error) {
+	entries, _ := unstructured.NestedSlice(obj.Object, "metadata", "managedFields")
+	fieldsByManager := make(map[string][]ManagedField)
+	for _, item := range entries {
+		entry, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		manager, _ := entry["manager"].(string)
+		set, ok := entry["fieldsV1"].(map[string]interface{})
+		if !ok {
+			set, _ = entry["fields"].(map[string]interface{})
+		}
+		entryFields, err := flattenFieldSet(set, nil)
+		if err != nil {
+			return nil, fmt.Errorf("%s %q has invalid managed fields of %s: %v", obj.GetKind(), obj.GetName(), manager, err)
+		}
+		fieldsByManager[manager] = append(fieldsByManager[manager], entryFields...)
+	}
+	return fieldsByManager, nil
+}
+
+// flattenFieldSet returns the leaf fields of a FieldsV1 set, whose keys are prefixed by f: (a map
+// field), k: (a list element by key), or v: (a list element by value). The "." key marks the owner of
+// a field with children, which is not a leaf itself.
+func flattenFieldSet(set map[string]interface{}, prefix []fieldSegment) ([]ManagedField, error) {
+	var fields []ManagedField
+	for key, child := range set {
+		if key == "." {
+			continue
+		}
+		segment, err := parseFieldSegment(key)
+		if err != nil {
+			return nil, err
+		}
+		segments := append(append([]fieldSegment{}, prefix...), segment)
+		childSet, _ := child.(map[string]interface{})
+		if isLeafFieldSet(childSet) {
+			fields = append(fields, ManagedField{Path: formatFieldPath(segments), segments: segments})
+			continue
+		}
+		childFields, err := flattenFieldSet(childSet, segments)
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, childFields...)
+	}
+	return fields, nil
+}
+
+// isLeafFieldSet returns whether a set has no children other than the "." marker
+func isLeafFieldSet(set map[string]interface{}) bool {
+	for key := range set {
+		if key != "." {
+			return false
+		}
+	}
+	return true
+}
+
+func parseFieldSegment(key string) (fieldSegment, error) {
+	switch {
+	case strings.HasPrefix(key, "f:"):
+		return fieldSegment{field: strings.TrimPrefix(key, "f:")}, nil
+	case strings.HasPrefix(key, "k:"):
+		var listKey map[string]interface{}
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(key, "k:")), &listKey); err != nil {
+			return fieldSegment{}, fmt.Errorf("invalid list key %q", key)
+		}
+		return fieldSegment{key: canonicalizeNumbers(listKey).(map[string]interface{})}, nil
+	case strings.HasPrefix(key, "v:"):
+		var value interface{}
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(key, "v:")), &value); err != nil {
+			return fieldSegment{}, fmt.Errorf("invalid list value %q", key)
+		}
+		return fieldSegment{value: canonicalizeNumbers(value), isValue: true}, nil
+	}
+	return fieldSegment{}, fmt.Errorf("unknown field %q", key)
+}
+
+func formatFieldPath(segments []fieldSegment) string {
+	var path string
+	for _, segment := range segments {
+		switch {
+		case segment.isValue:
+			path += fmt.Sprintf("[%v]", segment.value)
+		case segment.key != nil:
+			var names []string
+			for name := range segment.key {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			var parts []string
+			for _, name := range names {
+				parts = append(parts, fmt.Sprintf("%s=%v", name, segment.key[name]))
+			}
+			path += "[" + strings.Join(parts, ",") + "]"
+		default:
+			if path != "" {
+				path += "."
+			}
+			path += segment.field
+		}
+	}
+	return path
+}
+
+// OverwrittenManagedFields returns the paths of the fields set by the desired object which were changed
+// by another field manager since the manager applied them, sorted by path. When a client other than the
+// manager changes a field, the API server moves the ownership of the field from the manager to that
+// client, so these are the desired fields the manager no longer owns, but another manager does. This is
+// a more precise signal of drift under server-side apply than a diff of the whole object, which also
+// reports fields the manager never set. Fields the manager still owns are not reported even if their
+// live values differ from the desired object, since those are changes the manager has yet to apply.
+// Fields the desired object no longer sets are ignored, since the next apply releases them, as are
+// desired fields no manager owns.
+func OverwrittenManagedFields(desired *unstructured.Unstructured, live *unstructured.Unstructured, manager string) ([]string, error) {
+	fieldsByManager, err := managedFieldsByManager(live)
+	if err != nil {
+		return nil, err
+	}
+	// the keys of list items are matched by value, regardless of whether numbers were decoded as
+	// integers or floats
+	desired = CanonicalizeNumbers(desired)
+	owned := make(map[string]bool)
+	for _, field := range fieldsByManager[manager] {
+		owned[field.Path] = true
+	}
+	overwritten := make(map[string]bool)
+	for fieldManager, fields := range fieldsByManager {
+		if fieldManager == manager {
+			continue
+		}
+		for _, field := range fields {
+			if owned[field.Path] {
+				continue
+			}
+			if _, ok := resolveFieldPath(desired.Object, field.segments); ok {
+				overwritten[field.Path] = true
+			}
+		}
+	}
+	var paths []string
+	for path := range overwritten {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// resolveFieldPath returns the value at the path of a managed field
+func resolveFieldPath(value interface{}, segments []fieldSegment) (interface{}, bool) {
+	for _, segment := range segments {
+		if segment.field != "" {
+			m, ok := value.(map[string]interface{})
+			if !ok {
+				return nil, false
+			}
+			if value, ok = m[segment.field]; !ok {
+				return nil, false
+			}
+			continue
+		}
+		list, ok := value.([]interface{})
+		if !ok {
+			return nil, false
+		}
+		found := false
+		for _, item := range list {
+			if matchesFieldSegment(item, segment) {
+				value, found = item, true
+				break
+			}
+		}
+		if !found {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+func matchesFieldSegment(item interface{}, segment fieldSegment) bool {
+	if segment.isValue {
+		return reflect.DeepEqual(item, segment.value)
+	}
+	m, ok := item.(map[string]interface{})
+	if !ok {
+		return false
+	}
+	for name, keyValue := range segment.key {
+		if !reflect.DeepEqual(m[name], keyValue) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,170 @@
+package kube
+
+import (
+	"testing"
+
+	"github.com/ghodss/yaml"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// managedDeployment was applied by argocd, and shares the ownership of its label with another applier
+// which applied the same value. Its replicas are scaled by the controller manager, and its image was
+// changed by kubectl edit, which moved the ownership of the image from argocd to kubectl.
+const managedDeployment = `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: guestbook-ui
+  labels:
+    app: guestbook
+  managedFields:
+  - manager: argocd
+    operation: Apply
+    apiVersion: apps/v1
+    time: "2019-03-30T15:00:00Z"
+    fieldsType: FieldsV1
+    fieldsV1:
+      f:metadata:
+        f:labels:
+          f:app: {}
+      f:spec:
+        f:template:
+          f:spec:
+            f:containers:
+              k:{"name":"guestbook-ui"}:
+                .: {}
+                f:name: {}
+                f:ports:
+                  k:{"containerPort":80,"protocol":"TCP"}:
+                    .: {}
+                    f:containerPort: {}
+                    f:protocol: {}
+  - manager: labeler
+    operation: Apply
+    apiVersion: apps/v1
+    time: "2019-03-30T15:05:00Z"
+    fieldsType: FieldsV1
+    fieldsV1:
+      f:metadata:
+        f:labels:
+          f:app: {}
+  - manager: kube-controller-manager
+    operation: Update
+    apiVersion: apps/v1
+    time: "2019-03-30T15:10:00Z"
+    fieldsType: FieldsV1
+    fieldsV1:
+      f:spec:
+        f:replicas: {}
+      f:status:
+        f:replicas: {}
+  - manager: kubectl-edit
+    operation: Update
+    apiVersion: apps/v1
+    time: "2019-03-30T15:20:00Z"
+    fieldsType: FieldsV1
+    fieldsV1:
+      f:spec:
+        f:template:
+          f:spec:
+            f:containers:
+              k:{"name":"guestbook-ui"}:
+                f:image: {}
+spec:
+  replicas: 5
+  template:
+    spec:
+      containers:
+      - name: guestbook-ui
+        image: gcr.io/heptio-images/ks-guestbook-demo:0.3
+        ports:
+        - containerPort: 80
+          protocol: TCP
+status:
+  replicas: 5
+`
+
+func TestManagedFieldsOf(t *testing.T) {
+	var live unstructured.Unstructured
+	assert.Nil(t, yaml.Unmarshal([]byte(managedDeployment), &live.Object))
+
+	fields, err := ManagedFieldsOf(&live, "argocd")
+	assert.Nil(t, err)
+	var paths []string
+	for _, field := range fields {
+		paths = append(paths, field.Path)
+	}
+	assert.Equal(t, []string{
+		"metadata.labels.app",
+		"spec.template.spec.containers[name=guestbook-ui].name",
+		"spec.template.spec.containers[name=guestbook-ui].ports[containerPort=80,protocol=TCP].containerPort",
+		"spec.template.spec.containers[name=guestbook-ui].ports[containerPort=80,protocol=TCP].protocol",
+	}, paths)
+}
+
+func TestOverwrittenManagedFields(t *testing.T) {
+	var live unstructured.Unstructured
+	assert.Nil(t, yaml.Unmarshal([]byte(managedDeployment), &live.Object))
+	desired := &unstructured.Unstructured{}
+	assert.Nil(t, yaml.Unmarshal([]byte(`
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: guestbook-ui
+  labels:
+    app: guestbook
+spec:
+  template:
+    spec:
+      containers:
+      - name: guestbook-ui
+        image: gcr.io/heptio-images/ks-guestbook-demo:0.2
+        ports:
+        - containerPort: 80
+          protocol: TCP
+`), &desired.Object))
+
+	// the label is owned by the other applier too, and the replicas are not desired
+	overwritten, err := OverwrittenManagedFields(desired, &live, "argocd")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"spec.template.spec.containers[name=guestbook-ui].image"}, overwritten)
+
+	// once argocd applied the image again, it owns the image, and a desired image it has yet to apply
+	// is not overwritten
+	var reapplied unstructured.Unstructured
+	assert.Nil(t, yaml.Unmarshal([]byte(`
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: guestbook-ui
+  managedFields:
+  - manager: argocd
+    operation: Apply
+    apiVersion: apps/v1
+    time: "2019-03-30T15:30:00Z"
+    fieldsType: FieldsV1
+    fieldsV1:
+      f:spec:
+        f:template:
+          f:spec:
+            f:containers:
+              k:{"name":"guestbook-ui"}:
+                .: {}
+                f:image: {}
+                f:name: {}
+spec:
+  template:
+    spec:
+      containers:
+      - name: guestbook-ui
+        image: gcr.io/heptio-images/ks-guestbook-demo:0.2
+`), &reapplied.Object))
+	unstructured.SetNestedSlice(desired.Object, []interface{}{map[string]interface{}{
+		"name":  "guestbook-ui",
+		"image": "gcr.io/heptio-images/ks-guestbook-demo:0.4",
+	}}, "spec", "template", "spec", "containers")
+	overwritten, err = OverwrittenManagedFields(desired, &reapplied, "argocd")
+	assert.Nil(t, err)
+	assert.Empty(t, overwritten)
+}
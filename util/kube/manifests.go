@@ -0,0 +1,217 @@
+package kube
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	k8syaml "k8s.io/apimachinery/pkg/util/yaml"
+)
+
+// SplitYAML splits a stream of YAML (or JSON) documents into unstructured objects. Empty documents
+// are skipped, and List documents are expanded into their items.
+func SplitYAML(data []byte) ([]*unstructured.Unstructured, error) {
+	var objs []*unstructured.Unstructured
+	err := decodeYAMLStream(bytes.NewReader(data), func(obj *unstructured.Unstructured) error {
+		objs = append(objs, obj)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return objs, nil
+}
+
+// decodeYAMLStream decodes a stream of YAML (or JSON) documents one document at a time, calling handle
+// with each object, so the stream is never buffered as a whole. Empty documents are skipped, and List
+// documents are expanded into their items.
+func decodeYAMLStream(r io.Reader, handle func(*unstructured.Unstructured) error) error {
+	reader := k8syaml.NewYAMLReader(bufio.NewReader(r))
+	for {
+		doc, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		jsonBytes, err := yaml.YAMLToJSON(doc)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if string(bytes.TrimSpace(jsonBytes)) == "null" {
+			continue
+		}
+		var obj unstructured.Unstructured
+		err = obj.UnmarshalJSON(jsonBytes)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if obj.IsList() {
+			err = obj.EachListItem(func(item runtime.Object) error {
+				return handle(item.(*unstructured.Unstructured))
+			})
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			continue
+		}
+		if err = handle(&obj); err != nil {
+			return err
+		}
+	}
+}
+
+// ToList wraps the objects into a single List object, so they can be serialized as one document
+func ToList(objs []*unstructured.Unstructured) *unstructured.UnstructuredList {
+	list := &unstructured.UnstructuredList{
+		Object: map[string]interface{}{},
+		Items:  make([]unstructured.Unstructured, len(objs)),
+	}
+	list.SetAPIVersion("v1")
+	list.SetKind("List")
+	for i, obj := range objs {
+		list.Items[i] = *obj
+	}
+	return list
+}
+
+// GVKFromManifest returns the group version kind of a single YAML or JSON document. The whole document
+// is parsed, but only its apiVersion and kind are kept, rather than building an unstructured object. It
+// is an error for the data to contain more than one document.
+func GVKFromManifest(data []byte) (schema.GroupVersionKind, error) {
+	reader := k8syaml.NewYAMLReader(bufio.NewReader(bytes.NewReader(data)))
+	var typeMeta *metav1.TypeMeta
+	for {
+		doc, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return schema.GroupVersionKind{}, errors.WithStack(err)
+		}
+		if len(bytes.TrimSpace(doc)) == 0 {
+			continue
+		}
+		if typeMeta != nil {
+			return schema.GroupVersionKind{}, fmt.Errorf("manifest contains multiple documents")
+		}
+		typeMeta = &metav1.TypeMeta{}
+		err = yaml.Unmarshal(doc, typeMeta)
+		if err != nil {
+			return schema.GroupVersionKind{}, errors.WithStack(err)
+		}
+	}
+	if typeMeta == nil || typeMeta.Kind == "" {
+		return schema.GroupVersionKind{}, fmt.Errorf("manifest does not specify a kind")
+	}
+	return schema.FromAPIVersionAndKind(typeMeta.APIVersion, typeMeta.Kind), nil
+}
+
+// ReadManifestFile reads all objects from a YAML or JSON manifest file
+func ReadManifestFile(path string) ([]*unstructured.Unstructured, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	objs, err := SplitYAML(data)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse %s", path)
+	}
+	return objs, nil
+}
+
+// serverManagedMetadataFields are the metadata fields populated by the API server, which are not part
+// of an object's desired state
+var serverManagedMetadataFields = []string{
+	"uid",
+	"resourceVersion",
+	"creationTimestamp",
+	"generation",
+	"selfLink",
+	"managedFields",
+}
+
+// withoutServerFields returns a copy of an object with its status and server managed metadata removed
+func withoutServerFields(obj *unstructured.Unstructured) *unstructured.Unstructured {
+	obj = obj.DeepCopy()
+	for _, field := range serverManagedMetadataFields {
+		unstructured.RemoveNestedField(obj.Object, "metadata", field)
+	}
+	delete(obj.Object, "status")
+	return obj
+}
+
+// ExportResource returns the YAML of a live object with its status and server managed metadata
+// stripped, so the output can be applied again
+func ExportResource(obj *unstructured.Unstructured) ([]byte, error) {
+	data, err := yaml.Marshal(withoutServerFields(obj).Object)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return data, nil
+}
+
+// PreApplyValidateOpts are options for PreApplyValidate
+type PreApplyValidateOpts struct {
+	// Strip removes fields managed by the server from a copy of the object instead of failing
+	Strip bool
+}
+
+// PreApplyValidate verifies an object does not set fields which are managed by the server, such as
+// its status, uid or resourceVersion, which must not be sent on apply. Such fields are either
+// rejected by the server or cause the object to drift. Unless opts.Strip is set, a
+// ForbiddenFieldsError listing the paths of the offending fields is returned. Empty values, such as
+// the null creationTimestamp of objects converted from typed structs, are allowed. The object to apply
+// is returned, which with opts.Strip is a copy without the offending fields. The object passed in is
+// never modified.
+func PreApplyValidate(obj *unstructured.Unstructured, opts PreApplyValidateOpts) (*unstructured.Unstructured, error) {
+	if opts.Strip {
+		obj = obj.DeepCopy()
+	}
+	var paths [][]string
+	for _, field := range serverManagedMetadataFields {
+		paths = append(paths, []string{"metadata", field})
+	}
+	paths = append(paths, []string{"status"})
+
+	var forbidden []string
+	for _, path := range paths {
+		value, ok := unstructured.NestedFieldCopy(obj.Object, path...)
+		if !ok || isEmptyValue(value) {
+			continue
+		}
+		if opts.Strip {
+			unstructured.RemoveNestedField(obj.Object, path...)
+			continue
+		}
+		forbidden = append(forbidden, strings.Join(path, "."))
+	}
+	if len(forbidden) > 0 {
+		return nil, &ForbiddenFieldsError{Key: GetResourceKey(obj), Paths: forbidden}
+	}
+	return obj, nil
+}
+
+func isEmptyValue(value interface{}) bool {
+	switch v := value.(type) {
+	case nil:
+		return true
+	case string:
+		return v == ""
+	case map[string]interface{}:
+		return len(v) == 0
+	case []interface{}:
+		return len(v) == 0
+	}
+	return false
+}
@@ -0,0 +1,130 @@
+package kube
+
+import (
+	"testing"
+
+	"github.com/argoproj/argo-cd/test"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+const multiDocManifest = `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: demo
+data:
+  foo: bar
+---
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: demo
+spec:
+  replicas: 2
+`
+
+func TestSplitYAML(t *testing.T) {
+	objs, err := SplitYAML([]byte(multiDocManifest))
+	assert.Nil(t, err)
+	if assert.Equal(t, 2, len(objs)) {
+		assert.Equal(t, "ConfigMap", objs[0].GetKind())
+		assert.Equal(t, "Deployment", objs[1].GetKind())
+		assert.Equal(t, int64(2), objs[1].Object["spec"].(map[string]interface{})["replicas"])
+	}
+
+	objs, err = SplitYAML([]byte(`{"apiVersion": "v1", "kind": "Service", "metadata": {"name": "demo"}}`))
+	assert.Nil(t, err)
+	if assert.Equal(t, 1, len(objs)) {
+		assert.Equal(t, "Service", objs[0].GetKind())
+	}
+
+	_, err = SplitYAML([]byte("metadata:\n  name: demo\n"))
+	assert.NotNil(t, err)
+}
+
+func TestToList(t *testing.T) {
+	objs, err := SplitYAML([]byte(multiDocManifest))
+	assert.Nil(t, err)
+
+	list := ToList(objs)
+	assert.Equal(t, "List", list.GetKind())
+	assert.Equal(t, 2, len(list.Items))
+
+	data, err := list.MarshalJSON()
+	assert.Nil(t, err)
+	roundTripped, err := SplitYAML(data)
+	assert.Nil(t, err)
+	assert.Equal(t, objs, roundTripped)
+}
+
+func TestExportResource(t *testing.T) {
+	liveObj := MustToUnstructured(test.DemoDeployment())
+	liveObj.SetUID("b8b0d53e-1b4b-11e8-9d3c-42010a8a0002")
+	liveObj.SetResourceVersion("123")
+	liveObj.SetGeneration(2)
+	liveObj.SetSelfLink("/apis/apps/v1/namespaces/test-namespace/deployments/demo")
+	liveObj.SetCreationTimestamp(metav1.Now())
+	liveObj.Object["status"] = map[string]interface{}{"replicas": int64(2)}
+	metadata := liveObj.Object["metadata"].(map[string]interface{})
+	metadata["managedFields"] = []interface{}{map[string]interface{}{"manager": "kubectl"}}
+
+	data, err := ExportResource(liveObj)
+	assert.Nil(t, err)
+	objs, err := SplitYAML(data)
+	assert.Nil(t, err)
+	if assert.Equal(t, 1, len(objs)) {
+		exportedMetadata := objs[0].Object["metadata"].(map[string]interface{})
+		for _, field := range serverManagedMetadataFields {
+			assert.NotContains(t, exportedMetadata, field)
+		}
+		assert.NotContains(t, objs[0].Object, "status")
+		assert.Equal(t, "demo", objs[0].GetName())
+		assert.Equal(t, test.TestNamespace, objs[0].GetNamespace())
+		assert.Equal(t, liveObj.Object["spec"], objs[0].Object["spec"])
+	}
+	// the live object is left untouched
+	assert.Equal(t, "123", liveObj.GetResourceVersion())
+}
+
+func TestGVKFromManifest(t *testing.T) {
+	gvk, err := GVKFromManifest([]byte("---\napiVersion: apps/v1\nkind: Deployment\nmetadata:\n  name: demo\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, schema.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"}, gvk)
+
+	gvk, err = GVKFromManifest([]byte(`{"apiVersion": "v1", "kind": "Service", "metadata": {"name": "demo"}}`))
+	assert.Nil(t, err)
+	assert.Equal(t, schema.GroupVersionKind{Version: "v1", Kind: "Service"}, gvk)
+
+	_, err = GVKFromManifest([]byte(multiDocManifest))
+	assert.NotNil(t, err)
+
+	_, err = GVKFromManifest([]byte("metadata:\n  name: demo\n"))
+	assert.NotNil(t, err)
+}
+
+func TestPreApplyValidate(t *testing.T) {
+	t.Run("ResourceVersion", func(t *testing.T) {
+		obj := fakeDeploymentV1beta2()
+		obj.SetResourceVersion("123")
+		_, err := PreApplyValidate(obj, PreApplyValidateOpts{})
+		assert.NotNil(t, err)
+		forbiddenErr, ok := err.(*ForbiddenFieldsError)
+		assert.True(t, ok)
+		assert.Equal(t, []string{"metadata.resourceVersion"}, forbiddenErr.Paths)
+	})
+	t.Run("UID", func(t *testing.T) {
+		obj := fakeDeploymentV1beta2()
+		obj.SetUID("2a1a0b69-2b4c-11e8-a3b6-42010a8a0002")
+		stripped, err := PreApplyValidate(obj, PreApplyValidateOpts{Strip: true})
+		assert.Nil(t, err)
+		assert.Equal(t, "", string(stripped.GetUID()))
+		// the object passed in keeps its fields
+		assert.Equal(t, "2a1a0b69-2b4c-11e8-a3b6-42010a8a0002", string(obj.GetUID()))
+		// the null creationTimestamp and empty status of a converted typed object are allowed
+		_, err = PreApplyValidate(fakeDeploymentV1beta2(), PreApplyValidateOpts{})
+		assert.Nil(t, err)
+	})
+}
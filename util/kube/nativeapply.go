@@ -0,0 +1,173 @@
+package kube
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+)
+
+// lastAppliedConfigAnnotation is the annotation in which kubectl stores the configuration an object
+// was last applied with
+const lastAppliedConfigAnnotation = "kubectl.kubernetes.io/last-applied-configuration"
+
+// ApplyResourceNative applies an object in-process, without invoking kubectl. Like kubectl apply, a
+// three-way strategic merge patch is computed between the last applied configuration, the desired
+// object and the live object, and the last applied configuration is recorded in the same annotation
+// kubectl uses, so both apply paths can be used interchangeably. Fields which were previously applied
+// but are missing from the desired object are removed from the live object, while fields which were
+// never applied (e.g. defaults populated by the server) are kept. Kinds which have no merge strategy
+// (i.e. kinds which are not built into Kubernetes, such as custom resources) are applied using kubectl.
+func ApplyResourceNative(config *rest.Config, obj *unstructured.Unstructured, namespace string, opts ApplyOpts) (*unstructured.Unstructured, error) {
+	config = withWarningsLogged(config, fmt.Sprintf("applying %s/%s", obj.GetKind(), obj.GetName()), opts.WarningHandler)
+	dynClientPool := dynamic.NewDynamicClientPool(config)
+	disco, err := discovery.NewDiscoveryClientForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return applyResourceNative(dynClientPool, disco, config, obj, namespace, opts)
+}
+
+func applyResourceNative(dynClientPool dynamic.ClientPool, disco discovery.DiscoveryInterface, config *rest.Config, obj *unstructured.Unstructured, namespace string, opts ApplyOpts) (*unstructured.Unstructured, error) {
+	gvk := obj.GroupVersionKind()
+	versionedObj, err := scheme.Scheme.New(gvk)
+	if err != nil {
+		if runtime.IsNotRegisteredError(err) {
+			log.Debugf("%s has no merge strategy, applying with kubectl", gvk)
+			return ApplyResource(config, obj, namespace, opts)
+		}
+		return nil, err
+	}
+	log.Infof("Applying resource %s/%s natively in cluster: %s, namespace: %s", obj.GetKind(), obj.GetName(), config.Host, namespace)
+	if opts.CreateNamespace {
+		kubeclientset, err := kubernetes.NewForConfig(config)
+		if err != nil {
+			return nil, err
+		}
+		err = ensureNamespace(kubeclientset, obj, namespace, opts)
+		if err != nil {
+			return nil, err
+		}
+	}
+	dclient, err := dynClientPool.ClientForGroupVersionKind(gvk)
+	if err != nil {
+		return nil, err
+	}
+	apiResource, err := ServerResourceForGroupVersionKind(disco, gvk)
+	if err != nil {
+		return nil, err
+	}
+	if apiResource.Namespaced && obj.GetNamespace() != "" {
+		namespace = obj.GetNamespace()
+	} else if !apiResource.Namespaced {
+		namespace = ""
+	}
+	obj, err = decorateForSync(disco, obj, namespace, opts)
+	if err != nil {
+		return nil, err
+	}
+	reIf := dclient.Resource(apiResource, namespace)
+
+	modified, err := getModifiedConfiguration(obj)
+	if err != nil {
+		return nil, err
+	}
+	liveObj, err := reIf.Get(obj.GetName(), metav1.GetOptions{})
+	if err != nil {
+		if !apierr.IsNotFound(err) {
+			return nil, errors.WithStack(err)
+		}
+		var newObj unstructured.Unstructured
+		err = newObj.UnmarshalJSON(modified)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		createdObj, err := reIf.Create(&newObj)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		return createdObj, nil
+	}
+
+	current, err := json.Marshal(liveObj)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	original := []byte(liveObj.GetAnnotations()[lastAppliedConfigAnnotation])
+	lookupPatchMeta, err := strategicpatch.NewPatchMetaFromStruct(versionedObj)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	patch, err := strategicpatch.CreateThreeWayMergePatch(original, modified, current, lookupPatchMeta, true)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if string(patch) == "{}" {
+		log.Debugf("Resource %s/%s is unchanged", obj.GetKind(), obj.GetName())
+		return liveObj, nil
+	}
+	patchedObj, err := reIf.Patch(obj.GetName(), types.StrategicMergePatchType, patch)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return patchedObj, nil
+}
+
+// getModifiedConfiguration returns the serialized object annotated with its own configuration, in the
+// same way kubectl apply records the last applied configuration
+func getModifiedConfiguration(obj *unstructured.Unstructured) ([]byte, error) {
+	obj = obj.DeepCopy()
+	annotations := obj.GetAnnotations()
+	delete(annotations, lastAppliedConfigAnnotation)
+	obj.SetAnnotations(annotations)
+	original, err := json.Marshal(obj)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	setAnnotation(obj, lastAppliedConfigAnnotation, string(original))
+	modified, err := json.Marshal(obj)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return modified, nil
+}
+
+// ApplyPatch applies a JSON merge patch, such as the delta between a desired and a live object computed
+// from their diff, to a live resource and returns the patched object. Unlike an apply, only the fields in
+// the patch are sent, and the last applied configuration is left as it is. An empty patch is a no-op, and
+// the live object is returned unchanged.
+func ApplyPatch(dclient dynamic.Interface, apiResource *metav1.APIResource, namespace string, name string, mergePatch []byte) (*unstructured.Unstructured, error) {
+	reIf := dclient.Resource(apiResource, namespace)
+	if isEmptyPatch(mergePatch) {
+		log.Debugf("Patch of %s/%s is empty", apiResource.Kind, name)
+		liveObj, err := reIf.Get(name, metav1.GetOptions{})
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		return liveObj, nil
+	}
+	patchedObj, err := reIf.Patch(name, types.MergePatchType, mergePatch)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return patchedObj, nil
+}
+
+// isEmptyPatch returns whether a merge patch leaves the patched object unchanged
+func isEmptyPatch(patch []byte) bool {
+	trimmed := string(bytes.TrimSpace(patch))
+	return trimmed == "" || trimmed == "{}" || trimmed == "null"
+}
@@ -0,0 +1,260 @@
+package kube
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/argoproj/argo-cd/test"
+	"github.com/stretchr/testify/assert"
+	appsv1beta2 "k8s.io/api/apps/v1beta2"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	fakedynamic "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+	kubetesting "k8s.io/client-go/testing"
+)
+
+func fakeDeploymentV1beta2() *unstructured.Unstructured {
+	deploy := MustToUnstructured(test.DemoDeployment())
+	deploy.SetAPIVersion("apps/v1beta2")
+	return deploy
+}
+
+func TestApplyResourceNativePatch(t *testing.T) {
+	kubeclientset := fake.NewSimpleClientset()
+	fakeDiscovery, ok := kubeclientset.Discovery().(*fakediscovery.FakeDiscovery)
+	assert.True(t, ok)
+	fakeDiscovery.Fake.Resources = resourceList()
+
+	// the live object was last applied with 2 replicas, and has fields populated by the server
+	liveObj := fakeDeploymentV1beta2()
+	lastApplied, err := getModifiedConfiguration(liveObj)
+	assert.Nil(t, err)
+	err = liveObj.UnmarshalJSON(lastApplied)
+	assert.Nil(t, err)
+	liveObj.SetResourceVersion("123")
+	liveObj.Object["status"] = map[string]interface{}{"replicas": int64(2)}
+
+	desired := fakeDeploymentV1beta2()
+	desired.Object["spec"].(map[string]interface{})["replicas"] = int64(5)
+
+	var patch map[string]interface{}
+	fakeClientPool := fakedynamic.FakeClientPool{}
+	fakeClientPool.AddReactor("get", "deployments", func(action kubetesting.Action) (handled bool, ret runtime.Object, err error) {
+		return true, liveObj, nil
+	})
+	fakeClientPool.AddReactor("patch", "deployments", func(action kubetesting.Action) (handled bool, ret runtime.Object, err error) {
+		err = json.Unmarshal(action.(kubetesting.PatchAction).GetPatch(), &patch)
+		assert.Nil(t, err)
+		return true, desired, nil
+	})
+
+	_, err = applyResourceNative(&fakeClientPool, fakeDiscovery, &rest.Config{}, desired, test.TestNamespace, ApplyOpts{})
+	assert.Nil(t, err)
+	// the patch only contains the replica count and the updated last applied configuration, which is
+	// the same patch kubectl apply would send
+	assert.Equal(t, float64(5), patch["spec"].(map[string]interface{})["replicas"])
+	assert.NotContains(t, patch, "status")
+	expected, err := getModifiedConfiguration(desired)
+	assert.Nil(t, err)
+	var expectedObj unstructured.Unstructured
+	assert.Nil(t, expectedObj.UnmarshalJSON(expected))
+	annotations := patch["metadata"].(map[string]interface{})["annotations"].(map[string]interface{})
+	assert.Equal(t, expectedObj.GetAnnotations()[lastAppliedConfigAnnotation], annotations[lastAppliedConfigAnnotation])
+}
+
+func TestApplyResourceNativePrunesRemovedFields(t *testing.T) {
+	kubeclientset := fake.NewSimpleClientset()
+	fakeDiscovery, ok := kubeclientset.Discovery().(*fakediscovery.FakeDiscovery)
+	assert.True(t, ok)
+	fakeDiscovery.Fake.Resources = resourceList()
+
+	// the live object was last applied with a revision history limit, and has a progress deadline
+	// defaulted by the server
+	liveObj := fakeDeploymentV1beta2()
+	unstructured.SetNestedField(liveObj.Object, int64(3), "spec", "revisionHistoryLimit")
+	lastApplied, err := getModifiedConfiguration(liveObj)
+	assert.Nil(t, err)
+	err = liveObj.UnmarshalJSON(lastApplied)
+	assert.Nil(t, err)
+	unstructured.SetNestedField(liveObj.Object, int64(600), "spec", "progressDeadlineSeconds")
+
+	desired := fakeDeploymentV1beta2()
+
+	var patch map[string]interface{}
+	fakeClientPool := fakedynamic.FakeClientPool{}
+	fakeClientPool.AddReactor("get", "deployments", func(action kubetesting.Action) (handled bool, ret runtime.Object, err error) {
+		return true, liveObj, nil
+	})
+	fakeClientPool.AddReactor("patch", "deployments", func(action kubetesting.Action) (handled bool, ret runtime.Object, err error) {
+		err = json.Unmarshal(action.(kubetesting.PatchAction).GetPatch(), &patch)
+		assert.Nil(t, err)
+		return true, desired, nil
+	})
+
+	_, err = applyResourceNative(&fakeClientPool, fakeDiscovery, &rest.Config{}, desired, test.TestNamespace, ApplyOpts{})
+	assert.Nil(t, err)
+	spec := patch["spec"].(map[string]interface{})
+	// the field which is no longer applied is deleted, while the field populated by the server is kept
+	value, ok := spec["revisionHistoryLimit"]
+	assert.True(t, ok)
+	assert.Nil(t, value)
+	assert.NotContains(t, spec, "progressDeadlineSeconds")
+}
+
+func TestApplyResourceNativeMatchesKubectl(t *testing.T) {
+	// annotated returns a live object which was last applied with the given object, as kubectl does
+	annotated := func(obj *unstructured.Unstructured) *unstructured.Unstructured {
+		lastApplied, err := getModifiedConfiguration(obj)
+		assert.Nil(t, err)
+		var liveObj unstructured.Unstructured
+		assert.Nil(t, liveObj.UnmarshalJSON(lastApplied))
+		liveObj.SetResourceVersion("123")
+		return &liveObj
+	}
+	withReplicas := func(obj *unstructured.Unstructured, replicas int64) *unstructured.Unstructured {
+		unstructured.SetNestedField(obj.Object, replicas, "spec", "replicas")
+		return obj
+	}
+	withRevisionHistoryLimit := func(obj *unstructured.Unstructured) *unstructured.Unstructured {
+		unstructured.SetNestedField(obj.Object, int64(3), "spec", "revisionHistoryLimit")
+		return obj
+	}
+	withSidecar := func(obj *unstructured.Unstructured) *unstructured.Unstructured {
+		containers, _ := unstructured.NestedSlice(obj.Object, "spec", "template", "spec", "containers")
+		containers[0].(map[string]interface{})["image"] = "gcr.io/kuar-demo/kuard-amd64:2"
+		containers = append(containers, map[string]interface{}{"name": "sidecar", "image": "busybox"})
+		unstructured.SetNestedSlice(obj.Object, containers, "spec", "template", "spec", "containers")
+		return obj
+	}
+
+	tests := []struct {
+		name    string
+		liveObj *unstructured.Unstructured
+		desired *unstructured.Unstructured
+		// unmanaged are the fields of the live object which apply leaves alone, such as fields
+		// populated by the server
+		unmanaged [][]string
+	}{{
+		name: "scale",
+		liveObj: func() *unstructured.Unstructured {
+			liveObj := annotated(fakeDeploymentV1beta2())
+			liveObj.Object["status"] = map[string]interface{}{"replicas": int64(2)}
+			return liveObj
+		}(),
+		desired:   withReplicas(fakeDeploymentV1beta2(), 5),
+		unmanaged: [][]string{{"status"}},
+	}, {
+		name: "removed field",
+		liveObj: func() *unstructured.Unstructured {
+			liveObj := annotated(withRevisionHistoryLimit(fakeDeploymentV1beta2()))
+			unstructured.SetNestedField(liveObj.Object, int64(600), "spec", "progressDeadlineSeconds")
+			return liveObj
+		}(),
+		desired:   fakeDeploymentV1beta2(),
+		unmanaged: [][]string{{"spec", "progressDeadlineSeconds"}},
+	}, {
+		name:    "merged containers",
+		liveObj: annotated(fakeDeploymentV1beta2()),
+		desired: withSidecar(fakeDeploymentV1beta2()),
+	}, {
+		name: "never applied",
+		liveObj: func() *unstructured.Unstructured {
+			liveObj := withRevisionHistoryLimit(fakeDeploymentV1beta2())
+			liveObj.SetResourceVersion("123")
+			return liveObj
+		}(),
+		desired:   withReplicas(fakeDeploymentV1beta2(), 3),
+		unmanaged: [][]string{{"spec", "revisionHistoryLimit"}},
+	}}
+	opts := ApplyOpts{AppInstance: test.TestAppInstanceName}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kubeclientset := fake.NewSimpleClientset()
+			fakeDiscovery, ok := kubeclientset.Discovery().(*fakediscovery.FakeDiscovery)
+			assert.True(t, ok)
+			fakeDiscovery.Fake.Resources = resourceList()
+
+			// the native apply is patched into the live object the way the API server would
+			fakeClientPool := fakedynamic.FakeClientPool{}
+			fakeClientPool.AddReactor("get", "deployments", func(action kubetesting.Action) (handled bool, ret runtime.Object, err error) {
+				return true, tt.liveObj, nil
+			})
+			fakeClientPool.AddReactor("patch", "deployments", func(action kubetesting.Action) (handled bool, ret runtime.Object, err error) {
+				current, err := json.Marshal(tt.liveObj)
+				assert.Nil(t, err)
+				patched, err := strategicpatch.StrategicMergePatch(current, action.(kubetesting.PatchAction).GetPatch(), appsv1beta2.Deployment{})
+				assert.Nil(t, err)
+				var patchedObj unstructured.Unstructured
+				assert.Nil(t, patchedObj.UnmarshalJSON(patched))
+				return true, &patchedObj, nil
+			})
+			nativeObj, err := applyResourceNative(&fakeClientPool, fakeDiscovery, &rest.Config{}, tt.desired, test.TestNamespace, opts)
+			assert.Nil(t, err)
+
+			// kubectl apply results in the object it is given, recording it as the last applied configuration
+			applied, restore := fakeKubectl(t)
+			defer restore()
+			_, err = applyResource(kubeclientset, &rest.Config{}, tt.desired, test.TestNamespace, opts)
+			assert.Nil(t, err)
+			assert.Equal(t, 1, len(*applied))
+			modified, err := getModifiedConfiguration((*applied)[0])
+			assert.Nil(t, err)
+			var kubectlObj unstructured.Unstructured
+			assert.Nil(t, kubectlObj.UnmarshalJSON(modified))
+
+			for _, fields := range append(tt.unmanaged, []string{"metadata", "resourceVersion"}) {
+				unstructured.RemoveNestedField(nativeObj.Object, fields...)
+				unstructured.RemoveNestedField(kubectlObj.Object, fields...)
+			}
+			assert.Equal(t, kubectlObj.Object, nativeObj.Object)
+		})
+	}
+}
+
+func TestApplyResourceNativeUnregisteredKind(t *testing.T) {
+	applied, restore := fakeKubectl(t)
+	defer restore()
+
+	app := &unstructured.Unstructured{}
+	app.SetAPIVersion("argoproj.io/v1alpha1")
+	app.SetKind("Application")
+	app.SetName("guestbook")
+	_, err := applyResourceNative(&fakedynamic.FakeClientPool{}, &fakediscovery.FakeDiscovery{Fake: &kubetesting.Fake{}}, &rest.Config{}, app, test.TestNamespace, ApplyOpts{})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(*applied))
+}
+
+func TestApplyPatch(t *testing.T) {
+	liveObj := fakeDeploymentV1beta2()
+	fakeDynClient := fakedynamic.FakeClient{Fake: &kubetesting.Fake{}}
+	var patches []string
+	fakeDynClient.Fake.AddReactor("get", "deployments", func(action kubetesting.Action) (handled bool, ret runtime.Object, err error) {
+		return true, liveObj, nil
+	})
+	fakeDynClient.Fake.AddReactor("patch", "deployments", func(action kubetesting.Action) (handled bool, ret runtime.Object, err error) {
+		patch := action.(kubetesting.PatchAction).GetPatch()
+		patches = append(patches, string(patch))
+		patched := liveObj.DeepCopy()
+		assert.Nil(t, json.Unmarshal(patch, &patched.Object))
+		return true, patched, nil
+	})
+	apiResource := &metav1.APIResource{Name: "deployments", Namespaced: true, Kind: "Deployment"}
+
+	patched, err := ApplyPatch(&fakeDynClient, apiResource, test.TestNamespace, liveObj.GetName(), []byte(`{"spec":{"replicas":5}}`))
+	assert.Nil(t, err)
+	replicas, _ := unstructured.NestedFieldCopy(patched.Object, "spec", "replicas")
+	assert.Equal(t, float64(5), replicas)
+	assert.Equal(t, []string{`{"spec":{"replicas":5}}`}, patches)
+
+	// an empty patch returns the live object without patching it
+	unchanged, err := ApplyPatch(&fakeDynClient, apiResource, test.TestNamespace, liveObj.GetName(), []byte("{}"))
+	assert.Nil(t, err)
+	assert.Equal(t, liveObj, unchanged)
+	assert.Equal(t, 1, len(patches))
+}
@@ -0,0 +1,106 @@
+package kube
+
+import (
+	"fmt"
+
+	"github.com/argoproj/argo-cd/util/diff"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/rest"
+)
+
+// PlanResult is the change applying a single object would make
+type PlanResult struct {
+	// Key identifies the object
+	Key ResourceKey
+	// Action is whether the object would be created or updated, or None if it is unchanged
+	Action ReconcileAction
+	// Predicted is the object the API server would store, as returned by the dry run. Not set for
+	// objects which could not be dry run.
+	Predicted *unstructured.Unstructured
+	// Diff is a unified diff of the live object and the predicted object, if the object would change
+	Diff string
+	// Message explains the action, if necessary
+	Message string
+	// Error is the error which occurred while planning the object, if any
+	Error error
+}
+
+// PlanApply returns a preview of the change applying each object would make, without changing the
+// cluster. Every object is applied with a server-side dry run and compared with its live counterpart,
+// as with ComputeLiveDiff, so the preview includes server defaults and admission mutations. Objects are
+// planned in kind priority order, so CRDs are dry run before their instances. Since a dry run does not
+// create a CRD, instances of CRDs in the set which are not installed yet are planned as created without
+// a dry run. Every object is planned, and errors of all failed objects are aggregated in the returned
+// error. Requires Kubernetes 1.13 or later.
+func PlanApply(config *rest.Config, objs []*unstructured.Unstructured, namespace string, opts ApplyOpts) ([]PlanResult, error) {
+	disco, err := discovery.NewDiscoveryClientForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	if err = verifyServerSideDryRun(disco); err != nil {
+		return nil, err
+	}
+	if opts.ExcludeHelmTests {
+		objs = withoutHelmTests(objs)
+	}
+	restClientFor := func(gv schema.GroupVersion) (rest.Interface, error) {
+		return newUnstructuredRESTClient(config, gv)
+	}
+	return planApply(disco, restClientFor, objs, namespace, config.Host, defaultDryRunCache, opts.KindPriorities)
+}
+
+func planApply(disco discovery.DiscoveryInterface, restClientFor func(schema.GroupVersion) (rest.Interface, error), objs []*unstructured.Unstructured, namespace string, cluster string, cache *dryRunCache, priorities KindPriorities) ([]PlanResult, error) {
+	objs, err := withDefaultNamespace(disco, objs, namespace)
+	if err != nil {
+		return nil, err
+	}
+	crdKinds := crdDefinedKinds(objs)
+	var results []PlanResult
+	var errs []error
+	for _, obj := range sortByKindPriority(objs, priorities) {
+		result := planObject(disco, restClientFor, obj, namespace, cluster, cache, crdKinds)
+		if result.Error != nil {
+			errs = append(errs, result.Error)
+		}
+		results = append(results, result)
+	}
+	return results, utilerrors.NewAggregate(errs)
+}
+
+func planObject(disco discovery.DiscoveryInterface, restClientFor func(schema.GroupVersion) (rest.Interface, error), obj *unstructured.Unstructured, namespace string, cluster string, cache *dryRunCache, crdKinds map[schema.GroupKind]bool) PlanResult {
+	result := PlanResult{Key: GetResourceKey(obj), Action: ReconcileActionNone}
+	gvk := obj.GroupVersionKind()
+	apiResource, err := ServerResourceForGroupVersionKind(disco, gvk)
+	if err != nil {
+		if IsUnknownKindError(err) && crdKinds[gvk.GroupKind()] {
+			result.Action = ReconcileActionCreate
+			result.Message = fmt.Sprintf("%s is defined by a CRD which is not created yet, so it can not be dry run", gvk.Kind)
+			result.Diff, result.Error = diff.DiffText(obj, nil, diff.DiffTextOpts{NoColor: true})
+			return result
+		}
+		result.Error = err
+		return result
+	}
+	restClient, err := restClientFor(gvk.GroupVersion())
+	if err != nil {
+		result.Error = err
+		return result
+	}
+	liveDiff, err := dryRunDiff(restClient, apiResource, obj, liveResourceNamespace(apiResource, obj, namespace), cluster, cache)
+	if err != nil {
+		result.Error = err
+		return result
+	}
+	result.Predicted = liveDiff.predicted
+	result.Diff = liveDiff.text
+	switch {
+	case !liveDiff.exists:
+		result.Action = ReconcileActionCreate
+	case liveDiff.modified:
+		result.Action = ReconcileActionUpdate
+	}
+	return result
+}
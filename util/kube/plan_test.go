@@ -0,0 +1,149 @@
+package kube
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/argoproj/argo-cd/test"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	"k8s.io/client-go/rest"
+	kubetesting "k8s.io/client-go/testing"
+)
+
+// newPlanServer returns a server which stores a resource quota, answers dry runs of other objects by
+// echoing them, and records every request which would mutate the cluster
+func newPlanServer(t *testing.T, mutations *[]string) *httptest.Server {
+	defaulting := newDefaultingServer(t, new(int))
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.URL.Query().Get("dryRun") != "All" {
+			*mutations = append(*mutations, r.Method+" "+r.URL.Path)
+		}
+		if strings.Contains(r.URL.Path, "/resourcequotas") {
+			defaulting.Config.Handler.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		switch r.Method {
+		case "GET":
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"kind":"Status","apiVersion":"v1","status":"Failure","reason":"NotFound","code":404}`))
+		case "POST":
+			body, err := ioutil.ReadAll(r.Body)
+			assert.Nil(t, err)
+			var obj unstructured.Unstructured
+			assert.Nil(t, obj.UnmarshalJSON(body))
+			obj.SetUID("2")
+			data, err := json.Marshal(&obj)
+			assert.Nil(t, err)
+			w.WriteHeader(http.StatusCreated)
+			_, _ = w.Write(data)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))
+}
+
+func TestPlanApply(t *testing.T) {
+	var mutations []string
+	server := newPlanServer(t, &mutations)
+	defer server.Close()
+	config := &rest.Config{Host: server.URL}
+	restClientFor := func(gv schema.GroupVersion) (rest.Interface, error) {
+		return newUnstructuredRESTClient(config, gv)
+	}
+	fakeDiscovery := &fakediscovery.FakeDiscovery{Fake: &kubetesting.Fake{}}
+	fakeDiscovery.Resources = []*metav1.APIResourceList{{
+		GroupVersion: "v1",
+		APIResources: []metav1.APIResource{
+			{Name: "resourcequotas", Namespaced: true, Kind: "ResourceQuota"},
+			{Name: "configmaps", Namespaced: true, Kind: "ConfigMap"},
+		},
+	}, {
+		GroupVersion: "apiextensions.k8s.io/v1beta1",
+		APIResources: []metav1.APIResource{
+			{Name: "customresourcedefinitions", Kind: "CustomResourceDefinition"},
+		},
+	}, {
+		// the group of the CRD is served, but the kind is not created yet
+		GroupVersion: "example.com/v1",
+	}}
+
+	configMap := &unstructured.Unstructured{}
+	configMap.SetAPIVersion("v1")
+	configMap.SetKind("ConfigMap")
+	configMap.SetName("settings")
+	configMap.Object["data"] = map[string]interface{}{"mode": "fast"}
+	crd := &unstructured.Unstructured{}
+	crd.SetAPIVersion("apiextensions.k8s.io/v1beta1")
+	crd.SetKind("CustomResourceDefinition")
+	crd.SetName("widgets.example.com")
+	crd.Object["spec"] = map[string]interface{}{
+		"group": "example.com",
+		"names": map[string]interface{}{"kind": "Widget", "plural": "widgets"},
+	}
+	widget := &unstructured.Unstructured{}
+	widget.SetAPIVersion("example.com/v1")
+	widget.SetKind("Widget")
+	widget.SetName("my-widget")
+
+	objs := []*unstructured.Unstructured{widget, newResourceQuota("2"), configMap, crd}
+	results, err := planApply(fakeDiscovery, restClientFor, objs, test.TestNamespace, server.URL, newDryRunCache(), nil)
+	assert.Nil(t, err)
+	assert.Empty(t, mutations)
+	if !assert.Len(t, results, 4) {
+		return
+	}
+
+	// the CRD is dry run first
+	assert.Equal(t, "CustomResourceDefinition", results[0].Key.Kind)
+	assert.Equal(t, ReconcileActionCreate, results[0].Action)
+	assert.NotNil(t, results[0].Predicted)
+
+	actions := make(map[string]PlanResult)
+	for _, result := range results {
+		assert.Nil(t, result.Error)
+		actions[result.Key.Kind] = result
+	}
+	quota := actions["ResourceQuota"]
+	assert.Equal(t, ReconcileActionUpdate, quota.Action)
+	assert.Contains(t, quota.Diff, "-    cpu: 500m")
+	assert.Contains(t, quota.Diff, "+    cpu: \"2\"")
+
+	assert.Equal(t, ReconcileActionCreate, actions["ConfigMap"].Action)
+	assert.Equal(t, test.TestNamespace, actions["ConfigMap"].Predicted.GetNamespace())
+	assert.Contains(t, actions["ConfigMap"].Diff, "+  mode: fast")
+
+	// the instance of the CRD can not be dry run before the CRD exists
+	assert.Equal(t, ReconcileActionCreate, actions["Widget"].Action)
+	assert.Nil(t, actions["Widget"].Predicted)
+	assert.Contains(t, actions["Widget"].Message, "not created yet")
+}
+
+func TestPlanApplyUnknownKind(t *testing.T) {
+	var mutations []string
+	server := newPlanServer(t, &mutations)
+	defer server.Close()
+	restClientFor := func(gv schema.GroupVersion) (rest.Interface, error) {
+		return newUnstructuredRESTClient(&rest.Config{Host: server.URL}, gv)
+	}
+	fakeDiscovery := &fakediscovery.FakeDiscovery{Fake: &kubetesting.Fake{}}
+	fakeDiscovery.Resources = []*metav1.APIResourceList{{GroupVersion: "example.com/v1"}}
+	widget := &unstructured.Unstructured{}
+	widget.SetAPIVersion("example.com/v1")
+	widget.SetKind("Widget")
+	widget.SetName("my-widget")
+
+	results, err := planApply(fakeDiscovery, restClientFor, []*unstructured.Unstructured{widget}, test.TestNamespace, server.URL, newDryRunCache(), nil)
+	assert.NotNil(t, err)
+	assert.Len(t, results, 1)
+	assert.True(t, IsUnknownKindError(results[0].Error))
+	assert.Empty(t, mutations)
+}
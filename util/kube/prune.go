@@ -0,0 +1,175 @@
+package kube
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// PruneOpts are options for pruning resources
+type PruneOpts struct {
+	// Allowlist restricts pruning to resources of the listed group kinds. When empty, resources of
+	// any kind are pruned.
+	Allowlist []schema.GroupKind
+	// TrackingMethod is how objects record the application tracking them, one of the TrackingMethod
+	// constants. Defaults to TrackingMethodLabel.
+	TrackingMethod string
+	// RecordEvents records every pruned object as a Kubernetes event on the object
+	RecordEvents bool
+}
+
+// allowed returns whether the options permit pruning an object of the given group kind
+func (o PruneOpts) allowed(gk schema.GroupKind) bool {
+	if len(o.Allowlist) == 0 {
+		return true
+	}
+	for _, allowed := range o.Allowlist {
+		if allowed == gk {
+			return true
+		}
+	}
+	return false
+}
+
+// SkippedPrune is a resource with the prune label which was not pruned, because it does not belong to
+// the application
+type SkippedPrune struct {
+	Obj    *unstructured.Unstructured
+	Reason string
+}
+
+// PruneResources deletes the resources with the specified label which are no longer part of the
+// desired set of objects, and returns the pruned resources. The label value identifies the application
+// the resources belong to. Resources which carry the label but were adopted by another controller, or
+// are tracked by another application, are not pruned and are returned as skipped instead.
+func PruneResources(ctx context.Context, config *rest.Config, desired []*unstructured.Unstructured, namespace string, labelName string, labelValue string, opts PruneOpts) ([]*unstructured.Unstructured, []SkippedPrune, error) {
+	live, err := GetResourcesWithLabel(ctx, config, namespace, labelName, labelValue, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	kubeclientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, nil, err
+	}
+	dynClientPool := dynamic.NewDynamicClientPool(config)
+	return pruneResources(kubeclientset, dynClientPool, kubeclientset.Discovery(), desired, live, namespace, labelName, labelValue, opts)
+}
+
+func pruneResources(kubeclientset kubernetes.Interface, dynClientPool dynamic.ClientPool, disco discovery.DiscoveryInterface, desired, live []*unstructured.Unstructured, namespace string, labelName string, labelValue string, opts PruneOpts) ([]*unstructured.Unstructured, []SkippedPrune, error) {
+	// desired objects without a namespace are created in the default namespace, so they are matched
+	// with live objects there
+	desired, err := withDefaultNamespace(disco, desired, namespace)
+	if err != nil {
+		return nil, nil, err
+	}
+	candidates, skipped := pruneCandidates(desired, live, labelName, labelValue, opts)
+	var pruned []*unstructured.Unstructured
+	for _, obj := range candidates {
+		err = deleteResource(dynClientPool, disco, obj, DeleteOpts{})
+		if err != nil {
+			return pruned, skipped, err
+		}
+		if opts.RecordEvents {
+			recordPruneEvent(kubeclientset, obj)
+		}
+		pruned = append(pruned, obj)
+	}
+	return pruned, skipped, nil
+}
+
+// foreignOwnership returns why an object does not belong to the application instance, or the empty
+// string if it does. An object belongs to another application if IsTracked reports it is tracked by it
+// with the label the object was selected by, and to another controller if it has a controller owner reference (e.g. pods, which inherit the labels
+// of their template). With the annotation tracking methods, objects which are not tracked at all do not
+// belong to the application either, even though they carry its label.
+func foreignOwnership(obj *unstructured.Unstructured, labelName string, appInstance string, trackingMethod string) string {
+	tracked, appName := IsTracked(obj, trackingMethod, labelName)
+	if tracked && appName != appInstance {
+		return fmt.Sprintf("tracked by application '%s'", appName)
+	}
+	if !tracked && usesTrackingAnnotation(trackingMethod) {
+		return "not tracked by an application"
+	}
+	for _, ref := range obj.GetOwnerReferences() {
+		if ref.Controller != nil && *ref.Controller {
+			return fmt.Sprintf("controlled by %s '%s'", ref.Kind, ref.Name)
+		}
+	}
+	return ""
+}
+
+// pruneCandidates returns the live objects which are not part of the desired set, and which the
+// options permit pruning. Since the same object may be listed under several API groups (e.g.
+// extensions and apps deployments), live objects sharing a UID with a desired object are retained.
+// Objects which do not belong to the application instance are returned as skipped.
+func pruneCandidates(desired, live []*unstructured.Unstructured, labelName string, appInstance string, opts PruneOpts) ([]*unstructured.Unstructured, []SkippedPrune) {
+	desiredKeys := make(map[ResourceKey]bool)
+	for _, obj := range desired {
+		desiredKeys[GetResourceKey(obj)] = true
+	}
+	retainedUIDs := make(map[types.UID]bool)
+	for _, obj := range live {
+		if desiredKeys[GetResourceKey(obj)] {
+			retainedUIDs[obj.GetUID()] = true
+		}
+	}
+	var candidates []*unstructured.Unstructured
+	var skipped []SkippedPrune
+	seenUIDs := make(map[types.UID]bool)
+	for _, obj := range live {
+		uid := obj.GetUID()
+		if retainedUIDs[uid] || seenUIDs[uid] {
+			continue
+		}
+		if !opts.allowed(obj.GroupVersionKind().GroupKind()) {
+			log.Debugf("Not pruning %s: kind is not in the prune allowlist", GetResourceKey(obj))
+			continue
+		}
+		seenUIDs[uid] = true
+		if reason := foreignOwnership(obj, labelName, appInstance, opts.TrackingMethod); reason != "" {
+			log.Warnf("Not pruning %s: %s", GetResourceKey(obj), reason)
+			skipped = append(skipped, SkippedPrune{Obj: obj, Reason: reason})
+			continue
+		}
+		candidates = append(candidates, obj)
+	}
+	return candidates, skipped
+}
+
+// DeleteResource deletes a single object. Deleting an object which does not exist is not an error.
+func DeleteResource(config *rest.Config, obj *unstructured.Unstructured, opts DeleteOpts) error {
+	dynClientPool := dynamic.NewDynamicClientPool(config)
+	disco, err := discovery.NewDiscoveryClientForConfig(config)
+	if err != nil {
+		return err
+	}
+	return deleteResource(dynClientPool, disco, obj, opts)
+}
+
+func deleteResource(dynClientPool dynamic.ClientPool, disco discovery.DiscoveryInterface, obj *unstructured.Unstructured, opts DeleteOpts) error {
+	gvk := obj.GroupVersionKind()
+	dclient, err := dynClientPool.ClientForGroupVersionKind(gvk)
+	if err != nil {
+		return err
+	}
+	apiResource, err := ServerResourceForGroupVersionKind(disco, gvk)
+	if err != nil {
+		return err
+	}
+	log.Infof("Deleting resource %s", GetResourceKey(obj))
+	err = dclient.Resource(apiResource, obj.GetNamespace()).Delete(obj.GetName(), opts.deleteOptions())
+	if err != nil && !apierr.IsNotFound(err) {
+		return errors.WithStack(err)
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package kube
+
+import (
+	"context"
+	"testing"
+
+	"github.com/argoproj/argo-cd/common"
+	"github.com/argoproj/argo-cd/test"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestPruneCandidatesAllowlist(t *testing.T) {
+	desiredSvc := MustToUnstructured(test.DemoService())
+	liveSvc := desiredSvc.DeepCopy()
+	liveSvc.SetUID("svc")
+
+	staleSvc := MustToUnstructured(test.DemoService())
+	staleSvc.SetName("stale-svc")
+	staleSvc.SetUID("stale-svc")
+
+	staleDeploy := MustToUnstructured(test.DemoDeployment())
+	staleDeploy.SetName("stale-deploy")
+	staleDeploy.SetUID("stale-deploy")
+
+	staleConfigMap := &unstructured.Unstructured{}
+	staleConfigMap.SetAPIVersion("v1")
+	staleConfigMap.SetKind("ConfigMap")
+	staleConfigMap.SetName("stale-cm")
+	staleConfigMap.SetUID(types.UID("stale-cm"))
+
+	desired := []*unstructured.Unstructured{desiredSvc}
+	live := []*unstructured.Unstructured{liveSvc, staleSvc, staleDeploy, staleConfigMap}
+
+	candidates, _ := pruneCandidates(desired, live, "", "", PruneOpts{})
+	assert.Equal(t, 3, len(candidates))
+
+	candidates, _ = pruneCandidates(desired, live, "", "", PruneOpts{
+		Allowlist: []schema.GroupKind{{Kind: "Service"}, {Group: "apps", Kind: "Deployment"}},
+	})
+	var names []string
+	for _, obj := range candidates {
+		names = append(names, obj.GetName())
+	}
+	assert.Equal(t, []string{"stale-svc", "stale-deploy"}, names)
+}
+
+func TestPruneCandidatesSameObjectInMultipleGroups(t *testing.T) {
+	desired := MustToUnstructured(test.DemoDeployment())
+	desired.SetAPIVersion("apps/v1beta2")
+	live := desired.DeepCopy()
+	live.SetUID("deploy")
+	liveExtensions := live.DeepCopy()
+	liveExtensions.SetAPIVersion("extensions/v1beta1")
+
+	candidates, _ := pruneCandidates([]*unstructured.Unstructured{desired}, []*unstructured.Unstructured{live, liveExtensions}, "", "", PruneOpts{})
+	assert.Equal(t, 0, len(candidates))
+}
+
+func TestPruneCandidatesForeignOwnership(t *testing.T) {
+	stale := MustToUnstructured(test.DemoService())
+	stale.SetName("stale")
+	stale.SetUID("stale")
+	SetTrackingID(stale, TrackingMethodAnnotation, "guestbook", "", "")
+
+	foreignApp := MustToUnstructured(test.DemoService())
+	foreignApp.SetName("foreign-app")
+	foreignApp.SetUID("foreign-app")
+	SetTrackingID(foreignApp, TrackingMethodAnnotation, "other-app", "", "")
+
+	isController := true
+	adopted := MustToUnstructured(test.DemoService())
+	adopted.SetName("adopted")
+	adopted.SetUID("adopted")
+	adopted.SetOwnerReferences([]metav1.OwnerReference{{APIVersion: "example.com/v1", Kind: "Widget", Name: "demo", Controller: &isController}})
+
+	candidates, skipped := pruneCandidates(nil, []*unstructured.Unstructured{stale, foreignApp, adopted}, "", "guestbook", PruneOpts{})
+	if assert.Equal(t, 1, len(candidates)) {
+		assert.Equal(t, "stale", candidates[0].GetName())
+	}
+	if assert.Equal(t, 2, len(skipped)) {
+		assert.Equal(t, "foreign-app", skipped[0].Obj.GetName())
+		assert.Equal(t, "tracked by application 'other-app'", skipped[0].Reason)
+		assert.Equal(t, "adopted", skipped[1].Obj.GetName())
+		assert.Equal(t, "controlled by Widget 'demo'", skipped[1].Reason)
+	}
+
+	// with annotation tracking, a copy of the labels and annotations of an object is not tracked
+	copied := stale.DeepCopy()
+	copied.SetName("copied")
+	copied.SetUID("copied")
+	candidates, skipped = pruneCandidates(nil, []*unstructured.Unstructured{stale, copied}, "", "guestbook", PruneOpts{TrackingMethod: TrackingMethodAnnotation})
+	if assert.Equal(t, 1, len(candidates)) {
+		assert.Equal(t, "stale", candidates[0].GetName())
+	}
+	if assert.Equal(t, 1, len(skipped)) {
+		assert.Equal(t, "copied", skipped[0].Obj.GetName())
+		assert.Equal(t, "not tracked by an application", skipped[0].Reason)
+	}
+}
+
+func TestPruneCandidatesSelectedLabel(t *testing.T) {
+	// Helm charts set the instance label to the name of the release, which differs from the application
+	stale := MustToUnstructured(test.DemoService())
+	stale.SetUID("stale")
+	stale.SetLabels(map[string]string{common.LabelApplicationName: "guestbook", common.LabelKeyInstance: "guestbook-release"})
+
+	candidates, skipped := pruneCandidates(nil, []*unstructured.Unstructured{stale}, common.LabelApplicationName, "guestbook", PruneOpts{})
+	assert.Equal(t, 0, len(skipped))
+	if assert.Equal(t, 1, len(candidates)) {
+		assert.Equal(t, stale.GetName(), candidates[0].GetName())
+	}
+
+	// the object is still tracked by another application if the selected label says so
+	stale.SetLabels(map[string]string{common.LabelApplicationName: "other-app", common.LabelKeyInstance: "guestbook"})
+	candidates, skipped = pruneCandidates(nil, []*unstructured.Unstructured{stale}, common.LabelApplicationName, "guestbook", PruneOpts{})
+	assert.Equal(t, 0, len(candidates))
+	if assert.Equal(t, 1, len(skipped)) {
+		assert.Equal(t, "tracked by application 'other-app'", skipped[0].Reason)
+	}
+}
+
+func TestPruneResourcesWithoutNamespace(t *testing.T) {
+	fakeClientPool, fakeDiscovery := newReconcileFixture()
+	live, err := getResourcesWithLabel(context.Background(), fakeClientPool, fakeDiscovery, test.TestNamespace, "app", "guestbook", 1)
+	assert.Nil(t, err)
+
+	// the desired config map does not specify a namespace, but is the live config map in the namespace
+	desired := []*unstructured.Unstructured{newReconcileObject("ConfigMap", "guestbook-config")}
+	pruned, _, err := pruneResources(fake.NewSimpleClientset(), fakeClientPool, fakeDiscovery, desired, live, test.TestNamespace, "app", "guestbook", PruneOpts{})
+	assert.Nil(t, err)
+	if assert.Equal(t, 1, len(pruned)) {
+		assert.Equal(t, "guestbook-stale", pruned[0].GetName())
+	}
+}
+
+func TestPruneResourcesRecordsEvents(t *testing.T) {
+	fakeClientPool, fakeDiscovery := newReconcileFixture()
+	live, err := getResourcesWithLabel(context.Background(), fakeClientPool, fakeDiscovery, test.TestNamespace, "app", "guestbook", 1)
+	assert.Nil(t, err)
+	kubeclientset := fake.NewSimpleClientset()
+
+	desired := []*unstructured.Unstructured{newReconcileObject("ConfigMap", "guestbook-config")}
+	pruned, _, err := pruneResources(kubeclientset, fakeClientPool, fakeDiscovery, desired, live, test.TestNamespace, "app", "guestbook", PruneOpts{RecordEvents: true})
+	assert.Nil(t, err)
+	if assert.Equal(t, 1, len(pruned)) {
+		events, err := getResourceEvents(kubeclientset, pruned[0], EventOpts{})
+		assert.Nil(t, err)
+		if assert.Equal(t, 1, len(events)) {
+			assert.Equal(t, EventReasonPruned, events[0].Reason)
+			assert.Equal(t, "Pruned ConfigMap guestbook-stale", events[0].Message)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package kube
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// CanI returns whether the user of the REST config is allowed to perform a verb on a resource in a
+// namespace, like `kubectl auth can-i`. An empty namespace checks access across all namespaces, which is
+// also how cluster scoped resources are checked.
+func CanI(config *rest.Config, verb string, gvr schema.GroupVersionResource, namespace string) (bool, error) {
+	kubeclientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return false, err
+	}
+	return canI(kubeclientset, verb, gvr, namespace)
+}
+
+func canI(kubeclientset kubernetes.Interface, verb string, gvr schema.GroupVersionResource, namespace string) (bool, error) {
+	review, err := kubeclientset.AuthorizationV1().SelfSubjectAccessReviews().Create(&authorizationv1.SelfSubjectAccessReview{
+		Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+			ResourceAttributes: &authorizationv1.ResourceAttributes{
+				Namespace: namespace,
+				Verb:      verb,
+				Group:     gvr.Group,
+				Version:   gvr.Version,
+				Resource:  gvr.Resource,
+			},
+		},
+	})
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	return review.Status.Allowed, nil
+}
+
+// AccessibleNamespaces returns the namespaces in which the user of the REST config is allowed to list
+// resources, so that bulk operations can skip namespaces the user cannot read. A namespace is accessible
+// if the user may list any kind of resource in it, whether by a wildcard rule or by rules for specific
+// resources.
+func AccessibleNamespaces(config *rest.Config) ([]string, error) {
+	kubeclientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return accessibleNamespaces(kubeclientset)
+}
+
+func accessibleNamespaces(kubeclientset kubernetes.Interface) ([]string, error) {
+	namespaces, err := kubeclientset.CoreV1().Namespaces().List(metav1.ListOptions{})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	accessible := make([]string, 0)
+	for _, ns := range namespaces.Items {
+		allowed, err := canListInNamespace(kubeclientset, ns.Name)
+		if err != nil {
+			return nil, err
+		}
+		if allowed {
+			accessible = append(accessible, ns.Name)
+		}
+	}
+	return accessible, nil
+}
+
+// canListInNamespace returns whether the rules of the user allow listing any kind of resource in a
+// namespace. Rules restricted to resource names do not permit lists.
+func canListInNamespace(kubeclientset kubernetes.Interface, namespace string) (bool, error) {
+	review, err := kubeclientset.AuthorizationV1().SelfSubjectRulesReviews().Create(&authorizationv1.SelfSubjectRulesReview{
+		Spec: authorizationv1.SelfSubjectRulesReviewSpec{Namespace: namespace},
+	})
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	for _, rule := range review.Status.ResourceRules {
+		if len(rule.Resources) == 0 || len(rule.ResourceNames) > 0 {
+			continue
+		}
+		for _, verb := range rule.Verbs {
+			if verb == listVerb || verb == "*" {
+				return true, nil
+			}
+		}
+	}
+	if review.Status.Incomplete {
+		// authorizers which can not enumerate rules (e.g. webhooks) are still consulted by access reviews
+		allResources := schema.GroupVersionResource{Group: "*", Version: "*", Resource: "*"}
+		return canI(kubeclientset, listVerb, allResources, namespace)
+	}
+	return false, nil
+}
+
+// preflightVerbs are the verbs checked for every kind before applying
+var preflightVerbs = []string{"create", "update"}
+
+// preflightApply verifies the user is allowed to create and update every kind of object in the namespace
+// it is applied to, so that missing permissions are reported up front rather than failing part way
+// through applying the objects
+func preflightApply(kubeclientset kubernetes.Interface, objs []*unstructured.Unstructured, namespace string) error {
+	checked := make(map[string]bool)
+	var missing []string
+	for _, obj := range objs {
+		gvk := obj.GroupVersionKind()
+		apiResource, err := ServerResourceForGroupVersionKind(kubeclientset.Discovery(), gvk)
+		if err != nil {
+			return err
+		}
+		objNamespace := ""
+		if apiResource.Namespaced {
+			objNamespace = namespace
+			if obj.GetNamespace() != "" {
+				objNamespace = obj.GetNamespace()
+			}
+		}
+		gvr := gvk.GroupVersion().WithResource(apiResource.Name)
+		groupResource := gvr.GroupResource()
+		for _, verb := range preflightVerbs {
+			check := fmt.Sprintf("%s %s in namespace '%s'", verb, groupResource.String(), objNamespace)
+			if checked[check] {
+				continue
+			}
+			checked[check] = true
+			allowed, err := canI(kubeclientset, verb, gvr, objNamespace)
+			if err != nil {
+				return err
+			}
+			if !allowed {
+				missing = append(missing, check)
+			}
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing RBAC permissions: cannot %s", strings.Join(missing, ", cannot "))
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package kube
+
+import (
+	"testing"
+
+	"github.com/argoproj/argo-cd/test"
+	"github.com/stretchr/testify/assert"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	kubetesting "k8s.io/client-go/testing"
+)
+
+// newRBACClientset returns a fake clientset which only allows the given verb/resource combinations
+func newRBACClientset(t *testing.T, allowed ...string) (*fake.Clientset, *[]authorizationv1.ResourceAttributes) {
+	kubeclientset := fake.NewSimpleClientset()
+	fakeDiscovery, ok := kubeclientset.Discovery().(*fakediscovery.FakeDiscovery)
+	assert.True(t, ok)
+	fakeDiscovery.Fake.Resources = resourceList()
+	var reviewed []authorizationv1.ResourceAttributes
+	kubeclientset.PrependReactor("create", "selfsubjectaccessreviews", func(action kubetesting.Action) (handled bool, ret runtime.Object, err error) {
+		review := action.(kubetesting.CreateAction).GetObject().(*authorizationv1.SelfSubjectAccessReview)
+		attrs := review.Spec.ResourceAttributes
+		reviewed = append(reviewed, *attrs)
+		for _, allow := range allowed {
+			if allow == attrs.Verb+" "+attrs.Resource {
+				review.Status.Allowed = true
+			}
+		}
+		return true, review, nil
+	})
+	return kubeclientset, &reviewed
+}
+
+func TestCanI(t *testing.T) {
+	servicesGVR := apiv1.SchemeGroupVersion.WithResource("services")
+	kubeclientset, _ := newRBACClientset(t, "create services")
+	allowed, err := canI(kubeclientset, "create", servicesGVR, test.TestNamespace)
+	assert.Nil(t, err)
+	assert.True(t, allowed)
+
+	allowed, err = canI(kubeclientset, "delete", servicesGVR, test.TestNamespace)
+	assert.Nil(t, err)
+	assert.False(t, allowed)
+}
+
+func TestPreflightApply(t *testing.T) {
+	svc := MustToUnstructured(test.DemoService())
+	otherSvc := svc.DeepCopy()
+	otherSvc.SetName("other")
+	deploy := fakeDeploymentV1beta2()
+	objs := []*unstructured.Unstructured{svc, otherSvc, deploy}
+
+	kubeclientset, reviewed := newRBACClientset(t, "create services", "update services", "create deployments", "update deployments")
+	err := preflightApply(kubeclientset, objs, test.TestNamespace)
+	assert.Nil(t, err)
+	// each kind is only checked once
+	assert.Equal(t, 4, len(*reviewed))
+
+	kubeclientset, _ = newRBACClientset(t, "create services", "update services", "create deployments")
+	err = preflightApply(kubeclientset, objs, test.TestNamespace)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "missing RBAC")
+	assert.Contains(t, err.Error(), "update deployments.apps")
+	assert.NotContains(t, err.Error(), "services")
+}
+
+func TestAccessibleNamespaces(t *testing.T) {
+	kubeclientset := fake.NewSimpleClientset(
+		&apiv1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}},
+		&apiv1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "kube-system"}},
+		&apiv1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: test.TestNamespace}},
+		&apiv1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "webhook"}},
+	)
+	// the test namespace grants lists of specific resources rather than all resources, kube-system only
+	// grants gets of a named secret, and the rules of the webhook namespace can not be enumerated
+	rules := map[string][]authorizationv1.ResourceRule{
+		"default":          {{Verbs: []string{"*"}, APIGroups: []string{"*"}, Resources: []string{"*"}}},
+		"kube-system":      {{Verbs: []string{"get", "list"}, APIGroups: []string{""}, Resources: []string{"secrets"}, ResourceNames: []string{"token"}}},
+		test.TestNamespace: {{Verbs: []string{"get", "list", "watch"}, APIGroups: []string{"", "apps"}, Resources: []string{"services", "deployments"}}},
+	}
+	kubeclientset.PrependReactor("create", "selfsubjectrulesreviews", func(action kubetesting.Action) (handled bool, ret runtime.Object, err error) {
+		review := action.(kubetesting.CreateAction).GetObject().(*authorizationv1.SelfSubjectRulesReview)
+		review.Status.ResourceRules = rules[review.Spec.Namespace]
+		review.Status.Incomplete = review.Spec.Namespace == "webhook"
+		return true, review, nil
+	})
+	kubeclientset.PrependReactor("create", "selfsubjectaccessreviews", func(action kubetesting.Action) (handled bool, ret runtime.Object, err error) {
+		review := action.(kubetesting.CreateAction).GetObject().(*authorizationv1.SelfSubjectAccessReview)
+		attrs := review.Spec.ResourceAttributes
+		review.Status.Allowed = attrs.Verb == "list" && attrs.Resource == "*" && attrs.Namespace == "webhook"
+		return true, review, nil
+	})
+
+	namespaces, err := accessibleNamespaces(kubeclientset)
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []string{"default", test.TestNamespace, "webhook"}, namespaces)
+}
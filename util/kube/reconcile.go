@@ -0,0 +1,179 @@
+package kube
+
+import (
+	"context"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+)
+
+// ReconcileAction is the action taken on an object by Reconcile
+type ReconcileAction string
+
+const (
+	// ReconcileActionNone means the live object already matches the desired object
+	ReconcileActionNone ReconcileAction = "None"
+	// ReconcileActionCreate means the desired object does not exist and is created
+	ReconcileActionCreate ReconcileAction = "Create"
+	// ReconcileActionUpdate means the live object differs from the desired object and is updated
+	ReconcileActionUpdate ReconcileAction = "Update"
+	// ReconcileActionPrune means the live object is no longer desired and is deleted
+	ReconcileActionPrune ReconcileAction = "Prune"
+	// ReconcileActionSkipPrune means the live object is no longer desired, but is not deleted because
+	// it does not belong to the application
+	ReconcileActionSkipPrune ReconcileAction = "SkipPrune"
+)
+
+// ReconcileOpts are options for Reconcile
+type ReconcileOpts struct {
+	// ApplyOpts are the options used to apply created and updated objects
+	ApplyOpts ApplyOpts
+	// Prune deletes the live resources with the label which are no longer part of the desired objects
+	Prune bool
+	// PruneOpts are the options used to select the resources to prune
+	PruneOpts PruneOpts
+	// LabelName and LabelValue identify the live resources of the application. They are required to
+	// prune, and the label value identifies the application instance which owns the resources.
+	LabelName  string
+	LabelValue string
+	// DryRun only computes the plan, without changing anything in the cluster
+	DryRun bool
+}
+
+// ReconcileResult is the outcome of reconciling a single object
+type ReconcileResult struct {
+	// Key identifies the object
+	Key ResourceKey
+	// Action is the action taken (or planned, for a dry run) on the object
+	Action ReconcileAction
+	// Live is the object returned by the server after it was applied. Not set for dry runs and prunes.
+	Live *unstructured.Unstructured
+	// Message explains the action, if necessary
+	Message string
+	// Error is the error which occurred while taking the action, if any
+	Error error
+}
+
+// Reconcile brings the cluster in line with a set of desired objects. Desired objects which do not
+// exist or are out of sync are applied in kind priority order, and if opts.Prune is set, live resources
+// with the label which are no longer desired are deleted afterwards. Every apply is attempted, but
+// nothing is pruned if any of them failed. The returned report contains the action taken on each
+// object, and errors of all failed actions are aggregated in the returned error. With opts.DryRun, the
+// report is the plan, and nothing is changed.
+func Reconcile(config *rest.Config, desired []*unstructured.Unstructured, namespace string, opts ReconcileOpts) ([]ReconcileResult, error) {
+	dynClientPool := dynamic.NewDynamicClientPool(config)
+	disco, err := discovery.NewDiscoveryClientForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	apply := func(obj *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+		if opts.ApplyOpts.ServerSide {
+			return ApplyResource(config, obj, namespace, opts.ApplyOpts)
+		}
+		return applyResourceNative(dynClientPool, disco, config, obj, namespace, opts.ApplyOpts)
+	}
+	return reconcile(context.Background(), dynClientPool, disco, apply, desired, namespace, opts)
+}
+
+func reconcile(ctx context.Context, dynClientPool dynamic.ClientPool, disco discovery.DiscoveryInterface, apply func(*unstructured.Unstructured) (*unstructured.Unstructured, error), desired []*unstructured.Unstructured, namespace string, opts ReconcileOpts) ([]ReconcileResult, error) {
+	if opts.Prune && opts.LabelName == "" {
+		return nil, fmt.Errorf("pruning requires a label identifying the live resources")
+	}
+	desired, err := withDefaultNamespace(disco, desired, namespace)
+	if err != nil {
+		return nil, err
+	}
+	liveObjs, err := getLiveResources(dynClientPool, disco, desired, namespace, GetLiveOpts{IgnoreUnknownKinds: true})
+	if err != nil {
+		return nil, err
+	}
+	var live []*unstructured.Unstructured
+	for _, obj := range liveObjs {
+		if obj != nil {
+			live = append(live, obj)
+		}
+	}
+	toCreate, toUpdate, _ := CompareResourceSets(desired, live)
+	actions := make(map[ResourceKey]ReconcileAction)
+	for _, obj := range toCreate {
+		actions[GetResourceKey(obj)] = ReconcileActionCreate
+	}
+	for _, obj := range toUpdate {
+		actions[GetResourceKey(obj)] = ReconcileActionUpdate
+	}
+
+	var results []ReconcileResult
+	var errs []error
+	for _, obj := range sortByKindPriority(desired, opts.ApplyOpts.KindPriorities) {
+		result := ReconcileResult{Key: GetResourceKey(obj), Action: ReconcileActionNone}
+		if action, ok := actions[result.Key]; ok {
+			result.Action = action
+			if !opts.DryRun {
+				result.Live, result.Error = apply(obj)
+				if result.Error != nil {
+					errs = append(errs, result.Error)
+				}
+			}
+		}
+		results = append(results, result)
+	}
+	if !opts.Prune {
+		return results, utilerrors.NewAggregate(errs)
+	}
+	if len(errs) > 0 {
+		log.Warnf("Not pruning resources with label %s=%s since %d objects failed to apply", opts.LabelName, opts.LabelValue, len(errs))
+		return results, utilerrors.NewAggregate(errs)
+	}
+
+	labeled, err := getResourcesWithLabel(ctx, dynClientPool, disco, namespace, opts.LabelName, opts.LabelValue, DefaultBulkOptions.MaxConcurrency)
+	if err != nil {
+		return results, err
+	}
+	candidates, skipped := pruneCandidates(desired, labeled, opts.LabelName, opts.LabelValue, opts.PruneOpts)
+	for _, skip := range skipped {
+		results = append(results, ReconcileResult{Key: GetResourceKey(skip.Obj), Action: ReconcileActionSkipPrune, Message: skip.Reason})
+	}
+	// prune in reverse kind priority order, so objects are deleted before the objects they depend on
+	sorted := sortByKindPriority(candidates, opts.ApplyOpts.KindPriorities)
+	for i := len(sorted) - 1; i >= 0; i-- {
+		result := ReconcileResult{Key: GetResourceKey(sorted[i]), Action: ReconcileActionPrune}
+		if !opts.DryRun {
+			result.Error = deleteResource(dynClientPool, disco, sorted[i], DeleteOpts{})
+			if result.Error != nil {
+				errs = append(errs, result.Error)
+			}
+		}
+		results = append(results, result)
+	}
+	return results, utilerrors.NewAggregate(errs)
+}
+
+// withDefaultNamespace returns the objects with the namespace set on namespaced objects which do not
+// specify one, so they can be matched with their live counterparts. Objects of kinds which are not
+// served by the API server (e.g. instances of a CRD which is not created yet) are returned unchanged.
+func withDefaultNamespace(disco discovery.DiscoveryInterface, objs []*unstructured.Unstructured, namespace string) ([]*unstructured.Unstructured, error) {
+	result := make([]*unstructured.Unstructured, len(objs))
+	for i, obj := range objs {
+		result[i] = obj
+		if obj.GetNamespace() != "" || namespace == "" {
+			continue
+		}
+		apiResource, err := ServerResourceForGroupVersionKind(disco, obj.GroupVersionKind())
+		if err != nil {
+			if IsUnknownKindError(err) {
+				continue
+			}
+			return nil, err
+		}
+		if apiResource.Namespaced {
+			result[i] = obj.DeepCopy()
+			result[i].SetNamespace(namespace)
+		}
+	}
+	return result, nil
+}
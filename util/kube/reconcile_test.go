@@ -0,0 +1,146 @@
+package kube
+
+import (
+	"context"
+	"testing"
+
+	"github.com/argoproj/argo-cd/test"
+	"github.com/stretchr/testify/assert"
+	apiv1 "k8s.io/api/core/v1"
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	fakedynamic "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/rest"
+	kubetesting "k8s.io/client-go/testing"
+)
+
+func newReconcileObject(kind string, name string) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{}
+	obj.SetAPIVersion("v1")
+	obj.SetKind(kind)
+	obj.SetName(name)
+	obj.SetLabels(map[string]string{"app": "guestbook"})
+	return obj
+}
+
+func newReconcileFixture() (*fakedynamic.FakeClientPool, *fakediscovery.FakeDiscovery) {
+	verbs := []string{"get", "list", "create", "patch", "delete"}
+	fakeDiscovery := &fakediscovery.FakeDiscovery{Fake: &kubetesting.Fake{}}
+	fakeDiscovery.Resources = []*metav1.APIResourceList{
+		{
+			GroupVersion: apiv1.SchemeGroupVersion.String(),
+			APIResources: []metav1.APIResource{
+				{Name: "services", Namespaced: true, Kind: "Service", Verbs: verbs},
+				{Name: "configmaps", Namespaced: true, Kind: "ConfigMap", Verbs: verbs},
+			},
+		},
+	}
+
+	// the config map is in sync, the stale config map is no longer desired, and the other service is
+	// labeled, but controlled by another controller
+	inSync := newReconcileObject("ConfigMap", "guestbook-config")
+	inSync.SetNamespace(test.TestNamespace)
+	inSync.SetUID("1")
+	stale := newReconcileObject("ConfigMap", "guestbook-stale")
+	stale.SetNamespace(test.TestNamespace)
+	stale.SetUID("2")
+	other := newReconcileObject("Service", "other-ui")
+	other.SetNamespace(test.TestNamespace)
+	other.SetUID("3")
+	isController := true
+	other.SetOwnerReferences([]metav1.OwnerReference{{APIVersion: "example.com/v1", Kind: "Widget", Name: "other", Controller: &isController}})
+	live := map[string][]unstructured.Unstructured{
+		"configmaps": {*inSync, *stale},
+		"services":   {*other},
+	}
+
+	fakeClientPool := &fakedynamic.FakeClientPool{}
+	fakeClientPool.AddReactor("get", "*", func(action kubetesting.Action) (bool, runtime.Object, error) {
+		name := action.(kubetesting.GetAction).GetName()
+		for _, obj := range live[action.GetResource().Resource] {
+			if obj.GetName() == name {
+				return true, obj.DeepCopy(), nil
+			}
+		}
+		return true, nil, apierr.NewNotFound(action.GetResource().GroupResource(), name)
+	})
+	fakeClientPool.AddReactor("list", "*", func(action kubetesting.Action) (bool, runtime.Object, error) {
+		return true, &unstructured.UnstructuredList{Items: live[action.GetResource().Resource]}, nil
+	})
+	fakeClientPool.AddReactor("create", "*", func(action kubetesting.Action) (bool, runtime.Object, error) {
+		return true, action.(kubetesting.CreateAction).GetObject(), nil
+	})
+	fakeClientPool.AddReactor("delete", "*", func(action kubetesting.Action) (bool, runtime.Object, error) {
+		return true, nil, nil
+	})
+	return fakeClientPool, fakeDiscovery
+}
+
+func reconcileWithFakes(t *testing.T, dryRun bool) ([]ReconcileResult, []kubetesting.Action) {
+	fakeClientPool, fakeDiscovery := newReconcileFixture()
+	apply := func(obj *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+		return applyResourceNative(fakeClientPool, fakeDiscovery, &rest.Config{}, obj, test.TestNamespace, ApplyOpts{})
+	}
+	desired := []*unstructured.Unstructured{
+		newReconcileObject("Service", "guestbook-ui"),
+		newReconcileObject("ConfigMap", "guestbook-config"),
+	}
+	opts := ReconcileOpts{Prune: true, LabelName: "app", LabelValue: "guestbook", DryRun: dryRun}
+	results, err := reconcile(context.Background(), fakeClientPool, fakeDiscovery, apply, desired, test.TestNamespace, opts)
+	assert.Nil(t, err)
+	var changes []kubetesting.Action
+	for _, action := range fakeClientPool.Actions() {
+		if action.GetVerb() == "create" || action.GetVerb() == "patch" || action.GetVerb() == "delete" {
+			changes = append(changes, action)
+		}
+	}
+	return results, changes
+}
+
+func reconcileActions(results []ReconcileResult) map[string]ReconcileAction {
+	actions := make(map[string]ReconcileAction)
+	for _, result := range results {
+		actions[result.Key.Name] = result.Action
+	}
+	return actions
+}
+
+func TestReconcile(t *testing.T) {
+	results, changes := reconcileWithFakes(t, false)
+	assert.Equal(t, map[string]ReconcileAction{
+		"guestbook-ui":     ReconcileActionCreate,
+		"guestbook-config": ReconcileActionNone,
+		"guestbook-stale":  ReconcileActionPrune,
+		"other-ui":         ReconcileActionSkipPrune,
+	}, reconcileActions(results))
+	for _, result := range results {
+		assert.Nil(t, result.Error)
+	}
+
+	if assert.Equal(t, 2, len(changes)) {
+		created := changes[0].(kubetesting.CreateAction).GetObject().(*unstructured.Unstructured)
+		assert.Equal(t, "guestbook-ui", created.GetName())
+		assert.Equal(t, test.TestNamespace, changes[0].GetNamespace())
+		assert.Equal(t, "guestbook-stale", changes[1].(kubetesting.DeleteAction).GetName())
+	}
+}
+
+func TestReconcileDryRun(t *testing.T) {
+	results, changes := reconcileWithFakes(t, true)
+	assert.Equal(t, map[string]ReconcileAction{
+		"guestbook-ui":     ReconcileActionCreate,
+		"guestbook-config": ReconcileActionNone,
+		"guestbook-stale":  ReconcileActionPrune,
+		"other-ui":         ReconcileActionSkipPrune,
+	}, reconcileActions(results))
+	assert.Empty(t, changes)
+}
+
+func TestReconcilePruneRequiresLabel(t *testing.T) {
+	fakeClientPool, fakeDiscovery := newReconcileFixture()
+	_, err := reconcile(context.Background(), fakeClientPool, fakeDiscovery, nil, nil, test.TestNamespace, ReconcileOpts{Prune: true})
+	assert.NotNil(t, err)
+}
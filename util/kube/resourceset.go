@@ -0,0 +1,53 @@
+package kube
+
+import (
+	"github.com/argoproj/argo-cd/util/diff"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// CompareResourceSets compares a set of desired objects against the set of live objects, and
+// returns the objects which need to be created (desired but not live), updated (both desired and
+// live, but differing) and deleted (live but no longer desired). Objects are matched by their
+// ResourceKey, so desired objects are expected to have their namespace set. Fields which only
+// exist in the live object (e.g. status, or server populated metadata) are ignored when comparing.
+func CompareResourceSets(desired, live []*unstructured.Unstructured) (toCreate, toUpdate, toDelete []*unstructured.Unstructured) {
+	liveByKey := make(map[ResourceKey]*unstructured.Unstructured)
+	for _, obj := range live {
+		if obj != nil {
+			liveByKey[GetResourceKey(obj)] = obj
+		}
+	}
+	desiredKeys := make(map[ResourceKey]bool)
+	for _, obj := range desired {
+		if obj == nil {
+			continue
+		}
+		key := GetResourceKey(obj)
+		desiredKeys[key] = true
+		liveObj, ok := liveByKey[key]
+		if !ok {
+			toCreate = append(toCreate, obj)
+		} else if diff.Diff(obj, liveObj).Modified {
+			toUpdate = append(toUpdate, obj)
+		}
+	}
+	for _, obj := range live {
+		if obj != nil && !desiredKeys[GetResourceKey(obj)] {
+			toDelete = append(toDelete, obj)
+		}
+	}
+	return toCreate, toUpdate, toDelete
+}
+
+// GroupByNamespace groups objects by their namespace, preserving the order of the objects within each
+// group. Cluster scoped objects, which have no namespace, are grouped under the empty string, as are
+// namespaced objects which leave their namespace to be defaulted.
+func GroupByNamespace(objs []*unstructured.Unstructured) map[string][]*unstructured.Unstructured {
+	groups := make(map[string][]*unstructured.Unstructured)
+	for _, obj := range objs {
+		if obj != nil {
+			groups[obj.GetNamespace()] = append(groups[obj.GetNamespace()], obj)
+		}
+	}
+	return groups
+}
@@ -0,0 +1,59 @@
+package kube
+
+import (
+	"testing"
+
+	"github.com/argoproj/argo-cd/test"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestCompareResourceSets(t *testing.T) {
+	unchanged := MustToUnstructured(test.DemoService())
+	liveUnchanged := unchanged.DeepCopy()
+	// fields populated by the server should not be considered a difference
+	liveUnchanged.SetResourceVersion("123")
+	liveUnchanged.SetUID("4d3c2b1a")
+
+	changed := MustToUnstructured(test.DemoDeployment())
+	liveChanged := changed.DeepCopy()
+	assert.True(t, unstructured.SetNestedField(liveChanged.Object, int64(5), "spec", "replicas"))
+
+	created := MustToUnstructured(test.DemoService())
+	created.SetName("new-svc")
+
+	deleted := MustToUnstructured(test.DemoService())
+	deleted.SetName("old-svc")
+
+	toCreate, toUpdate, toDelete := CompareResourceSets(
+		[]*unstructured.Unstructured{unchanged, changed, created},
+		[]*unstructured.Unstructured{liveUnchanged, liveChanged, deleted},
+	)
+	if assert.Equal(t, 1, len(toCreate)) {
+		assert.Equal(t, "new-svc", toCreate[0].GetName())
+	}
+	if assert.Equal(t, 1, len(toUpdate)) {
+		assert.Equal(t, "Deployment", toUpdate[0].GetKind())
+	}
+	if assert.Equal(t, 1, len(toDelete)) {
+		assert.Equal(t, "old-svc", toDelete[0].GetName())
+	}
+}
+
+func TestGroupByNamespace(t *testing.T) {
+	svc := MustToUnstructured(test.DemoService())
+	deployment := MustToUnstructured(test.DemoDeployment())
+	other := svc.DeepCopy()
+	other.SetNamespace("other")
+	clusterRole := &unstructured.Unstructured{}
+	clusterRole.SetAPIVersion("rbac.authorization.k8s.io/v1")
+	clusterRole.SetKind("ClusterRole")
+	clusterRole.SetName("guestbook-reader")
+
+	groups := GroupByNamespace([]*unstructured.Unstructured{svc, clusterRole, other, deployment, nil})
+	assert.Equal(t, map[string][]*unstructured.Unstructured{
+		svc.GetNamespace(): {svc, deployment},
+		"other":            {other},
+		"":                 {clusterRole},
+	}, groups)
+}
@@ -0,0 +1,75 @@
+package kube
+
+import (
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+)
+
+// apiResourceResolver returns the API resource which serves a kind
+type apiResourceResolver func(gvk schema.GroupVersionKind) (*metav1.APIResource, error)
+
+// discoveryResolver resolves API resources by querying the discovery API
+func discoveryResolver(disco discovery.DiscoveryInterface) apiResourceResolver {
+	return func(gvk schema.GroupVersionKind) (*metav1.APIResource, error) {
+		return ServerResourceForGroupVersionKind(disco, gvk)
+	}
+}
+
+// mapperResolver resolves API resources with a REST mapper
+func mapperResolver(mapper meta.RESTMapper) apiResourceResolver {
+	return func(gvk schema.GroupVersionKind) (*metav1.APIResource, error) {
+		return APIResourceForMapping(mapper, gvk)
+	}
+}
+
+// APIResourceForMapping returns the API resource which serves a kind according to a REST mapper. Kinds
+// the mapper does not know are reported as an UnknownKindError, like ServerResourceForGroupVersionKind.
+func APIResourceForMapping(mapper meta.RESTMapper, gvk schema.GroupVersionKind) (*metav1.APIResource, error) {
+	mapping, err := mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	if err != nil {
+		if meta.IsNoMatchError(err) {
+			return nil, &UnknownKindError{GroupVersionKind: gvk}
+		}
+		return nil, err
+	}
+	return &metav1.APIResource{
+		Name:       mapping.Resource,
+		Namespaced: mapping.Scope.Name() == meta.RESTScopeNameNamespace,
+		Group:      mapping.GroupVersionKind.Group,
+		Version:    mapping.GroupVersionKind.Version,
+		Kind:       mapping.GroupVersionKind.Kind,
+	}, nil
+}
+
+// GetLiveResourcesWithMapper is like GetLiveResources, but resolves the API resources of the objects with
+// the supplied REST mapper rather than with discovery, so callers which already hold a mapper do not pay
+// for discovery again.
+func GetLiveResourcesWithMapper(config *rest.Config, mapper meta.RESTMapper, objs []*unstructured.Unstructured, namespace string, opts GetLiveOpts) ([]*unstructured.Unstructured, error) {
+	return getLiveResourcesWithResolver(dynamic.NewDynamicClientPool(config), mapperResolver(mapper), objs, namespace, opts)
+}
+
+// ListResourcesWithMapper lists the resources of a kind, resolving its API resource with the supplied
+// REST mapper rather than with discovery. Cluster scoped resources are listed regardless of the namespace.
+func ListResourcesWithMapper(config *rest.Config, mapper meta.RESTMapper, gvk schema.GroupVersionKind, namespace string, listOpts metav1.ListOptions) ([]*unstructured.Unstructured, error) {
+	return listResourcesWithResolver(dynamic.NewDynamicClientPool(config), mapperResolver(mapper), gvk, namespace, listOpts)
+}
+
+func listResourcesWithResolver(dynClientPool dynamic.ClientPool, resolve apiResourceResolver, gvk schema.GroupVersionKind, namespace string, listOpts metav1.ListOptions) ([]*unstructured.Unstructured, error) {
+	apiResource, err := resolve(gvk)
+	if err != nil {
+		return nil, err
+	}
+	dclient, err := dynClientPool.ClientForGroupVersionKind(gvk)
+	if err != nil {
+		return nil, err
+	}
+	if !apiResource.Namespaced {
+		namespace = ""
+	}
+	return ListResources(dclient, *apiResource, namespace, listOpts)
+}
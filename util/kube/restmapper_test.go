@@ -0,0 +1,89 @@
+package kube
+
+import (
+	"testing"
+
+	"github.com/argoproj/argo-cd/test"
+	"github.com/stretchr/testify/assert"
+	apiv1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/dynamic"
+	fakedynamic "k8s.io/client-go/dynamic/fake"
+	kubetesting "k8s.io/client-go/testing"
+)
+
+func newFakeRESTMapper() meta.RESTMapper {
+	mapper := meta.NewDefaultRESTMapper(nil, dynamic.VersionInterfaces)
+	mapper.Add(apiv1.SchemeGroupVersion.WithKind("ConfigMap"), meta.RESTScopeNamespace)
+	mapper.Add(rbacv1.SchemeGroupVersion.WithKind("ClusterRole"), meta.RESTScopeRoot)
+	return mapper
+}
+
+func TestAPIResourceForMapping(t *testing.T) {
+	mapper := newFakeRESTMapper()
+	apiResource, err := APIResourceForMapping(mapper, apiv1.SchemeGroupVersion.WithKind("ConfigMap"))
+	assert.Nil(t, err)
+	assert.Equal(t, "configmaps", apiResource.Name)
+	assert.True(t, apiResource.Namespaced)
+
+	apiResource, err = APIResourceForMapping(mapper, rbacv1.SchemeGroupVersion.WithKind("ClusterRole"))
+	assert.Nil(t, err)
+	assert.Equal(t, "clusterroles", apiResource.Name)
+	assert.False(t, apiResource.Namespaced)
+
+	_, err = APIResourceForMapping(mapper, apiv1.SchemeGroupVersion.WithKind("Widget"))
+	assert.True(t, IsUnknownKindError(err))
+}
+
+func TestGetLiveResourcesWithMapper(t *testing.T) {
+	namespaces := make(map[string]string)
+	fakeClientPool := fakedynamic.FakeClientPool{}
+	fakeClientPool.AddReactor("get", "*", func(action kubetesting.Action) (handled bool, ret runtime.Object, err error) {
+		name := action.(kubetesting.GetAction).GetName()
+		namespaces[name] = action.GetNamespace()
+		obj := &unstructured.Unstructured{}
+		obj.SetName(name)
+		return true, obj, nil
+	})
+	configMap := MustToUnstructured(&apiv1.ConfigMap{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "ConfigMap"},
+		ObjectMeta: metav1.ObjectMeta{Name: "guestbook-config"},
+	})
+	clusterRole := MustToUnstructured(&rbacv1.ClusterRole{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "rbac.authorization.k8s.io/v1", Kind: "ClusterRole"},
+		ObjectMeta: metav1.ObjectMeta{Name: "guestbook-reader"},
+	})
+	widget := &unstructured.Unstructured{}
+	widget.SetAPIVersion("v1")
+	widget.SetKind("Widget")
+	widget.SetName("demo")
+
+	// no discovery client is involved, the kinds are resolved by the mapper alone
+	liveObjs, err := getLiveResourcesWithResolver(&fakeClientPool, mapperResolver(newFakeRESTMapper()), []*unstructured.Unstructured{configMap, clusterRole, widget}, test.TestNamespace, GetLiveOpts{IgnoreUnknownKinds: true})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(liveObjs))
+	assert.Nil(t, liveObjs[2])
+	assert.Equal(t, map[string]string{"guestbook-config": test.TestNamespace, "guestbook-reader": ""}, namespaces)
+}
+
+func TestListResourcesWithMapper(t *testing.T) {
+	var listNamespace string
+	fakeClientPool := fakedynamic.FakeClientPool{}
+	fakeClientPool.AddReactor("list", "clusterroles", func(action kubetesting.Action) (handled bool, ret runtime.Object, err error) {
+		listNamespace = action.GetNamespace()
+		item := unstructured.Unstructured{}
+		item.SetAPIVersion("rbac.authorization.k8s.io/v1")
+		item.SetKind("ClusterRole")
+		item.SetName("guestbook-reader")
+		return true, &unstructured.UnstructuredList{Items: []unstructured.Unstructured{item}}, nil
+	})
+	objs, err := listResourcesWithResolver(&fakeClientPool, mapperResolver(newFakeRESTMapper()), rbacv1.SchemeGroupVersion.WithKind("ClusterRole"), test.TestNamespace, metav1.ListOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(objs))
+	assert.Equal(t, "guestbook-reader", objs[0].GetName())
+	assert.Equal(t, "", listNamespace)
+}
@@ -0,0 +1,250 @@
+package kube
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// streamKubectl executes kubectl with the given arguments, streaming stdin to the process while its
+// standard output is read by readStdout. The standard error of kubectl is returned as the error if it
+// fails.
+var streamKubectl = func(args []string, stdin io.Reader, readStdout func(io.Reader) error) error {
+	cmd := exec.Command("kubectl", args...)
+	cmd.Env = kubectlEnv(os.Environ())
+	return streamCommand(cmd, stdin, readStdout)
+}
+
+// streamCommand runs a command, streaming stdin to it while its standard output is read by readStdout.
+// Standard error is collected concurrently, so the command can not block on a full pipe. The rest of
+// the output is discarded if readStdout returns early.
+func streamCommand(cmd *exec.Cmd, stdin io.Reader, readStdout func(io.Reader) error) error {
+	var stderr bytes.Buffer
+	cmd.Stdin = stdin
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if err = cmd.Start(); err != nil {
+		return errors.WithStack(err)
+	}
+	readErr := readStdout(stdout)
+	// the process must not block writing output nobody reads, and stdout must be drained before waiting
+	_, _ = io.Copy(ioutil.Discard, stdout)
+	err = cmd.Wait()
+	if err != nil {
+		if _, ok := err.(*exec.ExitError); ok {
+			return errors.New(stderr.String())
+		}
+		return err
+	}
+	return readErr
+}
+
+// ApplyResources applies several objects with a single kubectl invocation, and calls handle with each
+// object returned by the server. Unlike ApplyResource, the objects are encoded while kubectl reads them,
+// and its output is decoded one object at a time, so the memory used does not grow with the combined
+// size of the manifests.
+func ApplyResources(config *rest.Config, objs []*unstructured.Unstructured, namespace string, opts ApplyOpts, handle func(*unstructured.Unstructured) error) error {
+	config, err := applyConfig(config, opts)
+	if err != nil {
+		return err
+	}
+	kubeclientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return err
+	}
+	return applyResources(kubeclientset, config, objs, namespace, opts, handle)
+}
+
+func applyResources(kubeclientset kubernetes.Interface, config *rest.Config, objs []*unstructured.Unstructured, namespace string, opts ApplyOpts, handle func(*unstructured.Unstructured) error) error {
+	log.Infof("Applying %d resources in cluster: %s, namespace: %s", len(objs), config.Host, namespace)
+	if opts.CreateNamespace {
+		for _, obj := range objs {
+			if err := ensureNamespace(kubeclientset, obj, namespace, opts); err != nil {
+				return err
+			}
+		}
+	}
+	cmdArgs, err := kubectlConnectionArgs(config, opts)
+	if err != nil {
+		return err
+	}
+	applyArgs, err := kubectlApplyArgs(kubeclientset.Discovery(), config.Host, opts)
+	if err != nil {
+		return fmt.Errorf("failed to apply %d resources: %v", len(objs), err)
+	}
+	applyCmd := append(append(cmdArgs, "-n", namespace), append(applyArgs, "-o", "json", "-f", "-")...)
+
+	stdin, stdinWriter := io.Pipe()
+	go func() {
+		_ = stdinWriter.CloseWithError(writeList(stdinWriter, kubeclientset.Discovery(), objs, namespace, opts))
+	}()
+	// unblocks the writer if kubectl exits without reading all of its input
+	defer func() { _ = stdin.Close() }()
+	err = streamKubectl(applyCmd, stdin, func(stdout io.Reader) error {
+		return decodeObjects(stdout, handle)
+	})
+	if err != nil {
+		return &ApplyError{Category: ClassifyApplyError(err), Err: fmt.Errorf("failed to apply %d resources: %s", len(objs), err)}
+	}
+	return nil
+}
+
+// writeList writes the objects, decorated for sync, as a v1 List
+func writeList(w io.Writer, disco discovery.DiscoveryInterface, objs []*unstructured.Unstructured, namespace string, opts ApplyOpts) error {
+	if _, err := io.WriteString(w, `{"apiVersion":"v1","kind":"List","items":[`); err != nil {
+		return err
+	}
+	for i, obj := range objs {
+		if i > 0 {
+			if _, err := io.WriteString(w, ","); err != nil {
+				return err
+			}
+		}
+		decorated, err := decorateForSync(disco, obj, namespace, opts)
+		if err != nil {
+			return err
+		}
+		data, err := json.Marshal(decorated)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if _, err = w.Write(data); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(w, "]}")
+	return err
+}
+
+// ParseKubectlOutput parses the JSON output of kubectl, which may be a single object, a List, or a
+// stream of concatenated objects and lists, and returns all objects in the order they were output. The
+// items of lists are returned rather than the lists themselves.
+func ParseKubectlOutput(out []byte) ([]*unstructured.Unstructured, error) {
+	var objs []*unstructured.Unstructured
+	err := decodeObjects(bytes.NewReader(out), func(obj *unstructured.Unstructured) error {
+		objs = append(objs, obj)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return objs, nil
+}
+
+// decodeObjects decodes a stream of JSON objects, calling handle with each object. Objects whose kind ends
+// in "List" are lists, and the items of lists are handled rather than the lists themselves. If the kind
+// of a list precedes its items, as in the lists written by writeList, the items are decoded and handled
+// one at a time rather than decoding the whole list first. Otherwise the items are held undecoded until
+// the kind is read.
+func decodeObjects(r io.Reader, handle func(*unstructured.Unstructured) error) error {
+	decoder := json.NewDecoder(r)
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return errors.WithStack(err)
+		}
+		if token != json.Delim('{') {
+			return fmt.Errorf("unexpected token %v, expected an object", token)
+		}
+		fields := make(map[string]json.RawMessage)
+		kind := ""
+		itemsHandled := false
+		for decoder.More() {
+			token, err := decoder.Token()
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			key, ok := token.(string)
+			if !ok {
+				return fmt.Errorf("unexpected token %v in object", token)
+			}
+			if key == "items" && isListKind(kind) {
+				itemsHandled = true
+				if err = decodeItems(decoder, handle); err != nil {
+					return err
+				}
+				continue
+			}
+			var value json.RawMessage
+			if err = decoder.Decode(&value); err != nil {
+				return errors.WithStack(err)
+			}
+			fields[key] = value
+			if key == "kind" {
+				// a kind which is not a string is left for unmarshalling the object to report
+				_ = json.Unmarshal(value, &kind)
+			}
+		}
+		if _, err := decoder.Token(); err != nil {
+			return errors.WithStack(err)
+		}
+		if isListKind(kind) {
+			if items, ok := fields["items"]; ok && !itemsHandled {
+				if err = decodeItems(json.NewDecoder(bytes.NewReader(items)), handle); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		data, err := json.Marshal(fields)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		var obj unstructured.Unstructured
+		if err = obj.UnmarshalJSON(data); err != nil {
+			return err
+		}
+		if err = handle(&obj); err != nil {
+			return err
+		}
+	}
+}
+
+// isListKind returns whether a kind is the kind of a list, such as List or ConfigMapList
+func isListKind(kind string) bool {
+	return strings.HasSuffix(kind, "List")
+}
+
+// decodeItems decodes the items array of a list, calling handle with each item
+func decodeItems(decoder *json.Decoder, handle func(*unstructured.Unstructured) error) error {
+	token, err := decoder.Token()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if token == nil {
+		return nil
+	}
+	for decoder.More() {
+		var data json.RawMessage
+		if err = decoder.Decode(&data); err != nil {
+			return errors.WithStack(err)
+		}
+		var item unstructured.Unstructured
+		if err = item.UnmarshalJSON(data); err != nil {
+			return err
+		}
+		if err = handle(&item); err != nil {
+			return err
+		}
+	}
+	_, err = decoder.Token()
+	return errors.WithStack(err)
+}
@@ -0,0 +1,138 @@
+package kube
+
+import (
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/argoproj/argo-cd/test"
+	"github.com/stretchr/testify/assert"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+)
+
+// echoKubectl replaces kubectl with cat, which returns the applied list as is
+func echoKubectl() func() {
+	orig := streamKubectl
+	streamKubectl = func(args []string, stdin io.Reader, readStdout func(io.Reader) error) error {
+		return streamCommand(exec.Command("cat"), stdin, readStdout)
+	}
+	return func() { streamKubectl = orig }
+}
+
+func TestApplyResourcesLargeManifest(t *testing.T) {
+	defer echoKubectl()()
+
+	// about 32MB of manifests, which pass through kubectl without ever being held in memory at once
+	value := strings.Repeat("x", 16*1024)
+	var objs []*unstructured.Unstructured
+	for i := 0; i < 2000; i++ {
+		objs = append(objs, MustToUnstructured(&apiv1.ConfigMap{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "ConfigMap"},
+			ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("config-%d", i)},
+			Data:       map[string]string{"a": value, "b": value},
+		}))
+	}
+	var names []string
+	err := applyResources(fake.NewSimpleClientset(), &rest.Config{}, objs, test.TestNamespace, ApplyOpts{}, func(obj *unstructured.Unstructured) error {
+		names = append(names, obj.GetName())
+		return nil
+	})
+	assert.Nil(t, err)
+	if assert.Equal(t, len(objs), len(names)) {
+		assert.Equal(t, "config-0", names[0])
+		assert.Equal(t, "config-1999", names[1999])
+	}
+}
+
+func TestApplyResourcesHandlerError(t *testing.T) {
+	defer echoKubectl()()
+
+	var objs []*unstructured.Unstructured
+	for i := 0; i < 100; i++ {
+		objs = append(objs, MustToUnstructured(&apiv1.ConfigMap{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "ConfigMap"},
+			ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("config-%d", i)},
+			Data:       map[string]string{"a": strings.Repeat("x", 64*1024)},
+		}))
+	}
+	// kubectl is not blocked by output which is no longer read
+	err := applyResources(fake.NewSimpleClientset(), &rest.Config{}, objs, test.TestNamespace, ApplyOpts{}, func(obj *unstructured.Unstructured) error {
+		return fmt.Errorf("rejected %s", obj.GetName())
+	})
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "rejected config-0")
+	}
+}
+
+func TestDecodeObjects(t *testing.T) {
+	input := `{"apiVersion": "v1", "kind": "Service", "metadata": {"name": "single"}, "spec": {"replicas": 1}}
+{"apiVersion": "v1", "kind": "List", "items": [{"apiVersion": "v1", "kind": "ConfigMap", "metadata": {"name": "first"}}, {"apiVersion": "v1", "kind": "ConfigMap", "metadata": {"name": "second"}}]}`
+	var objs []*unstructured.Unstructured
+	err := decodeObjects(strings.NewReader(input), func(obj *unstructured.Unstructured) error {
+		objs = append(objs, obj)
+		return nil
+	})
+	assert.Nil(t, err)
+	if assert.Equal(t, 3, len(objs)) {
+		assert.Equal(t, "single", objs[0].GetName())
+		assert.Equal(t, int64(1), objs[0].Object["spec"].(map[string]interface{})["replicas"])
+		assert.Equal(t, "first", objs[1].GetName())
+		assert.Equal(t, "second", objs[2].GetName())
+	}
+}
+
+func TestParseKubectlOutput(t *testing.T) {
+	names := func(out string) []string {
+		objs, err := ParseKubectlOutput([]byte(out))
+		assert.Nil(t, err)
+		var result []string
+		for _, obj := range objs {
+			result = append(result, obj.GetName())
+		}
+		return result
+	}
+	single := `{"apiVersion": "v1", "kind": "ConfigMap", "metadata": {"name": "single"}}`
+	list := `{"apiVersion": "v1", "kind": "List", "metadata": {}, "items": [
+  {"apiVersion": "v1", "kind": "ConfigMap", "metadata": {"name": "first"}},
+  {"apiVersion": "v1", "kind": "ConfigMap", "metadata": {"name": "second"}}
+]}`
+	emptyList := `{"apiVersion": "v1", "kind": "List", "items": null}`
+
+	assert.Equal(t, []string{"single"}, names(single))
+	assert.Equal(t, []string{"first", "second"}, names(list))
+	assert.Equal(t, []string{"single", "first", "second", "single"}, names(single+"\n"+list+"\n"+emptyList+single))
+	assert.Nil(t, names(""))
+
+	// kubectl writes the keys of lists in order, with the items before the kind
+	sortedList := `{"apiVersion": "v1", "items": [{"apiVersion": "v1", "kind": "ConfigMap", "metadata": {"name": "first"}}], "kind": "ConfigMapList"}`
+	assert.Equal(t, []string{"first"}, names(sortedList))
+
+	// objects which are not lists are returned whole, even if they have items
+	objs, err := ParseKubectlOutput([]byte(`{"apiVersion": "example.com/v1", "kind": "Inventory", "metadata": {"name": "stock"}, "items": [{"name": "apples"}]}`))
+	assert.Nil(t, err)
+	if assert.Equal(t, 1, len(objs)) {
+		assert.Equal(t, "stock", objs[0].GetName())
+		assert.Equal(t, []interface{}{map[string]interface{}{"name": "apples"}}, objs[0].Object["items"])
+	}
+
+	_, err = ParseKubectlOutput([]byte(`[{"kind": "ConfigMap"}]`))
+	assert.NotNil(t, err)
+	_, err = ParseKubectlOutput([]byte(`{"kind": "ConfigMap"`))
+	assert.NotNil(t, err)
+}
+
+func TestStreamCommandLargeStderr(t *testing.T) {
+	cmd := exec.Command("sh", "-c", "cat >/dev/null; head -c 1000000 /dev/zero | tr '\\0' e >&2; exit 1")
+	err := streamCommand(cmd, strings.NewReader(strings.Repeat("x", 1000000)), func(stdout io.Reader) error {
+		return nil
+	})
+	if assert.NotNil(t, err) {
+		assert.Equal(t, 1000000, len(err.Error()))
+	}
+}
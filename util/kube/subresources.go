@@ -0,0 +1,98 @@
+package kube
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+)
+
+// SupportsSubresource returns whether the resource serving a kind has the given subresource, such as
+// "scale" or "status"
+func SupportsSubresource(disco discovery.DiscoveryInterface, gvk schema.GroupVersionKind, subresource string) (bool, error) {
+	resources, err := disco.ServerResourcesForGroupVersion(gvk.GroupVersion().String())
+	if err != nil {
+		return false, err
+	}
+	resourceName := ""
+	for _, r := range resources.APIResources {
+		if r.Kind == gvk.Kind && !strings.Contains(r.Name, "/") {
+			resourceName = r.Name
+			break
+		}
+	}
+	if resourceName == "" {
+		return false, &UnknownKindError{GroupVersionKind: gvk}
+	}
+	for _, r := range resources.APIResources {
+		if r.Name == resourceName+"/"+subresource {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// UpdateStatus updates only the status subresource of an object, so that the spec of the object can
+// not be changed by accident, and returns the updated object. The dynamic client does not address
+// subresources, so a REST client configured the same way is used instead.
+func UpdateStatus(config *rest.Config, apiResource *metav1.APIResource, namespace string, obj *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+	disco, err := discovery.NewDiscoveryClientForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	restClient, err := newUnstructuredRESTClient(config, obj.GroupVersionKind().GroupVersion())
+	if err != nil {
+		return nil, err
+	}
+	return updateStatus(restClient, disco, apiResource, namespace, obj)
+}
+
+func updateStatus(restClient rest.Interface, disco discovery.DiscoveryInterface, apiResource *metav1.APIResource, namespace string, obj *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+	gvk := obj.GroupVersionKind()
+	supported, err := SupportsSubresource(disco, gvk, "status")
+	if err != nil {
+		return nil, err
+	}
+	if !supported {
+		return nil, fmt.Errorf("%s does not have a status subresource", gvk)
+	}
+	if obj.GetName() == "" {
+		return nil, fmt.Errorf("resource was supplied without a name")
+	}
+	result := &unstructured.Unstructured{}
+	err = restClient.Put().
+		NamespaceIfScoped(namespace, apiResource.Namespaced).
+		Resource(apiResource.Name).
+		Name(obj.GetName()).
+		SubResource("status").
+		Body(obj).
+		Do().
+		Into(result)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return result, nil
+}
+
+// newUnstructuredRESTClient returns a REST client for a group version which encodes and decodes
+// unstructured objects, configured the same way as the dynamic client
+func newUnstructuredRESTClient(config *rest.Config, gv schema.GroupVersion) (*rest.RESTClient, error) {
+	configCopy := *config
+	configCopy.ContentConfig = dynamic.ContentConfig()
+	configCopy.GroupVersion = &gv
+	if gv.Group == "" {
+		configCopy.APIPath = "/api"
+	} else {
+		configCopy.APIPath = "/apis"
+	}
+	if configCopy.UserAgent == "" {
+		configCopy.UserAgent = rest.DefaultKubernetesUserAgent()
+	}
+	return rest.RESTClientFor(&configCopy)
+}
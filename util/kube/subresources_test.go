@@ -0,0 +1,75 @@
+package kube
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	argoappv1 "github.com/argoproj/argo-cd/pkg/apis/application/v1alpha1"
+	"github.com/argoproj/argo-cd/test"
+	"github.com/stretchr/testify/assert"
+	appsv1beta2 "k8s.io/api/apps/v1beta2"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	"k8s.io/client-go/rest"
+	kubetesting "k8s.io/client-go/testing"
+)
+
+func TestSupportsSubresource(t *testing.T) {
+	fakeDiscovery := &fakediscovery.FakeDiscovery{Fake: &kubetesting.Fake{}}
+	fakeDiscovery.Resources = resourceList()
+	fakeDiscovery.Resources[0].APIResources = append(fakeDiscovery.Resources[0].APIResources, metav1.APIResource{Name: "configmaps", Namespaced: true, Kind: "ConfigMap"})
+
+	supported, err := SupportsSubresource(fakeDiscovery, appsv1beta2.SchemeGroupVersion.WithKind("Deployment"), "scale")
+	assert.Nil(t, err)
+	assert.True(t, supported)
+
+	supported, err = SupportsSubresource(fakeDiscovery, apiv1.SchemeGroupVersion.WithKind("ConfigMap"), "scale")
+	assert.Nil(t, err)
+	assert.False(t, supported)
+
+	_, err = SupportsSubresource(fakeDiscovery, apiv1.SchemeGroupVersion.WithKind("Widget"), "scale")
+	assert.True(t, IsUnknownKindError(err))
+}
+
+func TestUpdateStatus(t *testing.T) {
+	var requestPath string
+	var requestBody map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestPath = r.Method + " " + r.URL.Path
+		body, err := ioutil.ReadAll(r.Body)
+		assert.Nil(t, err)
+		assert.Nil(t, json.Unmarshal(body, &requestBody))
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(body)
+	}))
+	defer server.Close()
+
+	fakeDiscovery := &fakediscovery.FakeDiscovery{Fake: &kubetesting.Fake{}}
+	fakeDiscovery.Resources = resourceList()
+	app := &unstructured.Unstructured{}
+	app.SetAPIVersion(argoappv1.SchemeGroupVersion.String())
+	app.SetKind("Application")
+	app.SetName("guestbook")
+	app.Object["status"] = map[string]interface{}{"comparisonResult": map[string]interface{}{"status": "Synced"}}
+	appResource := &metav1.APIResource{Name: "applications", Namespaced: true, Kind: "Application"}
+
+	restClient, err := newUnstructuredRESTClient(&rest.Config{Host: server.URL}, argoappv1.SchemeGroupVersion)
+	assert.Nil(t, err)
+
+	// applications are not served with a status subresource by resourceList
+	_, err = updateStatus(restClient, fakeDiscovery, appResource, test.TestNamespace, app)
+	assert.NotNil(t, err)
+
+	fakeDiscovery.Resources[len(fakeDiscovery.Resources)-1].APIResources = append(fakeDiscovery.Resources[len(fakeDiscovery.Resources)-1].APIResources,
+		metav1.APIResource{Name: "applications/status", Namespaced: true, Kind: "Application"})
+	updated, err := updateStatus(restClient, fakeDiscovery, appResource, test.TestNamespace, app)
+	assert.Nil(t, err)
+	assert.Equal(t, "PUT /apis/argoproj.io/v1alpha1/namespaces/test-namespace/applications/guestbook/status", requestPath)
+	assert.Equal(t, app.Object["status"], requestBody["status"])
+	assert.Equal(t, app.Object["status"], updated.Object["status"])
+}
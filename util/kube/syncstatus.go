@@ -0,0 +1,145 @@
+package kube
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	argoappv1 "github.com/argoproj/argo-cd/pkg/apis/application/v1alpha1"
+	"github.com/argoproj/argo-cd/util/diff"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+)
+
+// IgnoreDifferences lists fields whose differences are ignored for the resources it matches. An empty
+// name or namespace matches any.
+type IgnoreDifferences struct {
+	Group     string
+	Kind      string
+	Name      string
+	Namespace string
+	// JSONPointers are the RFC 6901 paths of the ignored fields (e.g. /spec/replicas)
+	JSONPointers []string
+}
+
+// matches returns whether the ignored differences apply to a resource
+func (d IgnoreDifferences) matches(key ResourceKey) bool {
+	return d.Group == key.Group && d.Kind == key.Kind &&
+		(d.Name == "" || d.Name == key.Name) && (d.Namespace == "" || d.Namespace == key.Namespace)
+}
+
+// SyncStatusOpts are options for SyncStatus
+type SyncStatusOpts struct {
+	// DiffOpts are the options used to compare desired and live objects
+	DiffOpts diff.DiffOpts
+	// IgnoreDifferences lists fields whose differences do not make a resource out of sync
+	IgnoreDifferences []IgnoreDifferences
+}
+
+// ResourceSyncStatus is the sync status of an individual resource
+type ResourceSyncStatus struct {
+	Key ResourceKey
+	// Status is Synced or OutOfSync, like the status of the resource in an application's comparison result
+	Status argoappv1.ComparisonStatus
+	// Missing reports the resource is OutOfSync because it does not exist
+	Missing bool
+}
+
+// SyncStatus compares a set of desired objects with their live counterparts, and returns Synced if all
+// of them exist and match, or OutOfSync otherwise, along with the status of each object. The statuses
+// are the same as the application controller reports in comparison results. Objects are
+// compared with the same normalized diff as an apply, so fields populated by the server are not
+// differences, and neither are the fields listed in opts.IgnoreDifferences.
+func SyncStatus(config *rest.Config, desired []*unstructured.Unstructured, namespace string, opts SyncStatusOpts) (argoappv1.ComparisonStatus, []ResourceSyncStatus, error) {
+	dynClientPool := dynamic.NewDynamicClientPool(config)
+	disco, err := discovery.NewDiscoveryClientForConfig(config)
+	if err != nil {
+		return "", nil, err
+	}
+	return syncStatus(dynClientPool, disco, desired, namespace, opts)
+}
+
+func syncStatus(dynClientPool dynamic.ClientPool, disco discovery.DiscoveryInterface, desired []*unstructured.Unstructured, namespace string, opts SyncStatusOpts) (argoappv1.ComparisonStatus, []ResourceSyncStatus, error) {
+	desired, err := withDefaultNamespace(disco, desired, namespace)
+	if err != nil {
+		return "", nil, err
+	}
+	liveObjs, err := getLiveResources(dynClientPool, disco, desired, namespace, GetLiveOpts{IgnoreUnknownKinds: true})
+	if err != nil {
+		return "", nil, err
+	}
+	aggregate := argoappv1.ComparisonStatusSynced
+	statuses := make([]ResourceSyncStatus, len(desired))
+	for i, obj := range desired {
+		key := GetResourceKey(obj)
+		status := ResourceSyncStatus{Key: key, Status: argoappv1.ComparisonStatusSynced}
+		if liveObjs[i] == nil {
+			status.Status = argoappv1.ComparisonStatusOutOfSync
+			status.Missing = true
+		} else {
+			desiredObj, liveObj := obj, liveObjs[i]
+			for _, ignore := range opts.IgnoreDifferences {
+				if !ignore.matches(key) {
+					continue
+				}
+				if desiredObj, err = removeJSONPointers(desiredObj, ignore.JSONPointers); err != nil {
+					return "", nil, err
+				}
+				if liveObj, err = removeJSONPointers(liveObj, ignore.JSONPointers); err != nil {
+					return "", nil, err
+				}
+			}
+			if diff.DiffWithOpts(desiredObj, liveObj, opts.DiffOpts).Modified {
+				status.Status = argoappv1.ComparisonStatusOutOfSync
+			}
+		}
+		if status.Status != argoappv1.ComparisonStatusSynced {
+			aggregate = argoappv1.ComparisonStatusOutOfSync
+		}
+		statuses[i] = status
+	}
+	return aggregate, statuses, nil
+}
+
+// removeJSONPointers returns a copy of an object without the fields at the given JSON pointers. Pointers
+// to fields which do not exist are ignored.
+func removeJSONPointers(obj *unstructured.Unstructured, pointers []string) (*unstructured.Unstructured, error) {
+	obj = obj.DeepCopy()
+	for _, pointer := range pointers {
+		if pointer == "" || !strings.HasPrefix(pointer, "/") {
+			return nil, fmt.Errorf("invalid JSON pointer %q", pointer)
+		}
+		var tokens []string
+		for _, token := range strings.Split(pointer[1:], "/") {
+			tokens = append(tokens, strings.Replace(strings.Replace(token, "~1", "/", -1), "~0", "~", -1))
+		}
+		removeJSONPointer(obj.Object, tokens)
+	}
+	return obj, nil
+}
+
+// removeJSONPointer removes the field at the path of reference tokens from a value
+func removeJSONPointer(value interface{}, tokens []string) {
+	last := len(tokens) == 1
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if last {
+			delete(v, tokens[0])
+			return
+		}
+		removeJSONPointer(v[tokens[0]], tokens[1:])
+	case []interface{}:
+		i, err := strconv.Atoi(tokens[0])
+		if err != nil || i < 0 || i >= len(v) {
+			return
+		}
+		if last {
+			// elements can not be removed in place, so the ignored element is emptied
+			v[i] = nil
+			return
+		}
+		removeJSONPointer(v[i], tokens[1:])
+	}
+}
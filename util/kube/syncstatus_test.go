@@ -0,0 +1,55 @@
+package kube
+
+import (
+	"testing"
+
+	argoappv1 "github.com/argoproj/argo-cd/pkg/apis/application/v1alpha1"
+	"github.com/argoproj/argo-cd/test"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestSyncStatus(t *testing.T) {
+	fakeClientPool, fakeDiscovery := newReconcileFixture()
+	modified := newReconcileObject("ConfigMap", "guestbook-config")
+	modified.Object["data"] = map[string]interface{}{"color": "blue"}
+	desired := []*unstructured.Unstructured{
+		modified,
+		newReconcileObject("ConfigMap", "guestbook-stale"),
+		newReconcileObject("Service", "guestbook-ui"),
+	}
+
+	status, resources, err := syncStatus(fakeClientPool, fakeDiscovery, desired, test.TestNamespace, SyncStatusOpts{})
+	assert.Nil(t, err)
+	assert.Equal(t, argoappv1.ComparisonStatusOutOfSync, status)
+	assert.Equal(t, []ResourceSyncStatus{
+		{Key: NewResourceKey("", "ConfigMap", test.TestNamespace, "guestbook-config"), Status: argoappv1.ComparisonStatusOutOfSync},
+		{Key: NewResourceKey("", "ConfigMap", test.TestNamespace, "guestbook-stale"), Status: argoappv1.ComparisonStatusSynced},
+		{Key: NewResourceKey("", "Service", test.TestNamespace, "guestbook-ui"), Status: argoappv1.ComparisonStatusOutOfSync, Missing: true},
+	}, resources)
+
+	// the modified data is ignored
+	opts := SyncStatusOpts{IgnoreDifferences: []IgnoreDifferences{{Kind: "ConfigMap", JSONPointers: []string{"/data"}}}}
+	status, resources, err = syncStatus(fakeClientPool, fakeDiscovery, desired[:2], test.TestNamespace, opts)
+	assert.Nil(t, err)
+	assert.Equal(t, argoappv1.ComparisonStatusSynced, status)
+	assert.Equal(t, argoappv1.ComparisonStatusSynced, resources[0].Status)
+}
+
+func TestRemoveJSONPointers(t *testing.T) {
+	obj := &unstructured.Unstructured{Object: map[string]interface{}{
+		"metadata": map[string]interface{}{"annotations": map[string]interface{}{"example.com/rev": "3", "keep": "yes"}},
+		"spec":     map[string]interface{}{"replicas": int64(3), "ports": []interface{}{int64(80), int64(443)}},
+	}}
+	removed, err := removeJSONPointers(obj, []string{"/metadata/annotations/example.com~1rev", "/spec/replicas", "/spec/missing/field"})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"metadata": map[string]interface{}{"annotations": map[string]interface{}{"keep": "yes"}},
+		"spec":     map[string]interface{}{"ports": []interface{}{int64(80), int64(443)}},
+	}, removed.Object)
+	// the object itself is not modified
+	assert.Equal(t, int64(3), obj.Object["spec"].(map[string]interface{})["replicas"])
+
+	_, err = removeJSONPointers(obj, []string{"spec/replicas"})
+	assert.NotNil(t, err)
+}
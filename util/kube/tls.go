@@ -0,0 +1,67 @@
+package kube
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+
+	utilnet "k8s.io/apimachinery/pkg/util/net"
+	"k8s.io/client-go/rest"
+)
+
+// ConfigureTLS restricts the connections of clients created from the config to the given minimum TLS
+// version (e.g. tls.VersionTLS12) and, if any are given, to the given cipher suites. The vendored
+// client does not expose these settings, so the transport it creates is replaced with a copy using the
+// restricted TLS configuration. Requests fail rather than connect with the default settings if the
+// transport can not be restricted. This only applies to clients created in-process: kubectl, which is
+// used to apply resources, negotiates TLS on its own.
+func ConfigureTLS(config *rest.Config, minVersion uint16, cipherSuites []uint16) error {
+	if config.Transport != nil {
+		return fmt.Errorf("TLS settings can not be applied to a custom transport")
+	}
+	wrapTransport := config.WrapTransport
+	config.WrapTransport = func(rt http.RoundTripper) http.RoundTripper {
+		rt = restrictTLS(rt, minVersion, cipherSuites)
+		if wrapTransport != nil {
+			rt = wrapTransport(rt)
+		}
+		return rt
+	}
+	return nil
+}
+
+// restrictTLS returns a copy of a transport with the restricted TLS configuration. Transports are
+// shared by all clients with the same TLS configuration, so the transport itself must not be changed.
+func restrictTLS(rt http.RoundTripper, minVersion uint16, cipherSuites []uint16) http.RoundTripper {
+	transport, ok := rt.(*http.Transport)
+	if !ok {
+		return failingRoundTripper{err: fmt.Errorf("TLS settings can not be applied to transport %T", rt)}
+	}
+	var tlsConfig *tls.Config
+	if transport.TLSClientConfig != nil {
+		tlsConfig = transport.TLSClientConfig.Clone()
+	} else {
+		tlsConfig = &tls.Config{}
+	}
+	tlsConfig.MinVersion = minVersion
+	if len(cipherSuites) > 0 {
+		tlsConfig.CipherSuites = cipherSuites
+	}
+	return utilnet.SetTransportDefaults(&http.Transport{
+		Proxy:               transport.Proxy,
+		Dial:                transport.Dial,
+		DialContext:         transport.DialContext,
+		TLSHandshakeTimeout: transport.TLSHandshakeTimeout,
+		MaxIdleConnsPerHost: transport.MaxIdleConnsPerHost,
+		TLSClientConfig:     tlsConfig,
+	})
+}
+
+// failingRoundTripper fails every request with an error
+type failingRoundTripper struct {
+	err error
+}
+
+func (rt failingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	return nil, rt.err
+}
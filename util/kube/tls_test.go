@@ -0,0 +1,41 @@
+package kube
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/rest"
+)
+
+func TestConfigureTLS(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"major": "1", "minor": "9"}`))
+	}))
+	server.TLS = &tls.Config{MaxVersion: tls.VersionTLS12}
+	server.StartTLS()
+	defer server.Close()
+
+	serverVersion := func(minVersion uint16) error {
+		config := &rest.Config{Host: server.URL, TLSClientConfig: rest.TLSClientConfig{Insecure: true}}
+		err := ConfigureTLS(config, minVersion, []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256})
+		assert.Nil(t, err)
+		disco, err := discovery.NewDiscoveryClientForConfig(config)
+		assert.Nil(t, err)
+		_, err = disco.ServerVersion()
+		return err
+	}
+	assert.Nil(t, serverVersion(tls.VersionTLS12))
+	// the server does not support TLS 1.3
+	err := serverVersion(tls.VersionTLS13)
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "protocol version")
+	}
+
+	err = ConfigureTLS(&rest.Config{Transport: http.DefaultTransport}, tls.VersionTLS12, nil)
+	assert.NotNil(t, err)
+}
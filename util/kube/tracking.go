@@ -0,0 +1,175 @@
+package kube
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/argoproj/argo-cd/common"
+	"github.com/argoproj/argo-cd/util/diff"
+	log "github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/discovery"
+)
+
+// SetSyncRevision records the revision an object is synced from in its annotations. Other
+// annotations of the object are preserved.
+func SetSyncRevision(obj *unstructured.Unstructured, revision string) {
+	setAnnotation(obj, common.AnnotationKeySyncRevision, revision)
+}
+
+// GetSyncRevision returns the revision an object was last synced from, or the empty string if unknown
+func GetSyncRevision(obj *unstructured.Unstructured) string {
+	return obj.GetAnnotations()[common.AnnotationKeySyncRevision]
+}
+
+// SetSyncTimestamp records the time an object is synced in its annotations
+func SetSyncTimestamp(obj *unstructured.Unstructured, timestamp time.Time) {
+	setAnnotation(obj, common.AnnotationKeySyncTimestamp, timestamp.UTC().Format(time.RFC3339))
+}
+
+const (
+	// TrackingMethodLabel tracks resources with the LabelKeyInstance label
+	TrackingMethodLabel = "label"
+	// TrackingMethodAnnotation tracks resources with the AnnotationKeyTrackingID annotation
+	TrackingMethodAnnotation = "annotation"
+	// TrackingMethodAnnotationAndLabel tracks resources with the annotation, and also sets the label for
+	// tools which select resources by it
+	TrackingMethodAnnotationAndLabel = "annotation+label"
+)
+
+// IsTracked returns whether an object is tracked by an application according to the tracking method, and
+// the name of the application. The label method uses the labelKey label, or the annotation if the
+// application name was too long for a label, and the annotation methods the AnnotationKeyTrackingID
+// annotation, which is only honored if it identifies the object itself, since annotations may be copied
+// to other objects. Unknown methods are treated as the label method. An empty labelKey is the
+// LabelKeyInstance label SetTrackingID sets, and callers which select objects by another label (e.g.
+// because Helm charts set LabelKeyInstance to the release name) pass that label instead.
+func IsTracked(obj *unstructured.Unstructured, trackingMethod string, labelKey string) (bool, string) {
+	if usesTrackingAnnotation(trackingMethod) {
+		return isTrackedByAnnotation(obj)
+	}
+	if labelKey == "" {
+		labelKey = common.LabelKeyInstance
+	}
+	if appName := obj.GetLabels()[labelKey]; appName != "" {
+		return true, appName
+	}
+	return isTrackedByAnnotation(obj)
+}
+
+// usesTrackingAnnotation returns whether a tracking method only honors the tracking annotation, so that
+// objects which merely carry the labels of an application (e.g. pods, which inherit the labels of their
+// template) are not tracked by it
+func usesTrackingAnnotation(trackingMethod string) bool {
+	return trackingMethod == TrackingMethodAnnotation || trackingMethod == TrackingMethodAnnotationAndLabel
+}
+
+// SetTrackingID records that an object is tracked by an application, according to the tracking method.
+// Applications outside of the namespace of Argo CD are identified as <namespace>_<name>, which is the
+// name IsTracked returns. The label method falls back to the annotation if the identifier is not a valid
+// label value (e.g. it is longer than 63 characters), and the annotation and label method only sets the
+// label if it is valid. Since the annotation identifies the object it is set on, namespace must be the
+// namespace a namespaced object without metadata.namespace is applied in, and empty for cluster scoped
+// objects.
+func SetTrackingID(obj *unstructured.Unstructured, trackingMethod string, appName string, appNamespace string, namespace string) {
+	if appNamespace != "" {
+		appName = appNamespace + "_" + appName
+	}
+	if obj.GetNamespace() != "" {
+		namespace = obj.GetNamespace()
+	}
+	validLabel := len(validation.IsValidLabelValue(appName)) == 0
+	switch trackingMethod {
+	case TrackingMethodAnnotation:
+		setAnnotation(obj, common.AnnotationKeyTrackingID, trackingID(obj, appName, namespace))
+	case TrackingMethodAnnotationAndLabel:
+		setAnnotation(obj, common.AnnotationKeyTrackingID, trackingID(obj, appName, namespace))
+		if validLabel {
+			setLabel(obj, common.LabelKeyInstance, appName)
+		}
+	default:
+		if validLabel {
+			setLabel(obj, common.LabelKeyInstance, appName)
+		} else {
+			log.Debugf("Tracking %s/%s by annotation, since '%s' is not a valid label value", obj.GetKind(), obj.GetName(), appName)
+			setAnnotation(obj, common.AnnotationKeyTrackingID, trackingID(obj, appName, namespace))
+		}
+	}
+}
+
+// trackingID returns the value of the tracking annotation of an object in a namespace tracked by an
+// application, in the form <app>:<group>/<kind>:<namespace>/<name>
+func trackingID(obj *unstructured.Unstructured, appName string, namespace string) string {
+	gvk := obj.GroupVersionKind()
+	return fmt.Sprintf("%s:%s/%s:%s/%s", appName, gvk.Group, gvk.Kind, namespace, obj.GetName())
+}
+
+func isTrackedByAnnotation(obj *unstructured.Unstructured) (bool, string) {
+	id := obj.GetAnnotations()[common.AnnotationKeyTrackingID]
+	sep := strings.Index(id, ":")
+	if sep <= 0 {
+		return false, ""
+	}
+	appName := id[:sep]
+	if id != trackingID(obj, appName, obj.GetNamespace()) {
+		return false, ""
+	}
+	return true, appName
+}
+
+// DefaultAnnotationFilter lists the prefixes of operational annotations, which are managed by tools
+// such as kubectl rather than being part of an object's desired state
+var DefaultAnnotationFilter = []string{
+	"kubectl.kubernetes.io/",
+}
+
+// decorateForSync returns a copy of an object stamped with the sync revision, timestamp and application
+// instance requested by the apply options, and without the annotations filtered by the options. The
+// object itself is returned if no changes are requested. Discovery resolves the namespace the object is
+// applied in, which identifies it in the tracking annotation, and is only used if opts.AppInstance is set.
+func decorateForSync(disco discovery.DiscoveryInterface, obj *unstructured.Unstructured, namespace string, opts ApplyOpts) (*unstructured.Unstructured, error) {
+	if opts.SyncRevision == "" && !opts.SyncTimestamp && opts.AppInstance == "" && len(opts.AnnotationFilter) == 0 {
+		return obj, nil
+	}
+	obj = obj.DeepCopy()
+	diff.FilterAnnotations(obj, opts.AnnotationFilter)
+	if opts.AppInstance != "" {
+		trackingNamespace := namespace
+		apiResource, err := ServerResourceForGroupVersionKind(disco, obj.GroupVersionKind())
+		if err == nil {
+			trackingNamespace = liveResourceNamespace(apiResource, obj, namespace)
+		} else if !IsUnknownKindError(err) {
+			return nil, err
+		}
+		// objects of kinds which are not served yet (e.g. instances of a CRD applied along with them)
+		// are assumed to be namespaced, as most custom resources are
+		SetTrackingID(obj, opts.TrackingMethod, opts.AppInstance, "", trackingNamespace)
+	}
+	if opts.SyncRevision != "" {
+		SetSyncRevision(obj, opts.SyncRevision)
+	}
+	if opts.SyncTimestamp {
+		SetSyncTimestamp(obj, time.Now())
+	}
+	return obj, nil
+}
+
+func setAnnotation(obj *unstructured.Unstructured, key string, value string) {
+	annotations := obj.GetAnnotations()
+	if annotations == nil {
+		annotations = make(map[string]string)
+	}
+	annotations[key] = value
+	obj.SetAnnotations(annotations)
+}
+
+func setLabel(obj *unstructured.Unstructured, key string, value string) {
+	labels := obj.GetLabels()
+	if labels == nil {
+		labels = make(map[string]string)
+	}
+	labels[key] = value
+	obj.SetLabels(labels)
+}
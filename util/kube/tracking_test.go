@@ -0,0 +1,161 @@
+package kube
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/argoproj/argo-cd/common"
+	"github.com/argoproj/argo-cd/test"
+	"github.com/stretchr/testify/assert"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	kubetesting "k8s.io/client-go/testing"
+)
+
+func TestSyncRevision(t *testing.T) {
+	obj := MustToUnstructured(test.DemoService())
+	assert.Equal(t, "", GetSyncRevision(obj))
+
+	obj.SetAnnotations(map[string]string{"foo": "bar"})
+	SetSyncRevision(obj, "abc123")
+	assert.Equal(t, "abc123", GetSyncRevision(obj))
+	SetSyncRevision(obj, "abc123")
+	assert.Equal(t, map[string]string{"foo": "bar", common.AnnotationKeySyncRevision: "abc123"}, obj.GetAnnotations())
+
+	SetSyncRevision(obj, "def456")
+	assert.Equal(t, "def456", GetSyncRevision(obj))
+	assert.Equal(t, "bar", obj.GetAnnotations()["foo"])
+}
+
+func TestDecorateForSync(t *testing.T) {
+	obj := MustToUnstructured(test.DemoService())
+	decorated, err := decorateForSync(nil, obj, "", ApplyOpts{})
+	assert.Nil(t, err)
+	assert.True(t, obj == decorated)
+
+	decorated, err = decorateForSync(nil, obj, "", ApplyOpts{SyncRevision: "abc123", SyncTimestamp: true})
+	assert.Nil(t, err)
+	assert.Equal(t, "abc123", GetSyncRevision(decorated))
+	assert.NotEmpty(t, decorated.GetAnnotations()[common.AnnotationKeySyncTimestamp])
+	// the original object must not be modified
+	assert.Equal(t, "", GetSyncRevision(obj))
+}
+
+func TestDecorateForSyncAppInstance(t *testing.T) {
+	fakeDiscovery := &fakediscovery.FakeDiscovery{Fake: &kubetesting.Fake{}}
+	fakeDiscovery.Resources = resourceList()
+	obj := fakeDeploymentV1beta2()
+	obj.SetNamespace("")
+
+	decorated, err := decorateForSync(fakeDiscovery, obj, test.TestNamespace, ApplyOpts{AppInstance: "guestbook", TrackingMethod: TrackingMethodAnnotation})
+	assert.Nil(t, err)
+	live := decorated.DeepCopy()
+	live.SetNamespace(test.TestNamespace)
+	tracked, appName := IsTracked(live, TrackingMethodAnnotation, "")
+	assert.True(t, tracked)
+	assert.Equal(t, "guestbook", appName)
+}
+
+func TestDecorateForSyncAnnotationFilter(t *testing.T) {
+	obj := MustToUnstructured(test.DemoService())
+	obj.SetAnnotations(map[string]string{common.AnnotationKeySyncRevision: "abc123", "kubectl.kubernetes.io/last-applied-configuration": "{}"})
+	decorated, err := decorateForSync(nil, obj, "", ApplyOpts{AnnotationFilter: DefaultAnnotationFilter})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{common.AnnotationKeySyncRevision: "abc123"}, decorated.GetAnnotations())
+	assert.Equal(t, 2, len(obj.GetAnnotations()))
+}
+
+func TestIsTrackedByLabel(t *testing.T) {
+	obj := MustToUnstructured(test.DemoService())
+	tracked, _ := IsTracked(obj, TrackingMethodLabel, "")
+	assert.False(t, tracked)
+
+	obj.SetLabels(map[string]string{common.LabelKeyInstance: "guestbook"})
+	tracked, appName := IsTracked(obj, TrackingMethodLabel, "")
+	assert.True(t, tracked)
+	assert.Equal(t, "guestbook", appName)
+
+	// the annotation methods ignore the label
+	tracked, _ = IsTracked(obj, TrackingMethodAnnotation, "")
+	assert.False(t, tracked)
+
+	// the label method honors the label the caller selects by
+	obj.SetLabels(map[string]string{common.LabelKeyInstance: "guestbook-release", common.LabelApplicationName: "guestbook"})
+	tracked, appName = IsTracked(obj, TrackingMethodLabel, common.LabelApplicationName)
+	assert.True(t, tracked)
+	assert.Equal(t, "guestbook", appName)
+	_, appName = IsTracked(obj, TrackingMethodLabel, "")
+	assert.Equal(t, "guestbook-release", appName)
+}
+
+func TestIsTrackedByAnnotation(t *testing.T) {
+	obj := MustToUnstructured(test.DemoDeployment())
+	obj.SetAnnotations(map[string]string{common.AnnotationKeyTrackingID: "guestbook:apps/Deployment:" + test.TestNamespace + "/demo"})
+	tracked, appName := IsTracked(obj, TrackingMethodAnnotation, "")
+	assert.True(t, tracked)
+	assert.Equal(t, "guestbook", appName)
+	tracked, appName = IsTracked(obj, TrackingMethodAnnotationAndLabel, "")
+	assert.True(t, tracked)
+	assert.Equal(t, "guestbook", appName)
+
+	// an annotation copied from another object does not track the object
+	copied := obj.DeepCopy()
+	copied.SetName("copy")
+	tracked, _ = IsTracked(copied, TrackingMethodAnnotation, "")
+	assert.False(t, tracked)
+
+	obj.SetAnnotations(map[string]string{common.AnnotationKeyTrackingID: "malformed"})
+	tracked, _ = IsTracked(obj, TrackingMethodAnnotation, "")
+	assert.False(t, tracked)
+}
+
+func TestSetTrackingID(t *testing.T) {
+	for _, method := range []string{TrackingMethodLabel, TrackingMethodAnnotation, TrackingMethodAnnotationAndLabel} {
+		obj := MustToUnstructured(test.DemoDeployment())
+		SetTrackingID(obj, method, "guestbook", "", "")
+		tracked, appName := IsTracked(obj, method, "")
+		assert.True(t, tracked, method)
+		assert.Equal(t, "guestbook", appName, method)
+
+		SetTrackingID(obj, method, "guestbook", "team-a", "")
+		_, appName = IsTracked(obj, method, "")
+		assert.Equal(t, "team-a_guestbook", appName, method)
+	}
+
+	obj := MustToUnstructured(test.DemoDeployment())
+	SetTrackingID(obj, TrackingMethodAnnotationAndLabel, "guestbook", "", "")
+	assert.Equal(t, "guestbook", obj.GetLabels()[common.LabelKeyInstance])
+	assert.Equal(t, "guestbook:apps/Deployment:"+test.TestNamespace+"/demo", obj.GetAnnotations()[common.AnnotationKeyTrackingID])
+}
+
+func TestSetTrackingIDLongName(t *testing.T) {
+	longName := strings.Repeat("a", 64)
+	obj := MustToUnstructured(test.DemoDeployment())
+	SetTrackingID(obj, TrackingMethodLabel, longName, "", "")
+	assert.NotContains(t, obj.GetLabels(), common.LabelKeyInstance)
+	tracked, appName := IsTracked(obj, TrackingMethodLabel, "")
+	assert.True(t, tracked)
+	assert.Equal(t, longName, appName)
+
+	obj = MustToUnstructured(test.DemoDeployment())
+	SetTrackingID(obj, TrackingMethodAnnotationAndLabel, longName, "", "")
+	assert.NotContains(t, obj.GetLabels(), common.LabelKeyInstance)
+	_, appName = IsTracked(obj, TrackingMethodAnnotationAndLabel, "")
+	assert.Equal(t, longName, appName)
+}
+
+func TestSetTrackingIDWithoutNamespace(t *testing.T) {
+	for _, appName := range []string{"guestbook", strings.Repeat("a", 64)} {
+		for _, method := range []string{TrackingMethodLabel, TrackingMethodAnnotation, TrackingMethodAnnotationAndLabel} {
+			manifest := MustToUnstructured(test.DemoDeployment())
+			manifest.SetNamespace("")
+			SetTrackingID(manifest, method, appName, "", test.TestNamespace)
+
+			// the API server defaults the namespace of the live object
+			live := manifest.DeepCopy()
+			live.SetNamespace(test.TestNamespace)
+			tracked, trackedName := IsTracked(live, method, "")
+			assert.True(t, tracked, method)
+			assert.Equal(t, appName, trackedName, method)
+		}
+	}
+}
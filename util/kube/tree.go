@@ -0,0 +1,136 @@
+package kube
+
+import (
+	"fmt"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+)
+
+// ResourceNode is a resource in a resource tree, along with the resources it owns
+type ResourceNode struct {
+	Obj      *unstructured.Unstructured
+	Children []*ResourceNode
+}
+
+// ChildKinds are the kinds of the resources which may be owned by resources of each kind. Only these
+// kinds are searched for the children of a resource, rather than every kind served by the cluster.
+var ChildKinds = map[string][]schema.GroupKind{
+	"Deployment":  {{Group: "apps", Kind: "ReplicaSet"}},
+	"ReplicaSet":  {{Kind: "Pod"}},
+	"StatefulSet": {{Kind: "Pod"}, {Group: "apps", Kind: "ControllerRevision"}},
+	"DaemonSet":   {{Kind: "Pod"}, {Group: "apps", Kind: "ControllerRevision"}},
+	"Job":         {{Kind: "Pod"}},
+	"CronJob":     {{Group: "batch", Kind: "Job"}},
+}
+
+// GetResourceTree gets the live counterpart of a resource, and the resources it owns, as determined by
+// their owner references, recursively up to maxDepth levels below the resource. Children are searched in
+// the namespace of the resource, among the kinds listed in ChildKinds.
+func GetResourceTree(config *rest.Config, root *unstructured.Unstructured, maxDepth int) (*ResourceNode, error) {
+	dynClientPool := dynamic.NewDynamicClientPool(config)
+	disco, err := discovery.NewDiscoveryClientForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return getResourceTree(dynClientPool, disco, root, maxDepth)
+}
+
+func getResourceTree(dynClientPool dynamic.ClientPool, disco discovery.DiscoveryInterface, root *unstructured.Unstructured, maxDepth int) (*ResourceNode, error) {
+	liveObjs, err := getLiveResources(dynClientPool, disco, []*unstructured.Unstructured{root}, root.GetNamespace(), GetLiveOpts{})
+	if err != nil {
+		return nil, err
+	}
+	if liveObjs[0] == nil {
+		return nil, fmt.Errorf("%s '%s' not found", root.GetKind(), root.GetName())
+	}
+	infos, err := APIResourcesSupportingVerb(disco, listVerb)
+	if err != nil {
+		return nil, err
+	}
+	tree := &resourceTree{
+		dynClientPool: dynClientPool,
+		namespace:     liveObjs[0].GetNamespace(),
+		infos:         make(map[schema.GroupKind]GroupVersionResourceInfo),
+		listed:        make(map[schema.GroupKind][]*unstructured.Unstructured),
+	}
+	for _, info := range infos {
+		// the first version served of a kind is used
+		if _, ok := tree.infos[info.GroupVersionKind.GroupKind()]; !ok {
+			tree.infos[info.GroupVersionKind.GroupKind()] = info
+		}
+	}
+	node := &ResourceNode{Obj: liveObjs[0]}
+	if err = tree.addChildren(node, maxDepth); err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+// resourceTree finds the children of resources. Each kind is listed at most once.
+type resourceTree struct {
+	dynClientPool dynamic.ClientPool
+	namespace     string
+	infos         map[schema.GroupKind]GroupVersionResourceInfo
+	listed        map[schema.GroupKind][]*unstructured.Unstructured
+}
+
+func (t *resourceTree) addChildren(node *ResourceNode, depth int) error {
+	if depth <= 0 {
+		return nil
+	}
+	for _, gk := range ChildKinds[node.Obj.GetKind()] {
+		candidates, err := t.list(gk)
+		if err != nil {
+			return err
+		}
+		for _, candidate := range candidates {
+			if !isOwnedBy(candidate, node.Obj) {
+				continue
+			}
+			child := &ResourceNode{Obj: candidate}
+			if err = t.addChildren(child, depth-1); err != nil {
+				return err
+			}
+			node.Children = append(node.Children, child)
+		}
+	}
+	return nil
+}
+
+// list returns the resources of a kind in the namespace of the tree. Kinds which are not served by the
+// cluster have no resources.
+func (t *resourceTree) list(gk schema.GroupKind) ([]*unstructured.Unstructured, error) {
+	if objs, ok := t.listed[gk]; ok {
+		return objs, nil
+	}
+	info, ok := t.infos[gk]
+	if !ok {
+		t.listed[gk] = nil
+		return nil, nil
+	}
+	dclient, err := t.dynClientPool.ClientForGroupVersionKind(info.GroupVersionKind)
+	if err != nil {
+		return nil, err
+	}
+	objs, err := ListResources(dclient, info.APIResource, t.namespace, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	t.listed[gk] = objs
+	return objs, nil
+}
+
+// isOwnedBy returns whether an object has an owner reference to the owner
+func isOwnedBy(obj *unstructured.Unstructured, owner *unstructured.Unstructured) bool {
+	for _, ref := range obj.GetOwnerReferences() {
+		if ref.UID == owner.GetUID() {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,88 @@
+package kube
+
+import (
+	"testing"
+
+	"github.com/argoproj/argo-cd/test"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	fakedynamic "k8s.io/client-go/dynamic/fake"
+	kubetesting "k8s.io/client-go/testing"
+)
+
+func TestGetResourceTree(t *testing.T) {
+	fakeDiscovery := &fakediscovery.FakeDiscovery{Fake: &kubetesting.Fake{}}
+	fakeDiscovery.Resources = []*metav1.APIResourceList{
+		{
+			GroupVersion: "v1",
+			APIResources: []metav1.APIResource{
+				{Name: "pods", Namespaced: true, Kind: "Pod", Verbs: []string{"list"}},
+			},
+		},
+		{
+			GroupVersion: "apps/v1beta2",
+			APIResources: []metav1.APIResource{
+				{Name: "deployments", Namespaced: true, Kind: "Deployment", Verbs: []string{"get", "list"}},
+				{Name: "replicasets", Namespaced: true, Kind: "ReplicaSet", Verbs: []string{"list"}},
+			},
+		},
+	}
+	newObj := func(apiVersion string, kind string, name string, owner *unstructured.Unstructured) *unstructured.Unstructured {
+		obj := &unstructured.Unstructured{}
+		obj.SetAPIVersion(apiVersion)
+		obj.SetKind(kind)
+		obj.SetName(name)
+		obj.SetNamespace(test.TestNamespace)
+		obj.SetUID(types.UID(kind + "/" + name))
+		if owner != nil {
+			obj.SetOwnerReferences([]metav1.OwnerReference{{APIVersion: owner.GetAPIVersion(), Kind: owner.GetKind(), Name: owner.GetName(), UID: owner.GetUID()}})
+		}
+		return obj
+	}
+	deployment := newObj("apps/v1beta2", "Deployment", "guestbook-ui", nil)
+	replicaSet := newObj("apps/v1beta2", "ReplicaSet", "guestbook-ui-5d8f", deployment)
+	otherReplicaSet := newObj("apps/v1beta2", "ReplicaSet", "other-7c9b", nil)
+	pod1 := newObj("v1", "Pod", "guestbook-ui-5d8f-abc", replicaSet)
+	pod2 := newObj("v1", "Pod", "guestbook-ui-5d8f-def", replicaSet)
+	otherPod := newObj("v1", "Pod", "other-7c9b-ghi", otherReplicaSet)
+
+	listed := make(map[string]int)
+	fakeClientPool := fakedynamic.FakeClientPool{}
+	fakeClientPool.AddReactor("get", "deployments", func(action kubetesting.Action) (bool, runtime.Object, error) {
+		return true, deployment, nil
+	})
+	fakeClientPool.AddReactor("list", "*", func(action kubetesting.Action) (bool, runtime.Object, error) {
+		listed[action.GetResource().Resource]++
+		list := &unstructured.UnstructuredList{}
+		switch action.GetResource().Resource {
+		case "replicasets":
+			list.Items = []unstructured.Unstructured{*replicaSet, *otherReplicaSet}
+		case "pods":
+			list.Items = []unstructured.Unstructured{*pod1, *otherPod, *pod2}
+		}
+		return true, list, nil
+	})
+
+	tree, err := getResourceTree(&fakeClientPool, fakeDiscovery, newObj("apps/v1beta2", "Deployment", "guestbook-ui", nil), 2)
+	assert.Nil(t, err)
+	assert.Equal(t, "guestbook-ui", tree.Obj.GetName())
+	if assert.Equal(t, 1, len(tree.Children)) {
+		rs := tree.Children[0]
+		assert.Equal(t, "guestbook-ui-5d8f", rs.Obj.GetName())
+		if assert.Equal(t, 2, len(rs.Children)) {
+			assert.Equal(t, "guestbook-ui-5d8f-abc", rs.Children[0].Obj.GetName())
+			assert.Equal(t, "guestbook-ui-5d8f-def", rs.Children[1].Obj.GetName())
+		}
+	}
+	// only the kinds which may be children are listed
+	assert.Equal(t, map[string]int{"replicasets": 1, "pods": 1}, listed)
+
+	tree, err = getResourceTree(&fakeClientPool, fakeDiscovery, deployment, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(tree.Children))
+	assert.Empty(t, tree.Children[0].Children)
+}
@@ -0,0 +1,126 @@
+package kube
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"k8s.io/client-go/rest"
+)
+
+// WarningHandler handles the warnings returned by the API server in Warning response headers, such
+// as the deprecation warnings of APIs scheduled for removal
+type WarningHandler interface {
+	HandleWarningHeader(code int, agent string, text string)
+}
+
+// WarningCollector is a WarningHandler which collects the text of all warnings it handles
+type WarningCollector struct {
+	lock     sync.Mutex
+	warnings []string
+}
+
+// HandleWarningHeader records the text of a warning
+func (c *WarningCollector) HandleWarningHeader(code int, agent string, text string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.warnings = append(c.warnings, text)
+}
+
+// Warnings returns the text of the warnings collected so far, in the order they were received
+func (c *WarningCollector) Warnings() []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	warnings := make([]string, len(c.warnings))
+	copy(warnings, c.warnings)
+	return warnings
+}
+
+// warningLogger is a WarningHandler which logs warnings
+type warningLogger struct {
+	action string
+}
+
+func (l *warningLogger) HandleWarningHeader(code int, agent string, text string) {
+	log.Warnf("Server warning while %s: %s", l.action, text)
+}
+
+// SetWarningHandler installs a handler of the warnings returned by the API server for all requests
+// made by clients created from the config. Handlers installed earlier keep receiving warnings.
+func SetWarningHandler(config *rest.Config, handler WarningHandler) {
+	wrapTransport := config.WrapTransport
+	config.WrapTransport = func(rt http.RoundTripper) http.RoundTripper {
+		if wrapTransport != nil {
+			rt = wrapTransport(rt)
+		}
+		return &warningRoundTripper{delegate: rt, handler: handler}
+	}
+}
+
+// withWarningsLogged returns a copy of a config which logs the warnings returned by the API server,
+// so the warnings of in-process operations are surfaced like those printed by kubectl, and passes them
+// to the caller's handler, if it is not nil
+func withWarningsLogged(config *rest.Config, action string, handler WarningHandler) *rest.Config {
+	configCopy := *config
+	SetWarningHandler(&configCopy, &warningLogger{action: action})
+	if handler != nil {
+		SetWarningHandler(&configCopy, handler)
+	}
+	return &configCopy
+}
+
+type warningRoundTripper struct {
+	delegate http.RoundTripper
+	handler  WarningHandler
+}
+
+func (rt *warningRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := rt.delegate.RoundTrip(req)
+	if resp != nil {
+		for _, header := range resp.Header["Warning"] {
+			if code, agent, text, ok := parseWarningHeader(header); ok {
+				rt.handler.HandleWarningHeader(code, agent, text)
+			}
+		}
+	}
+	return resp, err
+}
+
+// parseWarningHeader parses a Warning header value of the form `299 - "text"` (RFC 7234, section
+// 5.5), as sent by the API server. A trailing warn-date is ignored.
+func parseWarningHeader(header string) (int, string, string, bool) {
+	parts := strings.SplitN(strings.TrimSpace(header), " ", 3)
+	if len(parts) != 3 {
+		return 0, "", "", false
+	}
+	code, err := strconv.Atoi(parts[0])
+	if err != nil || len(parts[0]) != 3 {
+		return 0, "", "", false
+	}
+	quoted := parts[2]
+	if !strings.HasPrefix(quoted, `"`) {
+		return 0, "", "", false
+	}
+	// find the closing quote, skipping escaped characters
+	end := -1
+	for i := 1; i < len(quoted); i++ {
+		if quoted[i] == '\\' {
+			i++
+			continue
+		}
+		if quoted[i] == '"' {
+			end = i
+			break
+		}
+	}
+	if end < 0 {
+		return 0, "", "", false
+	}
+	text, err := strconv.Unquote(quoted[:end+1])
+	if err != nil {
+		return 0, "", "", false
+	}
+	return code, parts[1], text, true
+}
@@ -0,0 +1,114 @@
+package kube
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/argoproj/argo-cd/common"
+	"github.com/argoproj/argo-cd/test"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+type roundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestSetWarningHandler(t *testing.T) {
+	config := &rest.Config{
+		Host: "https://prod.example.com:6443",
+		Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			header := http.Header{}
+			header.Set("Content-Type", "application/json")
+			header.Add("Warning", `299 - "extensions/v1beta1 Ingress is deprecated in v1.14+, unavailable in v1.22+; use networking.k8s.io/v1 Ingress"`)
+			header.Add("Warning", `299 - "a \"quoted\" warning" "Tue, 15 Nov 1994 08:12:31 GMT"`)
+			header.Add("Warning", `malformed`)
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Header:     header,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"major": "1", "minor": "9"}`)),
+				Request:    req,
+			}, nil
+		}),
+	}
+	collector := &WarningCollector{}
+	SetWarningHandler(config, collector)
+	kubeclientset, err := kubernetes.NewForConfig(config)
+	assert.Nil(t, err)
+	_, err = kubeclientset.Discovery().ServerVersion()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{
+		"extensions/v1beta1 Ingress is deprecated in v1.14+, unavailable in v1.22+; use networking.k8s.io/v1 Ingress",
+		`a "quoted" warning`,
+	}, collector.Warnings())
+
+	// handlers installed on a copy of the config do not replace the original handler
+	configCopy := withWarningsLogged(config, "testing", nil)
+	kubeclientset, err = kubernetes.NewForConfig(configCopy)
+	assert.Nil(t, err)
+	_, err = kubeclientset.Discovery().ServerVersion()
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(collector.Warnings()))
+}
+
+// newWarningServer returns a server which serves config maps, and returns a deprecation warning with
+// every config map request
+func newWarningServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/api":
+			_, _ = w.Write([]byte(`{"kind":"APIVersions","versions":["v1"]}`))
+			return
+		case "/apis":
+			_, _ = w.Write([]byte(`{"kind":"APIGroupList","apiVersion":"v1","groups":[]}`))
+			return
+		case "/api/v1":
+			_, _ = w.Write([]byte(`{"kind":"APIResourceList","groupVersion":"v1","resources":[` +
+				`{"name":"configmaps","namespaced":true,"kind":"ConfigMap","verbs":["create","get","list"]}]}`))
+			return
+		}
+		w.Header().Add("Warning", `299 - "v1 ConfigMap is deprecated"`)
+		switch {
+		case r.Method == http.MethodPost:
+			body, _ := ioutil.ReadAll(r.Body)
+			w.WriteHeader(http.StatusCreated)
+			_, _ = w.Write(body)
+		case strings.HasSuffix(r.URL.Path, "/configmaps"):
+			_, _ = w.Write([]byte(`{"apiVersion":"v1","kind":"ConfigMapList","metadata":{},"items":[]}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"kind":"Status","apiVersion":"v1","status":"Failure","reason":"NotFound","code":404}`))
+		}
+	}))
+}
+
+func TestWarningsReachCaller(t *testing.T) {
+	server := newWarningServer()
+	defer server.Close()
+	config := &rest.Config{Host: server.URL}
+
+	collector := &WarningCollector{}
+	_, err := GetResourcesWithLabel(context.Background(), config, test.TestNamespace, common.LabelApplicationName, "guestbook", &BulkOptions{WarningHandler: collector})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"v1 ConfigMap is deprecated"}, collector.Warnings())
+
+	collector = &WarningCollector{}
+	obj := &unstructured.Unstructured{}
+	obj.SetAPIVersion("v1")
+	obj.SetKind("ConfigMap")
+	obj.SetName("guestbook-config")
+	_, err = ApplyResourceNative(config, obj, test.TestNamespace, ApplyOpts{WarningHandler: collector})
+	assert.Nil(t, err)
+	// both the get of the live object and its creation returned the warning
+	assert.Equal(t, []string{"v1 ConfigMap is deprecated", "v1 ConfigMap is deprecated"}, collector.Warnings())
+}
@@ -0,0 +1,296 @@
+package kube
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/util/jsonpath"
+)
+
+// ObjectEvent is a watch event of one of the objects watched by WatchObjects
+type ObjectEvent struct {
+	Key   ResourceKey
+	Event watch.Event
+}
+
+// WatchObjects watches a known set of objects, such as the objects applied by a sync. Rather than
+// opening a watch per object, objects of the same kind in the same namespace share a single watch,
+// narrowed by the labels common to all of them, and events are demultiplexed back to the individual
+// objects. Namespaced objects which do not specify a namespace are watched in the given namespace, and
+// their events are keyed by the objects as given. The returned channel is closed when the context is
+// done or all watches have ended.
+func WatchObjects(ctx context.Context, config *rest.Config, objs []*unstructured.Unstructured, namespace string) (chan ObjectEvent, error) {
+	dynClientPool := dynamic.NewDynamicClientPool(config)
+	disco, err := discovery.NewDiscoveryClientForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return watchObjects(ctx, dynClientPool, disco, objs, namespace)
+}
+
+func watchObjects(ctx context.Context, dynClientPool dynamic.ClientPool, disco discovery.DiscoveryInterface, objs []*unstructured.Unstructured, namespace string) (chan ObjectEvent, error) {
+	// events carry the namespace of the live objects, so objects are keyed by the namespace they are in
+	defaulted, err := withDefaultNamespace(disco, objs, namespace)
+	if err != nil {
+		return nil, err
+	}
+	givenKeys := make(map[ResourceKey]ResourceKey)
+	for i, obj := range defaulted {
+		givenKeys[GetResourceKey(obj)] = GetResourceKey(objs[i])
+	}
+	groups := groupByKindAndNamespace(defaulted)
+	watchers := make([]watch.Interface, 0)
+	keySets := make([]map[ResourceKey]ResourceKey, 0)
+	for _, group := range groups {
+		dclient, err := dynClientPool.ClientForGroupVersionKind(group.gvk)
+		if err != nil {
+			stopAll(watchers)
+			return nil, err
+		}
+		apiResource, err := ServerResourceForGroupVersionKind(disco, group.gvk)
+		if err != nil {
+			stopAll(watchers)
+			return nil, err
+		}
+		watchNamespace := group.namespace
+		if !apiResource.Namespaced {
+			watchNamespace = ""
+		}
+		listOpts, err := narrowingListOptions(group.objs)
+		if err != nil {
+			stopAll(watchers)
+			return nil, err
+		}
+		watcher, err := dclient.Resource(apiResource, watchNamespace).Watch(listOpts)
+		if err != nil {
+			stopAll(watchers)
+			return nil, err
+		}
+		keys := make(map[ResourceKey]ResourceKey)
+		for _, obj := range group.objs {
+			keys[GetResourceKey(obj)] = givenKeys[GetResourceKey(obj)]
+		}
+		watchers = append(watchers, watcher)
+		keySets = append(keySets, keys)
+	}
+
+	ch := make(chan ObjectEvent)
+	var wg sync.WaitGroup
+	wg.Add(len(watchers))
+	for i := range watchers {
+		watcher := watchers[i]
+		keys := keySets[i]
+		go func() {
+			defer wg.Done()
+			defer watcher.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case event, ok := <-watcher.ResultChan():
+					if !ok {
+						return
+					}
+					obj, isUnstructured := event.Object.(*unstructured.Unstructured)
+					if !isUnstructured {
+						continue
+					}
+					key, ok := keys[GetResourceKey(obj)]
+					if !ok {
+						continue
+					}
+					select {
+					case ch <- ObjectEvent{Key: key, Event: event}:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(ch)
+		log.Debugf("Stopped watching %d objects", len(objs))
+	}()
+	return ch, nil
+}
+
+// rewatchBackoff is the backoff between the watches of WaitForJSONPath, so a watch which keeps ending
+// at once (e.g. because its resource version expired) does not spin against the API server
+var rewatchBackoff = wait.Backoff{
+	Duration: 100 * time.Millisecond,
+	Factor:   2,
+	Jitter:   0.1,
+}
+
+// maxRewatchDelay is the longest delay between the watches of WaitForJSONPath
+const maxRewatchDelay = 10 * time.Second
+
+// WaitForJSONPath waits until the value of a JSONPath expression (e.g. "{.status.phase}") evaluated
+// against an object equals the expected value, similar to `kubectl wait --for=jsonpath`. The object is
+// watched rather than polled. An object which does not exist yet, or which does not have the field yet,
+// is waited for. Returns the object once the condition is met, or an error if the context is done first.
+func WaitForJSONPath(ctx context.Context, dclient dynamic.Interface, apiResource metav1.APIResource, namespace string, name string, jsonPath string, expected string) (*unstructured.Unstructured, error) {
+	if !strings.HasPrefix(jsonPath, "{") {
+		jsonPath = fmt.Sprintf("{%s}", jsonPath)
+	}
+	parser := jsonpath.New("wait").AllowMissingKeys(true)
+	if err := parser.Parse(jsonPath); err != nil {
+		return nil, fmt.Errorf("invalid JSONPath '%s': %v", jsonPath, err)
+	}
+	matches := func(obj *unstructured.Unstructured) (bool, error) {
+		var buf bytes.Buffer
+		if err := parser.Execute(&buf, obj.Object); err != nil {
+			return false, err
+		}
+		return buf.String() == expected, nil
+	}
+
+	resource := dclient.Resource(&apiResource, namespace)
+	delay := rewatchBackoff.Duration
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		var resourceVersion string
+		obj, err := resource.Get(name, metav1.GetOptions{})
+		if err == nil {
+			matched, err := matches(obj)
+			if err != nil {
+				return nil, err
+			}
+			if matched {
+				return obj, nil
+			}
+			resourceVersion = obj.GetResourceVersion()
+		} else if !apierr.IsNotFound(err) {
+			return nil, errors.WithStack(err)
+		}
+		watcher, err := resource.Watch(metav1.ListOptions{
+			FieldSelector:   fmt.Sprintf("metadata.name=%s", name),
+			ResourceVersion: resourceVersion,
+		})
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		obj, err = waitForMatchingEvent(ctx, watcher, matches)
+		watcher.Stop()
+		if obj != nil || err != nil {
+			return obj, err
+		}
+		// the watch expired before the condition was met, so get the object again and resume watching
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait.Jitter(delay, rewatchBackoff.Jitter)):
+		}
+		delay = time.Duration(float64(delay) * rewatchBackoff.Factor)
+		if delay > maxRewatchDelay {
+			delay = maxRewatchDelay
+		}
+	}
+}
+
+// waitForMatchingEvent returns the first object added or modified by the events of a watch which
+// matches the condition. Returns nil if the watch ends first.
+func waitForMatchingEvent(ctx context.Context, watcher watch.Interface, matches func(*unstructured.Unstructured) (bool, error)) (*unstructured.Unstructured, error) {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case event, ok := <-watcher.ResultChan():
+			if !ok {
+				return nil, nil
+			}
+			if event.Type != watch.Added && event.Type != watch.Modified {
+				continue
+			}
+			obj, ok := event.Object.(*unstructured.Unstructured)
+			if !ok {
+				continue
+			}
+			matched, err := matches(obj)
+			if err != nil {
+				return nil, err
+			}
+			if matched {
+				return obj, nil
+			}
+		}
+	}
+}
+
+// objectGroup is a set of objects of the same kind in the same namespace, which can be watched or
+// listed together
+type objectGroup struct {
+	gvk       schema.GroupVersionKind
+	namespace string
+	objs      []*unstructured.Unstructured
+}
+
+// groupByKindAndNamespace groups objects by their kind and namespace, in the order the groups are first
+// encountered. Namespaced objects should have their namespace defaulted (see withDefaultNamespace), or
+// they are grouped apart from live objects in the same namespace.
+func groupByKindAndNamespace(objs []*unstructured.Unstructured) []*objectGroup {
+	var groups []*objectGroup
+	groupByKey := make(map[string]*objectGroup)
+	for _, obj := range objs {
+		gvk := obj.GroupVersionKind()
+		groupKey := fmt.Sprintf("%s/%s", gvk, obj.GetNamespace())
+		group, ok := groupByKey[groupKey]
+		if !ok {
+			group = &objectGroup{gvk: gvk, namespace: obj.GetNamespace()}
+			groupByKey[groupKey] = group
+			groups = append(groups, group)
+		}
+		group.objs = append(group.objs, obj)
+	}
+	return groups
+}
+
+// narrowingListOptions returns list options selecting as few objects besides the given ones as possible.
+// A single object is selected by name. Field selectors cannot select a set of names, so multiple objects
+// are selected by the labels they have in common.
+func narrowingListOptions(objs []*unstructured.Unstructured) (metav1.ListOptions, error) {
+	if len(objs) == 1 {
+		return metav1.ListOptions{FieldSelector: fmt.Sprintf("metadata.name=%s", objs[0].GetName())}, nil
+	}
+	commonLabels := make(map[string]string)
+	for key, value := range objs[0].GetLabels() {
+		commonLabels[key] = value
+	}
+	for _, obj := range objs[1:] {
+		for key, value := range commonLabels {
+			if objValue, ok := obj.GetLabels()[key]; !ok || objValue != value {
+				delete(commonLabels, key)
+			}
+		}
+	}
+	selector, err := SelectorFromMap(commonLabels)
+	if err != nil {
+		return metav1.ListOptions{}, err
+	}
+	return metav1.ListOptions{LabelSelector: selector.String()}, nil
+}
+
+func stopAll(watchers []watch.Interface) {
+	for _, watcher := range watchers {
+		watcher.Stop()
+	}
+}
@@ -0,0 +1,120 @@
+package kube
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/argoproj/argo-cd/common"
+	"github.com/argoproj/argo-cd/test"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	fakedynamic "k8s.io/client-go/dynamic/fake"
+	kubetesting "k8s.io/client-go/testing"
+)
+
+func TestWatchObjects(t *testing.T) {
+	fakeDiscovery := &fakediscovery.FakeDiscovery{Fake: &kubetesting.Fake{}}
+	fakeDiscovery.Resources = resourceList()
+	fakeWatcher := watch.NewFake()
+	fakeClientPool := fakedynamic.FakeClientPool{}
+	fakeClientPool.AddWatchReactor("deployments", kubetesting.DefaultWatchReactor(fakeWatcher, nil))
+
+	newDeployment := func(name string) *unstructured.Unstructured {
+		deploy := fakeDeploymentV1beta2()
+		deploy.SetName(name)
+		deploy.SetLabels(map[string]string{common.LabelApplicationName: "guestbook", "component": name})
+		return deploy
+	}
+	frontend := newDeployment("frontend")
+	backend := newDeployment("backend")
+	// the manifest of the backend does not specify its namespace
+	backendManifest := backend.DeepCopy()
+	backendManifest.SetNamespace("")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch, err := watchObjects(ctx, &fakeClientPool, fakeDiscovery, []*unstructured.Unstructured{frontend, backendManifest}, test.TestNamespace)
+	assert.Nil(t, err)
+
+	// both deployments share a single watch, narrowed by their common label
+	watchActions := 0
+	for _, action := range fakeClientPool.Actions() {
+		if watchAction, ok := action.(kubetesting.WatchAction); ok {
+			watchActions++
+			assert.Equal(t, test.TestNamespace, watchAction.GetNamespace())
+			assert.Equal(t, common.LabelApplicationName+"=guestbook", watchAction.GetWatchRestrictions().Labels.String())
+		}
+	}
+	assert.Equal(t, 1, watchActions)
+
+	go func() {
+		fakeWatcher.Modify(frontend)
+		fakeWatcher.Modify(newDeployment("unrelated"))
+		fakeWatcher.Delete(backend)
+	}()
+	first := <-ch
+	assert.Equal(t, GetResourceKey(frontend), first.Key)
+	assert.Equal(t, watch.Modified, first.Event.Type)
+	second := <-ch
+	assert.Equal(t, GetResourceKey(backendManifest), second.Key)
+	assert.Equal(t, watch.Deleted, second.Event.Type)
+
+	cancel()
+	for range ch {
+	}
+}
+
+func TestWaitForJSONPath(t *testing.T) {
+	newPod := func(phase string) *unstructured.Unstructured {
+		pod := &unstructured.Unstructured{}
+		pod.SetAPIVersion("v1")
+		pod.SetKind("Pod")
+		pod.SetName("demo")
+		pod.SetNamespace(test.TestNamespace)
+		if phase != "" {
+			unstructured.SetNestedField(pod.Object, phase, "status", "phase")
+		}
+		return pod
+	}
+	fakeWatcher := watch.NewFake()
+	fakeDynClient := fakedynamic.FakeClient{Fake: &kubetesting.Fake{}}
+	fakeDynClient.AddReactor("get", "pods", func(action kubetesting.Action) (bool, runtime.Object, error) {
+		// the pod has no status yet
+		return true, newPod(""), nil
+	})
+	fakeDynClient.AddWatchReactor("pods", kubetesting.DefaultWatchReactor(fakeWatcher, nil))
+	go func() {
+		fakeWatcher.Modify(newPod("Pending"))
+		fakeWatcher.Modify(newPod("Running"))
+	}()
+
+	apiResource := metav1.APIResource{Name: "pods", Namespaced: true, Kind: "Pod"}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	obj, err := WaitForJSONPath(ctx, &fakeDynClient, apiResource, test.TestNamespace, "demo", ".status.phase", "Running")
+	assert.Nil(t, err)
+	if assert.NotNil(t, obj) {
+		phase, _ := unstructured.NestedString(obj.Object, "status", "phase")
+		assert.Equal(t, "Running", phase)
+	}
+
+	// the condition is never met before the context is done. The watch was stopped, so every watch ends
+	// at once, and is retried with a backoff rather than in a tight loop.
+	fakeDynClient.ClearActions()
+	ctx, cancel = context.WithTimeout(context.Background(), 350*time.Millisecond)
+	defer cancel()
+	_, err = WaitForJSONPath(ctx, &fakeDynClient, apiResource, test.TestNamespace, "demo", "{.status.phase}", "Succeeded")
+	assert.Equal(t, context.DeadlineExceeded, err)
+	watches := 0
+	for _, action := range fakeDynClient.Actions() {
+		if _, ok := action.(kubetesting.WatchAction); ok {
+			watches++
+		}
+	}
+	assert.True(t, watches >= 2 && watches <= 4, "%d watches", watches)
+}